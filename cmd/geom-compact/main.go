@@ -0,0 +1,44 @@
+// geom-compact rewrites bolt database files without their unused pages. The server has to be stopped first,
+// a running server can compact its own database with POST /_admin/compact.
+//
+//	go run ./cmd/geom-compact test.db
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/fnurk/geom/pkg/store"
+)
+
+var timeout = flag.Duration("timeout", time.Second, "how long to wait for a file that is in use")
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [flags] file...\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	failed := false
+	for _, path := range flag.Args() {
+		res, err := store.CompactFile(path, *timeout)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", path, err)
+			failed = true
+			continue
+		}
+		fmt.Printf("%s: %d -> %d bytes, reclaimed %d in %s\n", path, res.SizeBefore, res.SizeAfter, res.Reclaimed, res.Duration.Round(time.Millisecond))
+	}
+
+	if failed {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,75 @@
+// geom-ts generates a typed TypeScript client from the OpenAPI document of a geom server, see
+// handlers.AddOpenAPIEndpoint and package tsclient. Run it in the frontend's build, a changed type then
+// fails to compile where it's used:
+//
+//	go run ./cmd/geom-ts -o web/src/geom.ts http://localhost:8080/openapi.json
+//	go run ./examples -openapi openapi.json && go run ./cmd/geom-ts -o web/src/geom.ts openapi.json
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/fnurk/geom/pkg/tsclient"
+)
+
+var out = flag.String("o", "", "file to write the client to, stdout if empty")
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [flags] openapi.json|url|-\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	spec, err := read(flag.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", flag.Arg(0), err)
+		os.Exit(1)
+	}
+
+	client, err := tsclient.Generate(spec)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", flag.Arg(0), err)
+		os.Exit(1)
+	}
+
+	if *out == "" {
+		os.Stdout.Write(client)
+		return
+	}
+	if err := os.WriteFile(*out, client, 0644); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// read reads the document from a file, a url or stdin
+func read(src string) ([]byte, error) {
+	switch {
+	case src == "-":
+		return io.ReadAll(os.Stdin)
+	case strings.HasPrefix(src, "http://"), strings.HasPrefix(src, "https://"):
+		client := http.Client{Timeout: 30 * time.Second}
+		res, err := client.Get(src)
+		if err != nil {
+			return nil, err
+		}
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("%s", res.Status)
+		}
+		return io.ReadAll(res.Body)
+	}
+	return os.ReadFile(src)
+}
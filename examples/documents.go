@@ -1,7 +1,12 @@
 package main
 
 import (
-	"fmt"
+	"context"
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/fnurk/geom/pkg/auth"
@@ -9,6 +14,7 @@ import (
 	"github.com/fnurk/geom/pkg/model"
 
 	"github.com/fnurk/geom/pkg/pubsub"
+	"github.com/fnurk/geom/pkg/replication"
 	"github.com/fnurk/geom/pkg/store"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
@@ -24,7 +30,16 @@ type MetaFields struct {
 
 type Note struct {
 	MetaFields
-	Body string `json:"body"`
+	Body     string   `json:"body"`
+	Tags     []string `json:"tags" index:"inmem"`
+	Words    int      `json:"words"`    //computed
+	Comments int      `json:"comments"` //computed
+}
+
+type Comment struct {
+	MetaFields
+	NoteId string `json:"noteId"`
+	Body   string `json:"body"`
 }
 
 type Thing struct {
@@ -37,38 +52,167 @@ var changes pubsub.Pubsub
 
 var ds *store.Datastore
 
+// Run a leader and a follower side by side with:
+//
+//	go run ./examples
+//	go run ./examples -addr :8081 -dir follower -follow http://localhost:8080
+//
+// or with a database file per tenant, picked by subdomain or the X-Tenant header:
+//
+//	go run ./examples -tenants -provision acme,globex
+//	curl acme.localhost:8080/note/1
+var (
+	addr      = flag.String("addr", ":8080", "listen address")
+	dir       = flag.String("dir", ".", "directory for the database files")
+	follow    = flag.String("follow", "", "leader url, runs this server as a read only follower")
+	token     = flag.String("replication-token", "", "token followers use to authenticate to the leader")
+	tenants   = flag.Bool("tenants", false, "keep every tenant in its own database file")
+	provision = flag.String("provision", "", "comma separated tenants to create, with -tenants")
+	openapi   = flag.String("openapi", "", "write the OpenAPI document to this file and exit, see cmd/geom-ts")
+)
+
 func main() {
+	flag.Parse()
+
 	e := echo.New()
 
 	e.Use(middleware.LoggerWithConfig(middleware.LoggerConfig{
 		Format: "${time_rfc3339}: ${method} ${uri} -> ${status}\n",
 	}))
 
-	boltdb, err := store.NewBoltDb("test.db")
-	cache := store.NewInMemKV()
+	os.MkdirAll(*dir, 0755)
 
-	ds = store.NewDatastore(boltdb, cache)
+	var db store.Database
+	var boltdb *store.BoltDatabase
+	if *tenants {
+		if *follow != "" {
+			e.Logger.Fatal("replication is not supported with -tenants")
+		}
+		db = store.NewTenantDatabase(filepath.Join(*dir, "tenants"))
+	} else {
+		var err error
+		boltdb, err = store.NewBoltDb(filepath.Join(*dir, "test.db"))
+		if err != nil {
+			e.Logger.Fatal(err)
+		}
+		db = boltdb
+	}
+	cache := store.NewLRUCache(store.LRUConfig{
+		MaxBytes: 64 << 20,
+		TTL:      10 * time.Minute,
+	})
 
-	changes = pubsub.NewChanPubsub()
+	ds = store.NewDatastore(db, cache)
+
+	//notes are small and read a lot
+	ds.CacheType("note", store.CachePolicy{MaxDocSize: 16 * 1024})
+
+	//remembers the last changes so SSE clients can resume
+	changes = pubsub.NewReplayPubsub(pubsub.NewChanPubsub(), 1000)
 
 	model.RegisterType("note", Note{})
 	model.RegisterType("thing", Thing{})
+	model.RegisterType("comment", Comment{})
+	//list views only show tags and sizes, /note/1?projection=list
+	model.RegisterProjection("note", "list", "createdBy", "lastModified", "tags", "words", "comments")
 
-	ds.AddPutHook(func(t string, id string, value []byte) {
-		changes.Publish(&pubsub.Message{
-			Topic: fmt.Sprintf("%s.%s", t, id),
-			Body:  string(value),
-		})
+	ds.AddComputedField("note", store.ComputedField{
+		Field: "words",
+		Func: func(doc map[string]interface{}) (interface{}, error) {
+			body, _ := doc["body"].(string)
+			return len(strings.Fields(body)), nil
+		},
+	})
+	//notes per tag per month, eg. /_views/tags?prefix=["work"]
+	ds.AddView("tags", store.View{
+		Types: []string{"note"},
+		Map: func(t string, id string, doc map[string]interface{}) []store.ViewEntry {
+			created, _ := doc["created"].(string)
+			tags, _ := doc["tags"].([]interface{})
+			if len(created) < 7 {
+				return nil
+			}
+			entries := []store.ViewEntry{}
+			for _, tag := range tags {
+				entries = append(entries, store.ViewEntry{Key: []interface{}{tag, created[:7]}, Value: 1})
+			}
+			return entries
+		},
 	})
 
+	//64kB notes, a thousand of them and 10MB with attachments per user
+	ds.SetQuota("note", store.Quota{MaxDocSize: 64 * 1024, MaxDocs: 1000, MaxBytes: 10 << 20})
+
+	ds.AddComputedField("note", store.ComputedField{
+		Field:     "comments",
+		Aggregate: &store.ReferenceAggregate{Op: store.AggregateCount, From: "comment", Ref: "noteId"},
+	})
+
+	handlers.PublishChanges(ds, changes)
+
+	//binary attachments live in their own file
+	blobs, err := store.NewBlobStore(filepath.Join(*dir, "blobs.db"))
+	if err != nil {
+		e.Logger.Fatal(err)
+	}
+	ds.UseBlobStore(blobs)
+
+	var follower *replication.Follower
+	if *follow != "" {
+		boltdb.PeriodicDump = false
+		follower = replication.NewFollower(ds, *follow+"/_replication")
+		follower.Token = *token
+		follower.OnError = func(err error) {
+			e.Logger.Warn(err)
+		}
+	} else if !*tenants {
+		leader := replication.NewLeader(ds)
+		leader.Token = *token
+		leader.KeepChanges = 10000
+		replication.AddLeaderEndpoints(e.Group("/_replication"), leader)
+	}
+
 	err = ds.Init()
 	if err != nil {
 		e.Logger.Fatal(err)
 	}
 	defer ds.Close()
 
+	if td, ok := db.(*store.TenantDatabase); ok && *provision != "" {
+		for _, tenant := range strings.Split(*provision, ",") {
+			if err := td.Provision(context.Background(), tenant); err != nil {
+				e.Logger.Fatal(err)
+			}
+		}
+	}
+
+	if follower != nil {
+		//serve reads locally and let the leader handle writes
+		proxy, err := replication.ProxyWrites(*follow)
+		if err != nil {
+			e.Logger.Fatal(err)
+		}
+		e.Use(proxy)
+		go follower.Run(context.Background())
+	}
+
 	e.Use(middleware.Recover())
 
+	e.Use(func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			// Pretend everyone is logged in as userId 124, a real app would check a session or token here.
+			auth.SetIdentity(c, "124")
+			return next(c)
+		}
+	})
+
+	if *tenants {
+		e.Use(handlers.TenantMiddleware(
+			handlers.TenantFromSubdomain("localhost"),
+			handlers.TenantFromHeader("X-Tenant"),
+		))
+	}
+
 	handlers.AddCrudEndpointsForType(e, ds, changes, "note", handlers.CRUDLAccessCheckers{
 		GetCheck:    auth.Any(isOwner, isSharedWith),
 		PostCheck:   open,
@@ -77,6 +221,55 @@ func main() {
 		LiveCheck:   auth.Any(isOwner, isSharedWith),
 	})
 
+	handlers.AddCrudEndpointsForType(e, ds, changes, "comment", handlers.CRUDLAccessCheckers{
+		GetCheck:    open,
+		PostCheck:   open,
+		PutCheck:    isOwner,
+		DeleteCheck: isOwner,
+		LiveCheck:   open,
+	})
+
+	handlers.AddBulkEndpointsForType(e, ds, "note", handlers.CRUDLAccessCheckers{
+		GetCheck:    auth.Any(isOwner, isSharedWith),
+		PostCheck:   open,
+		PutCheck:    auth.Any(isOwner, isSharedWith),
+		DeleteCheck: auth.Any(isOwner, isSharedWith),
+	})
+
+	//likes and shares change without replacing the whole note
+	handlers.AddOpsEndpointsForType(e, ds, "note", handlers.CRUDLAccessCheckers{
+		PutCheck: auth.Any(isOwner, isSharedWith),
+	})
+
+	handlers.AddAttachmentEndpointsForType(e, ds, "note", handlers.CRUDLAccessCheckers{
+		GetCheck: auth.Any(isOwner, isSharedWith),
+		PutCheck: auth.Any(isOwner, isSharedWith),
+	})
+
+	handlers.AddViewEndpoint(e, ds, "tags", auth.Any(isOwner, isSharedWith))
+	//eg. /note?filter=tags contains "work" and words > 100&sort=-words
+	handlers.AddQueryEndpointForType(e, ds, "note", handlers.CRUDLAccessCheckers{
+		GetCheck: auth.Any(isOwner, isSharedWith),
+	})
+	//the list screen, eg. /note/live?filter=tags contains "work"&projection=list
+	handlers.AddLiveQueryEndpointForType(e, ds, changes, "note", handlers.CRUDLAccessCheckers{
+		LiveCheck: auth.Any(isOwner, isSharedWith),
+	})
+	handlers.AddUsageEndpoint(e, ds)
+
+	//one websocket for every live document, query and topic on a page, and for the editor's writes
+	realtime := handlers.NewRealtime(ds, changes)
+	realtime.AddType("note", handlers.CRUDLAccessCheckers{
+		PutCheck:    auth.Any(isOwner, isSharedWith),
+		DeleteCheck: auth.Any(isOwner, isSharedWith),
+		LiveCheck:   auth.Any(isOwner, isSharedWith),
+	})
+	realtime.AddType("comment", handlers.CRUDLAccessCheckers{
+		LiveCheck: open,
+	})
+	realtime.AddTopic("presence.*", open)
+	handlers.AddRealtimeEndpoint(e, realtime)
+
 	//use echo groups - maybe custom middleware for just these endpoints?
 	docGroup := e.Group("/documents")
 
@@ -89,10 +282,53 @@ func main() {
 		LiveCheck:   auth.Any(isOwner, isSharedWith),
 	})
 
+	//time-series data goes in a separate file
+	ts, err := store.NewTimeSeriesStore(filepath.Join(*dir, "metrics.db"))
+	if err != nil {
+		e.Logger.Fatal(err)
+	}
+	defer ts.Close()
+
+	ts.SetRetention("*", store.RetentionPolicy{
+		Raw: 7 * 24 * time.Hour,
+		Rollups: map[store.Resolution]time.Duration{
+			store.Minute: 30 * 24 * time.Hour,
+		},
+	})
+	ts.Start(time.Minute)
+
+	handlers.AddTimeSeriesEndpoints(e.Group("/ts"), ts, handlers.TimeSeriesAccessCheckers{
+		IngestCheck: open,
+		QueryCheck:  open,
+	})
+
+	handlers.AddAdminEndpoints(e.Group("/_admin"), ds, isAdmin)
+
+	//generated from the routes above and the registered types, browse it at /docs
+	info := handlers.OpenAPIInfo{Title: "geom documents example", Version: "0.1.0"}
+	handlers.AddOpenAPIEndpoint(e, info, true)
+
+	ds.WatchStats(context.Background(), time.Minute, map[string]store.BucketLimit{
+		"note": {MaxKeys: 100000, MaxKeyGrowth: 1000},
+	}, func(a store.Alert) {
+		e.Logger.Warnf("%s: %s (%d keys, %d bytes)", a.Bucket, a.Reason, a.Current.Keys, a.Current.Bytes)
+	})
+
 	//Serve the dummy index.html
 	e.Static("/", ".")
 
-	e.Logger.Fatal(e.Start(":8080"))
+	if *openapi != "" {
+		spec, err := json.MarshalIndent(handlers.OpenAPI(e, info), "", "  ")
+		if err == nil {
+			err = os.WriteFile(*openapi, spec, 0644)
+		}
+		if err != nil {
+			e.Logger.Fatal(err)
+		}
+		return
+	}
+
+	e.Logger.Fatal(e.Start(*addr))
 }
 
 var open = auth.AccessFunc(func(c echo.Context, doc []byte) bool {
@@ -100,16 +336,18 @@ var open = auth.AccessFunc(func(c echo.Context, doc []byte) bool {
 	return true
 })
 
+var isAdmin = auth.AccessFunc(func(c echo.Context, doc []byte) bool {
+	return auth.Identity(c) == "124"
+})
+
 var isOwner = auth.AccessFunc(func(c echo.Context, doc []byte) bool {
-	// Get logged in user(in this case userId 124) from context, maybe middleware already populated it?
-	return gjson.GetBytes(doc, "createdBy").String() == "124"
+	return gjson.GetBytes(doc, "createdBy").String() == auth.Identity(c)
 })
 
 var isSharedWith = auth.AccessFunc(func(c echo.Context, doc []byte) bool {
-	// Get logged in user(in this case userId 124) from context, maybe middleware already populated it?
 	shares := gjson.GetBytes(doc, "sharedWith").Array()
 	for _, v := range shares {
-		if v.String() == "124" {
+		if v.String() == auth.Identity(c) {
 			return true
 		}
 	}
@@ -48,3 +48,15 @@ func CheckAccess(c echo.Context, doc []byte, checks ...AccessFunc) bool {
 	}
 	return allowed
 }
+
+const identityKey = "geom.identity"
+
+// SetIdentity stores who is making the request, typically from an authentication middleware
+func SetIdentity(c echo.Context, identity string) {
+	c.Set(identityKey, identity)
+}
+
+func Identity(c echo.Context) string {
+	identity, _ := c.Get(identityKey).(string)
+	return identity
+}
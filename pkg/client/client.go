@@ -0,0 +1,220 @@
+// Package client talks to a geom server from Go, with documents decoded into their types:
+//
+//	c := client.New("http://localhost:8080")
+//	c.Token = token
+//	ctx = client.WithClient(ctx, c)
+//
+//	note, err := client.Get[Note](ctx, "note", id)
+//	res, err := client.Find[Note](ctx, "note", client.Query{Filter: `status == "open"`, Limit: 10})
+//	sub, err := client.Watch[Note](ctx, "note", id)
+//	for note := range sub.C {
+//	}
+//
+// The functions use the client in the context, Default if it has none, and fail with ErrNoClient if
+// neither is set. Idempotent requests are retried on
+// network errors and 502, 503 and 504 answers, live subscriptions reconnect and resume where they left off.
+package client
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+var (
+	ErrNotFound   = errors.New("not found")
+	ErrForbidden  = errors.New("forbidden")
+	ErrConflict   = errors.New("conflict")
+	ErrBadRequest = errors.New("bad request")
+	// Neither the context nor Default has a client
+	ErrNoClient = errors.New("no client, see WithClient")
+)
+
+// Error is an answer that wasn't 2xx, it matches ErrNotFound, ErrForbidden, ErrConflict and ErrBadRequest
+// with errors.Is
+type Error struct {
+	Status  int
+	Message string
+}
+
+func (e *Error) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("%d %s", e.Status, http.StatusText(e.Status))
+	}
+	return fmt.Sprintf("%d %s: %s", e.Status, http.StatusText(e.Status), e.Message)
+}
+
+func (e *Error) Is(target error) bool {
+	switch target {
+	case ErrNotFound:
+		return e.Status == http.StatusNotFound
+	case ErrForbidden:
+		return e.Status == http.StatusForbidden
+	case ErrConflict:
+		return e.Status == http.StatusConflict
+	case ErrBadRequest:
+		return e.Status == http.StatusBadRequest
+	}
+	return false
+}
+
+type Client struct {
+	BaseURL string
+	HTTP    *http.Client
+	// Sent as a bearer token, if set
+	Token string
+	// Used instead of Token if set, eg. to refresh tokens that expire
+	TokenSource func(ctx context.Context) (string, error)
+	// Sent with every request, eg. X-Tenant
+	Header http.Header
+	// How many times idempotent requests are retried, and the delay before the first retry. It doubles
+	// with every retry, up to MaxRetryDelay. Live subscriptions reconnect with the same delays.
+	Retries       int
+	RetryDelay    time.Duration
+	MaxRetryDelay time.Duration
+}
+
+// Default is used by the functions when the context doesn't carry a client, there's none unless it's set
+var Default *Client
+
+func New(baseURL string) *Client {
+	return &Client{
+		BaseURL:       strings.TrimSuffix(baseURL, "/"),
+		HTTP:          http.DefaultClient,
+		Header:        http.Header{},
+		Retries:       3,
+		RetryDelay:    100 * time.Millisecond,
+		MaxRetryDelay: 5 * time.Second,
+	}
+}
+
+type clientKey struct{}
+
+// WithClient makes the functions called with ctx use c
+func WithClient(ctx context.Context, c *Client) context.Context {
+	return context.WithValue(ctx, clientKey{}, c)
+}
+
+// From returns the client the functions use with ctx, nil if there's none
+func From(ctx context.Context) *Client {
+	if c, ok := ctx.Value(clientKey{}).(*Client); ok {
+		return c
+	}
+	return Default
+}
+
+type request struct {
+	method      string
+	path        string
+	query       url.Values
+	body        []byte
+	contentType string
+	header      http.Header
+	idempotent  bool
+}
+
+// do sends req, retrying it if it's idempotent. Answers that aren't 2xx are returned as *Error, a nil c
+// fails with ErrNoClient.
+func (c *Client) do(ctx context.Context, req request) (*http.Response, error) {
+	if c == nil {
+		return nil, ErrNoClient
+	}
+	for attempt := 0; ; attempt++ {
+		res, err := c.send(ctx, req)
+		if err == nil && !retryable(res.StatusCode) {
+			if res.StatusCode < 200 || res.StatusCode > 299 {
+				return nil, errorFrom(res)
+			}
+			return res, nil
+		}
+		if !req.idempotent || attempt >= c.Retries || ctx.Err() != nil {
+			if err != nil {
+				return nil, err
+			}
+			return nil, errorFrom(res)
+		}
+		if res != nil {
+			res.Body.Close()
+		}
+		if err := c.wait(ctx, attempt); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (c *Client) send(ctx context.Context, req request) (*http.Response, error) {
+	u := c.BaseURL + req.path
+	if len(req.query) > 0 {
+		u += "?" + req.query.Encode()
+	}
+	var body io.Reader
+	if req.body != nil {
+		body = bytes.NewReader(req.body)
+	}
+	r, err := http.NewRequestWithContext(ctx, req.method, u, body)
+	if err != nil {
+		return nil, err
+	}
+
+	for name, values := range c.Header {
+		r.Header[name] = values
+	}
+	for name, values := range req.header {
+		r.Header[name] = values
+	}
+	if req.body != nil {
+		contentType := req.contentType
+		if contentType == "" {
+			contentType = "application/json"
+		}
+		r.Header.Set("Content-Type", contentType)
+	}
+
+	token := c.Token
+	if c.TokenSource != nil {
+		if token, err = c.TokenSource(ctx); err != nil {
+			return nil, err
+		}
+	}
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	return c.HTTP.Do(r)
+}
+
+// wait sleeps before retry number attempt+1
+func (c *Client) wait(ctx context.Context, attempt int) error {
+	delay := c.RetryDelay
+	for i := 0; i < attempt && delay < c.MaxRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > c.MaxRetryDelay {
+		delay = c.MaxRetryDelay
+	}
+	select {
+	case <-time.After(delay):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func retryable(status int) bool {
+	switch status {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+func errorFrom(res *http.Response) error {
+	defer res.Body.Close()
+	msg, _ := io.ReadAll(io.LimitReader(res.Body, 4096))
+	return &Error{Status: res.StatusCode, Message: strings.TrimSpace(string(msg))}
+}
@@ -0,0 +1,270 @@
+package client_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/fnurk/geom/pkg/client"
+	"github.com/fnurk/geom/pkg/handlers"
+	"github.com/fnurk/geom/pkg/model"
+	"github.com/fnurk/geom/pkg/pubsub"
+	"github.com/fnurk/geom/pkg/store"
+	"github.com/labstack/echo/v4"
+)
+
+type note struct {
+	Title  string `json:"title"`
+	Status string `json:"status"`
+}
+
+type server struct {
+	*httptest.Server
+	ds *store.Datastore
+	// The next requests fail with 503 while this is above 0
+	unavailable int32
+}
+
+func newServer(t *testing.T) *server {
+	model.RegisterType("note", note{})
+	ds := store.NewDatastore(store.NewInMemDatabase(), nil)
+	changes := pubsub.NewReplayPubsub(pubsub.NewChanPubsub(), 100)
+	handlers.PublishChanges(ds, changes)
+	if err := ds.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &server{ds: ds}
+	e := echo.New()
+	e.Use(func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if atomic.AddInt32(&s.unavailable, -1) >= 0 {
+				return c.NoContent(http.StatusServiceUnavailable)
+			}
+			if c.Request().Header.Get(echo.HeaderAuthorization) != "Bearer secret" {
+				return c.NoContent(http.StatusUnauthorized)
+			}
+			return next(c)
+		}
+	})
+
+	allow := func(echo.Context, []byte) bool { return true }
+	notDone := func(c echo.Context, doc []byte) bool {
+		n := note{}
+		return json.Unmarshal(doc, &n) == nil && n.Status != "done"
+	}
+	checkers := handlers.CRUDLAccessCheckers{GetCheck: allow, PostCheck: allow, PutCheck: allow, DeleteCheck: notDone, LiveCheck: allow}
+	handlers.AddCrudEndpointsForType(e, ds, changes, "note", checkers)
+	handlers.AddQueryEndpointForType(e, ds, "note", checkers)
+	handlers.AddBulkEndpointsForType(e, ds, "note", checkers)
+	handlers.AddLiveQueryEndpointForType(e, ds, changes, "note", checkers)
+
+	s.Server = httptest.NewServer(e)
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *server) context(t *testing.T) context.Context {
+	c := client.New(s.URL)
+	c.Token = "secret"
+	c.RetryDelay = time.Millisecond
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	t.Cleanup(cancel)
+	return client.WithClient(ctx, c)
+}
+
+func TestCRUD(t *testing.T) {
+	s := newServer(t)
+	ctx := s.context(t)
+
+	id, err := client.Create(ctx, "note", note{Title: "first", Status: "open"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := client.Get[note](ctx, "note", id)
+	if err != nil || n.Title != "first" {
+		t.Fatalf("expected the created note, got %+v %v", n, err)
+	}
+
+	if err := client.Put(ctx, "note", id, note{Title: "replaced", Status: "open"}); err != nil {
+		t.Fatal(err)
+	}
+	n, err = client.Patch[note](ctx, "note", id, map[string]interface{}{"status": "done"})
+	if err != nil || n.Title != "replaced" || n.Status != "done" {
+		t.Fatalf("expected the patched note, got %+v %v", n, err)
+	}
+	n, err = client.Patch[note](ctx, "note", id, []model.PatchOp{{Op: "replace", Path: "/title", Value: []byte(`"patched"`)}})
+	if err != nil || n.Title != "patched" {
+		t.Fatalf("expected the json patched note, got %+v %v", n, err)
+	}
+
+	if err := client.Delete(ctx, "note", id); !errors.Is(err, client.ErrForbidden) {
+		t.Errorf("expected ErrForbidden deleting a done note, got %v", err)
+	}
+	client.Patch[note](ctx, "note", id, map[string]interface{}{"status": "open"})
+	if err := client.Delete(ctx, "note", id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Get[note](ctx, "note", id); !errors.Is(err, client.ErrNotFound) {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestQueryAndBulk(t *testing.T) {
+	s := newServer(t)
+	ctx := s.context(t)
+
+	res, err := client.Bulk(ctx, "note", []client.BulkItem[note]{
+		{Doc: &note{Title: "a", Status: "open"}},
+		{Doc: &note{Title: "b", Status: "done"}},
+		{Doc: &note{Title: "c", Status: "open"}},
+	}, false)
+	if err != nil || !res.Committed || len(res.Results) != 3 {
+		t.Fatalf("expected 3 committed items, got %+v %v", res, err)
+	}
+
+	found, err := client.Find[note](ctx, "note", client.Query{Filter: `status == "open"`, Sort: "-title"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found.Docs) != 2 || found.Docs[0].Doc.Title != "c" || found.Docs[1].Doc.Title != "a" {
+		t.Errorf("expected c and a, got %+v", found.Docs)
+	}
+
+	items, err := client.GetMany[note](ctx, "note", []string{res.Results[1].Id, "missing"}, client.Fields("title"))
+	if err != nil || len(items) != 2 {
+		t.Fatalf("expected 2 items, got %+v %v", items, err)
+	}
+	if items[0].Err() != nil || items[0].Doc != (note{Title: "b"}) {
+		t.Errorf("expected the title of b, got %+v", items[0])
+	}
+	if !errors.Is(items[1].Err(), client.ErrNotFound) {
+		t.Errorf("expected ErrNotFound for a missing id, got %v", items[1].Err())
+	}
+}
+
+func TestRetries(t *testing.T) {
+	s := newServer(t)
+	ctx := s.context(t)
+	id, _ := client.Create(ctx, "note", note{Title: "retried"})
+
+	atomic.StoreInt32(&s.unavailable, 2)
+	if n, err := client.Get[note](ctx, "note", id); err != nil || n.Title != "retried" {
+		t.Errorf("expected reads to be retried, got %+v %v", n, err)
+	}
+
+	atomic.StoreInt32(&s.unavailable, 1)
+	var e *client.Error
+	if _, err := client.Create(ctx, "note", note{}); !errors.As(err, &e) || e.Status != http.StatusServiceUnavailable {
+		t.Errorf("expected creates not to be retried, got %v", err)
+	}
+
+	atomic.StoreInt32(&s.unavailable, 10)
+	if _, err := client.Get[note](ctx, "note", id); !errors.As(err, &e) || e.Status != http.StatusServiceUnavailable {
+		t.Errorf("expected to give up after the retries, got %v", err)
+	}
+	atomic.StoreInt32(&s.unavailable, 0)
+}
+
+func TestAuth(t *testing.T) {
+	s := newServer(t)
+	ctx := s.context(t)
+
+	c := client.New(s.URL)
+	c.TokenSource = func(context.Context) (string, error) { return "secret", nil }
+	if _, err := client.Create(client.WithClient(ctx, c), "note", note{}); err != nil {
+		t.Errorf("expected the token from TokenSource to be sent, got %v", err)
+	}
+
+	var e *client.Error
+	c = client.New(s.URL)
+	if _, err := client.Create(client.WithClient(ctx, c), "note", note{}); !errors.As(err, &e) || e.Status != http.StatusUnauthorized {
+		t.Errorf("expected 401 without a token, got %v", err)
+	}
+}
+
+func TestNoClient(t *testing.T) {
+	ctx := context.Background()
+	if _, err := client.Get[note](ctx, "note", "1"); !errors.Is(err, client.ErrNoClient) {
+		t.Errorf("expected ErrNoClient without a client, got %v", err)
+	}
+	if _, err := client.Watch[note](ctx, "note", "1"); !errors.Is(err, client.ErrNoClient) {
+		t.Errorf("expected ErrNoClient from Watch without a client, got %v", err)
+	}
+}
+
+func next[T any](t *testing.T, sub *client.Subscription[T]) T {
+	t.Helper()
+	select {
+	case v, ok := <-sub.C:
+		if !ok {
+			t.Fatalf("subscription ended: %v", sub.Err())
+		}
+		return v
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for an event")
+	}
+	panic("unreachable")
+}
+
+func TestWatch(t *testing.T) {
+	s := newServer(t)
+	ctx := s.context(t)
+	id, _ := client.Create(ctx, "note", note{Title: "v1"})
+
+	if _, err := client.Watch[note](ctx, "note", "missing"); !errors.Is(err, client.ErrNotFound) {
+		t.Errorf("expected ErrNotFound watching a missing note, got %v", err)
+	}
+
+	watchCtx, cancel := context.WithCancel(ctx)
+	sub, err := client.Watch[note](watchCtx, "note", id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Put(ctx, "note", id, note{Title: "v2"})
+	if n := next(t, sub); n.Title != "v2" {
+		t.Errorf("expected v2, got %+v", n)
+	}
+
+	//reconnects and resumes after v2
+	s.CloseClientConnections()
+	client.Put(ctx, "note", id, note{Title: "v3"})
+	if n := next(t, sub); n.Title != "v3" {
+		t.Errorf("expected v3 after reconnecting, got %+v", n)
+	}
+
+	cancel()
+	for range sub.C {
+	}
+	if !errors.Is(sub.Err(), context.Canceled) {
+		t.Errorf("expected the subscription to end with the context, got %v", sub.Err())
+	}
+}
+
+func TestLiveQuery(t *testing.T) {
+	s := newServer(t)
+	ctx := s.context(t)
+	client.Create(ctx, "note", note{Title: "a", Status: "open"})
+
+	sub, err := client.LiveQuery[note](ctx, "note", client.Query{Filter: `status == "open"`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ev := next(t, sub); ev.Type != "initial" || len(ev.Docs) != 1 || ev.Docs[0].Doc.Title != "a" {
+		t.Errorf("expected a in the initial event, got %+v", ev)
+	}
+
+	id, _ := client.Create(ctx, "note", note{Title: "b", Status: "open"})
+	if ev := next(t, sub); ev.Type != "added" || ev.Id != id || ev.Doc.Title != "b" {
+		t.Errorf("expected b to be added, got %+v", ev)
+	}
+	client.Patch[note](ctx, "note", id, map[string]interface{}{"status": "done"})
+	if ev := next(t, sub); ev.Type != "removed" || ev.Id != id {
+		t.Errorf("expected b to be removed, got %+v", ev)
+	}
+}
@@ -0,0 +1,213 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const (
+	mimeMergePatch = "application/merge-patch+json"
+	mimeJSONPatch  = "application/json-patch+json"
+)
+
+// Option shapes the documents read, see Fields and Projection
+type Option func(url.Values)
+
+// Fields picks parts of documents by gjson paths, eg. Fields("title", "meta.owner")
+func Fields(paths ...string) Option {
+	return func(v url.Values) {
+		v.Set("fields", strings.Join(paths, ","))
+	}
+}
+
+// Projection picks parts of documents with a projection registered on the server
+func Projection(name string) Option {
+	return func(v url.Values) {
+		v.Set("projection", name)
+	}
+}
+
+// Query is a filter, sort order and limit as the server parses them, eg.
+// Query{Filter: `status == "open" and priority > 2`, Sort: "-priority", Limit: 10}
+type Query struct {
+	Filter string
+	Sort   string
+	// The server's default if 0
+	Limit int
+}
+
+func (q Query) values(opts []Option) url.Values {
+	v := values(opts)
+	if q.Filter != "" {
+		v.Set("filter", q.Filter)
+	}
+	if q.Sort != "" {
+		v.Set("sort", q.Sort)
+	}
+	if q.Limit > 0 {
+		v.Set("limit", strconv.Itoa(q.Limit))
+	}
+	return v
+}
+
+func values(opts []Option) url.Values {
+	v := url.Values{}
+	for _, opt := range opts {
+		opt(v)
+	}
+	return v
+}
+
+type Doc[T any] struct {
+	Id  string `json:"id"`
+	Doc T      `json:"doc"`
+}
+
+type Results[T any] struct {
+	Docs []Doc[T] `json:"docs"`
+	// There were more documents than the limit
+	Truncated bool `json:"truncated"`
+}
+
+// Item is the result for one document of GetMany or Bulk, Doc is only set by GetMany
+type Item[T any] struct {
+	Id     string `json:"id"`
+	Status int    `json:"status"`
+	Error  string `json:"error,omitempty"`
+	Doc    T      `json:"doc"`
+}
+
+// Err is the item's error as an *Error, nil if it succeeded
+func (i Item[T]) Err() error {
+	if i.Status >= 200 && i.Status <= 299 {
+		return nil
+	}
+	return &Error{Status: i.Status, Message: i.Error}
+}
+
+// BulkItem puts Doc, or deletes the document if Op is "delete". Puts without an Id create documents.
+type BulkItem[T any] struct {
+	Op  string `json:"op,omitempty"`
+	Id  string `json:"id,omitempty"`
+	Doc *T     `json:"doc,omitempty"`
+}
+
+type BulkResult[T any] struct {
+	// Atomic bulks are committed only if every item succeeded
+	Committed bool      `json:"committed"`
+	Results   []Item[T] `json:"results"`
+}
+
+func path(t string, elems ...string) string {
+	p := "/" + url.PathEscape(t)
+	for _, e := range elems {
+		p += "/" + url.PathEscape(e)
+	}
+	return p
+}
+
+// Get reads a document, the error matches ErrNotFound if there's none
+func Get[T any](ctx context.Context, t string, id string, opts ...Option) (T, error) {
+	var doc T
+	err := From(ctx).decode(ctx, request{method: http.MethodGet, path: path(t, id), query: values(opts), idempotent: true}, &doc)
+	return doc, err
+}
+
+// Create stores a new document and returns its id
+func Create[T any](ctx context.Context, t string, doc T) (string, error) {
+	body, err := json.Marshal(doc)
+	if err != nil {
+		return "", err
+	}
+	res, err := From(ctx).do(ctx, request{method: http.MethodPost, path: path(t), body: body})
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	id, err := io.ReadAll(res.Body)
+	return string(id), err
+}
+
+// Put replaces a document that exists
+func Put[T any](ctx context.Context, t string, id string, doc T) error {
+	body, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	return From(ctx).decode(ctx, request{method: http.MethodPut, path: path(t, id), body: body, idempotent: true}, nil)
+}
+
+// Patch applies a JSON Patch if patch encodes to an array, eg. []model.PatchOp, a JSON Merge Patch otherwise.
+// It returns the patched document.
+func Patch[T any](ctx context.Context, t string, id string, patch interface{}) (T, error) {
+	var doc T
+	body, err := json.Marshal(patch)
+	if err != nil {
+		return doc, err
+	}
+	contentType := mimeMergePatch
+	if strings.HasPrefix(string(body), "[") {
+		contentType = mimeJSONPatch
+	}
+	err = From(ctx).decode(ctx, request{method: http.MethodPatch, path: path(t, id), body: body, contentType: contentType}, &doc)
+	return doc, err
+}
+
+func Delete(ctx context.Context, t string, id string) error {
+	return From(ctx).decode(ctx, request{method: http.MethodDelete, path: path(t, id), idempotent: true}, nil)
+}
+
+// Find returns the documents matching q
+func Find[T any](ctx context.Context, t string, q Query, opts ...Option) (Results[T], error) {
+	res := Results[T]{}
+	err := From(ctx).decode(ctx, request{method: http.MethodGet, path: path(t), query: q.values(opts), idempotent: true}, &res)
+	return res, err
+}
+
+// GetMany reads many documents at once, in the order of ids. Missing or forbidden ones have an Item.Err.
+func GetMany[T any](ctx context.Context, t string, ids []string, opts ...Option) ([]Item[T], error) {
+	body, err := json.Marshal(map[string][]string{"ids": ids})
+	if err != nil {
+		return nil, err
+	}
+	items := []Item[T]{}
+	err = From(ctx).decode(ctx, request{method: http.MethodPost, path: path(t, "_mget"), query: values(opts), body: body, idempotent: true}, &items)
+	return items, err
+}
+
+// Bulk writes many documents at once, all or nothing unless bestEffort is set
+func Bulk[T any](ctx context.Context, t string, items []BulkItem[T], bestEffort bool) (BulkResult[T], error) {
+	res := BulkResult[T]{}
+	req := struct {
+		Mode  string        `json:"mode"`
+		Items []BulkItem[T] `json:"items"`
+	}{Mode: "atomic", Items: items}
+	if bestEffort {
+		req.Mode = "bestEffort"
+	}
+	body, err := json.Marshal(req)
+	if err != nil {
+		return res, err
+	}
+	err = From(ctx).decode(ctx, request{method: http.MethodPost, path: path(t, "_bulk"), body: body}, &res)
+	return res, err
+}
+
+// decode sends req and decodes the json answer into v, unless v is nil
+func (c *Client) decode(ctx context.Context, req request, v interface{}) error {
+	res, err := c.do(ctx, req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if v == nil {
+		_, err = io.Copy(io.Discard, res.Body)
+		return err
+	}
+	return json.NewDecoder(res.Body).Decode(v)
+}
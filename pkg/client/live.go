@@ -0,0 +1,153 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Subscription delivers what a live endpoint sends on C, over server-sent events. Dropped connections are
+// reopened after the retry delays, resuming after the last event received. C is closed when the context
+// is done or the server refuses to reconnect, Err tells why.
+type Subscription[T any] struct {
+	C    <-chan T
+	done chan struct{}
+	err  error
+}
+
+// Err is nil until C is closed
+func (s *Subscription[T]) Err() error {
+	select {
+	case <-s.done:
+		return s.err
+	default:
+		return nil
+	}
+}
+
+// Event is sent by live queries, see handlers.LiveEvent. Doc is empty for "removed".
+type Event[T any] struct {
+	Type      string   `json:"type"`
+	Docs      []Doc[T] `json:"docs,omitempty"`
+	Truncated bool     `json:"truncated,omitempty"`
+	Id        string   `json:"id,omitempty"`
+	Doc       T        `json:"doc"`
+	Error     string   `json:"error,omitempty"`
+}
+
+// Watch delivers the document every time it's written, Get reads it as it is
+func Watch[T any](ctx context.Context, t string, id string, opts ...Option) (*Subscription[T], error) {
+	return subscribe[T](ctx, path(t, id, "live", "sse"), values(opts))
+}
+
+// LiveQuery delivers the documents matching q in an "initial" event, then the changes to them
+func LiveQuery[T any](ctx context.Context, t string, q Query, opts ...Option) (*Subscription[Event[T]], error) {
+	return subscribe[Event[T]](ctx, path(t, "live", "sse"), q.values(opts))
+}
+
+// subscribe connects before returning, so a refused subscription is an error right away
+func subscribe[T any](ctx context.Context, path string, query url.Values) (*Subscription[T], error) {
+	c := From(ctx)
+	req := request{method: http.MethodGet, path: path, query: query, header: http.Header{}, idempotent: true}
+	req.header.Set("Accept", "text/event-stream")
+
+	res, err := c.do(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	ch := make(chan T)
+	s := &Subscription[T]{C: ch, done: make(chan struct{})}
+	go func() {
+		defer close(s.done)
+		defer close(ch)
+
+		lastId := ""
+		for attempt := 0; ; attempt++ {
+			//res is nil after a network error
+			if res != nil {
+				received, err := receive(ctx, res, ch, &lastId)
+				if err != nil {
+					s.err = err
+					return
+				}
+				if received {
+					attempt = 0
+				}
+			}
+
+			if lastId != "" {
+				req.header.Set("Last-Event-ID", lastId)
+			}
+			res, err = nil, c.wait(ctx, attempt)
+			if err == nil {
+				res, err = c.send(ctx, req)
+			}
+			switch {
+			case ctx.Err() != nil:
+				s.err = ctx.Err()
+				return
+			case err != nil:
+				//network errors, try again
+			case retryable(res.StatusCode):
+				res.Body.Close()
+				res = nil
+			case res.StatusCode != http.StatusOK:
+				s.err = errorFrom(res)
+				return
+			}
+		}
+	}()
+	return s, nil
+}
+
+// receive sends the events of res on ch until the stream ends, it tells if there were any. The error is
+// only set if the subscription can't go on.
+func receive[T any](ctx context.Context, res *http.Response, ch chan<- T, lastId *string) (bool, error) {
+	defer res.Body.Close()
+
+	received := false
+	data := []string{}
+	scanner := bufio.NewScanner(res.Body)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		field, value, _ := strings.Cut(line, ":")
+		value = strings.TrimPrefix(value, " ")
+		switch {
+		case line == "":
+			if len(data) == 0 {
+				continue
+			}
+			var v T
+			if err := json.Unmarshal([]byte(strings.Join(data, "\n")), &v); err != nil {
+				return received, err
+			}
+			data = data[:0]
+			select {
+			case ch <- v:
+				received = true
+			case <-ctx.Done():
+				return received, ctx.Err()
+			}
+		case field == "data":
+			data = append(data, value)
+		case field == "id":
+			if _, err := strconv.ParseUint(value, 10, 64); err == nil {
+				*lastId = value
+			}
+		}
+	}
+	if ctx.Err() != nil {
+		return received, ctx.Err()
+	}
+	//other errors are dropped connections
+	if err := scanner.Err(); err == bufio.ErrTooLong {
+		return received, err
+	}
+	return received, nil
+}
@@ -0,0 +1,110 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/fnurk/geom/pkg/auth"
+	"github.com/fnurk/geom/pkg/model"
+	"github.com/fnurk/geom/pkg/store"
+	"github.com/labstack/echo/v4"
+)
+
+// The doc passed to the access checker of the admin endpoints is always nil
+func AddAdminEndpoints(e *echo.Group, ds *store.Datastore, accessChecker auth.AccessFunc) {
+	e.GET("/stats", GetStats(ds, accessChecker))
+	e.POST("/compact", Compact(ds, accessChecker))
+	e.POST("/recompute/:type", Recompute(ds, accessChecker))
+	e.POST("/views/:name/rebuild", RebuildView(ds, accessChecker))
+	e.GET("/usage/:owner", GetUsage(ds, accessChecker))
+}
+
+func GetStats(ds *store.Datastore, accessChecker auth.AccessFunc) func(echo.Context) error {
+	return func(c echo.Context) error {
+		if !accessChecker(c, nil) {
+			return c.NoContent(http.StatusForbidden)
+		}
+
+		stats, err := ds.Stats()
+		if err != nil {
+			return c.String(http.StatusInternalServerError, err.Error())
+		}
+
+		return c.JSON(http.StatusOK, stats)
+	}
+}
+
+// Compact pauses writes while the database file is rewritten, so it's best run when traffic is low
+func Compact(ds *store.Datastore, accessChecker auth.AccessFunc) func(echo.Context) error {
+	return func(c echo.Context) error {
+		if !accessChecker(c, nil) {
+			return c.NoContent(http.StatusForbidden)
+		}
+
+		res, err := ds.Compact()
+		if err == store.ErrCompactNotSupported {
+			return c.String(http.StatusNotImplemented, err.Error())
+		}
+		if err != nil {
+			return c.String(http.StatusInternalServerError, err.Error())
+		}
+
+		return c.JSON(http.StatusOK, res)
+	}
+}
+
+// Recompute rewrites the computed fields of every document of a type after their definitions changed
+func Recompute(ds *store.Datastore, accessChecker auth.AccessFunc) func(echo.Context) error {
+	return func(c echo.Context) error {
+		if !accessChecker(c, nil) {
+			return c.NoContent(http.StatusForbidden)
+		}
+
+		t := c.Param("type")
+		if _, ok := model.Types[t]; !ok {
+			return c.NoContent(http.StatusNotFound)
+		}
+
+		changed, err := ds.Recompute(requestContext(c), t)
+		if err != nil {
+			return c.String(statusFor(err), err.Error())
+		}
+
+		return c.JSON(http.StatusOK, map[string]int{"changed": changed})
+	}
+}
+
+func RebuildView(ds *store.Datastore, accessChecker auth.AccessFunc) func(echo.Context) error {
+	return func(c echo.Context) error {
+		if !accessChecker(c, nil) {
+			return c.NoContent(http.StatusForbidden)
+		}
+
+		rows, err := ds.RebuildView(requestContext(c), c.Param("name"))
+		if err != nil {
+			return c.String(statusFor(err), err.Error())
+		}
+
+		return c.JSON(http.StatusOK, map[string]int{"rows": rows})
+	}
+}
+
+// GetUsage reports the usage of the owner in the path, or of the caller if there is none
+func GetUsage(ds *store.Datastore, accessChecker auth.AccessFunc) func(echo.Context) error {
+	return func(c echo.Context) error {
+		if !accessChecker(c, nil) {
+			return c.NoContent(http.StatusForbidden)
+		}
+
+		owner := c.Param("owner")
+		if owner == "" {
+			owner = auth.Identity(c)
+		}
+
+		usage, err := ds.Usage(requestContext(c), owner)
+		if err != nil {
+			return c.String(statusFor(err), err.Error())
+		}
+
+		return c.JSON(http.StatusOK, usage)
+	}
+}
@@ -0,0 +1,153 @@
+package handlers
+
+import (
+	"context"
+	"io"
+	"net/http"
+
+	"github.com/fnurk/geom/pkg/auth"
+	"github.com/fnurk/geom/pkg/store"
+	"github.com/labstack/echo/v4"
+)
+
+// Attachments are guarded by the checkers of the parent document: GetCheck for listing and downloads,
+// PutCheck for uploads and removals
+func AddAttachmentEndpointsForType(e *echo.Echo, ds *store.Datastore, t string, checkers CRUDLAccessCheckers) {
+	e.GET("/"+t+"/:id/attachments", ListAttachments(ds, t, checkers.GetCheck))
+	e.POST("/"+t+"/:id/attachments", UploadAttachments(ds, t, checkers.PutCheck))
+	e.GET("/"+t+"/:id/attachments/:name", DownloadAttachment(ds, t, checkers.GetCheck))
+	e.DELETE("/"+t+"/:id/attachments/:name", DeleteAttachment(ds, t, checkers.PutCheck))
+}
+
+func AddAttachmentEndpointsForTypeInGroup(e *echo.Group, ds *store.Datastore, t string, checkers CRUDLAccessCheckers) {
+	e.GET("/"+t+"/:id/attachments", ListAttachments(ds, t, checkers.GetCheck))
+	e.POST("/"+t+"/:id/attachments", UploadAttachments(ds, t, checkers.PutCheck))
+	e.GET("/"+t+"/:id/attachments/:name", DownloadAttachment(ds, t, checkers.GetCheck))
+	e.DELETE("/"+t+"/:id/attachments/:name", DeleteAttachment(ds, t, checkers.PutCheck))
+}
+
+func ListAttachments(ds *store.Datastore, t string, accessChecker auth.AccessFunc) func(echo.Context) error {
+	return func(c echo.Context) error {
+		ctx := requestContext(c)
+		doc, err := checkParent(ctx, c, ds, t, accessChecker)
+		if doc == nil {
+			return err
+		}
+
+		atts, err := store.DecodeAttachments(doc)
+		if err != nil {
+			return c.String(http.StatusInternalServerError, err.Error())
+		}
+
+		return c.JSON(http.StatusOK, atts)
+	}
+}
+
+// UploadAttachments stores every file part of a multipart body, named by the part's file name. Parts are
+// stored one at a time, when one fails the ones before it stay stored and can be listed.
+func UploadAttachments(ds *store.Datastore, t string, accessChecker auth.AccessFunc) func(echo.Context) error {
+	return func(c echo.Context) error {
+		ctx := requestContext(c)
+		id := c.Param("id")
+
+		doc, err := checkParent(ctx, c, ds, t, accessChecker)
+		if doc == nil {
+			return err
+		}
+
+		reader, err := c.Request().MultipartReader()
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+
+		stored := []store.Attachment{}
+		for {
+			part, err := reader.NextPart()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+			}
+			if part.FileName() == "" {
+				continue
+			}
+
+			contentType := part.Header.Get(echo.HeaderContentType)
+			if contentType == "" {
+				contentType = echo.MIMEOctetStream
+			}
+
+			att, err := ds.PutAttachmentContext(ctx, t, id, part.FileName(), contentType, part)
+			part.Close()
+			if err != nil {
+				return c.String(statusFor(err), err.Error())
+			}
+			stored = append(stored, att)
+		}
+
+		return c.JSON(http.StatusOK, stored)
+	}
+}
+
+func DownloadAttachment(ds *store.Datastore, t string, accessChecker auth.AccessFunc) func(echo.Context) error {
+	return func(c echo.Context) error {
+		ctx := requestContext(c)
+		id := c.Param("id")
+
+		doc, err := checkParent(ctx, c, ds, t, accessChecker)
+		if doc == nil {
+			return err
+		}
+
+		att, r, err := ds.OpenAttachmentContext(ctx, t, id, c.Param("name"))
+		if err == store.ErrAttachmentNotFound {
+			return c.NoContent(http.StatusNotFound)
+		}
+		if err != nil {
+			return c.String(http.StatusInternalServerError, err.Error())
+		}
+
+		c.Response().Header().Set(echo.HeaderContentType, att.ContentType)
+		c.Response().Header().Set("ETag", `"`+att.SHA256+`"`)
+		http.ServeContent(c.Response(), c.Request(), att.Name, att.Created, r)
+		return nil
+	}
+}
+
+func DeleteAttachment(ds *store.Datastore, t string, accessChecker auth.AccessFunc) func(echo.Context) error {
+	return func(c echo.Context) error {
+		ctx := requestContext(c)
+		id := c.Param("id")
+
+		doc, err := checkParent(ctx, c, ds, t, accessChecker)
+		if doc == nil {
+			return err
+		}
+
+		err = ds.DeleteAttachmentContext(ctx, t, id, c.Param("name"))
+		if err == store.ErrAttachmentNotFound {
+			return c.NoContent(http.StatusNotFound)
+		}
+		if err != nil {
+			return c.String(statusFor(err), err.Error())
+		}
+
+		return c.NoContent(http.StatusOK)
+	}
+}
+
+// checkParent returns the parent document if it exists and passes the check, otherwise the response has been written
+func checkParent(ctx context.Context, c echo.Context, ds *store.Datastore, t string, accessChecker auth.AccessFunc) ([]byte, error) {
+	doc, err := ds.GetContext(ctx, t, c.Param("id"))
+	if err != nil {
+		return nil, c.String(http.StatusInternalServerError, err.Error())
+	}
+	if doc == nil {
+		return nil, c.NoContent(http.StatusNotFound)
+	}
+	if !accessChecker(c, doc) {
+		return nil, c.NoContent(http.StatusForbidden)
+	}
+	return doc, nil
+}
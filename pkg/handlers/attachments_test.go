@@ -0,0 +1,60 @@
+package handlers_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/fnurk/geom/pkg/handlers"
+	"github.com/fnurk/geom/pkg/store"
+)
+
+// upload posts files, name to content, as one multipart body
+func (s *testServer) upload(t *testing.T, path string, files ...[2]string) (int, string) {
+	t.Helper()
+	body := &bytes.Buffer{}
+	w := multipart.NewWriter(body)
+	for _, f := range files {
+		part, err := w.CreateFormFile("file", f[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		part.Write([]byte(f[1]))
+	}
+	w.Close()
+	return s.request(t, http.MethodPost, path, w.FormDataContentType(), body.String())
+}
+
+func TestUploadAttachments_Quota(t *testing.T) {
+	s := newTestServer(t, func(ds *store.Datastore) {
+		ds.SetQuota("note", store.Quota{MaxBytes: 1000, OwnerField: "title"})
+	})
+	handlers.AddAttachmentEndpointsForType(s.e, s.ds, "note", allow)
+	s.ds.Put("note", "1", []byte(`{"title":"me"}`))
+
+	status, body := s.upload(t, "/note/1/attachments", [2]string{"small.txt", "small"}, [2]string{"large.txt", strings.Repeat("x", 1000)})
+	if status != http.StatusTooManyRequests {
+		t.Errorf("expected 429 past the byte quota, got %d %s", status, body)
+	}
+
+	//the parts before the failing one stay
+	status, body = s.request(t, http.MethodGet, "/note/1/attachments", "", "")
+	atts := []store.Attachment{}
+	json.Unmarshal([]byte(body), &atts)
+	if status != http.StatusOK || len(atts) != 1 || atts[0].Name != "small.txt" {
+		t.Errorf("expected small.txt to be stored, got %d %s", status, body)
+	}
+
+	if status, _ := s.upload(t, "/note/2/attachments", [2]string{"small.txt", "small"}); status != http.StatusNotFound {
+		t.Errorf("expected 404 for a missing note, got %d", status)
+	}
+	if status, _ := s.request(t, http.MethodDelete, "/note/1/attachments/none.txt", "", ""); status != http.StatusNotFound {
+		t.Errorf("expected 404 for a missing attachment, got %d", status)
+	}
+	if status, _ := s.request(t, http.MethodDelete, "/note/1/attachments/small.txt", "", ""); status != http.StatusOK {
+		t.Errorf("expected the attachment deleted, got %d", status)
+	}
+}
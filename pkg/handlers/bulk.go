@@ -0,0 +1,175 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/fnurk/geom/pkg/model"
+	"github.com/fnurk/geom/pkg/store"
+	"github.com/labstack/echo/v4"
+)
+
+type bulkRequest struct {
+	// "atomic"(default) or "bestEffort"
+	Mode  string            `json:"mode"`
+	Items []bulkRequestItem `json:"items"`
+}
+
+type bulkRequestItem struct {
+	// "put"(default) or "delete"
+	Op  string          `json:"op"`
+	Id  string          `json:"id"`
+	Doc json.RawMessage `json:"doc"`
+}
+
+type bulkResponse struct {
+	Committed bool             `json:"committed"`
+	Results   []bulkItemResult `json:"results"`
+}
+
+type bulkItemResult struct {
+	Id     string          `json:"id"`
+	Status int             `json:"status"`
+	Error  string          `json:"error,omitempty"`
+	Doc    json.RawMessage `json:"doc,omitempty"`
+}
+
+type mgetRequest struct {
+	Ids []string `json:"ids"`
+}
+
+func AddBulkEndpointsForType(e *echo.Echo, ds *store.Datastore, t string, checkers CRUDLAccessCheckers) {
+	e.POST("/"+t+"/_bulk", Bulk(ds, t, checkers))
+	e.POST("/"+t+"/_mget", MultiGet(ds, t, checkers))
+}
+
+func AddBulkEndpointsForTypeInGroup(e *echo.Group, ds *store.Datastore, t string, checkers CRUDLAccessCheckers) {
+	e.POST("/"+t+"/_bulk", Bulk(ds, t, checkers))
+	e.POST("/"+t+"/_mget", MultiGet(ds, t, checkers))
+}
+
+// Bulk writes many documents in one transaction, every item is checked like a single Post, Put or Delete would be.
+// Puts without an id create documents, puts with one replace the document and fail with 404 if there's none.
+func Bulk(ds *store.Datastore, t string, checkers CRUDLAccessCheckers) func(echo.Context) error {
+	return func(c echo.Context) error {
+		ctx := requestContext(c)
+
+		req := bulkRequest{}
+		if err := c.Bind(&req); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+
+		opts := store.BulkOptions{Mode: store.AllOrNothing}
+		switch req.Mode {
+		case "", "atomic":
+		case "bestEffort":
+			opts.Mode = store.BestEffort
+		default:
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("unknown mode %q", req.Mode))
+		}
+
+		items := make([]store.BulkItem, len(req.Items))
+		itemErrors := make([]error, len(req.Items))
+		for i, ri := range req.Items {
+			items[i] = store.BulkItem{Id: ri.Id}
+			switch ri.Op {
+			case "", "put":
+				doc, err := encodeDoc(t, ri.Doc)
+				if err != nil {
+					itemErrors[i] = fmt.Errorf("%w: %s", errBadRequest, err.Error())
+				}
+				items[i].Data = doc
+			case "delete":
+				items[i].Delete = true
+			default:
+				itemErrors[i] = fmt.Errorf("%w: unknown op %q", errBadRequest, ri.Op)
+			}
+		}
+
+		opts.Check = func(i int, item store.BulkItem, current []byte) error {
+			if itemErrors[i] != nil {
+				return itemErrors[i]
+			}
+			switch {
+			case item.Delete:
+				if !checkers.DeleteCheck(c, current) {
+					return errForbidden
+				}
+			case current == nil && item.Id != "":
+				//like Put, explicit ids wouldn't move the sequence along and a later Post would write over them
+				return store.ErrDocumentNotFound
+			case current == nil:
+				if !checkers.PostCheck(c, item.Data) {
+					return errForbidden
+				}
+			default:
+				if !checkers.PutCheck(c, current) {
+					return errForbidden
+				}
+			}
+			return nil
+		}
+
+		results, err := ds.Bulk(ctx, t, items, opts)
+		if err != nil && statusFor(err) >= http.StatusInternalServerError {
+			return c.String(statusFor(err), err.Error())
+		}
+
+		res := bulkResponse{Committed: err == nil, Results: make([]bulkItemResult, len(results))}
+		for i, r := range results {
+			res.Results[i] = bulkItemResult{Id: r.Id, Status: statusFor(r.Error)}
+			if r.Error != nil {
+				res.Results[i].Error = r.Error.Error()
+			}
+		}
+
+		return c.JSON(http.StatusOK, res)
+	}
+}
+
+// MultiGet reads many documents in one transaction, documents failing GetCheck get a 403 result
+func MultiGet(ds *store.Datastore, t string, checkers CRUDLAccessCheckers) func(echo.Context) error {
+	return func(c echo.Context) error {
+		ctx := requestContext(c)
+
+		paths, err := projection(c, t)
+		if err != nil {
+			return err
+		}
+
+		req := mgetRequest{}
+		if err := c.Bind(&req); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+
+		results, err := ds.GetMany(ctx, t, req.Ids)
+		if err != nil {
+			return c.String(statusFor(err), err.Error())
+		}
+
+		res := make([]bulkItemResult, len(results))
+		for i, r := range results {
+			if r.Error == nil && !checkers.GetCheck(c, r.Data) {
+				r.Error = errForbidden
+			}
+			res[i] = bulkItemResult{Id: r.Id, Status: statusFor(r.Error)}
+			if r.Error != nil {
+				res[i].Error = r.Error.Error()
+			} else {
+				res[i].Doc = project(r.Data, paths)
+			}
+		}
+
+		return c.JSON(http.StatusOK, res)
+	}
+}
+
+// encodeDoc normalizes a json document through the registered type, like Post does
+func encodeDoc(t string, raw []byte) ([]byte, error) {
+	obj := model.Types[t]
+	if err := json.Unmarshal(raw, &obj); err != nil {
+		return nil, err
+	}
+	return json.Marshal(obj)
+}
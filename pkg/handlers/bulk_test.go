@@ -0,0 +1,58 @@
+package handlers_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/fnurk/geom/pkg/handlers"
+	"github.com/labstack/echo/v4"
+)
+
+type bulkResult struct {
+	Id     string `json:"id"`
+	Status int    `json:"status"`
+}
+
+type bulkResponse struct {
+	Committed bool         `json:"committed"`
+	Results   []bulkResult `json:"results"`
+}
+
+func (s *testServer) bulk(t *testing.T, body string) bulkResponse {
+	t.Helper()
+	status, raw := s.request(t, http.MethodPost, "/note/_bulk", echo.MIMEApplicationJSON, body)
+	if status != http.StatusOK {
+		t.Fatalf("expected 200, got %d %s", status, raw)
+	}
+	res := bulkResponse{}
+	if err := json.Unmarshal([]byte(raw), &res); err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+func TestBulk_PutToMissingId(t *testing.T) {
+	s := newTestServer(t)
+	handlers.AddBulkEndpointsForType(s.e, s.ds, "note", allow)
+	s.ds.Put("note", "", []byte(`{"title":"first"}`))
+
+	res := s.bulk(t, `{"mode":"bestEffort","items":[{"id":"1","doc":{"title":"replaced"}},{"id":"3","doc":{"title":"made up"}},{"doc":{"title":"created"}}]}`)
+	if !res.Committed || res.Results[0].Status != http.StatusOK || res.Results[1].Status != http.StatusNotFound || res.Results[2].Id != "2" {
+		t.Fatalf("expected the put to a missing id to fail like Put does, got %+v", res)
+	}
+	if doc, _ := s.ds.Get("note", "3"); doc != nil {
+		t.Errorf("expected no note at the made up id, got %s", doc)
+	}
+
+	res = s.bulk(t, `{"items":[{"id":"9","doc":{"title":"made up"}}]}`)
+	if res.Committed || res.Results[0].Status != http.StatusNotFound {
+		t.Errorf("expected an atomic bulk with a missing id not to commit, got %+v", res)
+	}
+
+	//ids keep coming from the sequence
+	status, id := s.request(t, http.MethodPost, "/note", echo.MIMEApplicationJSON, `{"title":"posted"}`)
+	if status != http.StatusOK || id != "3" {
+		t.Errorf("expected the next post to get id 3, got %d %s", status, id)
+	}
+}
@@ -0,0 +1,45 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/fnurk/geom/pkg/model"
+	"github.com/fnurk/geom/pkg/store"
+)
+
+var (
+	errForbidden  = errors.New("forbidden")
+	errBadRequest = errors.New("bad request")
+)
+
+// statusFor maps errors from the store to http status codes
+func statusFor(err error) int {
+	switch {
+	case err == nil:
+		return http.StatusOK
+	case errors.Is(err, errForbidden):
+		return http.StatusForbidden
+	case errors.Is(err, errBadRequest), errors.Is(err, store.ErrInvalidOp),
+		errors.Is(err, store.ErrNoTenant), errors.Is(err, store.ErrInvalidTenant), errors.Is(err, store.ErrViewKey),
+		errors.Is(err, store.ErrInvalidFilter), errors.Is(err, model.ErrInvalidPatch), errors.Is(err, model.ErrInvalidDocument),
+		errors.Is(err, store.ErrAttachmentsReadOnly):
+		return http.StatusBadRequest
+	case errors.Is(err, store.ErrDocumentNotFound), errors.Is(err, store.ErrViewNotFound), errors.Is(err, store.ErrUnknownTenant):
+		return http.StatusNotFound
+	case errors.Is(err, model.ErrPatchConflict):
+		return http.StatusConflict
+	case errors.Is(err, store.ErrDocumentTooLarge):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, store.ErrQuotaExceeded):
+		return http.StatusTooManyRequests
+	case errors.Is(err, store.ErrRolledBack):
+		return http.StatusFailedDependency
+	case errors.Is(err, store.ErrReadOnly), errors.Is(err, store.ErrTooManyTenants):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
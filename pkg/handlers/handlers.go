@@ -1,6 +1,7 @@
 package handlers
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
@@ -10,7 +11,6 @@ import (
 	"github.com/fnurk/geom/pkg/pubsub"
 	"github.com/fnurk/geom/pkg/store"
 	"github.com/labstack/echo/v4"
-	"golang.org/x/net/websocket"
 )
 
 type CRUDLAccessCheckers struct {
@@ -25,23 +25,33 @@ func AddCrudEndpointsForType(e *echo.Echo, db store.Database, pb pubsub.Pubsub,
 	e.GET("/"+t+"/:id", Get(db, t, checkers.GetCheck))
 	e.POST("/"+t, Post(db, t, checkers.PostCheck))
 	e.PUT("/"+t+"/:id", Put(db, t, checkers.PutCheck))
+	e.PATCH("/"+t+"/:id", Patch(db, t, checkers.PutCheck))
 	e.DELETE("/"+t+"/:id", Delete(db, t, checkers.DeleteCheck))
 	e.GET("/"+t+"/:id/live", LiveUpdates(db, t, pb, checkers.LiveCheck))
+	e.GET("/"+t+"/:id/live/sse", LiveUpdates(db, t, pb, checkers.LiveCheck))
 }
 
 func AddCrudEndpointsForTypeInGroup(e *echo.Group, db store.Database, pb pubsub.Pubsub, t string, checkers CRUDLAccessCheckers) {
 	e.GET("/"+t+"/:id", Get(db, t, checkers.GetCheck))
 	e.POST("/"+t, Post(db, t, checkers.PostCheck))
 	e.PUT("/"+t+"/:id", Put(db, t, checkers.PutCheck))
+	e.PATCH("/"+t+"/:id", Patch(db, t, checkers.PutCheck))
 	e.DELETE("/"+t+"/:id", Delete(db, t, checkers.DeleteCheck))
 	e.GET("/"+t+"/:id/live", LiveUpdates(db, t, pb, checkers.LiveCheck))
+	e.GET("/"+t+"/:id/live/sse", LiveUpdates(db, t, pb, checkers.LiveCheck))
 }
 
-func Get(store store.Database, t string, accessChecker auth.AccessFunc) func(echo.Context) error {
+// Get returns the document, or part of it with ?fields= or ?projection=, see projection
+func Get(db store.Database, t string, accessChecker auth.AccessFunc) func(echo.Context) error {
 	return func(c echo.Context) error {
+		ctx := requestContext(c)
 		id := c.Param("id")
+		paths, err := projection(c, t)
+		if err != nil {
+			return err
+		}
 
-		doc, err := store.Get(t, id)
+		doc, err := store.GetContext(ctx, db, t, id)
 		if err != nil {
 			return c.String(http.StatusInternalServerError, err.Error())
 		}
@@ -70,12 +80,21 @@ func Get(store store.Database, t string, accessChecker auth.AccessFunc) func(ech
 			return c.NoContent(http.StatusNotFound)
 		}
 
+		if paths != nil {
+			normalized, err := json.Marshal(obj)
+			if err != nil {
+				return c.String(http.StatusInternalServerError, err.Error())
+			}
+			return c.JSONBlob(http.StatusOK, project(normalized, paths))
+		}
+
 		return c.JSON(http.StatusOK, obj)
 	}
 }
 
-func Post(store store.Database, t string, accessChecker auth.AccessFunc) func(echo.Context) error {
+func Post(db store.Database, t string, accessChecker auth.AccessFunc) func(echo.Context) error {
 	return func(c echo.Context) error {
+		ctx := requestContext(c)
 		dataType := model.Types[t]
 		obj := dataType
 		if err := c.Bind(&obj); err != nil {
@@ -92,21 +111,22 @@ func Post(store store.Database, t string, accessChecker auth.AccessFunc) func(ec
 			return c.String(http.StatusInternalServerError, err.Error())
 		}
 
-		id, err := store.Put(t, "", doc)
+		id, err := store.PutContext(ctx, db, t, "", doc)
 
 		if err != nil {
-			return c.String(http.StatusInternalServerError, err.Error())
+			return c.String(statusFor(err), err.Error())
 		}
 
 		return c.String(http.StatusOK, fmt.Sprintf("%s", id))
 	}
 }
 
-func Put(store store.Database, t string, accessChecker auth.AccessFunc) func(echo.Context) error {
+func Put(db store.Database, t string, accessChecker auth.AccessFunc) func(echo.Context) error {
 	return func(c echo.Context) error {
+		ctx := requestContext(c)
 		id := c.Param("id")
 
-		doc, err := store.Get(t, id)
+		doc, err := store.GetContext(ctx, db, t, id)
 		if err != nil {
 			return c.String(http.StatusInternalServerError, err.Error())
 		}
@@ -129,20 +149,21 @@ func Put(store store.Database, t string, accessChecker auth.AccessFunc) func(ech
 			return c.String(http.StatusInternalServerError, err.Error())
 		}
 
-		_, err = store.Put(t, id, bytes)
+		_, err = store.PutContext(ctx, db, t, id, bytes)
 
 		if err != nil {
-			return c.String(http.StatusInternalServerError, err.Error())
+			return c.String(statusFor(err), err.Error())
 		}
 		return c.NoContent(http.StatusOK)
 	}
 }
 
-func Delete(store store.Database, t string, accessChecker auth.AccessFunc) func(echo.Context) error {
+func Delete(db store.Database, t string, accessChecker auth.AccessFunc) func(echo.Context) error {
 	return func(c echo.Context) error {
+		ctx := requestContext(c)
 		id := c.Param("id")
 
-		doc, err := store.Get(t, id)
+		doc, err := store.GetContext(ctx, db, t, id)
 
 		if err != nil {
 			return err
@@ -155,21 +176,28 @@ func Delete(store store.Database, t string, accessChecker auth.AccessFunc) func(
 			return c.NoContent(http.StatusForbidden)
 		}
 
-		err = store.Delete(t, id)
+		err = store.DeleteContext(ctx, db, t, id)
 
 		if err != nil {
-			return c.String(http.StatusInternalServerError, err.Error())
+			return c.String(statusFor(err), err.Error())
 		}
 
 		return c.NoContent(http.StatusOK)
 	}
 }
 
-func LiveUpdates(store store.Database, t string, changes pubsub.Pubsub, accessChecker auth.AccessFunc) func(echo.Context) error {
+// LiveUpdates streams the document every time it's written, see stream for the transports
+func LiveUpdates(db store.Database, t string, changes pubsub.Pubsub, accessChecker auth.AccessFunc) func(echo.Context) error {
 	return func(c echo.Context) error {
+		ctx := requestContext(c)
 		id := c.Param("id")
 
-		doc, err := store.Get(t, id)
+		paths, err := projection(c, t)
+		if err != nil {
+			return err
+		}
+
+		doc, err := store.GetContext(ctx, db, t, id)
 
 		if err != nil {
 			return err
@@ -183,28 +211,59 @@ func LiveUpdates(store store.Database, t string, changes pubsub.Pubsub, accessCh
 			return c.NoContent(http.StatusForbidden)
 		}
 
-		websocket.Handler(func(ws *websocket.Conn) {
-			defer ws.Close()
-			changes.Subscribe(fmt.Sprintf("%s.%s", t, id), func(m *pubsub.Message, s pubsub.Subscriber) {
-				err := websocket.Message.Send(ws, m.Body)
-				if err != nil {
-					s.Unsubscribe()
-					ws.Close()
-				}
-			}, func() {
-				ws.Close()
-			})
-
-			for {
-				msg := ""
-				err := websocket.Message.Receive(ws, &msg)
-				if err != nil {
-					ws.Close()
-					break
+		return stream(c, func(send liveSend) pubsub.Subscriber {
+			return followDocument(c, db, t, id, changes, accessChecker, paths, send, false)
+		})
+	}
+}
+
+// followDocument sends the document every time it's written, while accessChecker allows reading it.
+// It starts with the document as it is if current is set, otherwise with what a resuming client missed.
+func followDocument(c echo.Context, db store.Database, t string, id string, changes pubsub.Pubsub, accessChecker auth.AccessFunc, paths []string, send liveSend, current bool) pubsub.Subscriber {
+	ctx := requestContext(c)
+	topic := LiveTopic(ctx, t, id)
+	failed := false
+	deliver := func(m *pubsub.Message) {
+		//deletes have no body, see PublishChanges, and documents can stop being readable
+		if failed || m.Body == "" || echoed(c, m) || !accessChecker(c, []byte(m.Body)) {
+			return
+		}
+		failed = send(m.Id, project([]byte(m.Body), paths)) != nil
+	}
+
+	return follow(changes, topic, func() uint64 {
+		if !current {
+			after, resuming := lastEventId(c)
+			if !resuming {
+				return 0
+			}
+			if msgs, ok := missed(changes, topic, after); ok {
+				for _, m := range msgs {
+					deliver(m)
+					after = m.Id
 				}
+				return after
 			}
+		}
+		//start over from the document as it is now
+		last := lastPublished(changes)
+		doc, err := store.GetContext(ctx, db, t, id)
+		if err == nil && doc != nil {
+			deliver(&pubsub.Message{Topic: topic, Body: string(doc), Id: last})
+		}
+		return last
+	}, deliver)
+}
 
-		}).ServeHTTP(c.Response(), c.Request())
-		return nil
+// requestContext carries the request's cancellation, the acting identity, the tenant and the realtime
+// connection writing into the store
+func requestContext(c echo.Context) context.Context {
+	ctx := store.WithIdentity(c.Request().Context(), auth.Identity(c))
+	if tenant := Tenant(c); tenant != "" {
+		ctx = store.WithTenant(ctx, tenant)
+	}
+	if origin, _ := c.Get(originKey).(string); origin != "" {
+		ctx = store.WithOrigin(ctx, origin)
 	}
+	return ctx
 }
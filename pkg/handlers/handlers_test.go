@@ -0,0 +1,172 @@
+package handlers_test
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fnurk/geom/pkg/handlers"
+	"github.com/fnurk/geom/pkg/model"
+	"github.com/fnurk/geom/pkg/pubsub"
+	"github.com/fnurk/geom/pkg/store"
+	"github.com/labstack/echo/v4"
+)
+
+type note struct {
+	Title    string `json:"title"`
+	Status   string `json:"status,omitempty"`
+	Priority int    `json:"priority,omitempty"`
+}
+
+type testServer struct {
+	*httptest.Server
+	e       *echo.Echo
+	ds      *store.Datastore
+	changes *pubsub.ReplayPubsub
+}
+
+var allow = handlers.CRUDLAccessCheckers{
+	GetCheck:    func(echo.Context, []byte) bool { return true },
+	PostCheck:   func(echo.Context, []byte) bool { return true },
+	PutCheck:    func(echo.Context, []byte) bool { return true },
+	DeleteCheck: func(echo.Context, []byte) bool { return true },
+	LiveCheck:   func(echo.Context, []byte) bool { return true },
+}
+
+// newTestServer serves the crud endpoints of note, add more to s.e before making requests. configure runs
+// before the datastore is initialized.
+func newTestServer(t *testing.T, configure ...func(ds *store.Datastore)) *testServer {
+	model.RegisterType("note", note{})
+	ds := store.NewDatastore(store.NewInMemDatabase(), nil)
+	blobs, err := store.NewBlobStore(filepath.Join(t.TempDir(), "blobs.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ds.UseBlobStore(blobs)
+	changes := pubsub.NewReplayPubsub(pubsub.NewChanPubsub(), 100)
+	handlers.PublishChanges(ds, changes)
+	for _, fn := range configure {
+		fn(ds)
+	}
+	if err := ds.Init(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(ds.Close)
+
+	e := echo.New()
+	handlers.AddCrudEndpointsForType(e, ds, changes, "note", allow)
+
+	s := &testServer{Server: httptest.NewServer(e), e: e, ds: ds, changes: changes}
+	t.Cleanup(s.Close)
+	return s
+}
+
+// request returns the status and body of a request to the server
+func (s *testServer) request(t *testing.T, method string, path string, contentType string, body string) (int, string) {
+	t.Helper()
+	req, err := http.NewRequest(method, s.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if contentType != "" {
+		req.Header.Set(echo.HeaderContentType, contentType)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	b, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res.StatusCode, string(b)
+}
+
+type sseEvent struct {
+	id   string
+	data string
+}
+
+type sseStream struct {
+	events chan sseEvent
+}
+
+// sse follows a live endpoint over server-sent events until the test ends, it's subscribed once this returns
+func (s *testServer) sse(t *testing.T, path string, lastEventId string) *sseStream {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.URL+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(echo.HeaderAccept, "text/event-stream")
+	if lastEventId != "" {
+		req.Header.Set("Last-Event-ID", lastEventId)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200 from %s, got %d", path, res.StatusCode)
+	}
+
+	st := &sseStream{events: make(chan sseEvent, 100)}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer res.Body.Close()
+		ev := sseEvent{}
+		scanner := bufio.NewScanner(res.Body)
+		for scanner.Scan() {
+			line := scanner.Text()
+			switch {
+			case strings.HasPrefix(line, "id: "):
+				ev.id = line[len("id: "):]
+			case strings.HasPrefix(line, "data: "):
+				ev.data += line[len("data: "):]
+			case line == "" && ev.data != "":
+				select {
+				case st.events <- ev:
+				case <-ctx.Done():
+					return
+				}
+				ev = sseEvent{}
+			}
+		}
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	return st
+}
+
+// next is the next event, the test fails if none comes
+func (st *sseStream) next(t *testing.T) sseEvent {
+	t.Helper()
+	select {
+	case ev := <-st.events:
+		return ev
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for an event")
+		return sseEvent{}
+	}
+}
+
+// none fails the test if an event comes
+func (st *sseStream) none(t *testing.T) {
+	t.Helper()
+	select {
+	case ev := <-st.events:
+		t.Errorf("expected no event, got %s", ev.data)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -0,0 +1,174 @@
+package handlers
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fnurk/geom/pkg/pubsub"
+	"github.com/labstack/echo/v4"
+	"golang.org/x/net/websocket"
+)
+
+// Live endpoints are websockets, or server-sent events if the request accepts text/event-stream or the
+// path ends with /sse. SSE events have ids when the pubsub is a pubsub.ReplayPubsub, a client reconnecting
+// with Last-Event-ID (or ?lastEventId=) gets what it missed.
+
+// SSEHeartbeat is how often a comment is sent to keep idle SSE connections open through proxies
+var SSEHeartbeat = 15 * time.Second
+
+// liveSend delivers an event to a live client, id is 0 if it can't be resumed from
+type liveSend func(id uint64, data []byte) error
+
+func wantsSSE(c echo.Context) bool {
+	return strings.HasSuffix(c.Path(), "/sse") || strings.Contains(c.Request().Header.Get(echo.HeaderAccept), "text/event-stream")
+}
+
+// stream runs a live subscription until the client goes away, subscribe starts sending and returns the
+// subscription to end
+func stream(c echo.Context, subscribe func(send liveSend) pubsub.Subscriber) error {
+	if wantsSSE(c) {
+		return streamSSE(c, subscribe)
+	}
+
+	websocket.Handler(func(ws *websocket.Conn) {
+		defer ws.Close()
+		sub := subscribe(func(id uint64, data []byte) error {
+			return websocket.Message.Send(ws, string(data))
+		})
+		defer sub.Unsubscribe()
+
+		for {
+			msg := ""
+			if err := websocket.Message.Receive(ws, &msg); err != nil {
+				return
+			}
+		}
+	}).ServeHTTP(c.Response(), c.Request())
+	return nil
+}
+
+func streamSSE(c echo.Context, subscribe func(send liveSend) pubsub.Subscriber) error {
+	w := c.Response()
+	w.Header().Set(echo.HeaderContentType, "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no") //nginx
+	w.WriteHeader(http.StatusOK)
+
+	lock := sync.Mutex{}
+	done := false
+	write := func(s string) error {
+		lock.Lock()
+		defer lock.Unlock()
+		//messages still being delivered can't write after the handler returns
+		if done {
+			return io.ErrClosedPipe
+		}
+		if _, err := io.WriteString(w, s); err != nil {
+			return err
+		}
+		w.Flush()
+		return nil
+	}
+	defer func() {
+		lock.Lock()
+		done = true
+		lock.Unlock()
+	}()
+
+	sub := subscribe(func(id uint64, data []byte) error {
+		ev := strings.Builder{}
+		if id != 0 {
+			fmt.Fprintf(&ev, "id: %d\n", id)
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			fmt.Fprintf(&ev, "data: %s\n", line)
+		}
+		ev.WriteString("\n")
+		return write(ev.String())
+	})
+	defer sub.Unsubscribe()
+	//the headers go out once subscribed, a client that has them won't miss writes
+	if err := write(""); err != nil {
+		return nil
+	}
+
+	heartbeat := time.NewTicker(SSEHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-c.Request().Context().Done():
+			return nil
+		case <-heartbeat.C:
+			if err := write(": ping\n\n"); err != nil {
+				return nil
+			}
+		}
+	}
+}
+
+// lastEventId is the id of the last event a reconnecting client saw
+func lastEventId(c echo.Context) (uint64, bool) {
+	raw := c.Request().Header.Get("Last-Event-ID")
+	if raw == "" {
+		raw = c.QueryParam("lastEventId")
+	}
+	id, err := strconv.ParseUint(raw, 10, 64)
+	return id, err == nil
+}
+
+// lastPublished is the id of the latest message, 0 if changes doesn't number them
+func lastPublished(changes pubsub.Pubsub) uint64 {
+	if r, ok := changes.(*pubsub.ReplayPubsub); ok {
+		return r.Last()
+	}
+	return 0
+}
+
+// missed returns what a client that saw the event with id after didn't see, ok is false if it can't be known
+func missed(changes pubsub.Pubsub, pattern string, after uint64) ([]*pubsub.Message, bool) {
+	r, ok := changes.(*pubsub.ReplayPubsub)
+	if !ok {
+		return nil, false
+	}
+	return r.Since(after, pattern)
+}
+
+// follow subscribes to pattern and hands every message to handle, in order. catchUp runs once subscribed
+// so nothing slips in between. Messages arriving meanwhile wait for it, messages whose id isn't after the
+// one it returns are dropped, the client is already up to date with them. They can still be on their way
+// after catchUp, a ReplayPubsub numbers messages before passing them on.
+func follow(changes pubsub.Pubsub, pattern string, catchUp func() uint64, handle func(m *pubsub.Message)) pubsub.Subscriber {
+	lock := sync.Mutex{}
+	started := false
+	upTo := uint64(0)
+	pending := []*pubsub.Message{}
+
+	sub := changes.Subscribe(pattern, func(m *pubsub.Message, s pubsub.Subscriber) {
+		lock.Lock()
+		defer lock.Unlock()
+		if !started {
+			pending = append(pending, m)
+			return
+		}
+		if m.Id == 0 || m.Id > upTo {
+			handle(m)
+		}
+	}, func() {})
+
+	last := catchUp()
+	lock.Lock()
+	defer lock.Unlock()
+	started = true
+	upTo = last
+	for _, m := range pending {
+		if m.Id == 0 || m.Id > upTo {
+			handle(m)
+		}
+	}
+	return sub
+}
@@ -0,0 +1,127 @@
+package handlers_test
+
+import (
+	"bufio"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fnurk/geom/pkg/handlers"
+	"github.com/labstack/echo/v4"
+)
+
+func TestLiveUpdates_SSE(t *testing.T) {
+	s := newTestServer(t)
+	s.ds.Put("note", "1", []byte(`{"title":"first"}`))
+	s.ds.Put("note", "2", []byte(`{"title":"other"}`))
+
+	//the Accept header asks for events without /sse
+	st := s.sse(t, "/note/1/live", "")
+	s.ds.Put("note", "1", []byte(`{"title":"second","status":"open"}`))
+	first := st.next(t)
+	if first.data != `{"title":"second","status":"open"}` {
+		t.Errorf("expected the written note, got %s", first.data)
+	}
+	s.ds.Put("note", "2", []byte(`{"title":"still other"}`))
+	s.ds.Delete("note", "1")
+	st.none(t)
+
+	s.ds.Put("note", "1", []byte(`{"title":"third","status":"done"}`))
+	if ev := st.next(t); eventId(t, ev.id) <= eventId(t, first.id) {
+		t.Errorf("expected ids to increase, got %s after %s", ev.id, first.id)
+	}
+
+	fields := s.sse(t, "/note/1/live/sse?fields=title", "")
+	s.ds.Put("note", "1", []byte(`{"title":"fourth","status":"open"}`))
+	if ev := fields.next(t); ev.data != `{"title":"fourth"}` {
+		t.Errorf("expected only the title, got %s", ev.data)
+	}
+}
+
+func TestLiveUpdates_Resume(t *testing.T) {
+	s := newTestServer(t)
+	s.ds.Put("note", "1", []byte(`{"title":"first"}`))
+
+	st := s.sse(t, "/note/1/live/sse", "")
+	s.ds.Put("note", "1", []byte(`{"title":"second"}`))
+	seen := st.next(t)
+
+	//written while the client is away
+	s.ds.Put("note", "1", []byte(`{"title":"third"}`))
+	s.ds.Put("note", "1", []byte(`{"title":"fourth"}`))
+
+	resumed := s.sse(t, "/note/1/live/sse", seen.id)
+	for _, want := range []string{`{"title":"third"}`, `{"title":"fourth"}`} {
+		if ev := resumed.next(t); ev.data != want {
+			t.Errorf("expected %s, got %s", want, ev.data)
+		}
+	}
+	resumed.none(t)
+	s.ds.Put("note", "1", []byte(`{"title":"fifth"}`))
+	if ev := resumed.next(t); ev.data != `{"title":"fifth"}` {
+		t.Errorf("expected the next write after catching up, got %s", ev.data)
+	}
+
+	//EventSource can't set headers on the first connection
+	query := s.sse(t, "/note/1/live/sse?lastEventId="+seen.id, "")
+	if ev := query.next(t); ev.data != `{"title":"third"}` {
+		t.Errorf("expected ?lastEventId to resume, got %s", ev.data)
+	}
+
+	//too far ahead to know what was missed, the note as it is
+	unknown := s.sse(t, "/note/1/live/sse", "1000")
+	if ev := unknown.next(t); ev.data != `{"title":"fifth"}` {
+		t.Errorf("expected the current note, got %s", ev.data)
+	}
+	unknown.none(t)
+}
+
+func TestLiveUpdates_Refused(t *testing.T) {
+	s := newTestServer(t)
+	checkers := allow
+	checkers.LiveCheck = func(echo.Context, []byte) bool { return false }
+	handlers.AddCrudEndpointsForTypeInGroup(s.e.Group("/private"), s.ds, s.changes, "note", checkers)
+	s.ds.Put("note", "1", []byte(`{"title":"first"}`))
+
+	if status, _ := s.request(t, http.MethodGet, "/note/2/live/sse", "", ""); status != http.StatusNotFound {
+		t.Errorf("expected 404 for a missing note, got %d", status)
+	}
+	if status, _ := s.request(t, http.MethodGet, "/private/note/1/live/sse", "", ""); status != http.StatusForbidden {
+		t.Errorf("expected 403 for a note that can't be followed, got %d", status)
+	}
+}
+
+func TestLiveUpdates_Heartbeat(t *testing.T) {
+	heartbeat := handlers.SSEHeartbeat
+	handlers.SSEHeartbeat = 10 * time.Millisecond
+	defer func() { handlers.SSEHeartbeat = heartbeat }()
+
+	s := newTestServer(t)
+	s.ds.Put("note", "1", []byte(`{"title":"first"}`))
+	res, err := http.Get(s.URL + "/note/1/live/sse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if ct := res.Header.Get(echo.HeaderContentType); ct != "text/event-stream" {
+		t.Errorf("expected text/event-stream, got %s", ct)
+	}
+
+	line := make(chan string, 1)
+	go func() {
+		scanner := bufio.NewScanner(res.Body)
+		if scanner.Scan() {
+			line <- scanner.Text()
+		}
+		close(line)
+	}()
+	select {
+	case l := <-line:
+		if !strings.HasPrefix(l, ":") {
+			t.Errorf("expected a comment, got %s", l)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("timed out waiting for a heartbeat")
+	}
+}
@@ -0,0 +1,201 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+
+	"github.com/fnurk/geom/pkg/auth"
+	"github.com/fnurk/geom/pkg/pubsub"
+	"github.com/fnurk/geom/pkg/store"
+	"github.com/labstack/echo/v4"
+)
+
+// LiveEvent is sent to live query clients. The first one is "initial" with the documents matching when
+// the query started, then "added", "changed" and "removed" as documents enter, change in and leave it.
+// It's "error" if the query couldn't run.
+type LiveEvent struct {
+	Type      string           `json:"type"`
+	Docs      []store.QueryDoc `json:"docs,omitempty"`
+	Truncated bool             `json:"truncated,omitempty"`
+	Id        string           `json:"id,omitempty"`
+	Doc       json.RawMessage  `json:"doc,omitempty"`
+	Error     string           `json:"error,omitempty"`
+}
+
+// PublishChanges publishes every committed write to its LiveTopic, documents as they were written and
+// deletes with an empty body. Live queries need it, or hooks publishing the same.
+func PublishChanges(ds *store.Datastore, pb pubsub.Pubsub) {
+	ds.AddPutContextHook(func(ctx context.Context, t string, id string, value []byte) {
+		pb.Publish(&pubsub.Message{Topic: LiveTopic(ctx, t, id), Body: string(value), Origin: store.OriginFrom(ctx)})
+	})
+	ds.AddDeleteContextHook(func(ctx context.Context, t string, id string) {
+		pb.Publish(&pubsub.Message{Topic: LiveTopic(ctx, t, id), Origin: store.OriginFrom(ctx)})
+	})
+}
+
+// Documents are only sent while LiveCheck allows reading them
+func AddLiveQueryEndpointForType(e *echo.Echo, ds *store.Datastore, pb pubsub.Pubsub, t string, checkers CRUDLAccessCheckers) {
+	e.GET("/"+t+"/live", LiveQuery(ds, t, pb, checkers.LiveCheck))
+	e.GET("/"+t+"/live/sse", LiveQuery(ds, t, pb, checkers.LiveCheck))
+}
+
+func AddLiveQueryEndpointForTypeInGroup(e *echo.Group, ds *store.Datastore, pb pubsub.Pubsub, t string, checkers CRUDLAccessCheckers) {
+	e.GET("/"+t+"/live", LiveQuery(ds, t, pb, checkers.LiveCheck))
+	e.GET("/"+t+"/live/sse", LiveQuery(ds, t, pb, checkers.LiveCheck))
+}
+
+// LiveQuery streams LiveEvents as json, see stream for the transports. It takes filter, sort (of the
+// initial documents), fields and projection like Query does. A client resuming after Last-Event-ID gets
+// "changed" or "removed" for the documents written since, or "initial" again if that isn't known.
+func LiveQuery(ds *store.Datastore, t string, changes pubsub.Pubsub, accessChecker auth.AccessFunc) func(echo.Context) error {
+	return func(c echo.Context) error {
+		paths, err := projection(c, t)
+		if err != nil {
+			return err
+		}
+		lq, err := newLiveQuery(c, ds, t, accessChecker, c.QueryParam("filter"), c.QueryParam("sort"), paths)
+		if err != nil {
+			return err
+		}
+		return stream(c, func(send liveSend) pubsub.Subscriber {
+			return lq.start(changes, send)
+		})
+	}
+}
+
+type liveQuery struct {
+	c             echo.Context
+	ds            *store.Datastore
+	t             string
+	query         store.Query
+	paths         []string
+	accessChecker auth.AccessFunc
+
+	send    liveSend
+	members map[string]struct{}
+	failed  bool
+}
+
+func newLiveQuery(c echo.Context, ds *store.Datastore, t string, accessChecker auth.AccessFunc, filter string, sort string, paths []string) (*liveQuery, error) {
+	lq := &liveQuery{
+		c:             c,
+		ds:            ds,
+		t:             t,
+		paths:         paths,
+		accessChecker: accessChecker,
+		members:       map[string]struct{}{},
+		query:         store.Query{Sort: store.ParseSort(sort)},
+	}
+	if filter != "" {
+		f, err := store.ParseFilter(filter)
+		if err != nil {
+			return nil, echo.NewHTTPError(statusFor(err), err.Error())
+		}
+		lq.query.Filter = f
+	}
+	lq.query.Allow = func(id string, doc []byte) bool {
+		return accessChecker(c, doc)
+	}
+	return lq, nil
+}
+
+func (lq *liveQuery) start(changes pubsub.Pubsub, send liveSend) pubsub.Subscriber {
+	ctx := requestContext(lq.c)
+	pattern := LiveTopic(ctx, lq.t, "*")
+	lq.send = send
+
+	return follow(changes, pattern, func() uint64 {
+		//the documents are read after this, changes up to it are in them
+		last := lastPublished(changes)
+		res, err := lq.ds.Query(ctx, lq.t, lq.query)
+		if err != nil {
+			lq.emit(0, LiveEvent{Type: "error", Error: err.Error()})
+			lq.failed = true
+			return last
+		}
+		for _, d := range res.Docs {
+			lq.members[d.Id] = struct{}{}
+		}
+
+		after, resuming := lastEventId(lq.c)
+		if resuming {
+			if msgs, ok := missed(changes, pattern, after); ok {
+				lq.resume(res.Docs, msgs, last)
+				return last
+			}
+		}
+
+		for i, d := range res.Docs {
+			res.Docs[i].Doc = project(d.Doc, lq.paths)
+		}
+		lq.emit(last, LiveEvent{Type: "initial", Docs: res.Docs, Truncated: res.Truncated})
+		return last
+	}, lq.change)
+}
+
+// resume sends the current state of the documents written since the client left
+func (lq *liveQuery) resume(docs []store.QueryDoc, msgs []*pubsub.Message, last uint64) {
+	current := map[string]store.QueryDoc{}
+	for _, d := range docs {
+		current[d.Id] = d
+	}
+	sent := map[string]struct{}{}
+	for _, m := range msgs {
+		id := topicId(m.Topic)
+		if _, ok := sent[id]; ok {
+			continue
+		}
+		sent[id] = struct{}{}
+		if d, ok := current[id]; ok {
+			lq.emit(last, LiveEvent{Type: "changed", Id: id, Doc: project(d.Doc, lq.paths)})
+		} else {
+			lq.emit(last, LiveEvent{Type: "removed", Id: id})
+		}
+	}
+}
+
+// change turns a published write into an event, if it's one the client should see
+func (lq *liveQuery) change(m *pubsub.Message) {
+	id := topicId(m.Topic)
+	_, member := lq.members[id]
+
+	doc := []byte(m.Body)
+	matches := m.Body != "" && lq.query.Filter.Match(doc) && lq.accessChecker(lq.c, doc)
+
+	emit := lq.emit
+	if echoed(lq.c, m) {
+		//the writer knows, the members still have to follow
+		emit = func(uint64, LiveEvent) {}
+	}
+
+	switch {
+	case matches && member:
+		emit(m.Id, LiveEvent{Type: "changed", Id: id, Doc: project(doc, lq.paths)})
+	case matches:
+		lq.members[id] = struct{}{}
+		emit(m.Id, LiveEvent{Type: "added", Id: id, Doc: project(doc, lq.paths)})
+	case member:
+		delete(lq.members, id)
+		emit(m.Id, LiveEvent{Type: "removed", Id: id})
+	}
+}
+
+// emit stops sending after the first failure, the connection is gone
+func (lq *liveQuery) emit(id uint64, ev LiveEvent) {
+	if lq.failed {
+		return
+	}
+	data, err := json.Marshal(ev)
+	if err == nil {
+		err = lq.send(id, data)
+	}
+	if err != nil {
+		lq.failed = true
+	}
+}
+
+// topicId is the document id of a LiveTopic
+func topicId(topic string) string {
+	return topic[strings.LastIndex(topic, ".")+1:]
+}
@@ -0,0 +1,159 @@
+package handlers_test
+
+import (
+	"encoding/json"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/fnurk/geom/pkg/handlers"
+	"github.com/fnurk/geom/pkg/pubsub"
+	"github.com/labstack/echo/v4"
+)
+
+func newLiveQueryServer(t *testing.T, checkers handlers.CRUDLAccessCheckers) *testServer {
+	s := newTestServer(t)
+	handlers.AddLiveQueryEndpointForType(s.e, s.ds, s.changes, "note", checkers)
+	return s
+}
+
+func liveEvent(t *testing.T, ev sseEvent) handlers.LiveEvent {
+	t.Helper()
+	le := handlers.LiveEvent{}
+	if err := json.Unmarshal([]byte(ev.data), &le); err != nil {
+		t.Fatalf("expected a LiveEvent, got %s", ev.data)
+	}
+	return le
+}
+
+// expect checks the next event is typ for the note with id and returns its event id
+func expect(t *testing.T, st *sseStream, typ string, id string) string {
+	t.Helper()
+	ev := st.next(t)
+	le := liveEvent(t, ev)
+	if le.Type != typ || le.Id != id {
+		t.Fatalf("expected %s of %s, got %s", typ, id, ev.data)
+	}
+	return ev.id
+}
+
+func eventId(t *testing.T, id string) uint64 {
+	t.Helper()
+	n, err := strconv.ParseUint(id, 10, 64)
+	if err != nil {
+		t.Fatalf("expected a numbered event, got id %q", id)
+	}
+	return n
+}
+
+var openNotes = "/note/live/sse?filter=" + url.QueryEscape(`status == "open"`)
+
+func TestLiveQuery(t *testing.T) {
+	s := newLiveQueryServer(t, allow)
+	s.ds.Put("note", "1", []byte(`{"title":"first","status":"open"}`))
+	s.ds.Put("note", "2", []byte(`{"title":"second","status":"done"}`))
+
+	st := s.sse(t, openNotes, "")
+	le := liveEvent(t, st.next(t))
+	if le.Type != "initial" || len(le.Docs) != 1 || le.Docs[0].Id != "1" {
+		t.Fatalf("expected initial with note 1, got %+v", le)
+	}
+
+	s.ds.Put("note", "3", []byte(`{"title":"third","status":"open"}`))
+	expect(t, st, "added", "3")
+	s.ds.Put("note", "1", []byte(`{"title":"renamed","status":"open"}`))
+	if le := liveEvent(t, st.next(t)); le.Type != "changed" || string(le.Doc) != `{"title":"renamed","status":"open"}` {
+		t.Errorf("expected note 1 changed, got %+v", le)
+	}
+	s.ds.Put("note", "1", []byte(`{"title":"renamed","status":"done"}`))
+	expect(t, st, "removed", "1")
+
+	//outside the query before and after
+	s.ds.Put("note", "2", []byte(`{"title":"still done","status":"done"}`))
+	st.none(t)
+
+	s.ds.Delete("note", "3")
+	expect(t, st, "removed", "3")
+}
+
+func TestLiveQuery_AccessCheck(t *testing.T) {
+	checkers := allow
+	checkers.LiveCheck = func(c echo.Context, doc []byte) bool {
+		return string(doc) != `{"title":"secret","status":"open"}`
+	}
+	s := newLiveQueryServer(t, checkers)
+	s.ds.Put("note", "1", []byte(`{"title":"secret","status":"open"}`))
+
+	st := s.sse(t, openNotes, "")
+	if le := liveEvent(t, st.next(t)); le.Type != "initial" || len(le.Docs) != 0 {
+		t.Fatalf("expected an initial event without the secret note, got %+v", le)
+	}
+	s.ds.Put("note", "2", []byte(`{"title":"secret","status":"open"}`))
+	s.ds.Put("note", "3", []byte(`{"title":"public","status":"open"}`))
+	expect(t, st, "added", "3")
+}
+
+// Writes published while the initial documents are read wait for the initial event
+func TestLiveQuery_WritesDuringCatchUp(t *testing.T) {
+	var changes *pubsub.ReplayPubsub
+	published := false
+	checkers := allow
+	checkers.LiveCheck = func(c echo.Context, doc []byte) bool {
+		//runs while the query reads the initial documents
+		if !published {
+			published = true
+			changes.Publish(&pubsub.Message{Topic: "note.2", Body: `{"title":"during","status":"open"}`})
+			time.Sleep(50 * time.Millisecond)
+		}
+		return true
+	}
+	s := newLiveQueryServer(t, checkers)
+	changes = s.changes
+	s.ds.Put("note", "1", []byte(`{"title":"before","status":"open"}`))
+
+	st := s.sse(t, openNotes, "")
+	initial := st.next(t)
+	if le := liveEvent(t, initial); le.Type != "initial" || len(le.Docs) != 1 {
+		t.Fatalf("expected the initial event first, got %s", initial.data)
+	}
+	if id := expect(t, st, "added", "2"); eventId(t, id) <= eventId(t, initial.id) {
+		t.Errorf("expected the write after the initial event to have a later id, got %s after %s", id, initial.id)
+	}
+	st.none(t)
+}
+
+func TestLiveQuery_Resume(t *testing.T) {
+	s := newLiveQueryServer(t, allow)
+	s.ds.Put("note", "1", []byte(`{"title":"first","status":"open"}`))
+	s.ds.Put("note", "2", []byte(`{"title":"second","status":"open"}`))
+
+	st := s.sse(t, openNotes, "")
+	initial := st.next(t)
+	if initial.id == "" {
+		t.Fatal("expected the initial event to have an id")
+	}
+
+	//written while the client is away
+	s.ds.Put("note", "1", []byte(`{"title":"first","status":"done"}`))
+	s.ds.Put("note", "2", []byte(`{"title":"edited","status":"open"}`))
+	s.ds.Put("note", "2", []byte(`{"title":"edited again","status":"open"}`))
+	s.ds.Put("note", "3", []byte(`{"title":"third","status":"open"}`))
+
+	resumed := s.sse(t, openNotes, initial.id)
+	expect(t, resumed, "removed", "1")
+	if le := liveEvent(t, resumed.next(t)); le.Type != "changed" || le.Id != "2" || string(le.Doc) != `{"title":"edited again","status":"open"}` {
+		t.Errorf("expected note 2 once as it is now, got %+v", le)
+	}
+	expect(t, resumed, "changed", "3")
+	resumed.none(t)
+
+	s.ds.Put("note", "4", []byte(`{"title":"fourth","status":"open"}`))
+	expect(t, resumed, "added", "4")
+
+	//too far back to know what was missed
+	unknown := s.sse(t, openNotes, "1000")
+	if le := liveEvent(t, unknown.next(t)); le.Type != "initial" || len(le.Docs) != 3 {
+		t.Errorf("expected initial again with the open notes, got %+v", le)
+	}
+}
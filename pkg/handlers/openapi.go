@@ -0,0 +1,314 @@
+package handlers
+
+import (
+	_ "embed"
+	"net/http"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/fnurk/geom/pkg/model"
+	"github.com/fnurk/geom/pkg/store"
+	"github.com/labstack/echo/v4"
+)
+
+type OpenAPIInfo struct {
+	Title       string `json:"title"`
+	Version     string `json:"version"`
+	Description string `json:"description,omitempty"`
+}
+
+type openAPIObject = map[string]interface{}
+
+//go:embed openapi.html
+var openAPIDocs []byte
+
+// AddOpenAPIEndpoint serves OpenAPI(e, info) at /openapi.json and, if docs is set, a viewer for it at /docs.
+// The document is generated on the first request, when every route has been registered.
+func AddOpenAPIEndpoint(e *echo.Echo, info OpenAPIInfo, docs bool) {
+	once := sync.Once{}
+	var spec openAPIObject
+	e.GET("/openapi.json", func(c echo.Context) error {
+		once.Do(func() {
+			spec = OpenAPI(e, info)
+		})
+		return c.JSON(http.StatusOK, spec)
+	})
+	if docs {
+		e.GET("/docs", func(c echo.Context) error {
+			//the viewer is embedded, it has no business loading anything from elsewhere
+			c.Response().Header().Set("Content-Security-Policy", "default-src 'self'; script-src 'unsafe-inline'; style-src 'unsafe-inline'")
+			return c.HTMLBlob(http.StatusOK, openAPIDocs)
+		})
+	}
+}
+
+// OpenAPI describes the routes registered on e as an OpenAPI 3.1 document. Routes of the handlers in this
+// package are described in full, with the schemas of model.Types for their documents, other routes by
+// their method and path. Live endpoints can't be described by OpenAPI, they're responses with an
+// x-geom-live extension naming the transport and the schema of the messages. The x-geom-index of a
+// field comes from the index tag on the type, indexes added with Datastore.AddIndex aren't in it.
+func OpenAPI(e *echo.Echo, info OpenAPIInfo) openAPIObject {
+	schemas := openAPIObject{
+		"LiveEvent": model.SchemaOf(LiveEvent{}),
+		"JSONPatch": model.SchemaOf([]model.PatchOp{}),
+	}
+	for t := range model.Types {
+		schema, _ := model.Schema(t)
+		if len(model.Projections[t]) > 0 {
+			names := []string{}
+			for name := range model.Projections[t] {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			schema["x-geom-projections"] = names
+		}
+		schemas[t] = schema
+	}
+
+	paths := openAPIObject{}
+	operationIds := map[string]int{}
+	routes := e.Routes()
+	sort.SliceStable(routes, func(i, j int) bool { return routes[i].Path < routes[j].Path })
+	for _, r := range routes {
+		//echo's own, static files and not found handlers
+		if r.Method == echo.RouteNotFound || strings.HasPrefix(r.Name, "github.com/labstack/echo/") {
+			continue
+		}
+
+		path, params := openAPIPath(r.Path)
+		t, tag := routeType(r.Path)
+		name, ours := geomHandler(r.Name)
+		op := openAPIOperation(name, r.Path, t)
+		if op == nil {
+			continue
+		}
+		//what a client generator needs to know, see cmd/geom-ts
+		if ours {
+			op["x-geom-operation"] = name
+			if t != "" {
+				op["x-geom-type"] = t
+			}
+		}
+		op["tags"] = []string{tag}
+		op["parameters"] = append(params, op["parameters"].([]openAPIObject)...)
+
+		id := strings.ToLower(r.Method) + strings.Trim(nonWord.ReplaceAllString(path, "_"), "_")
+		if operationIds[id]++; operationIds[id] > 1 {
+			continue
+		}
+		op["operationId"] = id
+
+		if paths[path] == nil {
+			paths[path] = openAPIObject{}
+		}
+		paths[path].(openAPIObject)[strings.ToLower(r.Method)] = op
+	}
+
+	return openAPIObject{
+		"openapi":    "3.1.0",
+		"info":       info,
+		"paths":      paths,
+		"components": openAPIObject{"schemas": schemas},
+	}
+}
+
+var nonWord = regexp.MustCompile(`[^a-zA-Z0-9]+`)
+
+// openAPIPath turns echo's :params and * into {params}
+func openAPIPath(path string) (string, []openAPIObject) {
+	params := []openAPIObject{}
+	parts := strings.Split(path, "/")
+	for i, part := range parts {
+		name := ""
+		switch {
+		case strings.HasPrefix(part, ":"):
+			name = part[1:]
+		case part == "*":
+			name = "path"
+		default:
+			continue
+		}
+		parts[i] = "{" + name + "}"
+		params = append(params, openAPIObject{"name": name, "in": "path", "required": true, "schema": openAPIObject{"type": "string"}})
+	}
+	return strings.Join(parts, "/"), params
+}
+
+// routeType is the registered type a route is for, if any, and the tag to group it under
+func routeType(path string) (string, string) {
+	t, tag := "", ""
+	for _, part := range strings.Split(path, "/") {
+		if part == "" || strings.HasPrefix(part, ":") || part == "*" {
+			continue
+		}
+		if _, ok := model.Types[part]; ok {
+			t = part
+		}
+		if tag == "" {
+			tag = strings.TrimPrefix(part, "_")
+		}
+	}
+	if t != "" {
+		tag = t
+	}
+	return t, tag
+}
+
+var (
+	handlerName = regexp.MustCompile(`^github\.com/fnurk/geom/pkg/handlers\.(.+?)(\.func\d+|-fm)*$`)
+	funcSuffix  = regexp.MustCompile(`(\.func\d+|-fm)+$`)
+)
+
+// geomHandler is the name of the handler in this package a route was registered with, eg. "Get"
+func geomHandler(name string) (string, bool) {
+	if m := handlerName.FindStringSubmatch(name); m != nil {
+		return m[1], true
+	}
+	return name, false
+}
+
+// openAPIOperation describes the route by its handler, nil leaves it out
+func openAPIOperation(name string, routePath string, t string) openAPIObject {
+	doc := openAPIObject{"type": "object"}
+	if t != "" {
+		doc = openAPIObject{"$ref": "#/components/schemas/" + t}
+	}
+	shape := []openAPIObject{
+		queryParam("fields", "comma separated gjson paths to return"),
+		queryParam("projection", "a projection registered with model.RegisterProjection"),
+	}
+
+	switch name {
+	case "AddOpenAPIEndpoint":
+		return nil
+	case "Get":
+		return operation("Get a "+t, shape, nil, jsonResponse(doc), 403, 404)
+	case "Post":
+		return operation("Create a "+t, nil, jsonBody(doc),
+			openAPIObject{"description": "The id of the document", "content": openAPIObject{echo.MIMETextPlain: openAPIObject{"schema": openAPIObject{"type": "string"}}}}, 400, 403)
+	case "Put":
+		return operation("Replace a "+t, nil, jsonBody(doc), openAPIObject{"description": "Replaced"}, 400, 403, 404)
+	case "Patch":
+		body := openAPIObject{"required": true, "content": openAPIObject{
+			MIMEMergePatch: openAPIObject{"schema": openAPIObject{"type": "object"}},
+			MIMEJSONPatch:  openAPIObject{"schema": openAPIObject{"$ref": "#/components/schemas/JSONPatch"}},
+		}}
+		return operation("Patch a "+t, nil, body, jsonResponse(doc), 400, 403, 404, 409, 415)
+	case "Delete":
+		return operation("Delete a "+t, nil, nil, openAPIObject{"description": "Deleted"}, 403, 404)
+	case "LiveUpdates":
+		params := append(shape, queryParam("lastEventId", "resume after this event, like the Last-Event-ID header"))
+		return liveOperation("Follow a "+t, routePath, params, doc)
+	case "LiveQuery":
+		params := append(shape, queryParam("filter", "see store.ParseFilter"), queryParam("sort", "eg. -created,title"),
+			queryParam("lastEventId", "resume after this event, like the Last-Event-ID header"))
+		return liveOperation("Follow a query of "+t, routePath, params, openAPIObject{"$ref": "#/components/schemas/LiveEvent"})
+	case "Query":
+		params := append(shape, queryParam("filter", "see store.ParseFilter"), queryParam("sort", "eg. -created,title"),
+			queryParam("limit", "the most documents returned"), queryParam("explain", "true adds how the query was run"))
+		res := model.SchemaOf(queryResponse{})
+		res["properties"].(openAPIObject)["docs"] = openAPIObject{"type": "array", "items": queryDoc(doc)}
+		return operation("Query "+t, params, nil, jsonResponse(res), 400)
+	case "Bulk":
+		req := model.SchemaOf(bulkRequest{})
+		req["properties"].(openAPIObject)["items"].(openAPIObject)["items"].(openAPIObject)["properties"].(openAPIObject)["doc"] = doc
+		return operation("Write many "+t, nil, jsonBody(req), jsonResponse(model.SchemaOf(bulkResponse{})), 400)
+	case "MultiGet":
+		return operation("Get many "+t, shape, jsonBody(model.SchemaOf(mgetRequest{})), jsonResponse(model.SchemaOf([]bulkItemResult{})), 400)
+	case "Apply":
+		ops := openAPIObject{"type": "array", "items": model.SchemaOf(store.Op{})}
+		return operation("Apply operations to a "+t, nil, jsonBody(ops), jsonResponse(doc), 400, 403, 404)
+	case "ListAttachments":
+		return operation("List the attachments of a "+t, nil, nil, jsonResponse(model.SchemaOf([]store.Attachment{})), 403, 404)
+	case "UploadAttachments":
+		body := openAPIObject{"required": true, "content": openAPIObject{echo.MIMEMultipartForm: openAPIObject{"schema": openAPIObject{"type": "object"}}}}
+		return operation("Upload attachments to a "+t, nil, body, jsonResponse(model.SchemaOf([]store.Attachment{})), 400, 403, 404)
+	case "DownloadAttachment":
+		return operation("Download an attachment of a "+t, nil, nil, openAPIObject{"description": "The attachment"}, 403, 404)
+	case "DeleteAttachment":
+		return operation("Delete an attachment of a "+t, nil, nil, openAPIObject{"description": "Deleted"}, 403, 404)
+	case "QueryView":
+		params := []openAPIObject{queryParam("prefix", "json array"), queryParam("start", "json array"),
+			queryParam("end", "json array"), queryParam("limit", "the most rows returned")}
+		return operation("Query a view", params, nil, jsonResponse(model.SchemaOf(viewResponse{})), 400, 404)
+	case "GetUsage":
+		return operation("Usage against the quotas", nil, nil, jsonResponse(model.SchemaOf(store.Usage{})), 403)
+	case "GetStats":
+		return operation("Database statistics", nil, nil, jsonResponse(model.SchemaOf(store.Stats{})), 403)
+	case "Compact":
+		return operation("Compact the database file", nil, nil, jsonResponse(openAPIObject{"type": "object"}), 403, 501)
+	case "Recompute":
+		return operation("Recompute computed fields", nil, nil, jsonResponse(openAPIObject{"type": "object"}), 403)
+	case "RebuildView":
+		return operation("Rebuild a view", nil, nil, jsonResponse(openAPIObject{"type": "object"}), 403, 404)
+	case "Ingest":
+		return operation("Add points to a series", nil, jsonBody(model.SchemaOf([]store.Point{})), openAPIObject{"description": "Stored"}, 400, 403)
+	case "QuerySeries":
+		params := []openAPIObject{queryParam("from", "RFC3339, default an hour ago"), queryParam("to", "RFC3339, default now"),
+			queryParam("resolution", "raw, 1m, 1h or 1d")}
+		//raw points, or rollups at the other resolutions
+		series := openAPIObject{"oneOf": []interface{}{model.SchemaOf([]store.Point{}), model.SchemaOf([]store.Aggregate{})}}
+		return operation("Query a series", params, nil, jsonResponse(series), 400, 403)
+	case "(*Realtime).Handle":
+		op := operation("Realtime websocket", nil, nil, openAPIObject{"description": "Not a websocket request"})
+		op["responses"].(openAPIObject)["101"] = openAPIObject{"description": "Switching protocols"}
+		op["x-geom-live"] = openAPIObject{
+			"transport": "websocket",
+			"send":      model.SchemaOf(realtimeRequest{}),
+			"message":   model.SchemaOf(realtimeResponse{}),
+		}
+		return op
+	}
+	//eg. main.listUsers
+	return operation(funcSuffix.ReplaceAllString(path.Base(name), ""), nil, nil, openAPIObject{"description": "OK"})
+}
+
+func operation(summary string, params []openAPIObject, body openAPIObject, ok openAPIObject, errors ...int) openAPIObject {
+	responses := openAPIObject{"200": ok}
+	for _, status := range errors {
+		responses[strconv.Itoa(status)] = openAPIObject{"description": http.StatusText(status)}
+	}
+	op := openAPIObject{"summary": summary, "responses": responses, "parameters": append([]openAPIObject{}, params...)}
+	if body != nil {
+		op["requestBody"] = body
+	}
+	return op
+}
+
+// liveOperation is a websocket, or server-sent events if path ends with /sse
+func liveOperation(summary string, path string, params []openAPIObject, message openAPIObject) openAPIObject {
+	if strings.HasSuffix(path, "/sse") {
+		op := operation(summary+" (server-sent events)", params, nil, openAPIObject{
+			"description": "Events with the messages as data",
+			"content":     openAPIObject{"text/event-stream": openAPIObject{"schema": openAPIObject{"type": "string"}}},
+		}, 400, 403, 404)
+		op["x-geom-live"] = openAPIObject{"transport": "sse", "message": message}
+		return op
+	}
+	op := operation(summary+" (websocket)", params, nil, openAPIObject{"description": "Not a websocket request"}, 400, 403, 404)
+	op["responses"].(openAPIObject)["101"] = openAPIObject{"description": "Switching protocols"}
+	op["x-geom-live"] = openAPIObject{"transport": "websocket", "message": message}
+	return op
+}
+
+func queryParam(name string, description string) openAPIObject {
+	return openAPIObject{"name": name, "in": "query", "description": description, "schema": openAPIObject{"type": "string"}}
+}
+
+func jsonBody(schema openAPIObject) openAPIObject {
+	return openAPIObject{"required": true, "content": openAPIObject{echo.MIMEApplicationJSON: openAPIObject{"schema": schema}}}
+}
+
+func jsonResponse(schema openAPIObject) openAPIObject {
+	return openAPIObject{"description": "OK", "content": openAPIObject{echo.MIMEApplicationJSON: openAPIObject{"schema": schema}}}
+}
+
+func queryDoc(doc openAPIObject) openAPIObject {
+	s := model.SchemaOf(store.QueryDoc{})
+	s["properties"].(openAPIObject)["doc"] = doc
+	return s
+}
@@ -0,0 +1,91 @@
+package handlers_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/fnurk/geom/pkg/handlers"
+	"github.com/labstack/echo/v4"
+)
+
+type openAPIOperation struct {
+	OperationId string `json:"operationId"`
+	Operation   string `json:"x-geom-operation"`
+	Type        string `json:"x-geom-type"`
+	Live        *struct {
+		Transport string `json:"transport"`
+	} `json:"x-geom-live"`
+}
+
+func TestOpenAPI(t *testing.T) {
+	s := newTestServer(t)
+	handlers.AddQueryEndpointForType(s.e, s.ds, "note", allow)
+	handlers.AddLiveQueryEndpointForType(s.e, s.ds, s.changes, "note", allow)
+	s.e.GET("/healthz", func(c echo.Context) error { return c.NoContent(http.StatusOK) })
+	handlers.AddOpenAPIEndpoint(s.e, handlers.OpenAPIInfo{Title: "notes", Version: "1.0"}, true)
+
+	status, body := s.request(t, http.MethodGet, "/openapi.json", "", "")
+	if status != http.StatusOK {
+		t.Fatalf("expected 200, got %d", status)
+	}
+	spec := struct {
+		OpenAPI string                                 `json:"openapi"`
+		Paths   map[string]map[string]openAPIOperation `json:"paths"`
+	}{}
+	if err := json.Unmarshal([]byte(body), &spec); err != nil {
+		t.Fatal(err)
+	}
+	if spec.OpenAPI != "3.1.0" {
+		t.Errorf("expected OpenAPI 3.1.0, got %s", spec.OpenAPI)
+	}
+
+	for _, want := range []struct {
+		path, method, operationId, operation, live string
+	}{
+		{"/note", "get", "getnote", "Query", ""},
+		{"/note", "post", "postnote", "Post", ""},
+		{"/note/{id}", "get", "getnote_id", "Get", ""},
+		{"/note/{id}", "patch", "patchnote_id", "Patch", ""},
+		{"/note/{id}/live", "get", "getnote_id_live", "LiveUpdates", "websocket"},
+		{"/note/{id}/live/sse", "get", "getnote_id_live_sse", "LiveUpdates", "sse"},
+		{"/note/live", "get", "getnote_live", "LiveQuery", "websocket"},
+		{"/note/live/sse", "get", "getnote_live_sse", "LiveQuery", "sse"},
+		{"/healthz", "get", "gethealthz", "", ""},
+	} {
+		op, ok := spec.Paths[want.path][want.method]
+		if !ok {
+			t.Errorf("expected %s %s", want.method, want.path)
+			continue
+		}
+		if op.OperationId != want.operationId || op.Operation != want.operation {
+			t.Errorf("expected %s %s to be %s and %q, got %+v", want.method, want.path, want.operationId, want.operation, op)
+		}
+		if want.operation != "" && op.Type != "note" {
+			t.Errorf("expected %s %s to be for note, got %q", want.method, want.path, op.Type)
+		}
+		if transport := ""; op.Live != nil || want.live != "" {
+			if op.Live != nil {
+				transport = op.Live.Transport
+			}
+			if transport != want.live {
+				t.Errorf("expected %s %s to be live over %q, got %q", want.method, want.path, want.live, transport)
+			}
+		}
+	}
+	for _, path := range []string{"/openapi.json", "/docs"} {
+		if _, ok := spec.Paths[path]; ok {
+			t.Errorf("expected %s to be left out", path)
+		}
+	}
+
+	res, err := http.Get(s.URL + "/docs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if csp := res.Header.Get("Content-Security-Policy"); !strings.Contains(csp, "default-src 'self'") {
+		t.Errorf("expected the viewer to only load from the server, got %q", csp)
+	}
+}
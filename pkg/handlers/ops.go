@@ -0,0 +1,48 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/fnurk/geom/pkg/auth"
+	"github.com/fnurk/geom/pkg/store"
+	"github.com/labstack/echo/v4"
+)
+
+// Operations are guarded by PutCheck, run against the document as it is when the transaction starts
+func AddOpsEndpointsForType(e *echo.Echo, ds *store.Datastore, t string, checkers CRUDLAccessCheckers) {
+	e.POST("/"+t+"/:id/_ops", Apply(ds, t, checkers.PutCheck))
+}
+
+func AddOpsEndpointsForTypeInGroup(e *echo.Group, ds *store.Datastore, t string, checkers CRUDLAccessCheckers) {
+	e.POST("/"+t+"/:id/_ops", Apply(ds, t, checkers.PutCheck))
+}
+
+// Apply takes a json array of operations, eg. [{"op":"inc","path":"likes","value":1}], and returns the updated document
+func Apply(ds *store.Datastore, t string, accessChecker auth.AccessFunc) func(echo.Context) error {
+	return func(c echo.Context) error {
+		ctx := requestContext(c)
+
+		ops := []store.Op{}
+		d := json.NewDecoder(c.Request().Body)
+		d.UseNumber()
+		if err := d.Decode(&ops); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+		if len(ops) == 0 {
+			return echo.NewHTTPError(http.StatusBadRequest, "no operations")
+		}
+
+		doc, err := ds.ApplyContext(ctx, t, c.Param("id"), func(current []byte) error {
+			if !accessChecker(c, current) {
+				return errForbidden
+			}
+			return nil
+		}, ops...)
+		if err != nil {
+			return c.String(statusFor(err), err.Error())
+		}
+
+		return c.JSONBlob(http.StatusOK, doc)
+	}
+}
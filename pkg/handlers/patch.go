@@ -0,0 +1,128 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/fnurk/geom/pkg/auth"
+	"github.com/fnurk/geom/pkg/model"
+	"github.com/fnurk/geom/pkg/store"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	MIMEMergePatch = "application/merge-patch+json"
+	MIMEJSONPatch  = "application/json-patch+json"
+)
+
+// Patch changes part of a document, a merge patch (RFC 7396) for application/merge-patch+json and
+// application/json, a JSON Patch (RFC 6902) for application/json-patch+json. The patch is applied in a
+// transaction, the result has to decode into the registered type, pass echo's Validator if there is one
+// and accessChecker like the document did before. It returns the patched document.
+func Patch(db store.Database, t string, accessChecker auth.AccessFunc) func(echo.Context) error {
+	return func(c echo.Context) error {
+		id := c.Param("id")
+
+		var apply func(doc []byte, patch []byte) ([]byte, error)
+		mediaType, _, _ := mime.ParseMediaType(c.Request().Header.Get(echo.HeaderContentType))
+		switch mediaType {
+		case MIMEMergePatch, echo.MIMEApplicationJSON:
+			apply = mergePatch
+		case MIMEJSONPatch:
+			apply = jsonPatch
+		default:
+			return c.String(http.StatusUnsupportedMediaType, fmt.Sprintf("use %s or %s", MIMEMergePatch, MIMEJSONPatch))
+		}
+
+		patch, err := io.ReadAll(c.Request().Body)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+
+		result, err := patchDocument(c, db, t, id, apply, patch, accessChecker)
+		if err != nil {
+			return c.String(statusFor(err), err.Error())
+		}
+
+		return c.JSONBlob(http.StatusOK, result)
+	}
+}
+
+// patchDocument applies patch to the document in a transaction, see Patch
+func patchDocument(c echo.Context, db store.Database, t string, id string, apply func(doc []byte, patch []byte) ([]byte, error), patch []byte, accessChecker auth.AccessFunc) ([]byte, error) {
+	var result []byte
+	err := store.UpdateTx(requestContext(c), db, func(tx store.Tx) error {
+		current, err := tx.Get(t, id)
+		if err != nil {
+			return err
+		}
+		if current == nil {
+			return store.ErrDocumentNotFound
+		}
+		if !accessChecker(c, current) {
+			return errForbidden
+		}
+
+		patched, err := apply(current, patch)
+		if err != nil {
+			return err
+		}
+		obj, err := model.Validate(t, patched)
+		if err != nil {
+			return err
+		}
+		if obj != nil {
+			if err := c.Validate(obj); err != nil && !errors.Is(err, echo.ErrValidatorNotRegistered) {
+				return fmt.Errorf("%w: %s", model.ErrInvalidDocument, err)
+			}
+			//fields outside the registered type aren't stored, like with Put
+			if patched, err = json.Marshal(obj); err != nil {
+				return err
+			}
+		}
+		if !accessChecker(c, patched) {
+			return errForbidden
+		}
+
+		if _, err := tx.Put(t, id, patched); err != nil {
+			return err
+		}
+		//computed fields may have changed on the way in
+		result, err = tx.Get(t, id)
+		return err
+	})
+	return result, err
+}
+
+// mergePatch and jsonPatch leave the attachment metadata alone, it's changed through the attachment endpoints
+func mergePatch(doc []byte, patch []byte) ([]byte, error) {
+	fields := map[string]json.RawMessage{}
+	if json.Unmarshal(patch, &fields) == nil {
+		if _, ok := fields[store.AttachmentsField]; ok {
+			return nil, store.ErrAttachmentsReadOnly
+		}
+	}
+	return model.MergePatch(doc, patch)
+}
+
+func jsonPatch(doc []byte, patch []byte) ([]byte, error) {
+	ops := []model.PatchOp{}
+	if json.Unmarshal(patch, &ops) == nil {
+		for _, op := range ops {
+			if touchesAttachments(op.Path) || touchesAttachments(op.From) {
+				return nil, store.ErrAttachmentsReadOnly
+			}
+		}
+	}
+	return model.JSONPatch(doc, patch)
+}
+
+func touchesAttachments(path string) bool {
+	p := "/" + store.AttachmentsField
+	return path == p || strings.HasPrefix(path, p+"/")
+}
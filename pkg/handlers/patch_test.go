@@ -0,0 +1,71 @@
+package handlers_test
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/fnurk/geom/pkg/handlers"
+	"github.com/labstack/echo/v4"
+)
+
+func TestPatch(t *testing.T) {
+	s := newTestServer(t)
+	s.ds.Put("note", "1", []byte(`{"title":"first","status":"open"}`))
+
+	status, body := s.request(t, http.MethodPatch, "/note/1", handlers.MIMEMergePatch, `{"status":"done","extra":true}`)
+	if status != http.StatusOK || body != `{"title":"first","status":"done"}` {
+		t.Errorf("expected the merged note without fields outside the type, got %d %s", status, body)
+	}
+	if doc, _ := s.ds.Get("note", "1"); strings.Contains(string(doc), "extra") {
+		t.Errorf("expected the stored note to match its type, got %s", doc)
+	}
+
+	status, body = s.request(t, http.MethodPatch, "/note/1", handlers.MIMEJSONPatch, `[{"op":"test","path":"/status","value":"done"},{"op":"replace","path":"/title","value":"patched"}]`)
+	if status != http.StatusOK || !strings.Contains(body, `"title":"patched"`) {
+		t.Errorf("expected the json patched note, got %d %s", status, body)
+	}
+
+	status, _ = s.request(t, http.MethodPatch, "/note/1", handlers.MIMEJSONPatch, `[{"op":"test","path":"/status","value":"open"}]`)
+	if status != http.StatusConflict {
+		t.Errorf("expected 409 for a failed test, got %d", status)
+	}
+	status, _ = s.request(t, http.MethodPatch, "/note/1", handlers.MIMEMergePatch, `{"priority":"high"}`)
+	if status != http.StatusBadRequest {
+		t.Errorf("expected 400 for a note that doesn't decode, got %d", status)
+	}
+	status, _ = s.request(t, http.MethodPatch, "/note/2", handlers.MIMEMergePatch, `{}`)
+	if status != http.StatusNotFound {
+		t.Errorf("expected 404 for a missing note, got %d", status)
+	}
+	status, _ = s.request(t, http.MethodPatch, "/note/1", echo.MIMETextPlain, `{}`)
+	if status != http.StatusUnsupportedMediaType {
+		t.Errorf("expected 415 for text, got %d", status)
+	}
+}
+
+func TestPatch_Attachments(t *testing.T) {
+	s := newTestServer(t)
+	s.ds.Put("note", "1", []byte(`{"title":"with files"}`))
+	if _, err := s.ds.PutAttachment("note", "1", "a.txt", "text/plain", strings.NewReader("content")); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, p := range []struct{ contentType, patch string }{
+		{handlers.MIMEMergePatch, `{"_attachments":null}`},
+		{handlers.MIMEJSONPatch, `[{"op":"replace","path":"/_attachments/0/size","value":0}]`},
+		{handlers.MIMEJSONPatch, `[{"op":"move","from":"/_attachments","path":"/title"}]`},
+	} {
+		if status, _ := s.request(t, http.MethodPatch, "/note/1", p.contentType, p.patch); status != http.StatusBadRequest {
+			t.Errorf("expected 400 for %s, got %d", p.patch, status)
+		}
+	}
+
+	status, _ := s.request(t, http.MethodPatch, "/note/1", handlers.MIMEMergePatch, `{"title":"renamed"}`)
+	if status != http.StatusOK {
+		t.Fatalf("expected the patch to pass, got %d", status)
+	}
+	if atts, err := s.ds.Attachments("note", "1"); err != nil || len(atts) != 1 {
+		t.Errorf("expected the attachment to be kept, got %v %v", atts, err)
+	}
+}
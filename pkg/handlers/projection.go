@@ -0,0 +1,46 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/fnurk/geom/pkg/model"
+	"github.com/labstack/echo/v4"
+)
+
+// projection returns the paths asked for with ?fields=title,meta.owner and ?projection=<name>, see
+// model.RegisterProjection. It's nil if the whole document is wanted.
+func projection(c echo.Context, t string) ([]string, error) {
+	return projectionPaths(t, c.QueryParam("projection"), c.QueryParam("fields"))
+}
+
+// projectionPaths are the paths of the named projection followed by the comma separated fields
+func projectionPaths(t string, name string, fields string) ([]string, error) {
+	var paths []string
+	if name != "" {
+		p, ok := model.Projection(t, name)
+		if !ok {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("%s has no projection %q", t, name))
+		}
+		paths = append(paths, p...)
+	}
+	for _, path := range strings.Split(fields, ",") {
+		if path = strings.TrimSpace(path); path != "" {
+			paths = append(paths, path)
+		}
+	}
+	return paths, nil
+}
+
+// project shapes doc to paths, documents that aren't objects are left as they are
+func project(doc []byte, paths []string) []byte {
+	if paths == nil {
+		return doc
+	}
+	projected, err := model.Project(doc, paths)
+	if err != nil {
+		return doc
+	}
+	return projected
+}
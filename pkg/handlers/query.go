@@ -0,0 +1,81 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/fnurk/geom/pkg/auth"
+	"github.com/fnurk/geom/pkg/store"
+	"github.com/labstack/echo/v4"
+)
+
+// DefaultQueryLimit is used when a query doesn't have a limit
+const DefaultQueryLimit = 100
+
+type queryResponse struct {
+	Docs      []store.QueryDoc `json:"docs"`
+	Truncated bool             `json:"truncated"`
+	Explain   *store.QueryPlan `json:"explain,omitempty"`
+}
+
+// Documents are only returned if GetCheck allows reading them
+func AddQueryEndpointForType(e *echo.Echo, ds *store.Datastore, t string, checkers CRUDLAccessCheckers) {
+	e.GET("/"+t, Query(ds, t, checkers.GetCheck))
+}
+
+func AddQueryEndpointForTypeInGroup(e *echo.Group, ds *store.Datastore, t string, checkers CRUDLAccessCheckers) {
+	e.GET("/"+t, Query(ds, t, checkers.GetCheck))
+}
+
+// Query takes a filter, a sort order and a limit, eg. ?filter=status=="open" and priority>2&sort=-priority&limit=10
+// (url encoded), see store.Filter. ?explain=true adds how the query was run to the response, ?fields= and
+// ?projection= shape the documents like they do for Get.
+func Query(ds *store.Datastore, t string, accessChecker auth.AccessFunc) func(echo.Context) error {
+	return func(c echo.Context) error {
+		ctx := requestContext(c)
+
+		paths, err := projection(c, t)
+		if err != nil {
+			return err
+		}
+
+		q := store.Query{
+			Sort:  store.ParseSort(c.QueryParam("sort")),
+			Limit: DefaultQueryLimit,
+			Allow: func(id string, doc []byte) bool {
+				return accessChecker(c, doc)
+			},
+		}
+
+		if filter := c.QueryParam("filter"); filter != "" {
+			f, err := store.ParseFilter(filter)
+			if err != nil {
+				return c.String(statusFor(err), err.Error())
+			}
+			q.Filter = f
+		}
+
+		if limit := c.QueryParam("limit"); limit != "" {
+			n, err := strconv.Atoi(limit)
+			//0 would be no limit at all
+			if err != nil || n <= 0 {
+				return echo.NewHTTPError(http.StatusBadRequest, "limit has to be a positive number")
+			}
+			q.Limit = n
+		}
+
+		res, err := ds.Query(ctx, t, q)
+		if err != nil {
+			return c.String(statusFor(err), err.Error())
+		}
+
+		for i := range res.Docs {
+			res.Docs[i].Doc = project(res.Docs[i].Doc, paths)
+		}
+		resp := queryResponse{Docs: res.Docs, Truncated: res.Truncated}
+		if explain, _ := strconv.ParseBool(c.QueryParam("explain")); explain {
+			resp.Explain = &res.Plan
+		}
+		return c.JSON(http.StatusOK, resp)
+	}
+}
@@ -0,0 +1,82 @@
+package handlers_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/fnurk/geom/pkg/handlers"
+	"github.com/fnurk/geom/pkg/store"
+	"github.com/labstack/echo/v4"
+)
+
+type queryResponse struct {
+	Docs      []store.QueryDoc `json:"docs"`
+	Truncated bool             `json:"truncated"`
+	Explain   *store.QueryPlan `json:"explain"`
+}
+
+func (s *testServer) query(t *testing.T, params url.Values) queryResponse {
+	t.Helper()
+	status, body := s.request(t, http.MethodGet, "/note?"+params.Encode(), "", "")
+	if status != http.StatusOK {
+		t.Fatalf("expected 200 for %s, got %d %s", params.Encode(), status, body)
+	}
+	res := queryResponse{}
+	if err := json.Unmarshal([]byte(body), &res); err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+func ids(docs []store.QueryDoc) string {
+	ids := []string{}
+	for _, d := range docs {
+		ids = append(ids, d.Id)
+	}
+	return strings.Join(ids, ",")
+}
+
+func TestQuery(t *testing.T) {
+	checkers := allow
+	checkers.GetCheck = func(c echo.Context, doc []byte) bool {
+		return !strings.Contains(string(doc), "secret")
+	}
+	s := newTestServer(t)
+	handlers.AddQueryEndpointForType(s.e, s.ds, "note", checkers)
+	s.ds.Put("note", "1", []byte(`{"title":"first","status":"open","priority":2}`))
+	s.ds.Put("note", "2", []byte(`{"title":"second","status":"done","priority":3}`))
+	s.ds.Put("note", "3", []byte(`{"title":"third","status":"open","priority":5}`))
+	s.ds.Put("note", "4", []byte(`{"title":"secret","status":"open","priority":4}`))
+
+	res := s.query(t, url.Values{"filter": {`status == "open"`}, "sort": {"-priority"}})
+	if ids(res.Docs) != "3,1" || res.Truncated {
+		t.Errorf("expected the open notes allowed, by priority, got %s", ids(res.Docs))
+	}
+
+	res = s.query(t, url.Values{"filter": {`status == "open" and priority > 1`}, "sort": {"priority"}, "limit": {"1"}})
+	if ids(res.Docs) != "1" {
+		t.Errorf("expected the first note, got %s", ids(res.Docs))
+	}
+
+	res = s.query(t, url.Values{"sort": {"title"}, "fields": {"title"}, "explain": {"true"}})
+	if ids(res.Docs) != "1,2,3" || string(res.Docs[0].Doc) != `{"title":"first"}` {
+		t.Errorf("expected the titles of every allowed note, got %s %s", ids(res.Docs), res.Docs[0].Doc)
+	}
+	if res.Explain == nil || res.Explain.Scanned != 4 || res.Explain.Matched != 3 {
+		t.Errorf("expected a scan of 4 notes matching 3, got %+v", res.Explain)
+	}
+
+	for _, params := range []url.Values{
+		{"filter": {`status ==`}},
+		{"limit": {"-1"}},
+		{"limit": {"0"}},
+		{"limit": {"many"}},
+	} {
+		if status, body := s.request(t, http.MethodGet, "/note?"+params.Encode(), "", ""); status != http.StatusBadRequest {
+			t.Errorf("expected 400 for %s, got %d %s", params.Encode(), status, body)
+		}
+	}
+}
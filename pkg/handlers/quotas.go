@@ -0,0 +1,20 @@
+package handlers
+
+import (
+	"github.com/fnurk/geom/pkg/auth"
+	"github.com/fnurk/geom/pkg/store"
+	"github.com/labstack/echo/v4"
+)
+
+// AddUsageEndpoint lets everyone see their own usage against the quotas, see store.Datastore.SetQuota
+func AddUsageEndpoint(e *echo.Echo, ds *store.Datastore) {
+	e.GET("/_usage", GetUsage(ds, signedIn))
+}
+
+func AddUsageEndpointInGroup(e *echo.Group, ds *store.Datastore) {
+	e.GET("/_usage", GetUsage(ds, signedIn))
+}
+
+var signedIn = auth.AccessFunc(func(c echo.Context, doc []byte) bool {
+	return auth.Identity(c) != ""
+})
@@ -0,0 +1,392 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/fnurk/geom/pkg/auth"
+	"github.com/fnurk/geom/pkg/model"
+	"github.com/fnurk/geom/pkg/pubsub"
+	"github.com/fnurk/geom/pkg/store"
+	"github.com/labstack/echo/v4"
+	"github.com/tidwall/match"
+	"golang.org/x/net/websocket"
+)
+
+// Realtime multiplexes live documents, live queries and pubsub topics over one websocket per client.
+// Clients send requests, every one answered with an "ack" or an "error" carrying the request's id:
+//
+//	{"id":"1","op":"subscribe","type":"note","doc":"12"}
+//	{"id":"2","op":"subscribe","type":"note","filter":"tags contains \"work\"","projection":"list"}
+//	{"id":"3","op":"subscribe","topic":"chat.lobby"}
+//	{"id":"4","op":"unsubscribe","sub":"1"}
+//	{"id":"5","op":"ping"}
+//
+// The ack of a subscribe has the subscription's id, its events come as {"type":"event","sub":"1","data":...}
+// where data is the document, a LiveEvent or a RealtimeMessage. Documents and queries are only sent while
+// their type's LiveCheck allows reading them, topics need to have been added with AddTopic.
+//
+// Documents can be written too, with ids the client makes up for the writes:
+//
+//	{"id":"w1","op":"put","type":"note","doc":"12","data":{"title":"new"}}
+//	{"id":"w2","op":"patch","type":"note","doc":"12","data":{"title":"newer"}}
+//	{"id":"w3","op":"delete","type":"note","doc":"12"}
+//
+// They're checked like Put, Patch and Delete do, with PutCheck and DeleteCheck. A patch is a JSON Patch
+// if data is an array, a merge patch otherwise. The ack of a put or a patch has the document as written.
+// The writes are not echoed to the connection's own subscriptions, the ack says it all.
+type Realtime struct {
+	ds      *store.Datastore
+	changes pubsub.Pubsub
+	types   map[string]CRUDLAccessCheckers
+	topics  map[string]auth.AccessFunc
+
+	// The most subscriptions a connection can have at once
+	MaxSubscriptions int
+}
+
+// RealtimeMessage is what a topic subscription gets for every message published to it
+type RealtimeMessage struct {
+	Topic string `json:"topic"`
+	Body  string `json:"body"`
+}
+
+type realtimeRequest struct {
+	Id   string `json:"id"`
+	Op   string `json:"op"`
+	Type string `json:"type,omitempty"`
+	// A document of Type, if not set it's a query of Type
+	Doc        string `json:"doc,omitempty"`
+	Filter     string `json:"filter,omitempty"`
+	Sort       string `json:"sort,omitempty"`
+	Fields     string `json:"fields,omitempty"`
+	Projection string `json:"projection,omitempty"`
+	Topic      string `json:"topic,omitempty"`
+	Sub        string `json:"sub,omitempty"`
+	// The document of a put, the patch of a patch
+	Data json.RawMessage `json:"data,omitempty"`
+}
+
+type realtimeResponse struct {
+	Type   string          `json:"type"`
+	Id     string          `json:"id,omitempty"`
+	Sub    string          `json:"sub,omitempty"`
+	Status int             `json:"status,omitempty"`
+	Error  string          `json:"error,omitempty"`
+	Data   json.RawMessage `json:"data,omitempty"`
+}
+
+func NewRealtime(ds *store.Datastore, changes pubsub.Pubsub) *Realtime {
+	return &Realtime{
+		ds:               ds,
+		changes:          changes,
+		types:            map[string]CRUDLAccessCheckers{},
+		topics:           map[string]auth.AccessFunc{},
+		MaxSubscriptions: 256,
+	}
+}
+
+// AddType allows subscribing to documents and queries of type t, checked with checkers.LiveCheck, and
+// writing them with checkers.PutCheck and checkers.DeleteCheck. Without a check it isn't allowed.
+func (rt *Realtime) AddType(t string, checkers CRUDLAccessCheckers) {
+	rt.types[t] = checkers
+}
+
+// AddTopic allows subscribing to the topics matching pattern, accessChecker gets the topic as the document.
+// Topics are per tenant, see RealtimeTopic.
+func (rt *Realtime) AddTopic(pattern string, accessChecker auth.AccessFunc) {
+	rt.topics[pattern] = accessChecker
+}
+
+// RealtimeTopic is the pubsub topic realtime clients subscribing to topic get messages from
+func RealtimeTopic(c echo.Context, topic string) string {
+	if tenant := Tenant(c); tenant != "" {
+		return fmt.Sprintf("%s/_topic.%s", tenant, topic)
+	}
+	return "_topic." + topic
+}
+
+func AddRealtimeEndpoint(e *echo.Echo, rt *Realtime) {
+	e.GET("/_realtime", rt.Handle)
+}
+
+func AddRealtimeEndpointInGroup(e *echo.Group, rt *Realtime) {
+	e.GET("/_realtime", rt.Handle)
+}
+
+// realtimeConns numbers connections, their writes are tagged with it
+var realtimeConns uint64
+
+const originKey = "geom.origin"
+
+// echoed tells if m is a change the realtime connection of c made itself
+func echoed(c echo.Context, m *pubsub.Message) bool {
+	origin, _ := c.Get(originKey).(string)
+	return origin != "" && m.Origin == origin
+}
+
+func (rt *Realtime) Handle(c echo.Context) error {
+	c.Set(originKey, "realtime-"+strconv.FormatUint(atomic.AddUint64(&realtimeConns, 1), 10))
+	websocket.Handler(func(ws *websocket.Conn) {
+		defer ws.Close()
+		conn := &realtimeConn{rt: rt, c: c, ws: ws, subs: map[string]pubsub.Subscriber{}}
+		defer conn.close()
+
+		for {
+			msg := ""
+			if err := websocket.Message.Receive(ws, &msg); err != nil {
+				return
+			}
+			req := realtimeRequest{}
+			if err := json.Unmarshal([]byte(msg), &req); err != nil {
+				conn.fail(req.Id, http.StatusBadRequest, "invalid request: "+err.Error())
+				continue
+			}
+			conn.handle(req)
+		}
+	}).ServeHTTP(c.Response(), c.Request())
+	return nil
+}
+
+type realtimeConn struct {
+	rt *Realtime
+	c  echo.Context
+	ws *websocket.Conn
+
+	writeLock sync.Mutex
+	subsLock  sync.Mutex
+	subs      map[string]pubsub.Subscriber
+	nextSub   int
+}
+
+func (conn *realtimeConn) handle(req realtimeRequest) {
+	switch req.Op {
+	case "subscribe":
+		conn.subscribe(req)
+	case "unsubscribe":
+		conn.subsLock.Lock()
+		sub, ok := conn.subs[req.Sub]
+		delete(conn.subs, req.Sub)
+		conn.subsLock.Unlock()
+		if !ok {
+			conn.fail(req.Id, http.StatusNotFound, "no subscription "+req.Sub)
+			return
+		}
+		sub.Unsubscribe()
+		conn.send(realtimeResponse{Type: "ack", Id: req.Id, Sub: req.Sub})
+	case "put", "patch", "delete":
+		doc, err := conn.write(req)
+		if err != nil {
+			conn.failWith(req.Id, err)
+			return
+		}
+		conn.send(realtimeResponse{Type: "ack", Id: req.Id, Data: doc})
+	case "ping":
+		conn.send(realtimeResponse{Type: "pong", Id: req.Id})
+	default:
+		conn.fail(req.Id, http.StatusBadRequest, "unknown op "+strconv.Quote(req.Op))
+	}
+}
+
+func (conn *realtimeConn) subscribe(req realtimeRequest) {
+	conn.subsLock.Lock()
+	if len(conn.subs) >= conn.rt.MaxSubscriptions {
+		conn.subsLock.Unlock()
+		conn.fail(req.Id, http.StatusTooManyRequests, "too many subscriptions")
+		return
+	}
+	conn.nextSub++
+	subId := strconv.Itoa(conn.nextSub)
+	conn.subsLock.Unlock()
+
+	send := func(id uint64, data []byte) error {
+		return conn.send(realtimeResponse{Type: "event", Sub: subId, Data: data})
+	}
+	//the ack goes out before the first event, follow sends it while catching up
+	ack := func() {
+		conn.send(realtimeResponse{Type: "ack", Id: req.Id, Sub: subId})
+	}
+
+	var sub pubsub.Subscriber
+	var err error
+	if req.Topic != "" {
+		sub, err = conn.subscribeTopic(req.Topic, ack, send)
+	} else {
+		sub, err = conn.subscribeType(req, ack, send)
+	}
+	if err != nil {
+		conn.failWith(req.Id, err)
+		return
+	}
+
+	conn.subsLock.Lock()
+	conn.subs[subId] = sub
+	conn.subsLock.Unlock()
+}
+
+// checker is the check of type t picked by pick, nil types and checks are bad requests and forbidden
+func (conn *realtimeConn) checker(t string, pick func(CRUDLAccessCheckers) auth.AccessFunc) (auth.AccessFunc, error) {
+	checkers, ok := conn.rt.types[t]
+	if !ok {
+		return nil, fmt.Errorf("%w: no realtime type %q", errBadRequest, t)
+	}
+	if check := pick(checkers); check != nil {
+		return check, nil
+	}
+	return nil, errForbidden
+}
+
+func (conn *realtimeConn) subscribeType(req realtimeRequest, ack func(), send liveSend) (pubsub.Subscriber, error) {
+	accessChecker, err := conn.checker(req.Type, func(checkers CRUDLAccessCheckers) auth.AccessFunc {
+		return checkers.LiveCheck
+	})
+	if err != nil {
+		return nil, err
+	}
+	paths, err := projectionPaths(req.Type, req.Projection, req.Fields)
+	if err != nil {
+		return nil, err
+	}
+
+	if req.Doc == "" {
+		lq, err := newLiveQuery(conn.c, conn.rt.ds, req.Type, accessChecker, req.Filter, req.Sort, paths)
+		if err != nil {
+			return nil, err
+		}
+		return lq.start(conn.rt.changes, func(id uint64, data []byte) error {
+			ack()
+			ack = func() {}
+			return send(id, data)
+		}), nil
+	}
+
+	doc, err := conn.rt.ds.GetContext(requestContext(conn.c), req.Type, req.Doc)
+	if err != nil {
+		return nil, err
+	}
+	if doc == nil {
+		return nil, store.ErrDocumentNotFound
+	}
+	if !accessChecker(conn.c, doc) {
+		return nil, errForbidden
+	}
+	ack()
+	return followDocument(conn.c, conn.rt.ds, req.Type, req.Doc, conn.rt.changes, accessChecker, paths, send, true), nil
+}
+
+func (conn *realtimeConn) subscribeTopic(topic string, ack func(), send liveSend) (pubsub.Subscriber, error) {
+	//a pattern would get topics the checker never saw
+	if strings.ContainsAny(topic, "*?") {
+		return nil, fmt.Errorf("%w: topic %q has wildcards", errBadRequest, topic)
+	}
+	allowed := false
+	for pattern, accessChecker := range conn.rt.topics {
+		if match.Match(topic, pattern) && accessChecker(conn.c, []byte(topic)) {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		return nil, errForbidden
+	}
+	ack()
+	return conn.rt.changes.Subscribe(RealtimeTopic(conn.c, topic), func(m *pubsub.Message, s pubsub.Subscriber) {
+		data, err := json.Marshal(RealtimeMessage{Topic: topic, Body: m.Body})
+		if err == nil {
+			send(m.Id, data)
+		}
+	}, func() {}), nil
+}
+
+// write makes the put, patch or delete of req, returning the document as written
+func (conn *realtimeConn) write(req realtimeRequest) ([]byte, error) {
+	if req.Doc == "" {
+		return nil, fmt.Errorf("%w: %s needs a doc", errBadRequest, req.Op)
+	}
+	pick := func(checkers CRUDLAccessCheckers) auth.AccessFunc { return checkers.PutCheck }
+	if req.Op == "delete" {
+		pick = func(checkers CRUDLAccessCheckers) auth.AccessFunc { return checkers.DeleteCheck }
+	}
+	accessChecker, err := conn.checker(req.Type, pick)
+	if err != nil {
+		return nil, err
+	}
+
+	if req.Op == "patch" {
+		apply := mergePatch
+		if strings.HasPrefix(strings.TrimSpace(string(req.Data)), "[") {
+			apply = jsonPatch
+		}
+		return patchDocument(conn.c, conn.rt.ds, req.Type, req.Doc, apply, req.Data, accessChecker)
+	}
+
+	var result []byte
+	err = conn.rt.ds.Update(requestContext(conn.c), func(tx store.Tx) error {
+		current, err := tx.Get(req.Type, req.Doc)
+		if err != nil {
+			return err
+		}
+		if current == nil {
+			return store.ErrDocumentNotFound
+		}
+		if !accessChecker(conn.c, current) {
+			return errForbidden
+		}
+		if req.Op == "delete" {
+			return tx.Delete(req.Type, req.Doc)
+		}
+
+		//decoded like Put binds it
+		obj := model.Types[req.Type]
+		if err := json.Unmarshal(req.Data, &obj); err != nil {
+			return fmt.Errorf("%w: %v", errBadRequest, err)
+		}
+		doc, err := json.Marshal(obj)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Put(req.Type, req.Doc, doc); err != nil {
+			return err
+		}
+		result, err = tx.Get(req.Type, req.Doc)
+		return err
+	})
+	return result, err
+}
+
+func (conn *realtimeConn) fail(id string, status int, msg string) {
+	conn.send(realtimeResponse{Type: "error", Id: id, Status: status, Error: msg})
+}
+
+func (conn *realtimeConn) failWith(id string, err error) {
+	if he, ok := err.(*echo.HTTPError); ok {
+		conn.fail(id, he.Code, fmt.Sprint(he.Message))
+		return
+	}
+	conn.fail(id, statusFor(err), err.Error())
+}
+
+// send is called from the subscriptions as well as the connection, one message at a time
+func (conn *realtimeConn) send(res realtimeResponse) error {
+	data, err := json.Marshal(res)
+	if err != nil {
+		return err
+	}
+	conn.writeLock.Lock()
+	defer conn.writeLock.Unlock()
+	return websocket.Message.Send(conn.ws, string(data))
+}
+
+func (conn *realtimeConn) close() {
+	conn.subsLock.Lock()
+	defer conn.subsLock.Unlock()
+	for _, sub := range conn.subs {
+		sub.Unsubscribe()
+	}
+	conn.subs = map[string]pubsub.Subscriber{}
+}
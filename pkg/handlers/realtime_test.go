@@ -0,0 +1,301 @@
+package handlers_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fnurk/geom/pkg/handlers"
+	"github.com/fnurk/geom/pkg/pubsub"
+	"github.com/labstack/echo/v4"
+	"golang.org/x/net/websocket"
+)
+
+type realtimeResponse struct {
+	Type   string          `json:"type"`
+	Id     string          `json:"id"`
+	Sub    string          `json:"sub"`
+	Status int             `json:"status"`
+	Error  string          `json:"error"`
+	Data   json.RawMessage `json:"data"`
+}
+
+type realtimeClient struct {
+	ws        *websocket.Conn
+	responses chan realtimeResponse
+}
+
+func newRealtimeServer(t *testing.T, configure func(rt *handlers.Realtime)) *testServer {
+	s := newTestServer(t)
+	rt := handlers.NewRealtime(s.ds, s.changes)
+	rt.AddType("note", allow)
+	if configure != nil {
+		configure(rt)
+	}
+	handlers.AddRealtimeEndpoint(s.e, rt)
+	return s
+}
+
+// realtime connects to /_realtime until the test ends
+func (s *testServer) realtime(t *testing.T) *realtimeClient {
+	t.Helper()
+	ws, err := websocket.Dial("ws"+strings.TrimPrefix(s.URL, "http")+"/_realtime", "", s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc := &realtimeClient{ws: ws, responses: make(chan realtimeResponse, 100)}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			res := realtimeResponse{}
+			if err := websocket.JSON.Receive(ws, &res); err != nil {
+				return
+			}
+			rc.responses <- res
+		}
+	}()
+	t.Cleanup(func() {
+		ws.Close()
+		<-done
+	})
+	return rc
+}
+
+func (rc *realtimeClient) send(t *testing.T, req string) {
+	t.Helper()
+	if err := websocket.Message.Send(rc.ws, req); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (rc *realtimeClient) next(t *testing.T) realtimeResponse {
+	t.Helper()
+	select {
+	case res := <-rc.responses:
+		return res
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for a response")
+		return realtimeResponse{}
+	}
+}
+
+func (rc *realtimeClient) none(t *testing.T) {
+	t.Helper()
+	select {
+	case res := <-rc.responses:
+		t.Errorf("expected nothing, got %+v", res)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// ack sends req and returns the subscription its ack has
+func (rc *realtimeClient) ack(t *testing.T, req string) realtimeResponse {
+	t.Helper()
+	rc.send(t, req)
+	res := rc.next(t)
+	if res.Type != "ack" {
+		t.Fatalf("expected an ack for %s, got %+v", req, res)
+	}
+	return res
+}
+
+func (rc *realtimeClient) event(t *testing.T, sub string) string {
+	t.Helper()
+	res := rc.next(t)
+	if res.Type != "event" || res.Sub != sub {
+		t.Fatalf("expected an event of %s, got %+v", sub, res)
+	}
+	return string(res.Data)
+}
+
+func TestRealtime_Documents(t *testing.T) {
+	s := newRealtimeServer(t, nil)
+	s.ds.Put("note", "1", []byte(`{"title":"first"}`))
+	rc := s.realtime(t)
+
+	sub := rc.ack(t, `{"id":"a","op":"subscribe","type":"note","doc":"1"}`).Sub
+	if data := rc.event(t, sub); data != `{"title":"first"}` {
+		t.Errorf("expected the note as it is, got %s", data)
+	}
+	s.ds.Put("note", "1", []byte(`{"title":"second"}`))
+	if data := rc.event(t, sub); data != `{"title":"second"}` {
+		t.Errorf("expected the written note, got %s", data)
+	}
+
+	fields := rc.ack(t, `{"id":"b","op":"subscribe","type":"note","doc":"1","fields":"status"}`).Sub
+	if data := rc.event(t, fields); data != `{}` {
+		t.Errorf("expected only the status, got %s", data)
+	}
+
+	if res := rc.ack(t, `{"id":"c","op":"unsubscribe","sub":"`+sub+`"}`); res.Id != "c" || res.Sub != sub {
+		t.Errorf("expected the unsubscribe acked, got %+v", res)
+	}
+	rc.ack(t, `{"id":"d","op":"unsubscribe","sub":"`+fields+`"}`)
+	s.ds.Put("note", "1", []byte(`{"title":"third"}`))
+	rc.none(t)
+}
+
+func TestRealtime_Queries(t *testing.T) {
+	s := newRealtimeServer(t, nil)
+	s.ds.Put("note", "1", []byte(`{"title":"first","status":"open"}`))
+	rc := s.realtime(t)
+
+	sub := rc.ack(t, `{"id":"a","op":"subscribe","type":"note","filter":"status == \"open\""}`).Sub
+	le := handlers.LiveEvent{}
+	if err := json.Unmarshal([]byte(rc.event(t, sub)), &le); err != nil || le.Type != "initial" || len(le.Docs) != 1 {
+		t.Fatalf("expected initial with note 1, got %+v", le)
+	}
+	s.ds.Put("note", "2", []byte(`{"title":"second","status":"open"}`))
+	if err := json.Unmarshal([]byte(rc.event(t, sub)), &le); err != nil || le.Type != "added" || le.Id != "2" {
+		t.Errorf("expected note 2 added, got %+v", le)
+	}
+}
+
+func TestRealtime_Topics(t *testing.T) {
+	s := newRealtimeServer(t, func(rt *handlers.Realtime) {
+		rt.AddTopic("chat.*", func(c echo.Context, topic []byte) bool {
+			return string(topic) != "chat.private"
+		})
+	})
+	rc := s.realtime(t)
+
+	sub := rc.ack(t, `{"id":"a","op":"subscribe","topic":"chat.lobby"}`).Sub
+	s.changes.Publish(&pubsub.Message{Topic: "_topic.chat.lobby", Body: "hello"})
+	if data := rc.event(t, sub); data != `{"topic":"chat.lobby","body":"hello"}` {
+		t.Errorf("expected the message, got %s", data)
+	}
+
+	for req, status := range map[string]int{
+		`{"id":"b","op":"subscribe","topic":"chat.*"}`:       http.StatusBadRequest,
+		`{"id":"c","op":"subscribe","topic":"chat.private"}`: http.StatusForbidden,
+		`{"id":"d","op":"subscribe","topic":"news"}`:         http.StatusForbidden,
+	} {
+		rc.send(t, req)
+		if res := rc.next(t); res.Type != "error" || res.Status != status {
+			t.Errorf("expected %d for %s, got %+v", status, req, res)
+		}
+	}
+}
+
+func TestRealtime_Errors(t *testing.T) {
+	s := newRealtimeServer(t, func(rt *handlers.Realtime) {
+		rt.MaxSubscriptions = 1
+	})
+	s.ds.Put("note", "1", []byte(`{"title":"first"}`))
+	rc := s.realtime(t)
+
+	if res := rc.ack(t, `{"id":"a","op":"subscribe","type":"note","doc":"1"}`); res.Id != "a" {
+		t.Errorf("expected the ack to have the request's id, got %+v", res)
+	}
+	rc.next(t)
+
+	for req, status := range map[string]int{
+		`{"id":"b","op":"subscribe","type":"note","doc":"1"}`:     http.StatusTooManyRequests,
+		`{"id":"c","op":"unsubscribe","sub":"9"}`:                 http.StatusNotFound,
+		`{"id":"d","op":"shout"}`:                                 http.StatusBadRequest,
+		`{"id":"e","op":"put","type":"note","data":{}}`:           http.StatusBadRequest,
+		`{"id":"f","op":"put","type":"user","doc":"1"}`:           http.StatusBadRequest,
+		`{"id":"g","op":"put","type":"note","doc":"9","data":{}}`: http.StatusNotFound,
+		`not json`: http.StatusBadRequest,
+	} {
+		rc.send(t, req)
+		if res := rc.next(t); res.Type != "error" || res.Status != status {
+			t.Errorf("expected %d for %s, got %+v", status, req, res)
+		}
+	}
+
+	rc.send(t, `{"id":"h","op":"ping"}`)
+	if res := rc.next(t); res.Type != "pong" || res.Id != "h" {
+		t.Errorf("expected a pong, got %+v", res)
+	}
+}
+
+func TestRealtime_Writes(t *testing.T) {
+	s := newRealtimeServer(t, func(rt *handlers.Realtime) {
+		readOnly := allow
+		readOnly.PutCheck, readOnly.DeleteCheck = nil, nil
+		rt.AddType("comment", readOnly)
+	})
+	s.ds.Put("note", "1", []byte(`{"title":"first"}`))
+	writer, reader := s.realtime(t), s.realtime(t)
+
+	mine := writer.ack(t, `{"id":"a","op":"subscribe","type":"note","doc":"1"}`).Sub
+	writer.event(t, mine)
+	theirs := reader.ack(t, `{"id":"a","op":"subscribe","type":"note","doc":"1"}`).Sub
+	reader.event(t, theirs)
+
+	if res := writer.ack(t, `{"id":"w1","op":"put","type":"note","doc":"1","data":{"title":"put"}}`); string(res.Data) != `{"title":"put"}` {
+		t.Errorf("expected the put note in the ack, got %s", res.Data)
+	}
+	if data := reader.event(t, theirs); data != `{"title":"put"}` {
+		t.Errorf("expected other connections to get the put, got %s", data)
+	}
+
+	if res := writer.ack(t, `{"id":"w2","op":"patch","type":"note","doc":"1","data":{"status":"open"}}`); string(res.Data) != `{"title":"put","status":"open"}` {
+		t.Errorf("expected the merge patched note in the ack, got %s", res.Data)
+	}
+	reader.event(t, theirs)
+	if res := writer.ack(t, `{"id":"w3","op":"patch","type":"note","doc":"1","data":[{"op":"remove","path":"/status"}]}`); string(res.Data) != `{"title":"put"}` {
+		t.Errorf("expected the json patched note in the ack, got %s", res.Data)
+	}
+	reader.event(t, theirs)
+
+	writer.ack(t, `{"id":"w4","op":"delete","type":"note","doc":"1"}`)
+	if doc, _ := s.ds.Get("note", "1"); doc != nil {
+		t.Errorf("expected the note deleted, got %s", doc)
+	}
+	//the writer's own subscription doesn't hear about its writes
+	writer.none(t)
+
+	writer.send(t, `{"id":"w5","op":"put","type":"comment","doc":"1","data":{}}`)
+	if res := writer.next(t); res.Type != "error" || res.Status != http.StatusForbidden {
+		t.Errorf("expected 403 without a PutCheck, got %+v", res)
+	}
+}
+
+func TestRealtime_PatchCheckedAfterwards(t *testing.T) {
+	s := newRealtimeServer(t, func(rt *handlers.Realtime) {
+		checkers := allow
+		checkers.PutCheck = func(c echo.Context, doc []byte) bool {
+			return !strings.Contains(string(doc), "locked")
+		}
+		rt.AddType("note", checkers)
+	})
+	s.ds.Put("note", "1", []byte(`{"title":"first"}`))
+	rc := s.realtime(t)
+
+	rc.send(t, `{"id":"w1","op":"patch","type":"note","doc":"1","data":{"status":"locked"}}`)
+	if res := rc.next(t); res.Type != "error" || res.Status != http.StatusForbidden {
+		t.Errorf("expected 403 for a patch PutCheck refuses the result of, got %+v", res)
+	}
+	if doc, _ := s.ds.Get("note", "1"); string(doc) != `{"title":"first"}` {
+		t.Errorf("expected the note unchanged, got %s", doc)
+	}
+}
+
+func TestRealtime_WritesToQueries(t *testing.T) {
+	s := newRealtimeServer(t, nil)
+	writer, reader := s.realtime(t), s.realtime(t)
+	subscribe := `{"id":"a","op":"subscribe","type":"note","filter":"status == \"open\""}`
+	mine := writer.ack(t, subscribe).Sub
+	writer.event(t, mine)
+	theirs := reader.ack(t, subscribe).Sub
+	reader.event(t, theirs)
+
+	s.ds.Put("note", "1", []byte(`{"title":"first"}`))
+	writer.ack(t, `{"id":"w1","op":"put","type":"note","doc":"1","data":{"title":"first","status":"open"}}`)
+	le := handlers.LiveEvent{}
+	if err := json.Unmarshal([]byte(reader.event(t, theirs)), &le); err != nil || le.Type != "added" || le.Id != "1" {
+		t.Errorf("expected other connections to get note 1 added, got %+v", le)
+	}
+	writer.none(t)
+
+	//the writer's query still follows the note it wasn't told about
+	s.ds.Put("note", "1", []byte(`{"title":"first","status":"done"}`))
+	if err := json.Unmarshal([]byte(writer.event(t, mine)), &le); err != nil || le.Type != "removed" || le.Id != "1" {
+		t.Errorf("expected note 1 removed from the writer's query, got %+v", le)
+	}
+}
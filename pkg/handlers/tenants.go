@@ -0,0 +1,89 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/fnurk/geom/pkg/auth"
+	"github.com/fnurk/geom/pkg/store"
+	"github.com/labstack/echo/v4"
+)
+
+// TenantResolver returns the tenant of a request, or "" if it can't tell
+type TenantResolver func(c echo.Context) string
+
+// TenantFromSubdomain resolves acme.example.com to acme when domain is example.com
+func TenantFromSubdomain(domain string) TenantResolver {
+	suffix := "." + strings.TrimPrefix(domain, ".")
+	return func(c echo.Context) string {
+		host := c.Request().Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if !strings.HasSuffix(host, suffix) {
+			return ""
+		}
+		return strings.TrimSuffix(host, suffix)
+	}
+}
+
+// TenantFromHeader takes the tenant the client asks for, a store.TenantDatabase only serves provisioned ones
+func TenantFromHeader(name string) TenantResolver {
+	return func(c echo.Context) string {
+		return c.Request().Header.Get(name)
+	}
+}
+
+// TenantFromIdentity looks the tenant up from the identity set by auth.SetIdentity, so it has to run after authentication
+func TenantFromIdentity(lookup func(identity string) string) TenantResolver {
+	return func(c echo.Context) string {
+		identity := auth.Identity(c)
+		if identity == "" {
+			return ""
+		}
+		return lookup(identity)
+	}
+}
+
+// TenantMiddleware scopes the request to the first tenant a resolver returns, requests without one are rejected.
+// Handlers pass the tenant on to the store, so a Datastore over a store.TenantDatabase only sees that tenant's data.
+func TenantMiddleware(resolvers ...TenantResolver) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			for _, resolve := range resolvers {
+				tenant := resolve(c)
+				if tenant == "" {
+					continue
+				}
+				if !store.ValidTenant(tenant) {
+					return c.String(http.StatusBadRequest, store.ErrInvalidTenant.Error())
+				}
+				SetTenant(c, tenant)
+				return next(c)
+			}
+			return c.String(http.StatusBadRequest, "unknown tenant")
+		}
+	}
+}
+
+const tenantKey = "geom.tenant"
+
+func SetTenant(c echo.Context, tenant string) {
+	c.Set(tenantKey, tenant)
+}
+
+func Tenant(c echo.Context) string {
+	tenant, _ := c.Get(tenantKey).(string)
+	return tenant
+}
+
+// LiveTopic is the pubsub topic live updates of a document are read from, publish changes to it from a put hook
+func LiveTopic(ctx context.Context, t string, id string) string {
+	if tenant := store.TenantFrom(ctx); tenant != "" {
+		return fmt.Sprintf("%s/%s.%s", tenant, t, id)
+	}
+	return fmt.Sprintf("%s.%s", t, id)
+}
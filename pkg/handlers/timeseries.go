@@ -0,0 +1,97 @@
+package handlers
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/fnurk/geom/pkg/auth"
+	"github.com/fnurk/geom/pkg/store"
+	"github.com/labstack/echo/v4"
+)
+
+// The doc passed to the checkers is the series name
+type TimeSeriesAccessCheckers struct {
+	IngestCheck auth.AccessFunc
+	QueryCheck  auth.AccessFunc
+}
+
+func AddTimeSeriesEndpoints(e *echo.Group, ts *store.TimeSeriesStore, checkers TimeSeriesAccessCheckers) {
+	e.POST("/:series", Ingest(ts, checkers.IngestCheck))
+	e.GET("/:series", QuerySeries(ts, checkers.QueryCheck))
+}
+
+func Ingest(ts *store.TimeSeriesStore, accessChecker auth.AccessFunc) func(echo.Context) error {
+	return func(c echo.Context) error {
+		series := c.Param("series")
+
+		if !accessChecker(c, []byte(series)) {
+			return c.NoContent(http.StatusForbidden)
+		}
+
+		points := []store.Point{}
+		if err := c.Bind(&points); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+
+		for i := range points {
+			if points[i].Time.IsZero() {
+				points[i].Time = time.Now()
+			}
+		}
+
+		err := ts.Append(series, points...)
+		if err == store.ErrInvalidTimestamp {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+		if err != nil {
+			return c.String(http.StatusInternalServerError, err.Error())
+		}
+
+		return c.NoContent(http.StatusOK)
+	}
+}
+
+// QuerySeries takes RFC3339 from/to (default: the last hour) and a resolution of raw, 1m, 1h or 1d
+func QuerySeries(ts *store.TimeSeriesStore, accessChecker auth.AccessFunc) func(echo.Context) error {
+	return func(c echo.Context) error {
+		series := c.Param("series")
+
+		if !accessChecker(c, []byte(series)) {
+			return c.NoContent(http.StatusForbidden)
+		}
+
+		to := time.Now()
+		from := to.Add(-time.Hour)
+		var err error
+
+		if v := c.QueryParam("from"); v != "" {
+			if from, err = time.Parse(time.RFC3339, v); err != nil {
+				return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+			}
+		}
+		if v := c.QueryParam("to"); v != "" {
+			if to, err = time.Parse(time.RFC3339, v); err != nil {
+				return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+			}
+		}
+
+		res, err := store.ParseResolution(c.QueryParam("resolution"))
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+
+		if res == store.Raw {
+			points, err := ts.Range(series, from, to)
+			if err != nil {
+				return c.String(http.StatusInternalServerError, err.Error())
+			}
+			return c.JSON(http.StatusOK, points)
+		}
+
+		aggs, err := ts.Rollups(series, res, from, to)
+		if err != nil {
+			return c.String(http.StatusInternalServerError, err.Error())
+		}
+		return c.JSON(http.StatusOK, aggs)
+	}
+}
@@ -0,0 +1,63 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/fnurk/geom/pkg/auth"
+	"github.com/fnurk/geom/pkg/store"
+	"github.com/labstack/echo/v4"
+)
+
+type viewResponse struct {
+	Rows []store.ViewRow `json:"rows"`
+}
+
+// Rows are only returned if accessChecker allows reading the document they were mapped from
+func AddViewEndpoint(e *echo.Echo, ds *store.Datastore, name string, accessChecker auth.AccessFunc) {
+	e.GET("/_views/"+name, QueryView(ds, name, accessChecker))
+}
+
+func AddViewEndpointInGroup(e *echo.Group, ds *store.Datastore, name string, accessChecker auth.AccessFunc) {
+	e.GET("/_views/"+name, QueryView(ds, name, accessChecker))
+}
+
+// QueryView takes the range as json arrays, eg. ?prefix=["work"]&limit=10 or ?start=["a",2023]&end=["a",2024]
+func QueryView(ds *store.Datastore, name string, accessChecker auth.AccessFunc) func(echo.Context) error {
+	return func(c echo.Context) error {
+		ctx := requestContext(c)
+
+		q := store.ViewQuery{
+			Filter: func(row store.ViewRow, doc []byte) bool {
+				return accessChecker(c, doc)
+			},
+		}
+
+		for param, key := range map[string]*[]interface{}{"start": &q.Start, "end": &q.End, "prefix": &q.Prefix} {
+			raw := c.QueryParam(param)
+			if raw == "" {
+				continue
+			}
+			if err := json.Unmarshal([]byte(raw), key); err != nil {
+				return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("%s: %s", param, err))
+			}
+		}
+
+		if limit := c.QueryParam("limit"); limit != "" {
+			n, err := strconv.Atoi(limit)
+			if err != nil || n < 0 {
+				return echo.NewHTTPError(http.StatusBadRequest, "limit has to be a positive number")
+			}
+			q.Limit = n
+		}
+
+		rows, err := ds.QueryView(ctx, name, q)
+		if err != nil {
+			return c.String(statusFor(err), err.Error())
+		}
+
+		return c.JSON(http.StatusOK, viewResponse{Rows: rows})
+	}
+}
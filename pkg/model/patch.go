@@ -0,0 +1,363 @@
+package model
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+var (
+	// The patch itself is malformed
+	ErrInvalidPatch = errors.New("invalid patch")
+	// The patch doesn't fit the document, a test failed or a path doesn't exist
+	ErrPatchConflict = errors.New("patch conflict")
+	// The document doesn't decode into its registered type
+	ErrInvalidDocument = errors.New("invalid document")
+)
+
+// PatchOp is a JSON Patch (RFC 6902) operation
+type PatchOp struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	From  string          `json:"from,omitempty"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+// MergePatch applies a JSON Merge Patch (RFC 7396), nulls in the patch remove fields
+func MergePatch(doc []byte, patch []byte) ([]byte, error) {
+	target, err := decodeValue(doc)
+	if err != nil {
+		return nil, err
+	}
+	p, err := decodeValue(patch)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidPatch, err)
+	}
+	return json.Marshal(mergePatch(target, p))
+}
+
+func mergePatch(target interface{}, patch interface{}) interface{} {
+	p, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	t, ok := target.(map[string]interface{})
+	if !ok {
+		t = map[string]interface{}{}
+	}
+	for k, v := range p {
+		if v == nil {
+			delete(t, k)
+			continue
+		}
+		t[k] = mergePatch(t[k], v)
+	}
+	return t
+}
+
+// JSONPatch applies a JSON Patch (RFC 6902), either every operation succeeds or the document is left as it was
+func JSONPatch(doc []byte, patch []byte) ([]byte, error) {
+	ops := []PatchOp{}
+	if err := json.Unmarshal(patch, &ops); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidPatch, err)
+	}
+	root, err := decodeValue(doc)
+	if err != nil {
+		return nil, err
+	}
+	for i, op := range ops {
+		if root, err = applyPatchOp(root, op); err != nil {
+			return nil, fmt.Errorf("operation %d (%s %s): %w", i, op.Op, op.Path, err)
+		}
+	}
+	return json.Marshal(root)
+}
+
+func applyPatchOp(root interface{}, op PatchOp) (interface{}, error) {
+	path, err := parsePointer(op.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	var value interface{}
+	switch op.Op {
+	case "add", "replace", "test":
+		if op.Value == nil {
+			return nil, fmt.Errorf("%w: missing value", ErrInvalidPatch)
+		}
+		if value, err = decodeValue(op.Value); err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidPatch, err)
+		}
+	case "move", "copy":
+		from, err := parsePointer(op.From)
+		if err != nil {
+			return nil, err
+		}
+		if value, err = getPointer(root, from); err != nil {
+			return nil, err
+		}
+		if op.Op == "copy" {
+			value = copyValue(value)
+			break
+		}
+		if op.Path == op.From {
+			return root, nil
+		}
+		if strings.HasPrefix(op.Path, op.From+"/") {
+			return nil, fmt.Errorf("%w: can't move %s into itself", ErrInvalidPatch, op.From)
+		}
+		if root, err = removePointer(root, from); err != nil {
+			return nil, err
+		}
+	case "remove":
+	default:
+		return nil, fmt.Errorf("%w: unknown op %q", ErrInvalidPatch, op.Op)
+	}
+
+	switch op.Op {
+	case "add", "move", "copy":
+		return addPointer(root, path, value)
+	case "remove":
+		return removePointer(root, path)
+	case "replace":
+		if _, err := getPointer(root, path); err != nil {
+			return nil, err
+		}
+		if len(path) == 0 {
+			return value, nil
+		}
+		if root, err = removePointer(root, path); err != nil {
+			return nil, err
+		}
+		return addPointer(root, path, value)
+	default: //test
+		current, err := getPointer(root, path)
+		if err != nil {
+			return nil, err
+		}
+		if !Equal(current, value) {
+			return nil, fmt.Errorf("%w: test failed", ErrPatchConflict)
+		}
+		return root, nil
+	}
+}
+
+// Equal compares decoded json values, numbers by value
+func Equal(a interface{}, b interface{}) bool {
+	if an, ok := Number(a); ok {
+		bn, ok := Number(b)
+		return ok && an == bn
+	}
+	switch av := a.(type) {
+	case map[string]interface{}:
+		bv, ok := b.(map[string]interface{})
+		if !ok || len(av) != len(bv) {
+			return false
+		}
+		for k, v := range av {
+			w, ok := bv[k]
+			if !ok || !Equal(v, w) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		bv, ok := b.([]interface{})
+		if !ok || len(av) != len(bv) {
+			return false
+		}
+		for i := range av {
+			if !Equal(av[i], bv[i]) {
+				return false
+			}
+		}
+		return true
+	}
+	return a == b
+}
+
+// Validate decodes data into a new value of the registered type of t, types without a template accept anything
+func Validate(t string, data []byte) (interface{}, error) {
+	template := Types[t]
+	if template == nil {
+		return nil, nil
+	}
+	typ := reflect.TypeOf(template)
+	if typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	v := reflect.New(typ).Interface()
+	if err := json.Unmarshal(data, v); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidDocument, err)
+	}
+	return v, nil
+}
+
+func decodeValue(data []byte) (interface{}, error) {
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+	var v interface{}
+	if err := d.Decode(&v); err != nil {
+		return nil, err
+	}
+	if d.More() {
+		return nil, errors.New("trailing data after json value")
+	}
+	return v, nil
+}
+
+func copyValue(v interface{}) interface{} {
+	switch val := v.(type) {
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(val))
+		for k, e := range val {
+			m[k] = copyValue(e)
+		}
+		return m
+	case []interface{}:
+		a := make([]interface{}, len(val))
+		for i, e := range val {
+			a[i] = copyValue(e)
+		}
+		return a
+	}
+	return v
+}
+
+// JSON Pointers (RFC 6901), "" is the whole document and "/a/0" the first element of a
+func parsePointer(p string) ([]string, error) {
+	if p == "" {
+		return []string{}, nil
+	}
+	if p[0] != '/' {
+		return nil, fmt.Errorf("%w: %q is not a json pointer", ErrInvalidPatch, p)
+	}
+	tokens := strings.Split(p[1:], "/")
+	for i, t := range tokens {
+		tokens[i] = strings.ReplaceAll(strings.ReplaceAll(t, "~1", "/"), "~0", "~")
+	}
+	return tokens, nil
+}
+
+func arrayIndex(token string, length int, appending bool) (int, error) {
+	if appending && token == "-" {
+		return length, nil
+	}
+	i, err := strconv.Atoi(token)
+	if err != nil || i < 0 || (token != "0" && token[0] == '0') {
+		return 0, fmt.Errorf("%w: %q is not an array index", ErrPatchConflict, token)
+	}
+	max := length - 1
+	if appending {
+		max = length
+	}
+	if i > max {
+		return 0, fmt.Errorf("%w: index %d out of range", ErrPatchConflict, i)
+	}
+	return i, nil
+}
+
+func getPointer(root interface{}, path []string) (interface{}, error) {
+	cur := root
+	for _, token := range path {
+		switch node := cur.(type) {
+		case map[string]interface{}:
+			v, ok := node[token]
+			if !ok {
+				return nil, fmt.Errorf("%w: %q not found", ErrPatchConflict, token)
+			}
+			cur = v
+		case []interface{}:
+			i, err := arrayIndex(token, len(node), false)
+			if err != nil {
+				return nil, err
+			}
+			cur = node[i]
+		default:
+			return nil, fmt.Errorf("%w: can't look up %q in a %T", ErrPatchConflict, token, cur)
+		}
+	}
+	return cur, nil
+}
+
+// updateParent replaces the parent of path with what fn returns, slices change when they grow or shrink
+func updateParent(node interface{}, path []string, fn func(parent interface{}, last string) (interface{}, error)) (interface{}, error) {
+	if len(path) == 1 {
+		return fn(node, path[0])
+	}
+	switch n := node.(type) {
+	case map[string]interface{}:
+		child, ok := n[path[0]]
+		if !ok {
+			return nil, fmt.Errorf("%w: %q not found", ErrPatchConflict, path[0])
+		}
+		v, err := updateParent(child, path[1:], fn)
+		if err != nil {
+			return nil, err
+		}
+		n[path[0]] = v
+		return n, nil
+	case []interface{}:
+		i, err := arrayIndex(path[0], len(n), false)
+		if err != nil {
+			return nil, err
+		}
+		v, err := updateParent(n[i], path[1:], fn)
+		if err != nil {
+			return nil, err
+		}
+		n[i] = v
+		return n, nil
+	}
+	return nil, fmt.Errorf("%w: can't look up %q in a %T", ErrPatchConflict, path[0], node)
+}
+
+func addPointer(root interface{}, path []string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	return updateParent(root, path, func(parent interface{}, last string) (interface{}, error) {
+		switch p := parent.(type) {
+		case map[string]interface{}:
+			p[last] = value
+			return p, nil
+		case []interface{}:
+			i, err := arrayIndex(last, len(p), true)
+			if err != nil {
+				return nil, err
+			}
+			p = append(p, nil)
+			copy(p[i+1:], p[i:])
+			p[i] = value
+			return p, nil
+		}
+		return nil, fmt.Errorf("%w: can't add %q to a %T", ErrPatchConflict, last, parent)
+	})
+}
+
+func removePointer(root interface{}, path []string) (interface{}, error) {
+	if len(path) == 0 {
+		return nil, fmt.Errorf("%w: can't remove the whole document", ErrInvalidPatch)
+	}
+	return updateParent(root, path, func(parent interface{}, last string) (interface{}, error) {
+		switch p := parent.(type) {
+		case map[string]interface{}:
+			if _, ok := p[last]; !ok {
+				return nil, fmt.Errorf("%w: %q not found", ErrPatchConflict, last)
+			}
+			delete(p, last)
+			return p, nil
+		case []interface{}:
+			i, err := arrayIndex(last, len(p), false)
+			if err != nil {
+				return nil, err
+			}
+			return append(p[:i], p[i+1:]...), nil
+		}
+		return nil, fmt.Errorf("%w: can't remove %q from a %T", ErrPatchConflict, last, parent)
+	})
+}
@@ -0,0 +1,94 @@
+package model_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/fnurk/geom/pkg/model"
+)
+
+func TestMergePatch(t *testing.T) {
+	cases := []struct{ doc, patch, want string }{
+		{`{"a":"b"}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"b"}`, `{"b":"c"}`, `{"a":"b","b":"c"}`},
+		{`{"a":"b","b":"c"}`, `{"a":null}`, `{"b":"c"}`},
+		{`{"a":[{"b":"c"}]}`, `{"a":[1]}`, `{"a":[1]}`},
+		{`{"a":{"b":"c"}}`, `{"a":{"b":"d","c":null}}`, `{"a":{"b":"d"}}`},
+		{`{"a":"foo"}`, `"bar"`, `"bar"`},
+		{`{"n":12345678901234567890}`, `{}`, `{"n":12345678901234567890}`},
+	}
+	for _, c := range cases {
+		got, err := model.MergePatch([]byte(c.doc), []byte(c.patch))
+		if err != nil || string(got) != c.want {
+			t.Errorf("%s + %s: expected %s, got %s %v", c.doc, c.patch, c.want, got, err)
+		}
+	}
+
+	if _, err := model.MergePatch([]byte(`{}`), []byte(`{`)); !errors.Is(err, model.ErrInvalidPatch) {
+		t.Errorf("expected ErrInvalidPatch, got %v", err)
+	}
+}
+
+func TestJSONPatch(t *testing.T) {
+	cases := []struct{ doc, patch, want string }{
+		{`{"foo":"bar"}`, `[{"op":"add","path":"/baz","value":"qux"}]`, `{"baz":"qux","foo":"bar"}`},
+		{`{"foo":["bar","baz"]}`, `[{"op":"add","path":"/foo/1","value":"qux"}]`, `{"foo":["bar","qux","baz"]}`},
+		{`{"foo":["bar"]}`, `[{"op":"add","path":"/foo/-","value":["abc"]}]`, `{"foo":["bar",["abc"]]}`},
+		{`{"foo":["bar","qux","baz"]}`, `[{"op":"remove","path":"/foo/1"}]`, `{"foo":["bar","baz"]}`},
+		{`{"baz":"qux","foo":"bar"}`, `[{"op":"replace","path":"/baz","value":"boo"}]`, `{"baz":"boo","foo":"bar"}`},
+		{`{"foo":{"bar":"baz","waldo":"fred"},"qux":{"corge":"grault"}}`, `[{"op":"move","from":"/foo/waldo","path":"/qux/thud"}]`,
+			`{"foo":{"bar":"baz"},"qux":{"corge":"grault","thud":"fred"}}`},
+		{`{"foo":["all","grass","cows","eat"]}`, `[{"op":"move","from":"/foo/1","path":"/foo/3"}]`, `{"foo":["all","cows","eat","grass"]}`},
+		{`{"a":{"b":1}}`, `[{"op":"copy","from":"/a","path":"/c"},{"op":"replace","path":"/c/b","value":2}]`, `{"a":{"b":1},"c":{"b":2}}`},
+		{`{"a/b":1,"m~n":2}`, `[{"op":"test","path":"/a~1b","value":1.0},{"op":"remove","path":"/m~0n"}]`, `{"a/b":1}`},
+		{`{"foo":"bar"}`, `[{"op":"add","path":"/child","value":{"grandchild":{}}}]`, `{"child":{"grandchild":{}},"foo":"bar"}`},
+		{`{"a":1}`, `[{"op":"replace","path":"","value":[]}]`, `[]`},
+	}
+	for _, c := range cases {
+		got, err := model.JSONPatch([]byte(c.doc), []byte(c.patch))
+		if err != nil || string(got) != c.want {
+			t.Errorf("%s + %s: expected %s, got %s %v", c.doc, c.patch, c.want, got, err)
+		}
+	}
+
+	failures := []struct {
+		doc, patch string
+		err        error
+	}{
+		{`{"baz":"qux"}`, `[{"op":"test","path":"/baz","value":"bar"}]`, model.ErrPatchConflict},
+		{`{"foo":"bar"}`, `[{"op":"add","path":"/baz/bat","value":"qux"}]`, model.ErrPatchConflict},
+		{`{"foo":"bar"}`, `[{"op":"remove","path":"/baz"}]`, model.ErrPatchConflict},
+		{`{"foo":[]}`, `[{"op":"add","path":"/foo/1","value":1}]`, model.ErrPatchConflict},
+		{`{"foo":[1]}`, `[{"op":"replace","path":"/foo/01","value":1}]`, model.ErrPatchConflict},
+		{`{"foo":"bar"}`, `[{"op":"add","path":"/baz"}]`, model.ErrInvalidPatch},
+		{`{"foo":"bar"}`, `[{"op":"frobnicate","path":"/baz"}]`, model.ErrInvalidPatch},
+		{`{"foo":"bar"}`, `[{"op":"add","path":"baz","value":1}]`, model.ErrInvalidPatch},
+		{`{"a":{"b":{}}}`, `[{"op":"move","from":"/a","path":"/a/b/c"}]`, model.ErrInvalidPatch},
+		{`{"foo":"bar"}`, `{"op":"add"}`, model.ErrInvalidPatch},
+	}
+	for _, f := range failures {
+		if _, err := model.JSONPatch([]byte(f.doc), []byte(f.patch)); !errors.Is(err, f.err) {
+			t.Errorf("%s + %s: expected %v, got %v", f.doc, f.patch, f.err, err)
+		}
+	}
+}
+
+type note struct {
+	Body  string `json:"body"`
+	Words int    `json:"words"`
+}
+
+func TestValidate(t *testing.T) {
+	model.RegisterType("patchnote", note{})
+
+	v, err := model.Validate("patchnote", []byte(`{"body":"hi","words":1,"extra":true}`))
+	if err != nil || v.(*note).Body != "hi" {
+		t.Errorf("expected a note, got %v %v", v, err)
+	}
+	if _, err := model.Validate("patchnote", []byte(`{"words":"many"}`)); !errors.Is(err, model.ErrInvalidDocument) {
+		t.Errorf("expected ErrInvalidDocument, got %v", err)
+	}
+	if _, err := model.Validate("unregistered", []byte(`{"words":"many"}`)); err != nil {
+		t.Errorf("unregistered types accept anything, got %v", err)
+	}
+}
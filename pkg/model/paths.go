@@ -0,0 +1,99 @@
+package model
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Paths address fields of a decoded document with dot separated names, eg. "meta.createdBy".
+// Only objects can be traversed, there are no array indexes.
+
+var ErrNotObject = errors.New("not an object")
+
+// DecodeObject decodes a json object keeping numbers as json.Number so they survive a round trip unchanged
+func DecodeObject(doc []byte) (map[string]interface{}, error) {
+	d := json.NewDecoder(bytes.NewReader(doc))
+	d.UseNumber()
+	obj := map[string]interface{}{}
+	if err := d.Decode(&obj); err != nil {
+		return nil, err
+	}
+	if obj == nil {
+		return nil, ErrNotObject
+	}
+	return obj, nil
+}
+
+func Lookup(obj map[string]interface{}, path string) (interface{}, bool) {
+	parts := strings.Split(path, ".")
+	var cur interface{} = obj
+	for _, part := range parts {
+		m, ok := cur.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		cur, ok = m[part]
+		if !ok {
+			return nil, false
+		}
+	}
+	return cur, true
+}
+
+// Assign sets the field at path, creating missing objects on the way
+func Assign(obj map[string]interface{}, path string, value interface{}) error {
+	parts := strings.Split(path, ".")
+	cur := obj
+	for _, part := range parts[:len(parts)-1] {
+		next, ok := cur[part]
+		if !ok || next == nil {
+			m := map[string]interface{}{}
+			cur[part] = m
+			cur = m
+			continue
+		}
+		m, ok := next.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%s: %w", path, ErrNotObject)
+		}
+		cur = m
+	}
+	cur[parts[len(parts)-1]] = value
+	return nil
+}
+
+// Remove deletes the field at path and reports whether it was there
+func Remove(obj map[string]interface{}, path string) bool {
+	parts := strings.Split(path, ".")
+	cur := obj
+	for _, part := range parts[:len(parts)-1] {
+		m, ok := cur[part].(map[string]interface{})
+		if !ok {
+			return false
+		}
+		cur = m
+	}
+	last := parts[len(parts)-1]
+	_, ok := cur[last]
+	delete(cur, last)
+	return ok
+}
+
+// Number converts a decoded json number to a float64
+func Number(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case json.Number:
+		f, err := n.Float64()
+		return f, err == nil
+	case float64:
+		return n, true
+	case int:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	}
+	return 0, false
+}
@@ -0,0 +1,49 @@
+package model
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/tidwall/gjson"
+)
+
+// Projections are named lists of gjson paths per type, eg. a "list" projection of note with just "title"
+var Projections = map[string]map[string][]string{}
+
+func RegisterProjection(t string, name string, paths ...string) {
+	if Projections[t] == nil {
+		Projections[t] = map[string][]string{}
+	}
+	Projections[t][name] = paths
+}
+
+func Projection(t string, name string) ([]string, bool) {
+	paths, ok := Projections[t][name]
+	return paths, ok
+}
+
+// Project keeps the parts of doc at paths. Plain dot paths keep their place, "meta.owner" becomes
+// {"meta":{"owner":...}}. Other gjson paths, eg. "comments.#", are keyed by the path itself.
+// Paths that aren't in doc are left out.
+func Project(doc []byte, paths []string) ([]byte, error) {
+	if !gjson.ValidBytes(doc) || !gjson.ParseBytes(doc).IsObject() {
+		return nil, ErrNotObject
+	}
+	obj := map[string]interface{}{}
+	for _, path := range paths {
+		r := gjson.GetBytes(doc, path)
+		if !r.Exists() {
+			continue
+		}
+		value := json.RawMessage(r.Raw)
+		if strings.ContainsAny(path, `\#@*?|()[]{}!=<>%`) {
+			obj[path] = value
+			continue
+		}
+		if err := Assign(obj, path, value); err != nil {
+			//"a" and "a.b" both asked for, "a" has it all
+			continue
+		}
+	}
+	return json.Marshal(obj)
+}
@@ -0,0 +1,41 @@
+package model_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/fnurk/geom/pkg/model"
+)
+
+func TestProject(t *testing.T) {
+	doc := []byte(`{"title":"t","n":1.50,"meta":{"owner":"alice","created":"2024"},"comments":[{"by":"a"},{"by":"b"}]}`)
+	cases := []struct {
+		paths []string
+		want  string
+	}{
+		{[]string{"title"}, `{"title":"t"}`},
+		{[]string{"title", "n", "missing"}, `{"n":1.50,"title":"t"}`},
+		{[]string{"meta.owner"}, `{"meta":{"owner":"alice"}}`},
+		{[]string{"meta", "meta.owner"}, `{"meta":{"owner":"alice","created":"2024"}}`},
+		{[]string{"comments.#", "comments.#.by"}, `{"comments.#":2,"comments.#.by":["a","b"]}`},
+		{[]string{}, `{}`},
+	}
+	for _, c := range cases {
+		got, err := model.Project(doc, c.paths)
+		if err != nil || string(got) != c.want {
+			t.Errorf("%v: expected %s, got %s %v", c.paths, c.want, got, err)
+		}
+	}
+
+	if _, err := model.Project([]byte(`[1]`), []string{"0"}); !errors.Is(err, model.ErrNotObject) {
+		t.Errorf("expected ErrNotObject, got %v", err)
+	}
+
+	model.RegisterProjection("projected", "list", "title")
+	if paths, ok := model.Projection("projected", "list"); !ok || len(paths) != 1 {
+		t.Errorf("projection not registered: %v", paths)
+	}
+	if _, ok := model.Projection("projected", "full"); ok {
+		t.Error("unknown projection found")
+	}
+}
@@ -0,0 +1,217 @@
+package model
+
+import (
+	"encoding/json"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schema is the JSON Schema of the registered type t, see SchemaOf
+func Schema(t string) (map[string]interface{}, bool) {
+	template, ok := Types[t]
+	if !ok {
+		return nil, false
+	}
+	return SchemaOf(template), true
+}
+
+// SchemaOf describes how v's type encodes to json, as JSON Schema 2020-12 (the dialect of OpenAPI 3.1).
+// Fields are named by their json tags and embedded structs are flattened like encoding/json does.
+// validate tags (go-playground/validator) become required, bounds, enums and formats, index tags
+// are kept as x-geom-index.
+func SchemaOf(v interface{}) map[string]interface{} {
+	if v == nil {
+		return map[string]interface{}{}
+	}
+	return schemaOf(reflect.TypeOf(v), map[reflect.Type]bool{})
+}
+
+var (
+	timeType       = reflect.TypeOf(time.Time{})
+	rawMessageType = reflect.TypeOf(json.RawMessage{})
+)
+
+func schemaOf(t reflect.Type, seen map[reflect.Type]bool) map[string]interface{} {
+	switch {
+	case t == timeType:
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case t == rawMessageType:
+		return map[string]interface{}{}
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		s := schemaOf(t.Elem(), seen)
+		if typ, ok := s["type"].(string); ok {
+			s["type"] = []string{typ, "null"}
+		}
+		return s
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer", "minimum": 0}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]interface{}{"type": "string", "contentEncoding": "base64"}
+		}
+		return map[string]interface{}{"type": "array", "items": schemaOf(t.Elem(), seen)}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": schemaOf(t.Elem(), seen)}
+	case reflect.Struct:
+		//recursive types end up as anything
+		if seen[t] {
+			return map[string]interface{}{}
+		}
+		seen[t] = true
+		defer delete(seen, t)
+
+		properties := map[string]interface{}{}
+		required := []string{}
+		addFields(t, seen, properties, &required)
+		s := map[string]interface{}{"type": "object", "properties": properties}
+		if len(required) > 0 {
+			s["required"] = required
+		}
+		return s
+	}
+	//interfaces and anything else
+	return map[string]interface{}{}
+}
+
+func addFields(t reflect.Type, seen map[reflect.Type]bool, properties map[string]interface{}, required *[]string) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+
+		ft := f.Type
+		if f.Anonymous && name == "" {
+			if ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				addFields(ft, seen, properties, required)
+				continue
+			}
+		}
+		if !f.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+
+		s := schemaOf(ft, seen)
+		if strings.Contains(","+opts+",", ",string,") {
+			s = map[string]interface{}{"type": "string"}
+		}
+		if validate := f.Tag.Get("validate"); validate != "" && validate != "-" {
+			if applyValidate(s, ft, validate) {
+				*required = append(*required, name)
+			}
+		}
+		if index := f.Tag.Get("index"); index != "" {
+			s["x-geom-index"] = strings.Split(index, ",")
+		}
+		properties[name] = s
+	}
+}
+
+// applyValidate adds the rules of a validate tag to s, rules after dive go to the items. It tells if
+// the field is required.
+func applyValidate(s map[string]interface{}, t reflect.Type, tag string) bool {
+	required := false
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	rules := strings.Split(tag, ",")
+	for i, rule := range rules {
+		name, param, _ := strings.Cut(rule, "=")
+		switch name {
+		case "required":
+			required = true
+		case "dive":
+			if items, ok := s["items"].(map[string]interface{}); ok {
+				applyValidate(items, t.Elem(), strings.Join(rules[i+1:], ","))
+			} else if values, ok := s["additionalProperties"].(map[string]interface{}); ok {
+				applyValidate(values, t.Elem(), strings.Join(rules[i+1:], ","))
+			}
+			return required
+		case "min", "gte":
+			bound(s, t, param, "minLength", "minimum", "minItems")
+		case "max", "lte":
+			bound(s, t, param, "maxLength", "maximum", "maxItems")
+		case "len":
+			bound(s, t, param, "minLength", "minimum", "minItems")
+			bound(s, t, param, "maxLength", "maximum", "maxItems")
+		case "gt":
+			bound(s, t, param, "", "exclusiveMinimum", "")
+		case "lt":
+			bound(s, t, param, "", "exclusiveMaximum", "")
+		case "oneof":
+			enum := []interface{}{}
+			for _, v := range strings.Fields(param) {
+				enum = append(enum, number(t, v))
+			}
+			s["enum"] = enum
+		case "email", "uri", "uuid", "hostname", "ipv4", "ipv6":
+			s["format"] = name
+		case "url":
+			s["format"] = "uri"
+		case "uuid4":
+			s["format"] = "uuid"
+		case "datetime":
+			s["format"] = "date-time"
+		case "alpha":
+			s["pattern"] = "^[a-zA-Z]*$"
+		case "alphanum":
+			s["pattern"] = "^[a-zA-Z0-9]*$"
+		case "numeric":
+			s["pattern"] = "^[-+]?[0-9]+(?:\\.[0-9]+)?$"
+		}
+	}
+	return required
+}
+
+// bound sets the keyword of min or max that fits the kind of t, if it has one
+func bound(s map[string]interface{}, t reflect.Type, param string, length string, value string, items string) {
+	switch t.Kind() {
+	case reflect.String:
+		if n, err := strconv.Atoi(param); err == nil && length != "" {
+			s[length] = n
+		}
+	case reflect.Slice, reflect.Array, reflect.Map:
+		if n, err := strconv.Atoi(param); err == nil && items != "" {
+			s[items] = n
+		}
+	default:
+		if n, err := strconv.ParseFloat(param, 64); err == nil {
+			s[value] = n
+		}
+	}
+}
+
+// number is v as a number if t is one
+func number(t reflect.Type, v string) interface{} {
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		if n, err := strconv.ParseFloat(v, 64); err == nil {
+			return n
+		}
+	}
+	return v
+}
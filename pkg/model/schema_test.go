@@ -0,0 +1,71 @@
+package model_test
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/fnurk/geom/pkg/model"
+)
+
+type schemaMeta struct {
+	Owner   string    `json:"owner" validate:"required,email"`
+	Created time.Time `json:"created"`
+}
+
+type schemaNode struct {
+	Name     string        `json:"name"`
+	Children []*schemaNode `json:"children"`
+}
+
+type schemaDoc struct {
+	schemaMeta
+	Title    string            `json:"title" validate:"required,min=1,max=80"`
+	Status   string            `json:"status" validate:"oneof=open done" index:"persist"`
+	Priority int               `json:"priority" validate:"gte=1,lte=5"`
+	Tags     []string          `json:"tags,omitempty" validate:"max=10,dive,alphanum" index:"inmem"`
+	Score    *float64          `json:"score"`
+	Count    int64             `json:"count,string"`
+	Extra    map[string]int    `json:"extra"`
+	Raw      json.RawMessage   `json:"raw"`
+	Tree     schemaNode        `json:"tree"`
+	Skipped  string            `json:"-"`
+	hidden   string            //left out
+	Labels   map[string]string `json:"labels" validate:"dive,max=3"`
+}
+
+func TestSchemaOf(t *testing.T) {
+	got, err := json.Marshal(model.SchemaOf(schemaDoc{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"properties":{` +
+		`"count":{"type":"string"},` +
+		`"created":{"format":"date-time","type":"string"},` +
+		`"extra":{"additionalProperties":{"type":"integer"},"type":"object"},` +
+		`"labels":{"additionalProperties":{"maxLength":3,"type":"string"},"type":"object"},` +
+		`"owner":{"format":"email","type":"string"},` +
+		`"priority":{"maximum":5,"minimum":1,"type":"integer"},` +
+		`"raw":{},` +
+		`"score":{"type":["number","null"]},` +
+		`"status":{"enum":["open","done"],"type":"string","x-geom-index":["persist"]},` +
+		`"tags":{"items":{"pattern":"^[a-zA-Z0-9]*$","type":"string"},"maxItems":10,"type":"array","x-geom-index":["inmem"]},` +
+		`"title":{"maxLength":80,"minLength":1,"type":"string"},` +
+		`"tree":{"properties":{"children":{"items":{},"type":"array"},"name":{"type":"string"}},"type":"object"}` +
+		`},"required":["owner","title"],"type":"object"}`
+	if string(got) != want {
+		t.Errorf("expected\n%s\ngot\n%s", want, got)
+	}
+}
+
+func TestSchema(t *testing.T) {
+	model.RegisterType("schemadoc", schemaDoc{})
+	defer delete(model.Types, "schemadoc")
+
+	if _, ok := model.Schema("schemadoc"); !ok {
+		t.Error("expected a schema for a registered type")
+	}
+	if _, ok := model.Schema("missing"); ok {
+		t.Error("expected no schema for a type that isn't registered")
+	}
+}
@@ -15,4 +15,8 @@ type Subscriber interface {
 type Message struct {
 	Topic string
 	Body  string
+	// Set by ReplayPubsub, 0 otherwise
+	Id uint64
+	// Where the change came from, see store.WithOrigin
+	Origin string
 }
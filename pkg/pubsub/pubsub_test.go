@@ -3,6 +3,7 @@ package pubsub_test
 import (
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/fnurk/geom/pkg/pubsub"
 	"go.uber.org/goleak"
@@ -105,3 +106,81 @@ func Benchmark_ChanPubSub_1000_Fanout(b *testing.B) {
 
 	ps.Shutdown()
 }
+
+func TestReplayPubsub_Since(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	ps := pubsub.NewReplayPubsub(pubsub.NewChanPubsub(), 3)
+	defer ps.Shutdown()
+
+	start := ps.Last()
+	ps.Publish(&pubsub.Message{Topic: "a.1", Body: "1"})
+	ps.Publish(&pubsub.Message{Topic: "b.1", Body: "2"})
+
+	msgs, ok := ps.Since(start, "a.*")
+	if !ok || len(msgs) != 1 || msgs[0].Body != "1" || msgs[0].Id != start+1 {
+		t.Errorf("expected the first message, got %v %v", msgs, ok)
+	}
+	if msgs, ok := ps.Since(ps.Last(), "*"); !ok || len(msgs) != 0 {
+		t.Errorf("expected nothing missed, got %v %v", msgs, ok)
+	}
+
+	ps.Publish(&pubsub.Message{Topic: "a.2", Body: "3"})
+	ps.Publish(&pubsub.Message{Topic: "a.3", Body: "4"})
+
+	//the first message is gone
+	if _, ok := ps.Since(start, "*"); ok {
+		t.Error("expected messages to be missing")
+	}
+	msgs, ok = ps.Since(start+1, "a.*")
+	if !ok || len(msgs) != 2 || msgs[0].Body != "3" || msgs[1].Body != "4" {
+		t.Errorf("expected the last two a messages, got %v %v", msgs, ok)
+	}
+	if _, ok := ps.Since(ps.Last()+1, "*"); ok {
+		t.Error("ids from the future can't be caught up on")
+	}
+}
+
+func TestReplayPubsub_SlowSubscriber(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	ps := pubsub.NewReplayPubsub(pubsub.NewChanPubsub(), 10)
+	defer ps.Shutdown()
+
+	release := make(chan struct{})
+	received := make(chan string, 10)
+	sub := ps.Subscribe("a", func(m *pubsub.Message, s pubsub.Subscriber) {
+		<-release
+		received <- m.Body
+	}, func() {})
+	defer sub.Unsubscribe()
+
+	//the subscriber holds up delivery, not publishing
+	published := make(chan struct{})
+	go func() {
+		for _, body := range []string{"1", "2", "3", "4", "5"} {
+			ps.Publish(&pubsub.Message{Topic: "a", Body: body})
+		}
+		close(published)
+	}()
+	select {
+	case <-published:
+	case <-time.After(time.Second):
+		t.Fatal("publishing waited for the subscriber")
+	}
+	if msgs, ok := ps.Since(ps.Last()-5, "a"); !ok || len(msgs) != 5 {
+		t.Errorf("expected 5 messages to be remembered, got %v %v", msgs, ok)
+	}
+
+	close(release)
+	for _, want := range []string{"1", "2", "3", "4", "5"} {
+		select {
+		case got := <-received:
+			if got != want {
+				t.Errorf("expected %s, got %s", want, got)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for %s", want)
+		}
+	}
+}
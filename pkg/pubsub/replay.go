@@ -0,0 +1,128 @@
+package pubsub
+
+import (
+	"sync"
+	"time"
+
+	"github.com/tidwall/match"
+)
+
+// ReplayPubsub numbers the messages published through it and remembers the last ones, so a subscriber
+// that lost its connection can catch up on what it missed. Ids start at the boot time in nanoseconds,
+// ids from before a restart are older than anything remembered.
+type ReplayPubsub struct {
+	Pubsub
+	lock sync.Mutex
+	last uint64
+	// ring of the last messages, oldest at start
+	buffer []*Message
+	start  int
+
+	// published messages waiting to be passed on by forward
+	queue    []*Message
+	wake     chan struct{}
+	stop     chan struct{}
+	stopped  chan struct{}
+	shutdown sync.Once
+}
+
+func NewReplayPubsub(p Pubsub, size int) *ReplayPubsub {
+	r := &ReplayPubsub{
+		Pubsub:  p,
+		last:    uint64(time.Now().UnixNano()),
+		buffer:  make([]*Message, 0, size),
+		wake:    make(chan struct{}, 1),
+		stop:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	go r.forward()
+	return r
+}
+
+// Publish sets the id of msg and returns, messages are passed on in id order
+func (r *ReplayPubsub) Publish(msg *Message) {
+	r.lock.Lock()
+	r.last++
+	msg.Id = r.last
+	if len(r.buffer) < cap(r.buffer) {
+		r.buffer = append(r.buffer, msg)
+	} else if cap(r.buffer) > 0 {
+		r.buffer[r.start] = msg
+		r.start = (r.start + 1) % len(r.buffer)
+	}
+	r.queue = append(r.queue, msg)
+	r.lock.Unlock()
+
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+}
+
+// forward passes the queued messages on without holding the lock, a slow subscriber holds up
+// delivery but not publishing
+func (r *ReplayPubsub) forward() {
+	defer close(r.stopped)
+	for {
+		select {
+		case <-r.wake:
+		case <-r.stop:
+			r.flush()
+			return
+		}
+		r.flush()
+	}
+}
+
+func (r *ReplayPubsub) flush() {
+	for {
+		r.lock.Lock()
+		queue := r.queue
+		r.queue = nil
+		r.lock.Unlock()
+		if len(queue) == 0 {
+			return
+		}
+		for _, msg := range queue {
+			r.Pubsub.Publish(msg)
+		}
+	}
+}
+
+// Shutdown passes on what has been published and then shuts the wrapped Pubsub down
+func (r *ReplayPubsub) Shutdown() {
+	r.shutdown.Do(func() {
+		close(r.stop)
+		<-r.stopped
+		r.Pubsub.Shutdown()
+	})
+}
+
+// Last is the id of the latest message
+func (r *ReplayPubsub) Last() uint64 {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.last
+}
+
+// Since returns the messages matching pattern published after id, ok is false if some of them
+// are no longer remembered
+func (r *ReplayPubsub) Since(id uint64, pattern string) (msgs []*Message, ok bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if id > r.last {
+		return nil, false
+	}
+	missed := r.last - id
+	if missed > uint64(len(r.buffer)) {
+		return nil, false
+	}
+	msgs = []*Message{}
+	for i := len(r.buffer) - int(missed); i < len(r.buffer); i++ {
+		m := r.buffer[(r.start+i)%len(r.buffer)]
+		if match.Match(m.Topic, pattern) {
+			msgs = append(msgs, m)
+		}
+	}
+	return msgs, true
+}
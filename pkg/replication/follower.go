@@ -0,0 +1,261 @@
+package replication
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/fnurk/geom/pkg/store"
+	"github.com/labstack/echo/v4"
+)
+
+// The follower keeps its position in this bucket, under id 1
+const positionBucket = "_replication"
+
+var (
+	errSnapshotNeeded     = errors.New("leader no longer has the changes, a new snapshot is needed")
+	errIncompleteSnapshot = errors.New("incomplete snapshot")
+)
+
+type Follower struct {
+	ds        *store.Datastore
+	LeaderURL string
+	Token     string
+	Client    *http.Client
+	// How long to wait before reconnecting after an error
+	RetryDelay time.Duration
+	// Called with every error that made the follower reconnect
+	OnError func(error)
+}
+
+// NewFollower makes ds read only, call it before ds.Init and start it with Run after
+func NewFollower(ds *store.Datastore, leaderURL string) *Follower {
+	ds.SetReadOnly(true)
+	ds.AddInitHook(func(ds *store.Datastore) error {
+		return ds.CreateBucketIfNotExists(positionBucket)
+	})
+
+	return &Follower{
+		ds:         ds,
+		LeaderURL:  leaderURL,
+		Client:     http.DefaultClient,
+		RetryDelay: time.Second,
+		OnError:    func(error) {},
+	}
+}
+
+// Position is the sequence number of the last change applied, 0 if nothing has been replicated yet
+func (f *Follower) Position(ctx context.Context) (uint64, error) {
+	doc, err := f.ds.GetContext(ctx, positionBucket, "1")
+	if err != nil || doc == nil {
+		return 0, err
+	}
+	return strconv.ParseUint(string(doc), 10, 64)
+}
+
+// Run replicates from the leader until ctx is done
+func (f *Follower) Run(ctx context.Context) error {
+	for {
+		err := f.follow(ctx)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		if err == errSnapshotNeeded {
+			err = f.savePosition(ctx, 0)
+		}
+		if err != nil {
+			f.OnError(err)
+		}
+
+		select {
+		case <-time.After(f.RetryDelay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (f *Follower) follow(ctx context.Context) error {
+	pos, err := f.Position(ctx)
+	if err != nil {
+		return err
+	}
+
+	if pos == 0 {
+		if pos, err = f.snapshot(ctx); err != nil {
+			return err
+		}
+	}
+
+	res, err := f.get(ctx, fmt.Sprintf("/changes?since=%d", pos))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusGone {
+		return errSnapshotNeeded
+	}
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("leader answered %s", res.Status)
+	}
+
+	scanner := newScanner(res)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 { //heartbeat
+			continue
+		}
+		change := store.Change{}
+		if err := json.Unmarshal(scanner.Bytes(), &change); err != nil {
+			return err
+		}
+		if err := f.apply(ctx, change); err != nil {
+			return err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return errors.New("leader closed the change stream")
+}
+
+func (f *Follower) apply(ctx context.Context, change store.Change) error {
+	return f.ds.Update(store.ReplicaContext(ctx), func(tx store.Tx) error {
+		var err error
+		if change.Deleted {
+			err = tx.Delete(change.Bucket, change.Id)
+		} else {
+			_, err = tx.Put(change.Bucket, change.Id, change.Data)
+		}
+		if err != nil {
+			return err
+		}
+		return putPosition(tx, change.Seq)
+	})
+}
+
+// snapshot replaces all documents with the leader's in a single transaction
+func (f *Follower) snapshot(ctx context.Context) (uint64, error) {
+	res, err := f.get(ctx, "/snapshot")
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("leader answered %s", res.Status)
+	}
+
+	scanner := newScanner(res)
+	if !scanner.Scan() {
+		return 0, errIncompleteSnapshot
+	}
+	header := snapshotHeader{}
+	if err := json.Unmarshal(scanner.Bytes(), &header); err != nil {
+		return 0, err
+	}
+	for _, bucket := range header.Buckets {
+		if err := f.ds.CreateBucketIfNotExistsContext(ctx, bucket); err != nil {
+			return 0, err
+		}
+	}
+
+	var seq uint64
+	err = f.ds.Update(store.ReplicaContext(ctx), func(tx store.Tx) error {
+		for _, bucket := range header.Buckets {
+			if err := clearBucket(tx, bucket); err != nil {
+				return err
+			}
+		}
+
+		for scanner.Scan() {
+			change := store.Change{}
+			if err := json.Unmarshal(scanner.Bytes(), &change); err != nil {
+				return err
+			}
+			if change.Bucket == "" { //end of snapshot
+				seq = change.Seq
+				return putPosition(tx, seq)
+			}
+			if _, err := tx.Put(change.Bucket, change.Id, change.Data); err != nil {
+				return err
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return err
+		}
+		return errIncompleteSnapshot
+	})
+
+	return seq, err
+}
+
+func (f *Follower) savePosition(ctx context.Context, pos uint64) error {
+	return f.ds.Update(store.ReplicaContext(ctx), func(tx store.Tx) error {
+		return putPosition(tx, pos)
+	})
+}
+
+func (f *Follower) get(ctx context.Context, path string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, f.LeaderURL+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	if f.Token != "" {
+		req.Header.Set(echo.HeaderAuthorization, "Bearer "+f.Token)
+	}
+	return f.Client.Do(req)
+}
+
+func putPosition(tx store.Tx, pos uint64) error {
+	_, err := tx.Put(positionBucket, "1", []byte(strconv.FormatUint(pos, 10)))
+	return err
+}
+
+func clearBucket(tx store.Tx, bucket string) error {
+	ids := []string{}
+	tx.ForEach(bucket, func(id string, data []byte) error {
+		ids = append(ids, id)
+		return nil
+	})
+	for _, id := range ids {
+		if err := tx.Delete(bucket, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func newScanner(res *http.Response) *bufio.Scanner {
+	scanner := bufio.NewScanner(res.Body)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	return scanner
+}
+
+// ProxyWrites sends every request that isn't a read to the leader, use it on followers
+func ProxyWrites(leaderURL string) (echo.MiddlewareFunc, error) {
+	target, err := url.Parse(leaderURL)
+	if err != nil {
+		return nil, err
+	}
+	proxy := httputil.NewSingleHostReverseProxy(target)
+
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			switch c.Request().Method {
+			case http.MethodGet, http.MethodHead, http.MethodOptions:
+				return next(c)
+			}
+			proxy.ServeHTTP(c.Response(), c.Request())
+			return nil
+		}
+	}, nil
+}
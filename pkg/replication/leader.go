@@ -0,0 +1,190 @@
+package replication
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/fnurk/geom/pkg/store"
+	"github.com/labstack/echo/v4"
+)
+
+/*
+
+Replication streams committed writes from a leader to read only followers over plain HTTP.
+
+A follower without a position downloads a snapshot: a header line with the bucket names, one line per
+document and an end line with the change sequence number the snapshot includes. After that it follows the
+change log from that number. Both are newline delimited JSON. The follower stores its position in the same
+transaction as every change it applies, so after a restart it continues where it stopped.
+
+*/
+
+const batchSize = 1000
+
+type snapshotHeader struct {
+	Buckets []string `json:"buckets"`
+}
+
+type Leader struct {
+	ds *store.Datastore
+	// Followers must send this as a bearer token, if set
+	Token string
+	// KeepChanges is how many changes are kept for followers to catch up with, 0 keeps all of them
+	KeepChanges int
+	Heartbeat   time.Duration
+
+	lock   sync.Mutex
+	notify chan struct{}
+	writes int
+}
+
+// NewLeader enables the change log on ds, so it has to be called before ds.Init
+func NewLeader(ds *store.Datastore) *Leader {
+	l := &Leader{
+		ds:        ds,
+		Heartbeat: 15 * time.Second,
+		notify:    make(chan struct{}),
+	}
+
+	ds.EnableChangeLog()
+	ds.AddPutHook(func(t string, id string, value []byte) {
+		l.changed()
+	})
+	ds.AddDeleteHook(func(t string, id string) {
+		l.changed()
+	})
+
+	return l
+}
+
+func AddLeaderEndpoints(e *echo.Group, l *Leader) {
+	e.GET("/snapshot", Snapshot(l))
+	e.GET("/changes", Changes(l))
+}
+
+// changed wakes up everyone waiting for changes and trims the change log now and then
+func (l *Leader) changed() {
+	l.lock.Lock()
+	close(l.notify)
+	l.notify = make(chan struct{})
+	l.writes++
+	trim := l.KeepChanges > 0 && l.writes%l.KeepChanges == 0
+	l.lock.Unlock()
+
+	if trim {
+		go l.ds.TrimChanges(context.Background(), l.KeepChanges)
+	}
+}
+
+func (l *Leader) wait() <-chan struct{} {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.notify
+}
+
+func (l *Leader) authorized(c echo.Context) bool {
+	return l.Token == "" || c.Request().Header.Get(echo.HeaderAuthorization) == "Bearer "+l.Token
+}
+
+func Snapshot(l *Leader) func(echo.Context) error {
+	return func(c echo.Context) error {
+		if !l.authorized(c) {
+			return c.NoContent(http.StatusUnauthorized)
+		}
+		ctx := c.Request().Context()
+
+		buckets := []string{}
+		for _, b := range l.ds.Buckets() {
+			if !store.IsInternalBucket(b) {
+				buckets = append(buckets, b)
+			}
+		}
+
+		c.Response().Header().Set(echo.HeaderContentType, "application/x-ndjson")
+		c.Response().WriteHeader(http.StatusOK)
+		enc := json.NewEncoder(c.Response())
+
+		if err := enc.Encode(snapshotHeader{Buckets: buckets}); err != nil {
+			return nil
+		}
+
+		seq, err := l.ds.SnapshotContext(ctx, func(bucket string, id string, data []byte) error {
+			return enc.Encode(store.Change{Bucket: bucket, Id: id, Data: data})
+		})
+		if err != nil {
+			//the missing end line tells the follower the snapshot is incomplete
+			return nil
+		}
+
+		enc.Encode(store.Change{Seq: seq})
+		return nil
+	}
+}
+
+// Changes streams the change log after the since parameter until the client goes away.
+// It answers 410 Gone if those changes have been trimmed, the follower has to take a new snapshot.
+func Changes(l *Leader) func(echo.Context) error {
+	return func(c echo.Context) error {
+		if !l.authorized(c) {
+			return c.NoContent(http.StatusUnauthorized)
+		}
+		ctx := c.Request().Context()
+
+		since, err := strconv.ParseUint(c.QueryParam("since"), 10, 64)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "since must be a sequence number")
+		}
+
+		first, err := l.ds.FirstChange(ctx)
+		if err != nil {
+			return c.String(http.StatusInternalServerError, err.Error())
+		}
+		if first > since+1 {
+			return c.NoContent(http.StatusGone)
+		}
+
+		c.Response().Header().Set(echo.HeaderContentType, "application/x-ndjson")
+		c.Response().WriteHeader(http.StatusOK)
+		c.Response().Flush()
+		enc := json.NewEncoder(c.Response())
+
+		heartbeat := time.NewTicker(l.Heartbeat)
+		defer heartbeat.Stop()
+
+		for {
+			//get the channel before reading so no change slips in between
+			notify := l.wait()
+
+			changes, err := l.ds.Changes(ctx, since, batchSize)
+			if err != nil {
+				return nil
+			}
+			for _, change := range changes {
+				if err := enc.Encode(change); err != nil {
+					return nil
+				}
+				since = change.Seq
+			}
+			c.Response().Flush()
+
+			if len(changes) == batchSize {
+				continue
+			}
+
+			select {
+			case <-notify:
+			case <-heartbeat.C:
+				if _, err := c.Response().Write([]byte("\n")); err != nil {
+					return nil
+				}
+				c.Response().Flush()
+			case <-ctx.Done():
+				return nil
+			}
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package replication_test
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/fnurk/geom/pkg/model"
+	"github.com/fnurk/geom/pkg/replication"
+	"github.com/fnurk/geom/pkg/store"
+	"github.com/labstack/echo/v4"
+)
+
+type note struct {
+	Body string `json:"body"`
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestReplication_SnapshotAndChanges(t *testing.T) {
+	model.RegisterType("note", note{})
+
+	leaderDs := store.NewDatastore(store.NewInMemDatabase(), nil)
+	leader := replication.NewLeader(leaderDs)
+	leader.Token = "secret"
+	leader.Heartbeat = 10 * time.Millisecond
+	if err := leaderDs.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	e := echo.New()
+	replication.AddLeaderEndpoints(e.Group("/_replication"), leader)
+	server := httptest.NewServer(e)
+	defer server.Close()
+
+	leaderDs.Put("note", "", []byte(`{"body":"before snapshot"}`))
+
+	followerDb := store.NewInMemDatabase()
+	followerDs := store.NewDatastore(followerDb, nil)
+	follower := replication.NewFollower(followerDs, server.URL+"/_replication")
+	follower.Token = "secret"
+	follower.RetryDelay = 10 * time.Millisecond
+	if err := followerDs.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- follower.Run(ctx) }()
+
+	waitFor(t, "snapshot", func() bool {
+		doc, _ := followerDs.Get("note", "1")
+		return string(doc) == `{"body":"before snapshot"}`
+	})
+
+	leaderDs.Put("note", "", []byte(`{"body":"after snapshot"}`))
+	leaderDs.Delete("note", "1")
+
+	waitFor(t, "changes", func() bool {
+		doc, _ := followerDs.Get("note", "2")
+		gone, _ := followerDs.Get("note", "1")
+		return doc != nil && gone == nil
+	})
+
+	if _, err := followerDs.Put("note", "", []byte(`{}`)); err != store.ErrReadOnly {
+		t.Errorf("expected follower to reject writes, got %v", err)
+	}
+
+	cancel()
+	<-done
+
+	// a restarted follower continues from its position instead of taking a new snapshot
+	pos, _ := follower.Position(context.Background())
+	if pos != 3 {
+		t.Errorf("expected position 3, got %d", pos)
+	}
+
+	leaderDs.Put("note", "", []byte(`{"body":"while down"}`))
+
+	restarted := replication.NewFollower(store.NewDatastore(followerDb, nil), server.URL+"/_replication")
+	restarted.Token = "secret"
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	go restarted.Run(ctx)
+
+	waitFor(t, "catch up", func() bool {
+		pos, _ := restarted.Position(context.Background())
+		return pos == 4
+	})
+}
@@ -0,0 +1,321 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Attachment metadata is kept on the parent document under this field
+const AttachmentsField = "_attachments"
+
+var (
+	ErrNoBlobStore        = errors.New("no blob store configured")
+	ErrAttachmentNotFound = errors.New("attachment not found")
+	// Writes can't change the attachment metadata of a document, only the attachment methods do
+	ErrAttachmentsReadOnly = errors.New(AttachmentsField + " can only be changed through the attachment methods")
+)
+
+type attachmentWriteKey struct{}
+
+// attachmentWrite marks the writes of the attachment methods, the only ones that may change the metadata
+func attachmentWrite(ctx context.Context) context.Context {
+	return context.WithValue(ctx, attachmentWriteKey{}, true)
+}
+
+func isAttachmentWrite(ctx context.Context) bool {
+	ok, _ := ctx.Value(attachmentWriteKey{}).(bool)
+	return ok
+}
+
+type Attachment struct {
+	Name        string    `json:"name"`
+	Size        int64     `json:"size"`
+	ContentType string    `json:"contentType"`
+	SHA256      string    `json:"sha256"`
+	Created     time.Time `json:"created"`
+	// Where the content is in the blob store, under the document's prefix. Attachments stored before
+	// blobs had their own names are kept under the attachment name.
+	Blob string `json:"blob,omitempty"`
+}
+
+// UseBlobStore enables attachments, blobs are removed when their parent document is deleted
+func (ds *Datastore) UseBlobStore(blobs *BlobStore) {
+	ds.blobs = blobs
+	ds.AddDeleteContextHook(func(ctx context.Context, t string, id string) {
+		blobs.DeletePrefix(attachmentPrefix(ctx, t, id))
+	})
+}
+
+func (ds *Datastore) Attachments(t string, id string) ([]Attachment, error) {
+	return ds.AttachmentsContext(context.Background(), t, id)
+}
+
+func (ds *Datastore) AttachmentsContext(ctx context.Context, t string, id string) ([]Attachment, error) {
+	doc, err := ds.GetContext(ctx, t, id)
+	if err != nil {
+		return nil, err
+	}
+	if doc == nil {
+		return nil, ErrDocumentNotFound
+	}
+	return DecodeAttachments(doc)
+}
+
+func (ds *Datastore) PutAttachment(t string, id string, name string, contentType string, r io.Reader) (Attachment, error) {
+	return ds.PutAttachmentContext(context.Background(), t, id, name, contentType, r)
+}
+
+// PutAttachmentContext stores the content of r under a new blob and then records it on the document, replacing
+// the attachment with the same name. r is read outside any transaction, the old blob is removed once the
+// document no longer refers to it.
+func (ds *Datastore) PutAttachmentContext(ctx context.Context, t string, id string, name string, contentType string, r io.Reader) (Attachment, error) {
+	if ds.blobs == nil {
+		return Attachment{}, ErrNoBlobStore
+	}
+
+	doc, err := ds.GetContext(ctx, t, id)
+	if err != nil {
+		return Attachment{}, err
+	}
+	if doc == nil {
+		return Attachment{}, ErrDocumentNotFound
+	}
+
+	blob, err := newBlobName()
+	if err != nil {
+		return Attachment{}, err
+	}
+	path := attachmentPrefix(ctx, t, id) + blob
+	info, err := ds.blobs.Write(path, r)
+	if err != nil {
+		ds.blobs.Delete(path)
+		return Attachment{}, err
+	}
+
+	att := Attachment{
+		Name:        name,
+		Size:        info.Size,
+		ContentType: contentType,
+		SHA256:      info.SHA256,
+		Created:     time.Now(),
+		Blob:        blob,
+	}
+
+	var replaced *Attachment
+	err = ds.Update(attachmentWrite(ctx), func(tx Tx) error {
+		replaced = nil
+		return ds.updateAttachments(tx, t, id, func(atts []Attachment) ([]Attachment, error) {
+			for i := range atts {
+				if atts[i].Name == name {
+					old := atts[i]
+					replaced = &old
+					atts[i] = att
+					return atts, nil
+				}
+			}
+			return append(atts, att), nil
+		})
+	})
+	if err != nil {
+		ds.blobs.Delete(path)
+		return Attachment{}, err
+	}
+
+	if replaced != nil {
+		ds.blobs.Delete(attachmentPath(ctx, t, id, *replaced))
+	}
+	return att, nil
+}
+
+// OpenAttachment returns the metadata and a seekable reader for the attachment
+func (ds *Datastore) OpenAttachment(t string, id string, name string) (Attachment, *BlobReader, error) {
+	return ds.OpenAttachmentContext(context.Background(), t, id, name)
+}
+
+func (ds *Datastore) OpenAttachmentContext(ctx context.Context, t string, id string, name string) (Attachment, *BlobReader, error) {
+	if ds.blobs == nil {
+		return Attachment{}, nil, ErrNoBlobStore
+	}
+
+	atts, err := ds.AttachmentsContext(ctx, t, id)
+	if err != nil {
+		return Attachment{}, nil, err
+	}
+	for _, att := range atts {
+		if att.Name == name {
+			r, err := ds.blobs.Open(attachmentPath(ctx, t, id, att))
+			if err == ErrBlobNotFound {
+				return Attachment{}, nil, ErrAttachmentNotFound
+			}
+			return att, r, err
+		}
+	}
+	return Attachment{}, nil, ErrAttachmentNotFound
+}
+
+func (ds *Datastore) DeleteAttachment(t string, id string, name string) error {
+	return ds.DeleteAttachmentContext(context.Background(), t, id, name)
+}
+
+// DeleteAttachmentContext removes the attachment from the document, and its blob once that has committed
+func (ds *Datastore) DeleteAttachmentContext(ctx context.Context, t string, id string, name string) error {
+	if ds.blobs == nil {
+		return ErrNoBlobStore
+	}
+
+	var removed Attachment
+	err := ds.Update(attachmentWrite(ctx), func(tx Tx) error {
+		return ds.updateAttachments(tx, t, id, func(atts []Attachment) ([]Attachment, error) {
+			kept := []Attachment{}
+			for _, att := range atts {
+				if att.Name == name {
+					removed = att
+				} else {
+					kept = append(kept, att)
+				}
+			}
+			if len(kept) == len(atts) {
+				return nil, ErrAttachmentNotFound
+			}
+			return kept, nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+	return ds.blobs.Delete(attachmentPath(ctx, t, id, removed))
+}
+
+// updateAttachments changes the attachment metadata of a document within tx
+func (ds *Datastore) updateAttachments(tx Tx, t string, id string, change func([]Attachment) ([]Attachment, error)) error {
+	doc, err := tx.Get(t, id)
+	if err != nil {
+		return err
+	}
+	if doc == nil {
+		return ErrDocumentNotFound
+	}
+	atts, err := DecodeAttachments(doc)
+	if err != nil {
+		return err
+	}
+	if atts, err = change(atts); err != nil {
+		return err
+	}
+	if doc, err = setAttachments(doc, atts); err != nil {
+		return err
+	}
+	_, err = tx.Put(t, id, doc)
+	return err
+}
+
+func DecodeAttachments(doc []byte) ([]Attachment, error) {
+	fields := map[string]json.RawMessage{}
+	if err := json.Unmarshal(doc, &fields); err != nil {
+		return nil, err
+	}
+	atts := []Attachment{}
+	if raw, ok := fields[AttachmentsField]; ok {
+		if err := json.Unmarshal(raw, &atts); err != nil {
+			return nil, err
+		}
+	}
+	return atts, nil
+}
+
+// checkAttachments keeps the attachment metadata of the stored document on doc, so whole document writes
+// don't lose it. Writes that bring their own metadata fail with ErrAttachmentsReadOnly unless it's what is
+// stored, eg. a document that was read and written back.
+func (ds *Datastore) checkAttachments(tx Tx, bucket string, id string, doc []byte) ([]byte, error) {
+	fields := map[string]json.RawMessage{}
+	if err := json.Unmarshal(doc, &fields); err != nil {
+		return doc, nil //not an object, nothing to keep
+	}
+	raw, given := fields[AttachmentsField]
+	if !given && ds.blobs == nil {
+		return doc, nil
+	}
+
+	stored := []Attachment{}
+	if id != "" {
+		old, err := tx.Get(bucket, id)
+		if err != nil {
+			return nil, err
+		}
+		if old != nil {
+			if atts, err := DecodeAttachments(old); err == nil {
+				stored = atts
+			}
+		}
+	}
+
+	if !given {
+		if len(stored) == 0 {
+			return doc, nil
+		}
+		return setAttachments(doc, stored)
+	}
+
+	atts := []Attachment{}
+	if err := json.Unmarshal(raw, &atts); err != nil {
+		return nil, ErrAttachmentsReadOnly
+	}
+	a, err := json.Marshal(atts)
+	if err != nil {
+		return nil, err
+	}
+	b, err := json.Marshal(stored)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(a, b) {
+		return nil, ErrAttachmentsReadOnly
+	}
+	return doc, nil
+}
+
+func setAttachments(doc []byte, atts []Attachment) ([]byte, error) {
+	fields := map[string]json.RawMessage{}
+	d := json.NewDecoder(bytes.NewReader(doc))
+	if err := d.Decode(&fields); err != nil {
+		return nil, err
+	}
+	raw, err := json.Marshal(atts)
+	if err != nil {
+		return nil, err
+	}
+	fields[AttachmentsField] = raw
+	return json.Marshal(fields)
+}
+
+// attachmentPath is the blob path of an attachment
+func attachmentPath(ctx context.Context, t string, id string, att Attachment) string {
+	if att.Blob == "" {
+		return attachmentPrefix(ctx, t, id) + att.Name
+	}
+	return attachmentPrefix(ctx, t, id) + att.Blob
+}
+
+// newBlobName is a random name, so uploads never write over a blob that's still referred to
+func newBlobName() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// attachmentPrefix is the blob path of the attachments of a document, tenants share the blob store
+func attachmentPrefix(ctx context.Context, t string, id string) string {
+	if tenant := TenantFrom(ctx); tenant != "" {
+		return fmt.Sprintf("%s/%s/%s/", tenant, t, id)
+	}
+	return fmt.Sprintf("%s/%s/", t, id)
+}
@@ -0,0 +1,157 @@
+package store_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/fnurk/geom/pkg/store"
+	bolt "go.etcd.io/bbolt"
+)
+
+func newAttachmentStore(t *testing.T) (*store.Datastore, *store.BlobStore) {
+	ds := store.NewDatastore(newTestBolt(t), nil)
+	blobs, err := store.NewBlobStore(filepath.Join(t.TempDir(), "blobs.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(blobs.Close)
+	ds.UseBlobStore(blobs)
+	return ds, blobs
+}
+
+func blobCount(t *testing.T, blobs *store.BlobStore) int {
+	n := 0
+	err := blobs.DB.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("blobs")).ForEach(func(k, v []byte) error {
+			n++
+			return nil
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func readAttachment(t *testing.T, ds *store.Datastore, name string) string {
+	_, r, err := ds.OpenAttachment("note", "1", name)
+	if err != nil {
+		t.Fatalf("opening %s: %v", name, err)
+	}
+	b, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestDatastore_ConcurrentAttachments(t *testing.T) {
+	ds, blobs := newAttachmentStore(t)
+	if err := ds.Init(); err != nil {
+		t.Fatal(err)
+	}
+	ds.CreateBucketIfNotExists("note")
+	ds.Put("note", "1", []byte(`{"title":"with files"}`))
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			name := fmt.Sprintf("file%d", i)
+			if _, err := ds.PutAttachment("note", "1", name, "text/plain", strings.NewReader(name)); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	atts, err := ds.Attachments("note", "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(atts) != 20 {
+		t.Errorf("expected 20 attachments, got %d", len(atts))
+	}
+	for _, att := range atts {
+		if got := readAttachment(t, ds, att.Name); got != att.Name {
+			t.Errorf("expected %s to contain its name, got %q", att.Name, got)
+		}
+	}
+	if n := blobCount(t, blobs); n != 20 {
+		t.Errorf("expected 20 blobs, got %d", n)
+	}
+}
+
+func TestDatastore_ReplaceAttachment(t *testing.T) {
+	ds, blobs := newAttachmentStore(t)
+	ds.SetQuota("note", store.Quota{MaxBytes: 1000})
+	if err := ds.Init(); err != nil {
+		t.Fatal(err)
+	}
+	ds.CreateBucketIfNotExists("note")
+	ctx := store.WithIdentity(context.Background(), "alice")
+	ds.PutContext(ctx, "note", "1", []byte(`{"title":"with files"}`))
+
+	if _, err := ds.PutAttachmentContext(ctx, "note", "1", "a.txt", "text/plain", strings.NewReader("first")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ds.PutAttachmentContext(ctx, "note", "1", "a.txt", "text/plain", strings.NewReader("second")); err != nil {
+		t.Fatal(err)
+	}
+	if got := readAttachment(t, ds, "a.txt"); got != "second" {
+		t.Errorf("expected the replaced content, got %q", got)
+	}
+	if n := blobCount(t, blobs); n != 1 {
+		t.Errorf("expected the old blob to be removed, got %d blobs", n)
+	}
+
+	//a replacement the quota rejects leaves the attachment as it was
+	_, err := ds.PutAttachmentContext(ctx, "note", "1", "a.txt", "text/plain", strings.NewReader(strings.Repeat("x", 2000)))
+	if !errors.Is(err, store.ErrQuotaExceeded) {
+		t.Fatalf("expected ErrQuotaExceeded, got %v", err)
+	}
+	if got := readAttachment(t, ds, "a.txt"); got != "second" {
+		t.Errorf("expected the attachment to be kept, got %q", got)
+	}
+	if n := blobCount(t, blobs); n != 1 {
+		t.Errorf("expected the rejected blob to be removed, got %d blobs", n)
+	}
+
+	if err := ds.DeleteAttachment("note", "1", "a.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ds.DeleteAttachment("note", "1", "a.txt"); err != store.ErrAttachmentNotFound {
+		t.Errorf("expected ErrAttachmentNotFound, got %v", err)
+	}
+	if n := blobCount(t, blobs); n != 0 {
+		t.Errorf("expected no blobs left, got %d", n)
+	}
+}
+
+func TestBlobStore_LargeWrite(t *testing.T) {
+	_, blobs := newAttachmentStore(t)
+
+	content := strings.Repeat("0123456789abcdef", 200*1024) //3.2MB, several batches
+	info, err := blobs.Write("big", strings.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size != int64(len(content)) {
+		t.Errorf("expected size %d, got %d", len(content), info.Size)
+	}
+	r, err := blobs.Open("big")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := io.ReadAll(r)
+	if string(b) != content {
+		t.Error("content differs")
+	}
+}
@@ -0,0 +1,236 @@
+package store
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const blobChunkSize = 64 * 1024
+
+// How many chunks Write commits per transaction
+const blobBatchChunks = 16
+
+var (
+	ErrBlobNotFound = errors.New("blob not found")
+)
+
+var (
+	blobMetaBucket  = []byte("blobs")
+	blobChunkBucket = []byte("chunks")
+)
+
+// BlobStore keeps binary data in fixed size chunks in its own bolt file, keyed by path
+type BlobStore struct {
+	DB *bolt.DB
+}
+
+type BlobInfo struct {
+	Size   int64
+	SHA256 string
+}
+
+func NewBlobStore(filename string) (*BlobStore, error) {
+	boltdb, err := bolt.Open(filename, 0666, nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = boltdb.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(blobMetaBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(blobChunkBucket)
+		return err
+	})
+	if err != nil {
+		boltdb.Close()
+		return nil, err
+	}
+
+	return &BlobStore{DB: boltdb}, nil
+}
+
+func (bs *BlobStore) Close() {
+	bs.DB.Close()
+}
+
+// Write replaces the blob at path with the contents of r. r is read between transactions, chunks are
+// committed blobBatchChunks at a time, so a slow reader doesn't hold up other writes. The blob can be opened
+// once it's complete, write to a new path to keep the old content readable until then.
+func (bs *BlobStore) Write(path string, r io.Reader) (BlobInfo, error) {
+	info := BlobInfo{}
+	hash := sha256.New()
+	r = io.TeeReader(r, hash)
+
+	if err := bs.Delete(path); err != nil {
+		return info, err
+	}
+
+	var next uint64
+	batch := [][]byte{}
+	flush := func() error {
+		err := bs.DB.Update(func(tx *bolt.Tx) error {
+			chunks := tx.Bucket(blobChunkBucket)
+			chunks.FillPercent = 1.0
+			for i, chunk := range batch {
+				if err := chunks.Put(chunkKey(path, next+uint64(i)), chunk); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		next += uint64(len(batch))
+		batch = batch[:0]
+		return err
+	}
+
+	for {
+		chunk := make([]byte, blobChunkSize)
+		n, err := io.ReadFull(r, chunk)
+		if n > 0 {
+			batch = append(batch, chunk[:n])
+			info.Size += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err == nil && len(batch) == blobBatchChunks {
+			err = flush()
+		}
+		if err != nil {
+			bs.Delete(path)
+			return info, err
+		}
+	}
+
+	info.SHA256 = hex.EncodeToString(hash.Sum(nil))
+	if err := flush(); err != nil {
+		bs.Delete(path)
+		return info, err
+	}
+	//the size makes the blob visible
+	err := bs.DB.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(blobMetaBucket).Put([]byte(path), itob(uint64(info.Size)))
+	})
+	if err != nil {
+		bs.Delete(path)
+	}
+	return info, err
+}
+
+func (bs *BlobStore) Delete(path string) error {
+	return bs.DB.Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket(blobMetaBucket).Delete([]byte(path)); err != nil {
+			return err
+		}
+		return deletePrefix(tx.Bucket(blobChunkBucket), chunkPrefix(path))
+	})
+}
+
+// DeletePrefix removes every blob with a path starting with prefix
+func (bs *BlobStore) DeletePrefix(prefix string) error {
+	return bs.DB.Update(func(tx *bolt.Tx) error {
+		if err := deletePrefix(tx.Bucket(blobMetaBucket), []byte(prefix)); err != nil {
+			return err
+		}
+		return deletePrefix(tx.Bucket(blobChunkBucket), []byte(prefix))
+	})
+}
+
+// Open returns a reader for the blob at path, it supports seeking so it can be used with http.ServeContent
+func (bs *BlobStore) Open(path string) (*BlobReader, error) {
+	var size int64 = -1
+	bs.DB.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket(blobMetaBucket).Get([]byte(path)); v != nil {
+			size = int64(binary.BigEndian.Uint64(v))
+		}
+		return nil
+	})
+	if size < 0 {
+		return nil, ErrBlobNotFound
+	}
+	return &BlobReader{store: bs, path: path, size: size}, nil
+}
+
+type BlobReader struct {
+	store  *BlobStore
+	path   string
+	size   int64
+	offset int64
+}
+
+func (br *BlobReader) Size() int64 {
+	return br.size
+}
+
+func (br *BlobReader) Read(p []byte) (int, error) {
+	n, err := br.ReadAt(p, br.offset)
+	br.offset += int64(n)
+	return n, err
+}
+
+func (br *BlobReader) ReadAt(p []byte, off int64) (int, error) {
+	if off >= br.size {
+		return 0, io.EOF
+	}
+	read := 0
+	err := br.store.DB.View(func(tx *bolt.Tx) error {
+		chunks := tx.Bucket(blobChunkBucket)
+		for read < len(p) && off < br.size {
+			chunk := chunks.Get(chunkKey(br.path, uint64(off/blobChunkSize)))
+			if chunk == nil {
+				return io.ErrUnexpectedEOF
+			}
+			n := copy(p[read:], chunk[off%blobChunkSize:])
+			read += n
+			off += int64(n)
+		}
+		return nil
+	})
+	if err == nil && read < len(p) {
+		err = io.EOF
+	}
+	return read, err
+}
+
+func (br *BlobReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += br.offset
+	case io.SeekEnd:
+		offset += br.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	br.offset = offset
+	return offset, nil
+}
+
+func chunkPrefix(path string) []byte {
+	return append([]byte(path), 0)
+}
+
+func chunkKey(path string, i uint64) []byte {
+	return append(chunkPrefix(path), itob(i)...)
+}
+
+func deletePrefix(b *bolt.Bucket, prefix []byte) error {
+	c := b.Cursor()
+	for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Seek(prefix) {
+		if err := c.Delete(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -1,16 +1,25 @@
 package store
 
 import (
+	"context"
 	"encoding/binary"
 	"strconv"
+	"sync"
 	"time"
 
 	bolt "go.etcd.io/bbolt"
 )
 
+// BoltDatabase has pointer receivers since online compaction swaps DB under its locks, it must be used as
+// the *BoltDatabase NewBoltDb returns. A copied BoltDatabase value no longer implements Database.
 type BoltDatabase struct {
+	// DB is replaced when the database is compacted online
 	DB           *bolt.DB
 	PeriodicDump bool
+
+	//writers hold writes for their whole transaction, Compact takes it to pause them
+	writes sync.RWMutex
+	swap   sync.RWMutex
 }
 
 func NewBoltDb(filename string) (*BoltDatabase, error) {
@@ -27,28 +36,50 @@ func NewBoltDb(filename string) (*BoltDatabase, error) {
 
 }
 
-func (db BoltDatabase) Init() error {
+func (db *BoltDatabase) Init() error {
 
 	//DUMP DATABASE TO OTHER FILE FOR VIEWING
 	if db.PeriodicDump {
-		go func(db *bolt.DB) {
+		go func() {
 			for {
 				c := time.Tick(2 * time.Second)
 				for range c {
-					db.View(func(tx *bolt.Tx) error {
+					db.view(context.Background(), func(tx *bolt.Tx) error {
 						tx.CopyFile("copy.db", 0666)
 						return nil
 					})
 				}
 			}
-		}(db.DB)
+		}()
 	}
 
 	return nil
 }
 
-func (db BoltDatabase) CreateBucketIfNotExists(bucketName string) error {
-	return db.DB.Update(func(tx *bolt.Tx) error {
+func (db *BoltDatabase) CreateBucketIfNotExists(bucketName string) error {
+	return db.CreateBucketIfNotExistsContext(context.Background(), bucketName)
+}
+
+func (db *BoltDatabase) Close() {
+	db.writes.Lock()
+	defer db.writes.Unlock()
+	db.current().Close()
+}
+
+func (db *BoltDatabase) Get(t string, id string) ([]byte, error) {
+	return db.GetContext(context.Background(), t, id)
+}
+
+func (db *BoltDatabase) Put(t string, id string, data []byte) (string, error) {
+	return db.PutContext(context.Background(), t, id, data)
+}
+
+func (db *BoltDatabase) Delete(t string, id string) error {
+	return db.DeleteContext(context.Background(), t, id)
+}
+
+func (db *BoltDatabase) CreateBucketIfNotExistsContext(ctx context.Context, bucketName string) error {
+	return db.update(ctx, func(tx *bolt.Tx) error {
 		_, err := tx.CreateBucketIfNotExists([]byte(bucketName))
 		if err != nil {
 			return err
@@ -57,70 +88,275 @@ func (db BoltDatabase) CreateBucketIfNotExists(bucketName string) error {
 	})
 }
 
-func (db BoltDatabase) Close() {
-	db.DB.Close()
+func (db *BoltDatabase) GetContext(ctx context.Context, t string, id string) ([]byte, error) {
+	var v []byte
+	err := db.View(ctx, func(tx Tx) error {
+		var err error
+		v, err = tx.Get(t, id)
+		return err
+	})
+	return v, err
 }
 
-func (db BoltDatabase) Get(t string, id string) ([]byte, error) {
-	var vCopy []byte
+func (db *BoltDatabase) PutContext(ctx context.Context, t string, id string, data []byte) (string, error) {
+	err := db.Update(ctx, func(tx Tx) error {
+		var err error
+		id, err = tx.Put(t, id, data)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	return id, nil
+}
 
-	db.DB.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(t))
-		v := b.Get(strtob(id))
+func (db *BoltDatabase) DeleteContext(ctx context.Context, t string, id string) error {
+	return db.Update(ctx, func(tx Tx) error {
+		return tx.Delete(t, id)
+	})
+}
 
-		if v != nil {
-			vCopy = make([]byte, len(v))
-			copy(vCopy, v)
-		}
+func (db *BoltDatabase) View(ctx context.Context, fn func(Tx) error) error {
+	return db.view(ctx, func(tx *bolt.Tx) error {
+		return fn(boltTx{tx: tx})
+	})
+}
 
-		return nil
+func (db *BoltDatabase) Update(ctx context.Context, fn func(Tx) error) error {
+	return db.update(ctx, func(tx *bolt.Tx) error {
+		return fn(boltTx{tx: tx})
 	})
+}
+
+// Stats implements StatsProvider
+func (db *BoltDatabase) Stats() (DatabaseStats, error) {
+	bdb := db.current()
+	dbStats := bdb.Stats()
+	txStats := dbStats.TxStats
 
-	if vCopy == nil {
+	stats := DatabaseStats{
+		Buckets:       map[string]BucketStats{},
+		PageSize:      bdb.Info().PageSize,
+		FreePages:     dbStats.FreePageN,
+		PendingPages:  dbStats.PendingPageN,
+		FreeBytes:     dbStats.FreeAlloc,
+		FreelistInuse: dbStats.FreelistInuse,
+		Tx: TxStats{
+			Started:       dbStats.TxN,
+			Open:          dbStats.OpenTxN,
+			PageCount:     txStats.GetPageCount(),
+			PageAlloc:     txStats.GetPageAlloc(),
+			Cursors:       txStats.GetCursorCount(),
+			Nodes:         txStats.GetNodeCount(),
+			Rebalances:    txStats.GetRebalance(),
+			RebalanceTime: txStats.GetRebalanceTime(),
+			Splits:        txStats.GetSplit(),
+			Spills:        txStats.GetSpill(),
+			SpillTime:     txStats.GetSpillTime(),
+			Writes:        txStats.GetWrite(),
+			WriteTime:     txStats.GetWriteTime(),
+		},
+	}
+
+	if size, err := fileSize(bdb.Path()); err == nil {
+		stats.FileSize = size
+	}
+
+	err := bdb.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+			bs := b.Stats()
+			stats.Buckets[string(name)] = BucketStats{
+				Keys:  bs.KeyN,
+				Bytes: int64(bs.LeafInuse + bs.BranchInuse + bs.InlineBucketInuse), //small buckets are inlined in their parent page
+				Pages: bs.LeafPageN + bs.LeafOverflowN + bs.BranchPageN + bs.BranchOverflowN,
+				Depth: bs.Depth,
+			}
+			return nil
+		})
+	})
+
+	return stats, err
+}
+
+type boltTx struct {
+	tx *bolt.Tx
+}
+
+func (btx boltTx) Get(t string, id string) ([]byte, error) {
+	b := btx.tx.Bucket([]byte(t))
+	if b == nil {
 		return nil, nil
 	}
 
+	v := b.Get(strtob(id))
+	if v == nil {
+		return nil, nil
+	}
+
+	//bolt values are only valid for the life of the transaction
+	vCopy := make([]byte, len(v))
+	copy(vCopy, v)
 	return vCopy, nil
 }
 
-func (db BoltDatabase) Put(t string, id string, data []byte) (string, error) {
-	retId := id
+func (btx boltTx) Put(t string, id string, data []byte) (string, error) {
+	b := btx.tx.Bucket([]byte(t))
+	if b == nil {
+		return "", ErrBucketNotFound
+	}
+
+	var bid []byte
+
+	if id == "" { //id empty? autoincrement
+		i, err := b.NextSequence()
+		if err != nil {
+			return "", err
+		}
+		id = strconv.FormatUint(i, 10)
+		bid = itob(i)
+	} else {
+		bid = strtob(id)
+	}
+
+	if err := b.Put(bid, data); err != nil {
+		return "", err
+	}
+	return id, nil
+}
 
-	db.DB.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(t))
+func (btx boltTx) ForEach(t string, fn func(id string, data []byte) error) error {
+	return btx.ForEachFrom(t, "", fn)
+}
 
-		var bid []byte
+func (btx boltTx) ForEachFrom(t string, id string, fn func(id string, data []byte) error) error {
+	b := btx.tx.Bucket([]byte(t))
+	if b == nil {
+		return ErrBucketNotFound
+	}
+	c := b.Cursor()
+	for k, v := c.Seek(strtob(id)); k != nil; k, v = c.Next() {
+		if len(k) != 8 || v == nil { //not a document
+			continue
+		}
+		vCopy := make([]byte, len(v))
+		copy(vCopy, v)
+		if err := fn(btos(k), vCopy); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-		if id == "" { //id empty? autoincrement
-			i, _ := b.NextSequence()
-			retId = id
-			bid = itob(i)
-		} else {
-			retId = id
-			bid = strtob(id)
+func (btx boltTx) Last(t string) (string, error) {
+	b := btx.tx.Bucket([]byte(t))
+	if b == nil {
+		return "", ErrBucketNotFound
+	}
+	c := b.Cursor()
+	for k, v := c.Last(); k != nil; k, v = c.Prev() {
+		if len(k) == 8 && v != nil {
+			return btos(k), nil
 		}
+	}
+	return "", nil
+}
 
-		err := b.Put(bid, []byte(data))
-		if err != nil {
+func (btx boltTx) GetKey(t string, key []byte) ([]byte, error) {
+	b := btx.tx.Bucket([]byte(t))
+	if b == nil {
+		return nil, nil
+	}
+	v := b.Get(key)
+	if v == nil {
+		return nil, nil
+	}
+	vCopy := make([]byte, len(v))
+	copy(vCopy, v)
+	return vCopy, nil
+}
+
+func (btx boltTx) PutKey(t string, key []byte, value []byte) error {
+	b := btx.tx.Bucket([]byte(t))
+	if b == nil {
+		return ErrBucketNotFound
+	}
+	return b.Put(key, value)
+}
+
+func (btx boltTx) DeleteKey(t string, key []byte) error {
+	b := btx.tx.Bucket([]byte(t))
+	if b == nil {
+		return ErrBucketNotFound
+	}
+	return b.Delete(key)
+}
+
+func (btx boltTx) ForEachKeyFrom(t string, from []byte, fn func(key []byte, value []byte) error) error {
+	b := btx.tx.Bucket([]byte(t))
+	if b == nil {
+		return ErrBucketNotFound
+	}
+	c := b.Cursor()
+	for k, v := c.Seek(from); k != nil; k, v = c.Next() {
+		if v == nil { //nested bucket
+			continue
+		}
+		kCopy := make([]byte, len(k))
+		copy(kCopy, k)
+		vCopy := make([]byte, len(v))
+		copy(vCopy, v)
+		if err := fn(kCopy, vCopy); err != nil {
 			return err
 		}
+	}
+	return nil
+}
 
-		return nil
-	})
+func (btx boltTx) Delete(t string, id string) error {
+	b := btx.tx.Bucket([]byte(t))
+	if b == nil {
+		return ErrBucketNotFound
+	}
+	return b.Delete(strtob(id))
+}
 
-	return retId, nil
+func (db *BoltDatabase) view(ctx context.Context, fn func(*bolt.Tx) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	for {
+		bdb := db.current()
+		err := bdb.View(fn)
+		if err == bolt.ErrDatabaseNotOpen && db.current() != bdb {
+			continue //compacted while starting the transaction, retry on the new file
+		}
+		return err
+	}
 }
 
-func (db BoltDatabase) Delete(t string, id string) error {
-	db.DB.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(t))
-		err := b.Delete([]byte(id))
-		if err != nil {
+// update runs fn in a write transaction. A transaction that gets the write lock after ctx is done rolls
+// back right away instead of holding it, once fn has started it runs to completion so the caller always
+// learns whether it committed. Writes are paused while the database is being compacted.
+func (db *BoltDatabase) update(ctx context.Context, fn func(*bolt.Tx) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	db.writes.RLock()
+	defer db.writes.RUnlock()
+
+	return db.current().Update(func(tx *bolt.Tx) error {
+		if err := ctx.Err(); err != nil {
 			return err
 		}
-		return nil
+		return fn(tx)
 	})
-	return nil
+}
+
+func (db *BoltDatabase) current() *bolt.DB {
+	db.swap.RLock()
+	defer db.swap.RUnlock()
+	return db.DB
 }
 
 func strtob(v string) []byte {
@@ -128,6 +364,10 @@ func strtob(v string) []byte {
 	return itob(uint64(i))
 }
 
+func btos(b []byte) string {
+	return strconv.FormatUint(binary.BigEndian.Uint64(b), 10)
+}
+
 func itob(v uint64) []byte {
 	b := make([]byte, 8)
 	binary.BigEndian.PutUint64(b, uint64(v))
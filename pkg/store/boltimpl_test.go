@@ -0,0 +1,96 @@
+package store_test
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fnurk/geom/pkg/store"
+	bolt "go.etcd.io/bbolt"
+)
+
+func newTestBolt(t *testing.T) *store.BoltDatabase {
+	db, err := store.NewBoltDb(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.PeriodicDump = false
+	t.Cleanup(db.Close)
+	return db
+}
+
+func TestBolt_PutAutoincrement(t *testing.T) {
+	db := newTestBolt(t)
+	db.CreateBucketIfNotExists("doc")
+
+	id, err := db.Put("doc", "", []byte("a"))
+	if err != nil || id != "1" {
+		t.Fatalf("expected id 1, got %q %v", id, err)
+	}
+
+	db.Delete("doc", id)
+	if v, _ := db.Get("doc", id); v != nil {
+		t.Errorf("expected deleted doc, got %s", v)
+	}
+}
+
+func TestBolt_CancelledWriteRollsBack(t *testing.T) {
+	db := newTestBolt(t)
+	db.CreateBucketIfNotExists("doc")
+
+	// hold the write lock
+	tx, err := db.DB.Begin(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	done := make(chan error)
+	go func() {
+		_, err := db.PutContext(store.WithIdentity(ctx, "someone"), "doc", "1", []byte("a"))
+		done <- err
+	}()
+
+	<-ctx.Done()
+	tx.Rollback()
+
+	// the write got the lock after its context was done, so it must not have been applied
+	if err := <-done; err != context.DeadlineExceeded {
+		t.Errorf("expected deadline exceeded, got %v", err)
+	}
+	db.DB.View(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte("doc")).Stats().KeyN != 0 {
+			t.Error("expected the cancelled write to roll back")
+		}
+		return nil
+	})
+
+	if _, err := db.Put("doc", "1", []byte("a")); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDatastore_Stats(t *testing.T) {
+	ds := store.NewDatastore(newTestBolt(t), nil)
+	ds.CreateBucketIfNotExists("doc")
+	for i := 0; i < 100; i++ {
+		ds.Put("doc", "", []byte(`{"body":"some text"}`))
+	}
+
+	stats, err := ds.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc := stats.Documents["doc"]
+	if doc.Keys != 100 || doc.Bytes < 100*20 || stats.FileSize == 0 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+
+	alerts := store.CheckLimits(stats, store.Stats{}, map[string]store.BucketLimit{"doc": {MaxKeys: 50}})
+	if len(alerts) != 1 || alerts[0].Bucket != "doc" {
+		t.Errorf("expected an alert, got %+v", alerts)
+	}
+}
@@ -0,0 +1,143 @@
+package store
+
+import (
+	"context"
+	"errors"
+)
+
+var (
+	ErrRolledBack = errors.New("rolled back")
+)
+
+type BulkMode int
+
+const (
+	// Every item is written or none is, the first failing item rolls back the whole batch
+	AllOrNothing BulkMode = iota
+	// Failing items are skipped and the rest are written. An item that fails once it's written, eg. in a
+	// view or an aggregate, can't be taken out and rolls back the batch like AllOrNothing does.
+	BestEffort
+)
+
+type BulkItem struct {
+	//empty id on a put -> autoincrement
+	Id     string
+	Data   []byte
+	Delete bool
+}
+
+type BulkResult struct {
+	Id    string
+	Data  []byte
+	Error error
+}
+
+type BulkOptions struct {
+	Mode BulkMode
+	// Check runs inside the transaction with the stored document(nil if there is none), an error fails the item
+	Check func(i int, item BulkItem, current []byte) error
+}
+
+// Bulk writes all items to bucket in a single transaction and returns one result per item, in order.
+// The returned error is only set when nothing was written.
+func (ds *Datastore) Bulk(ctx context.Context, bucket string, items []BulkItem, opts BulkOptions) ([]BulkResult, error) {
+	results := make([]BulkResult, len(items))
+
+	err := ds.Update(ctx, func(tx Tx) error {
+		for i, item := range items {
+			results[i] = BulkResult{Id: item.Id}
+
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+
+			err := bulkWrite(tx, bucket, i, item, opts, &results[i])
+			if err == nil {
+				continue
+			}
+
+			results[i].Error = err
+			var written *writtenError
+			if opts.Mode == AllOrNothing || errors.As(err, &written) {
+				return err
+			}
+		}
+		return nil
+	})
+
+	if err != nil {
+		for i := range results {
+			if results[i].Error == nil {
+				results[i].Error = ErrRolledBack
+			}
+		}
+		return results, err
+	}
+
+	return results, nil
+}
+
+func (ds *Datastore) PutMany(ctx context.Context, bucket string, items []BulkItem, opts BulkOptions) ([]BulkResult, error) {
+	for i := range items {
+		items[i].Delete = false
+	}
+	return ds.Bulk(ctx, bucket, items, opts)
+}
+
+func (ds *Datastore) DeleteMany(ctx context.Context, bucket string, ids []string, opts BulkOptions) ([]BulkResult, error) {
+	items := make([]BulkItem, len(ids))
+	for i, id := range ids {
+		items[i] = BulkItem{Id: id, Delete: true}
+	}
+	return ds.Bulk(ctx, bucket, items, opts)
+}
+
+// GetMany reads all ids in one transaction, missing documents get ErrDocumentNotFound
+func (ds *Datastore) GetMany(ctx context.Context, bucket string, ids []string) ([]BulkResult, error) {
+	results := make([]BulkResult, len(ids))
+
+	err := ds.View(ctx, func(tx Tx) error {
+		for i, id := range ids {
+			doc, err := tx.Get(bucket, id)
+			if err == nil && doc == nil {
+				err = ErrDocumentNotFound
+			}
+			results[i] = BulkResult{Id: id, Data: doc, Error: err}
+		}
+		return nil
+	})
+
+	return results, err
+}
+
+func bulkWrite(tx Tx, bucket string, i int, item BulkItem, opts BulkOptions, result *BulkResult) error {
+	var current []byte
+	if item.Id != "" {
+		var err error
+		current, err = tx.Get(bucket, item.Id)
+		if err != nil {
+			return err
+		}
+	}
+
+	if item.Delete && current == nil {
+		return ErrDocumentNotFound
+	}
+
+	if opts.Check != nil {
+		if err := opts.Check(i, item, current); err != nil {
+			return err
+		}
+	}
+
+	if item.Delete {
+		return tx.Delete(bucket, item.Id)
+	}
+
+	id, err := tx.Put(bucket, item.Id, item.Data)
+	if err != nil {
+		return err
+	}
+	result.Id = id
+	return nil
+}
@@ -0,0 +1,152 @@
+package store_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/fnurk/geom/pkg/model"
+	"github.com/fnurk/geom/pkg/store"
+)
+
+type bulkDoc struct {
+	Body string `json:"body"`
+}
+
+func newTestDatastore(t *testing.T) *store.Datastore {
+	model.RegisterType("bulk", bulkDoc{})
+	ds := store.NewDatastore(newTestBolt(t), store.NewInMemKV())
+	if err := ds.Init(); err != nil {
+		t.Fatal(err)
+	}
+	return ds
+}
+
+func TestDatastore_BulkModes(t *testing.T) {
+	ds := newTestDatastore(t)
+	ctx := context.Background()
+	denied := errors.New("denied")
+
+	items := []store.BulkItem{
+		{Data: []byte(`{"body":"a"}`)},
+		{Data: []byte(`{"body":"b"}`)},
+		{Data: []byte(`{"body":"c"}`)},
+	}
+	check := store.BulkOptions{
+		Check: func(i int, item store.BulkItem, current []byte) error {
+			if i == 1 {
+				return denied
+			}
+			return nil
+		},
+	}
+
+	results, err := ds.PutMany(ctx, "bulk", items, check)
+	if err != denied {
+		t.Fatalf("expected atomic bulk to fail, got %v", err)
+	}
+	if results[0].Error != store.ErrRolledBack || results[1].Error != denied {
+		t.Errorf("unexpected results %+v", results)
+	}
+
+	check.Mode = store.BestEffort
+	results, err = ds.PutMany(ctx, "bulk", items, check)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results[0].Id != "1" || results[1].Error != denied || results[2].Id != "2" {
+		t.Errorf("unexpected results %+v", results)
+	}
+
+	got, _ := ds.GetMany(ctx, "bulk", []string{"1", "2", "3"})
+	if string(got[1].Data) != `{"body":"c"}` || got[2].Error != store.ErrDocumentNotFound {
+		t.Errorf("unexpected get results %+v", got)
+	}
+
+	results, _ = ds.DeleteMany(ctx, "bulk", []string{"1", "3"}, store.BulkOptions{Mode: store.BestEffort})
+	if results[0].Error != nil || results[1].Error != store.ErrDocumentNotFound {
+		t.Errorf("unexpected delete results %+v", results)
+	}
+}
+
+// An item that fails after it was written can't be skipped, the batch is rolled back
+func TestDatastore_BulkFailsAfterWrite(t *testing.T) {
+	model.RegisterType("bulk", bulkDoc{})
+	ds := store.NewDatastore(newTestBolt(t), store.NewInMemKV())
+	ds.AddView("bodies", store.View{Types: []string{"bulk"}, Map: func(t string, id string, doc map[string]interface{}) []store.ViewEntry {
+		if doc["body"] == "bad" {
+			return []store.ViewEntry{{Key: []interface{}{map[string]interface{}{}}}}
+		}
+		return []store.ViewEntry{{Key: []interface{}{doc["body"]}}}
+	}})
+	published := 0
+	ds.AddPutContextHook(func(ctx context.Context, t string, id string, value []byte) {
+		published++
+	})
+	if err := ds.Init(); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	items := []store.BulkItem{
+		{Data: []byte(`{"body":"a"}`)},
+		{Data: []byte(`{"body":"bad"}`)},
+		{Data: []byte(`{"body":"c"}`)},
+	}
+	results, err := ds.PutMany(ctx, "bulk", items, store.BulkOptions{Mode: store.BestEffort})
+	if !errors.Is(err, store.ErrViewKey) {
+		t.Fatalf("expected the batch to fail with the view's error, got %v", err)
+	}
+	if results[0].Error != store.ErrRolledBack || !errors.Is(results[1].Error, store.ErrViewKey) || results[2].Error != store.ErrRolledBack {
+		t.Errorf("unexpected results %+v", results)
+	}
+
+	got, _ := ds.GetMany(ctx, "bulk", []string{"1", "2"})
+	if got[0].Error != store.ErrDocumentNotFound || got[1].Error != store.ErrDocumentNotFound {
+		t.Errorf("expected nothing written, got %+v", got)
+	}
+	if rows, err := ds.QueryView(ctx, "bodies", store.ViewQuery{}); err != nil || len(rows) != 0 {
+		t.Errorf("expected no view rows, got %v %v", rows, err)
+	}
+	if published != 0 {
+		t.Errorf("expected no hooks to run, got %d", published)
+	}
+}
+
+// plainDatabase and plainCache only have the methods of store.Database and store.Cache
+type plainDatabase struct{ store.Database }
+type plainCache struct{ store.Cache }
+
+func TestDatastore_PlainDatabase(t *testing.T) {
+	ds := store.NewDatastore(plainDatabase{store.NewInMemDatabase()}, plainCache{store.NewInMemKV()})
+	ds.CacheType("doc", store.CachePolicy{})
+	if err := ds.Init(); err != nil {
+		t.Fatal(err)
+	}
+	ds.CreateBucketIfNotExists("doc")
+	ctx := context.Background()
+
+	id, err := ds.PutContext(ctx, "doc", "", []byte("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, err := ds.GetContext(ctx, "doc", id); err != nil || string(v) != "a" {
+		t.Errorf("expected a, got %q %v", v, err)
+	}
+	if _, err := ds.PutContext(ctx, "doc", id, []byte("b")); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := ds.GetContext(ctx, "doc", id); string(v) != "b" {
+		t.Errorf("expected the cached copy to be invalidated, got %q", v)
+	}
+
+	err = ds.View(ctx, func(tx store.Tx) error {
+		return tx.ForEach("doc", func(id string, data []byte) error { return nil })
+	})
+	if err != store.ErrNoTransactions {
+		t.Errorf("expected ErrNoTransactions iterating, got %v", err)
+	}
+	if err := ds.DeleteContext(ctx, "doc", id); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,188 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// Committed writes are recorded here, in commit order, when the change log is enabled
+const ChangesBucket = "_changes"
+
+var (
+	ErrReadOnly = errors.New("datastore is read only")
+)
+
+type Change struct {
+	Seq     uint64 `json:"seq"`
+	Bucket  string `json:"bucket"`
+	Id      string `json:"id"`
+	Data    []byte `json:"data,omitempty"`
+	Deleted bool   `json:"deleted,omitempty"`
+}
+
+type replicaKey struct{}
+
+// ReplicaContext marks writes that come from replication, they are allowed on a read only Datastore
+func ReplicaContext(ctx context.Context) context.Context {
+	return context.WithValue(ctx, replicaKey{}, true)
+}
+
+func isReplicaWrite(ctx context.Context) bool {
+	replica, _ := ctx.Value(replicaKey{}).(bool)
+	return replica
+}
+
+// EnableChangeLog records every committed write to a document bucket, call it before Init
+func (ds *Datastore) EnableChangeLog() {
+	ds.changeLog = true
+}
+
+// SetReadOnly makes every write fail with ErrReadOnly, except the ones made with ReplicaContext
+func (ds *Datastore) SetReadOnly(readOnly bool) {
+	ds.readOnly = readOnly
+}
+
+// Internal buckets start with an underscore and are not part of the change log or snapshots
+func IsInternalBucket(bucket string) bool {
+	return strings.HasPrefix(bucket, "_") || bucket == IndexBucket
+}
+
+// Changes returns up to limit changes with a sequence number after since
+func (ds *Datastore) Changes(ctx context.Context, since uint64, limit int) ([]Change, error) {
+	changes := []Change{}
+	stop := errors.New("stop")
+
+	err := ds.View(ctx, func(tx Tx) error {
+		return tx.ForEachFrom(ChangesBucket, strconv.FormatUint(since+1, 10), func(id string, data []byte) error {
+			if len(changes) >= limit {
+				return stop
+			}
+			c := Change{}
+			if err := json.Unmarshal(data, &c); err != nil {
+				return err
+			}
+			c.Seq, _ = strconv.ParseUint(id, 10, 64)
+			changes = append(changes, c)
+			return nil
+		})
+	})
+	if err == stop {
+		err = nil
+	}
+	return changes, err
+}
+
+// LastChange returns the sequence number of the latest change, 0 if there is none
+func (ds *Datastore) LastChange(ctx context.Context) (uint64, error) {
+	var last uint64
+	err := ds.View(ctx, func(tx Tx) error {
+		return lastChange(tx, &last)
+	})
+	return last, err
+}
+
+// FirstChange returns the sequence number of the oldest change still kept, 0 if there is none
+func (ds *Datastore) FirstChange(ctx context.Context) (uint64, error) {
+	var first uint64
+	stop := errors.New("stop")
+	err := ds.View(ctx, func(tx Tx) error {
+		return tx.ForEach(ChangesBucket, func(id string, data []byte) error {
+			first, _ = strconv.ParseUint(id, 10, 64)
+			return stop
+		})
+	})
+	if err == stop {
+		err = nil
+	}
+	return first, err
+}
+
+// TrimChanges removes all but the latest keep changes, the latest one is always kept
+func (ds *Datastore) TrimChanges(ctx context.Context, keep int) error {
+	if keep < 1 {
+		keep = 1
+	}
+	stop := errors.New("stop")
+	return UpdateTx(ctx, ds.db, func(tx Tx) error {
+		var last uint64
+		if err := lastChange(tx, &last); err != nil {
+			return err
+		}
+		if last <= uint64(keep) {
+			return nil
+		}
+
+		//sequence numbers have no gaps, so only the oldest ones are visited
+		cutoff := last - uint64(keep)
+		ids := []string{}
+		err := tx.ForEach(ChangesBucket, func(id string, data []byte) error {
+			if seq, _ := strconv.ParseUint(id, 10, 64); seq > cutoff {
+				return stop
+			}
+			ids = append(ids, id)
+			return nil
+		})
+		if err != nil && err != stop {
+			return err
+		}
+		for _, id := range ids {
+			if err := tx.Delete(ChangesBucket, id); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// SnapshotContext calls fn for every document in every non internal bucket, from a single read transaction.
+// It returns the sequence number of the last change included in the snapshot.
+func (ds *Datastore) SnapshotContext(ctx context.Context, fn func(bucket string, id string, data []byte) error) (uint64, error) {
+	var last uint64
+	err := ds.View(ctx, func(tx Tx) error {
+		if ds.changeLog {
+			if err := lastChange(tx, &last); err != nil {
+				return err
+			}
+		}
+		for _, bucket := range ds.Buckets() {
+			if IsInternalBucket(bucket) {
+				continue
+			}
+			err := tx.ForEach(bucket, func(id string, data []byte) error {
+				if err := ctx.Err(); err != nil {
+					return err
+				}
+				return fn(bucket, id, data)
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return last, err
+}
+
+func lastChange(tx Tx, last *uint64) error {
+	id, err := tx.Last(ChangesBucket)
+	if err != nil || id == "" {
+		return err
+	}
+	*last, err = strconv.ParseUint(id, 10, 64)
+	return err
+}
+
+func (ds *Datastore) logChange(tx Tx, c Change) error {
+	if !ds.changeLog || IsInternalBucket(c.Bucket) {
+		return nil
+	}
+	data, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Put(ChangesBucket, "", data)
+	return err
+}
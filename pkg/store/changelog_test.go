@@ -0,0 +1,44 @@
+package store_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/fnurk/geom/pkg/store"
+)
+
+func TestDatastore_TrimChanges(t *testing.T) {
+	for name, db := range map[string]store.Database{"bolt": newTestBolt(t), "inmem": store.NewInMemDatabase()} {
+		t.Run(name, func(t *testing.T) {
+			ds := store.NewDatastore(db, nil)
+			ds.EnableChangeLog()
+			if err := ds.Init(); err != nil {
+				t.Fatal(err)
+			}
+			ds.CreateBucketIfNotExists("doc")
+			ctx := context.Background()
+
+			if last, err := ds.LastChange(ctx); err != nil || last != 0 {
+				t.Errorf("expected no changes, got %d %v", last, err)
+			}
+			for i := 0; i < 10; i++ {
+				ds.Put("doc", "1", []byte("x"))
+			}
+			if err := ds.TrimChanges(ctx, 3); err != nil {
+				t.Fatal(err)
+			}
+
+			first, _ := ds.FirstChange(ctx)
+			last, _ := ds.LastChange(ctx)
+			if first != 8 || last != 10 {
+				t.Errorf("expected changes 8 to 10, got %d to %d", first, last)
+			}
+			if err := ds.TrimChanges(ctx, 5); err != nil {
+				t.Fatal(err)
+			}
+			if first, _ := ds.FirstChange(ctx); first != 8 {
+				t.Errorf("expected nothing more to be trimmed, got first %d", first)
+			}
+		})
+	}
+}
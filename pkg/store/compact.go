@@ -0,0 +1,152 @@
+package store
+
+import (
+	"errors"
+	"os"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Copies are committed in transactions of at most this many bytes to bound memory use
+const compactTxMaxSize = 64 << 20
+
+var ErrCompactNotSupported = errors.New("database does not support compaction")
+
+// Compacter is implemented by databases that can give unused space back to the file system
+type Compacter interface {
+	Compact() (CompactResult, error)
+}
+
+type CompactResult struct {
+	SizeBefore int64         `json:"sizeBefore"`
+	SizeAfter  int64         `json:"sizeAfter"`
+	Reclaimed  int64         `json:"reclaimed"`
+	Duration   time.Duration `json:"duration"`
+}
+
+// Compact copies the live data into a fresh file and swaps it in, see BoltDatabase.Compact
+func (ds *Datastore) Compact() (CompactResult, error) {
+	c, ok := ds.db.(Compacter)
+	if !ok {
+		return CompactResult{}, ErrCompactNotSupported
+	}
+	return c.Compact()
+}
+
+// Compact copies the live data into a fresh file and atomically renames it over the database file.
+// Writes wait while the data is copied, reads continue on the old file until the new one is in place.
+func (db *BoltDatabase) Compact() (CompactResult, error) {
+	db.writes.Lock()
+	defer db.writes.Unlock()
+
+	start := time.Now()
+	old := db.current()
+	path := old.Path()
+
+	before, err := fileSize(path)
+	if err != nil {
+		return CompactResult{}, err
+	}
+
+	tmp := path + ".compact"
+	if err := compactInto(tmp, old); err != nil {
+		return CompactResult{}, err
+	}
+
+	//keep a link to the old file so it can be put back if the new one can't be opened
+	backup := path + ".old"
+	os.Remove(backup)
+	if err := os.Link(path, backup); err != nil {
+		os.Remove(tmp)
+		return CompactResult{}, err
+	}
+	defer os.Remove(backup)
+
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return CompactResult{}, err
+	}
+
+	fresh, err := bolt.Open(path, 0666, nil)
+	if err != nil {
+		os.Rename(backup, path)
+		return CompactResult{}, err
+	}
+
+	db.swap.Lock()
+	db.DB = fresh
+	db.swap.Unlock()
+
+	//waits for reads that are still running on the old file
+	old.Close()
+
+	return compactResult(before, path, start)
+}
+
+// CompactFile compacts a database file that no server has open, it fails if the file stays locked for timeout
+func CompactFile(path string, timeout time.Duration) (CompactResult, error) {
+	start := time.Now()
+
+	before, err := fileSize(path)
+	if err != nil {
+		return CompactResult{}, err
+	}
+
+	src, err := bolt.Open(path, 0666, &bolt.Options{Timeout: timeout})
+	if err != nil {
+		return CompactResult{}, err
+	}
+	defer src.Close()
+
+	tmp := path + ".compact"
+	if err := compactInto(tmp, src); err != nil {
+		return CompactResult{}, err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return CompactResult{}, err
+	}
+
+	return compactResult(before, path, start)
+}
+
+// compactInto writes the live data of src to a new file at path, the file is synced and closed when it returns
+func compactInto(path string, src *bolt.DB) error {
+	os.Remove(path) //left over from an interrupted compaction
+
+	dst, err := bolt.Open(path, 0666, nil)
+	if err != nil {
+		return err
+	}
+
+	err = bolt.Compact(dst, src, compactTxMaxSize)
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(path)
+	}
+	return err
+}
+
+func compactResult(before int64, path string, start time.Time) (CompactResult, error) {
+	after, err := fileSize(path)
+	if err != nil {
+		return CompactResult{}, err
+	}
+	return CompactResult{
+		SizeBefore: before,
+		SizeAfter:  after,
+		Reclaimed:  before - after,
+		Duration:   time.Since(start),
+	}, nil
+}
+
+func fileSize(path string) (int64, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
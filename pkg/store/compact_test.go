@@ -0,0 +1,126 @@
+package store_test
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fnurk/geom/pkg/store"
+)
+
+func fillAndPurge(t *testing.T, db store.Database) {
+	db.CreateBucketIfNotExists("doc")
+	body := bytes.Repeat([]byte("x"), 1024)
+	for i := 0; i < 2000; i++ {
+		if _, err := db.Put("doc", "", body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 1; i <= 2000; i++ {
+		if i%100 != 0 {
+			db.Delete("doc", fmt.Sprint(i))
+		}
+	}
+}
+
+func TestBolt_Compact(t *testing.T) {
+	db := newTestBolt(t)
+	fillAndPurge(t, db)
+
+	res, err := db.Compact()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Reclaimed <= 0 || res.SizeAfter >= res.SizeBefore {
+		t.Errorf("nothing reclaimed: %+v", res)
+	}
+
+	v, err := db.Get("doc", "100")
+	if err != nil || len(v) != 1024 {
+		t.Errorf("lost document: %d bytes, %v", len(v), err)
+	}
+	if v, _ := db.Get("doc", "1"); v != nil {
+		t.Error("deleted document came back")
+	}
+
+	//the sequence survives so new ids don't collide
+	id, err := db.Put("doc", "", []byte("new"))
+	if err != nil || id != "2001" {
+		t.Errorf("expected id 2001, got %q %v", id, err)
+	}
+}
+
+func TestBolt_CompactWhileWriting(t *testing.T) {
+	db := newTestBolt(t)
+	fillAndPurge(t, db)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 200)
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				id := fmt.Sprint(10000 + i*100 + j)
+				if _, err := db.Put("doc", id, []byte("w")); err != nil {
+					errs <- err
+				}
+				if _, err := db.Get("doc", "100"); err != nil {
+					errs <- err
+				}
+			}
+		}(i)
+	}
+
+	if _, err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	for i := 0; i < 4; i++ {
+		for j := 0; j < 50; j++ {
+			if v, _ := db.Get("doc", fmt.Sprint(10000+i*100+j)); v == nil {
+				t.Fatalf("write %d/%d lost", i, j)
+			}
+		}
+	}
+}
+
+func TestCompactFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db, err := store.NewBoltDb(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fillAndPurge(t, db)
+
+	//the file is locked while it's open
+	if _, err := store.CompactFile(path, 10*time.Millisecond); err == nil {
+		t.Error("compacted a file that is in use")
+	}
+	db.Close()
+
+	res, err := store.CompactFile(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Reclaimed <= 0 {
+		t.Errorf("nothing reclaimed: %+v", res)
+	}
+
+	db, err = store.NewBoltDb(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if v, _ := db.Get("doc", "2000"); len(v) != 1024 {
+		t.Error("lost document")
+	}
+}
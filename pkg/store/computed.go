@@ -0,0 +1,275 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/fnurk/geom/pkg/model"
+)
+
+type AggregateOp int
+
+const (
+	// Count the referencing documents
+	AggregateCount AggregateOp = iota
+	// Sum a numeric field of the referencing documents, other values count as 0
+	AggregateSum
+)
+
+// ReferenceAggregate is computed from the documents of type From whose Ref field holds the id of the document
+type ReferenceAggregate struct {
+	Op    AggregateOp
+	From  string
+	Ref   string
+	Field string
+}
+
+// ComputedField is maintained by the Datastore, values written by clients are replaced. Set either Func or Aggregate.
+// Func runs on every write of the document, an aggregate is updated in the transaction that writes a referencing document.
+type ComputedField struct {
+	// Path of the field, see model.Lookup
+	Field string
+	// Func gets the document being written with the aggregates and the computed fields declared before it set
+	Func      func(doc map[string]interface{}) (interface{}, error)
+	Aggregate *ReferenceAggregate
+}
+
+type aggregateTarget struct {
+	t     string
+	field ComputedField
+}
+
+// AddComputedField declares a computed field on type t, call it before Init.
+// Existing documents keep their values until Recompute is run.
+func (ds *Datastore) AddComputedField(t string, field ComputedField) {
+	ds.computed[t] = append(ds.computed[t], field)
+	if field.Aggregate != nil {
+		ds.aggregates[field.Aggregate.From] = append(ds.aggregates[field.Aggregate.From], aggregateTarget{t: t, field: field})
+	}
+}
+
+// Recompute rewrites the computed fields of every document of type t in a single transaction, run it after
+// changing a definition. It returns the number of documents that changed.
+func (ds *Datastore) Recompute(ctx context.Context, t string) (int, error) {
+	changed := 0
+
+	err := ds.Update(ctx, func(tx Tx) error {
+		changed = 0
+		dtx := tx.(*datastoreTx)
+
+		totals := map[string]map[string]float64{}
+		for _, cf := range ds.computed[t] {
+			if cf.Aggregate == nil {
+				continue
+			}
+			sums := map[string]float64{}
+			err := tx.ForEach(cf.Aggregate.From, func(id string, data []byte) error {
+				if ref, val := contribution(cf.Aggregate, data); ref != "" {
+					sums[ref] += val
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			totals[cf.Field] = sums
+		}
+
+		//collected first, bolt cursors don't like the bucket changing under them
+		ids, docs := []string{}, [][]byte{}
+		err := tx.ForEach(t, func(id string, data []byte) error {
+			ids = append(ids, id)
+			docs = append(docs, data)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for i, id := range ids {
+			obj, err := model.DecodeObject(docs[i])
+			if err != nil {
+				return fmt.Errorf("%s %s: %w", t, id, err)
+			}
+			for _, cf := range ds.computed[t] {
+				model.Remove(obj, cf.Field)
+				if cf.Aggregate != nil {
+					if err := model.Assign(obj, cf.Field, totals[cf.Field][id]); err != nil {
+						return err
+					}
+				}
+			}
+			if err := ds.computeFuncs(t, obj); err != nil {
+				return err
+			}
+
+			data, err := json.Marshal(obj)
+			if err != nil {
+				return err
+			}
+			if bytes.Equal(data, docs[i]) {
+				continue
+			}
+			if _, err := dtx.put(t, id, data); err != nil {
+				return err
+			}
+			changed++
+		}
+		return nil
+	})
+
+	return changed, err
+}
+
+// compute replaces the computed fields of a document of type t that is about to be written.
+// Aggregates keep their stored values, they only change when a referencing document does.
+func (ds *Datastore) compute(tx Tx, t string, id string, data []byte) ([]byte, error) {
+	fields := ds.computed[t]
+	if len(fields) == 0 {
+		return data, nil
+	}
+
+	obj, err := model.DecodeObject(data)
+	if err != nil {
+		return nil, err
+	}
+
+	var old map[string]interface{}
+	if id != "" {
+		raw, err := tx.Get(t, id)
+		if err != nil {
+			return nil, err
+		}
+		if raw != nil {
+			old, _ = model.DecodeObject(raw)
+		}
+	}
+
+	for _, cf := range fields {
+		model.Remove(obj, cf.Field)
+		if cf.Aggregate == nil {
+			continue
+		}
+		var v interface{} = 0
+		if old != nil {
+			if ov, ok := model.Lookup(old, cf.Field); ok {
+				v = ov
+			}
+		}
+		if err := model.Assign(obj, cf.Field, v); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := ds.computeFuncs(t, obj); err != nil {
+		return nil, err
+	}
+	return json.Marshal(obj)
+}
+
+func (ds *Datastore) computeFuncs(t string, obj map[string]interface{}) error {
+	for _, cf := range ds.computed[t] {
+		if cf.Func == nil {
+			continue
+		}
+		v, err := cf.Func(obj)
+		if err != nil {
+			return fmt.Errorf("computing %s.%s: %w", t, cf.Field, err)
+		}
+		if err := model.Assign(obj, cf.Field, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// referencing returns the stored document if documents of bucket are aggregated somewhere, nil otherwise
+func (dtx *datastoreTx) referencing(bucket string, id string) ([]byte, error) {
+	if len(dtx.ds.aggregates[bucket]) == 0 || id == "" {
+		return nil, nil
+	}
+	return dtx.tx.Get(bucket, id)
+}
+
+// aggregate moves the contribution of a document of type bucket from the document it referenced to the one it references now
+func (ds *Datastore) aggregate(dtx *datastoreTx, bucket string, old []byte, data []byte) error {
+	for _, target := range ds.aggregates[bucket] {
+		agg := target.field.Aggregate
+		oldRef, oldVal := contribution(agg, old)
+		newRef, newVal := contribution(agg, data)
+		if oldRef == newRef && oldVal == newVal {
+			continue
+		}
+
+		if oldRef != "" {
+			if err := ds.adjust(dtx, target, oldRef, -oldVal); err != nil {
+				return err
+			}
+		}
+		if newRef != "" {
+			if err := ds.adjust(dtx, target, newRef, newVal); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// adjust adds delta to an aggregate, documents that don't exist (yet) are left alone
+func (ds *Datastore) adjust(dtx *datastoreTx, target aggregateTarget, id string, delta float64) error {
+	raw, err := dtx.tx.Get(target.t, id)
+	if err != nil || raw == nil {
+		return err
+	}
+	obj, err := model.DecodeObject(raw)
+	if err != nil {
+		return err
+	}
+
+	cur, _ := model.Lookup(obj, target.field.Field)
+	n, _ := model.Number(cur)
+	if err := model.Assign(obj, target.field.Field, n+delta); err != nil {
+		return err
+	}
+	if err := ds.computeFuncs(target.t, obj); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return err
+	}
+	_, err = dtx.put(target.t, id, data)
+	return err
+}
+
+// contribution returns the id a document references and what it adds to the aggregate
+func contribution(agg *ReferenceAggregate, doc []byte) (string, float64) {
+	if doc == nil {
+		return "", 0
+	}
+	obj, err := model.DecodeObject(doc)
+	if err != nil {
+		return "", 0 //not an object, references nothing
+	}
+
+	ref := ""
+	switch v, _ := model.Lookup(obj, agg.Ref); v := v.(type) {
+	case string:
+		ref = v
+	case json.Number:
+		ref = v.String()
+	}
+	if ref == "" {
+		return "", 0
+	}
+
+	if agg.Op == AggregateSum {
+		v, _ := model.Lookup(obj, agg.Field)
+		n, _ := model.Number(v)
+		return ref, n
+	}
+	return ref, 1
+}
@@ -0,0 +1,114 @@
+package store_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/fnurk/geom/pkg/store"
+	"github.com/tidwall/gjson"
+)
+
+func wordCount(doc map[string]interface{}) (interface{}, error) {
+	body, _ := doc["body"].(string)
+	return len(strings.Fields(body)), nil
+}
+
+func newComputedDatastore(t *testing.T, db store.Database) *store.Datastore {
+	ds := store.NewDatastore(db, nil)
+	ds.AddComputedField("post", store.ComputedField{Field: "words", Func: wordCount})
+	ds.AddComputedField("post", store.ComputedField{Field: "stats.comments", Aggregate: &store.ReferenceAggregate{
+		Op: store.AggregateCount, From: "comment", Ref: "postId",
+	}})
+	ds.AddComputedField("post", store.ComputedField{Field: "stats.likes", Aggregate: &store.ReferenceAggregate{
+		Op: store.AggregateSum, From: "comment", Ref: "postId", Field: "likes",
+	}})
+	ds.CreateBucketIfNotExists("post")
+	ds.CreateBucketIfNotExists("comment")
+	return ds
+}
+
+func field(t *testing.T, ds *store.Datastore, bucket string, id string, path string) gjson.Result {
+	t.Helper()
+	doc, err := ds.Get(bucket, id)
+	if err != nil || doc == nil {
+		t.Fatalf("%s %s: %v", bucket, id, err)
+	}
+	return gjson.GetBytes(doc, path)
+}
+
+func TestDatastore_ComputedFields(t *testing.T) {
+	ds := newComputedDatastore(t, newTestBolt(t))
+
+	//client supplied values are replaced
+	ds.Put("post", "1", []byte(`{"body":"hello there world","words":100,"stats":{"comments":7}}`))
+	ds.Put("post", "2", []byte(`{"body":"second"}`))
+	if w := field(t, ds, "post", "1", "words").Int(); w != 3 {
+		t.Errorf("expected 3 words, got %d", w)
+	}
+	if n := field(t, ds, "post", "1", "stats.comments").Int(); n != 0 {
+		t.Errorf("expected 0 comments, got %d", n)
+	}
+
+	ds.Put("comment", "1", []byte(`{"postId":"1","likes":2}`))
+	ds.Put("comment", "2", []byte(`{"postId":"1","likes":3}`))
+	ds.Put("comment", "3", []byte(`{"postId":2}`))
+	if n := field(t, ds, "post", "1", "stats.comments").Int(); n != 2 {
+		t.Errorf("expected 2 comments, got %d", n)
+	}
+	if n := field(t, ds, "post", "1", "stats.likes").Int(); n != 5 {
+		t.Errorf("expected 5 likes, got %d", n)
+	}
+	if n := field(t, ds, "post", "2", "stats.comments").Int(); n != 1 {
+		t.Errorf("numeric reference: expected 1 comment, got %d", n)
+	}
+
+	//moving a comment and rewriting the post keep the aggregates right
+	ds.Put("comment", "2", []byte(`{"postId":"2","likes":3}`))
+	ds.Put("post", "1", []byte(`{"body":"edited"}`))
+	if n := field(t, ds, "post", "1", "stats.comments").Int(); n != 1 {
+		t.Errorf("expected 1 comment after move, got %d", n)
+	}
+	if n := field(t, ds, "post", "2", "stats.likes").Int(); n != 3 {
+		t.Errorf("expected 3 likes after move, got %d", n)
+	}
+	if w := field(t, ds, "post", "1", "words").Int(); w != 1 {
+		t.Errorf("expected 1 word after edit, got %d", w)
+	}
+
+	ds.Delete("comment", "1")
+	if n := field(t, ds, "post", "1", "stats.comments").Int(); n != 0 {
+		t.Errorf("expected 0 comments after delete, got %d", n)
+	}
+}
+
+func TestDatastore_Recompute(t *testing.T) {
+	db := newTestBolt(t)
+
+	//written before the fields were declared
+	plain := store.NewDatastore(db, nil)
+	plain.CreateBucketIfNotExists("post")
+	plain.CreateBucketIfNotExists("comment")
+	plain.Put("post", "1", []byte(`{"body":"one two"}`))
+	plain.Put("comment", "1", []byte(`{"postId":"1","likes":4}`))
+	plain.Put("comment", "2", []byte(`{"postId":"1"}`))
+
+	ds := newComputedDatastore(t, db)
+	changed, err := ds.Recompute(context.Background(), "post")
+	if err != nil || changed != 1 {
+		t.Fatalf("expected 1 change, got %d %v", changed, err)
+	}
+	if n := field(t, ds, "post", "1", "stats.comments").Int(); n != 2 {
+		t.Errorf("expected 2 comments, got %d", n)
+	}
+	if n := field(t, ds, "post", "1", "stats.likes").Int(); n != 4 {
+		t.Errorf("expected 4 likes, got %d", n)
+	}
+	if w := field(t, ds, "post", "1", "words").Int(); w != 2 {
+		t.Errorf("expected 2 words, got %d", w)
+	}
+
+	if changed, _ := ds.Recompute(context.Background(), "post"); changed != 0 {
+		t.Errorf("second recompute changed %d documents", changed)
+	}
+}
@@ -0,0 +1,40 @@
+package store
+
+import "context"
+
+type identityKey struct{}
+
+// WithIdentity attaches the acting identity to ctx, hooks and storage can read it with IdentityFrom
+func WithIdentity(ctx context.Context, identity string) context.Context {
+	return context.WithValue(ctx, identityKey{}, identity)
+}
+
+func IdentityFrom(ctx context.Context) string {
+	identity, _ := ctx.Value(identityKey{}).(string)
+	return identity
+}
+
+type tenantKey struct{}
+
+// WithTenant scopes storage calls made with ctx to a tenant, see TenantDatabase
+func WithTenant(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, tenantKey{}, tenant)
+}
+
+func TenantFrom(ctx context.Context) string {
+	tenant, _ := ctx.Value(tenantKey{}).(string)
+	return tenant
+}
+
+type originKey struct{}
+
+// WithOrigin tags writes made with ctx with where they came from, eg. a realtime connection, so changes
+// can be kept from being echoed back to it
+func WithOrigin(ctx context.Context, origin string) context.Context {
+	return context.WithValue(ctx, originKey{}, origin)
+}
+
+func OriginFrom(ctx context.Context) string {
+	origin, _ := ctx.Value(originKey{}).(string)
+	return origin
+}
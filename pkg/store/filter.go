@@ -0,0 +1,339 @@
+package store
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/fnurk/geom/pkg/model"
+	"github.com/tidwall/gjson"
+)
+
+var ErrInvalidFilter = errors.New("invalid filter")
+
+// Filter is a parsed filter expression, eg.
+//
+//	status == "open" and (priority >= 2 or tags contains "urgent")
+//	owner in ["alice","bob"]
+//
+// Paths are gjson paths, values are json. Comparisons only match values of the same kind, strings with
+// strings and numbers with numbers. contains matches arrays holding the value, missing fields equal null.
+type Filter struct {
+	// "and", "or" or a comparison: "==", "!=", "<", "<=", ">", ">=", "in", "contains"
+	Op       string
+	Path     string
+	Value    interface{}
+	Children []*Filter
+}
+
+func ParseFilter(s string) (*Filter, error) {
+	p := &filterParser{s: s}
+	f, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	p.space()
+	if p.pos < len(p.s) {
+		return nil, p.errorf("unexpected %q", p.s[p.pos:])
+	}
+	return f, nil
+}
+
+// Match reports whether doc passes the filter, a nil filter matches everything
+func (f *Filter) Match(doc []byte) bool {
+	if f == nil {
+		return true
+	}
+	switch f.Op {
+	case "and":
+		for _, c := range f.Children {
+			if !c.Match(doc) {
+				return false
+			}
+		}
+		return true
+	case "or":
+		for _, c := range f.Children {
+			if c.Match(doc) {
+				return true
+			}
+		}
+		return false
+	}
+
+	v := gjson.GetBytes(doc, f.Path).Value()
+	switch f.Op {
+	case "==":
+		return model.Equal(v, f.Value)
+	case "!=":
+		return !model.Equal(v, f.Value)
+	case "in":
+		values, _ := f.Value.([]interface{})
+		for _, el := range values {
+			if model.Equal(v, el) {
+				return true
+			}
+		}
+		return false
+	case "contains":
+		values, _ := v.([]interface{})
+		for _, el := range values {
+			if model.Equal(el, f.Value) {
+				return true
+			}
+		}
+		return false
+	}
+
+	c, ok := compareValues(v, f.Value)
+	if !ok {
+		return false
+	}
+	switch f.Op {
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	case ">=":
+		return c >= 0
+	}
+	return false
+}
+
+func (f *Filter) String() string {
+	if f == nil {
+		return ""
+	}
+	if f.Op == "and" || f.Op == "or" {
+		parts := make([]string, len(f.Children))
+		for i, c := range f.Children {
+			parts[i] = c.String()
+			if c.Op == "or" {
+				parts[i] = "(" + parts[i] + ")"
+			}
+		}
+		return strings.Join(parts, " "+f.Op+" ")
+	}
+	v, _ := json.Marshal(f.Value)
+	return fmt.Sprintf("%s %s %s", f.Path, f.Op, v)
+}
+
+// compareValues orders two numbers or two strings
+func compareValues(a interface{}, b interface{}) (int, bool) {
+	if an, ok := model.Number(a); ok {
+		bn, ok := model.Number(b)
+		switch {
+		case !ok:
+			return 0, false
+		case an < bn:
+			return -1, true
+		case an > bn:
+			return 1, true
+		}
+		return 0, true
+	}
+	as, ok := a.(string)
+	if !ok {
+		return 0, false
+	}
+	bs, ok := b.(string)
+	if !ok {
+		return 0, false
+	}
+	return strings.Compare(as, bs), true
+}
+
+type filterParser struct {
+	s   string
+	pos int
+}
+
+func (p *filterParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("%w at %d: %s", ErrInvalidFilter, p.pos, fmt.Sprintf(format, args...))
+}
+
+func (p *filterParser) space() {
+	for p.pos < len(p.s) && strings.IndexByte(" \t\n\r", p.s[p.pos]) >= 0 {
+		p.pos++
+	}
+}
+
+// keyword consumes word if it's next and not the start of a longer word
+func (p *filterParser) keyword(word string) bool {
+	p.space()
+	end := p.pos + len(word)
+	if !strings.HasPrefix(p.s[p.pos:], word) || (end < len(p.s) && !strings.ContainsAny(p.s[end:end+1], " \t\n\r([\"")) {
+		return false
+	}
+	p.pos = end
+	return true
+}
+
+func (p *filterParser) or() (*Filter, error) {
+	return p.list("or", p.and)
+}
+
+func (p *filterParser) and() (*Filter, error) {
+	return p.list("and", p.term)
+}
+
+func (p *filterParser) list(op string, next func() (*Filter, error)) (*Filter, error) {
+	f, err := next()
+	if err != nil {
+		return nil, err
+	}
+	children := []*Filter{f}
+	for p.keyword(op) {
+		f, err := next()
+		if err != nil {
+			return nil, err
+		}
+		children = append(children, f)
+	}
+	if len(children) == 1 {
+		return children[0], nil
+	}
+	return &Filter{Op: op, Children: children}, nil
+}
+
+func (p *filterParser) term() (*Filter, error) {
+	p.space()
+	if p.pos < len(p.s) && p.s[p.pos] == '(' {
+		p.pos++
+		f, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		p.space()
+		if p.pos >= len(p.s) || p.s[p.pos] != ')' {
+			return nil, p.errorf("missing )")
+		}
+		p.pos++
+		return f, nil
+	}
+
+	start := p.pos
+	for p.pos < len(p.s) && !strings.ContainsRune(" \t\n\r=!<>()", rune(p.s[p.pos])) {
+		p.pos++
+	}
+	path := p.s[start:p.pos]
+	if path == "" {
+		return nil, p.errorf("expected a path")
+	}
+
+	f := &Filter{Path: path}
+	p.space()
+	for _, op := range []string{"==", "!=", "<=", ">=", "<", ">"} {
+		if strings.HasPrefix(p.s[p.pos:], op) {
+			f.Op = op
+			p.pos += len(op)
+			break
+		}
+	}
+	if f.Op == "" {
+		for _, op := range []string{"in", "contains"} {
+			if p.keyword(op) {
+				f.Op = op
+				break
+			}
+		}
+	}
+	if f.Op == "" {
+		return nil, p.errorf("expected an operator after %s", path)
+	}
+
+	p.space()
+	d := json.NewDecoder(strings.NewReader(p.s[p.pos:]))
+	d.UseNumber()
+	if err := d.Decode(&f.Value); err != nil {
+		return nil, p.errorf("expected a json value after %s %s", path, f.Op)
+	}
+	p.pos += int(d.InputOffset())
+
+	if _, ok := f.Value.([]interface{}); f.Op == "in" && !ok {
+		return nil, p.errorf("in needs an array")
+	}
+	return f, nil
+}
+
+// scalar reports whether v can be an index key
+func scalar(v interface{}) bool {
+	switch v.(type) {
+	case string, bool, json.Number, float64:
+		return true
+	}
+	return false
+}
+
+// indexValues are the values of path in doc that are indexed, arrays are indexed by their elements
+func indexValues(doc []byte, path string) []interface{} {
+	r := gjson.GetBytes(doc, path)
+	if !r.Exists() {
+		return nil
+	}
+	values := []interface{}{}
+	if r.IsArray() {
+		for _, el := range r.Array() {
+			if v := el.Value(); scalar(v) {
+				values = append(values, v)
+			}
+		}
+		return values
+	}
+	if v := r.Value(); scalar(v) {
+		values = append(values, v)
+	}
+	return values
+}
+
+// indexRanges are the ranges of encoded values that hold every document f can match, ok is false if
+// f can't use an index
+func indexRanges(f *Filter) (ranges [][2][]byte, ok bool) {
+	var values []interface{}
+	switch f.Op {
+	case "==", "contains":
+		values = []interface{}{f.Value}
+	case "in":
+		values, _ = f.Value.([]interface{})
+	case "<", "<=", ">", ">=":
+		if !scalar(f.Value) {
+			return nil, false
+		}
+		if _, isBool := f.Value.(bool); isBool {
+			return nil, false
+		}
+		v, err := encodeViewKey([]interface{}{f.Value}, false)
+		if err != nil {
+			return nil, false
+		}
+		//everything of the same kind on the right side of the value
+		kind := v[:1]
+		if f.Op[0] == '>' {
+			return [][2][]byte{{v, []byte{kind[0] + 1}}}, true
+		}
+		return [][2][]byte{{kind, upTo(append(v, keyEnd))}}, true
+	default:
+		return nil, false
+	}
+
+	for _, v := range values {
+		if !scalar(v) {
+			return nil, false
+		}
+		k, err := encodeViewKey([]interface{}{v}, true)
+		if err != nil {
+			return nil, false
+		}
+		ranges = append(ranges, [2][]byte{k, upTo(k)})
+	}
+	return ranges, len(ranges) > 0
+}
+
+// upTo is the first key after every key starting with prefix
+func upTo(prefix []byte) []byte {
+	return append(append([]byte{}, prefix...), bytes.Repeat([]byte{0xff}, 9)...)
+}
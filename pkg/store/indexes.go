@@ -0,0 +1,256 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sort"
+	"sync"
+)
+
+// Index rows map a field value to the documents holding it, arrays are indexed by their elements.
+// A row is the encoded value (see encodeViewKey) followed by the document id. Persisted rows live in
+// IndexBucket prefixed by type and field, in memory rows are built on first use and kept per tenant.
+// Both are updated in the transaction writing the document.
+const IndexBucket = "index"
+
+type memIndex struct {
+	lock  sync.RWMutex
+	built bool
+	rows  []string
+}
+
+// AddIndex indexes field of type t, like an index tag on the registered type does. Call it before Init.
+func (ds *Datastore) AddIndex(t string, field string, indexType IndexType) {
+	ds.indexMap[t] = append(ds.indexMap[t], Index{indexType: indexType, fieldName: field})
+}
+
+// findIndex returns the index of t on path, in memory ones first
+func (ds *Datastore) findIndex(t string, path string) (Index, bool) {
+	found := false
+	var idx Index
+	for _, i := range ds.indexMap[t] {
+		if i.fieldName != path || (found && idx.indexType == INMEM) {
+			continue
+		}
+		idx, found = i, true
+	}
+	return idx, found
+}
+
+func (ds *Datastore) memIndex(ctx context.Context, t string, field string) *memIndex {
+	key := TenantFrom(ctx) + "\x00" + t + "\x00" + field
+	ds.memIndexLock.Lock()
+	defer ds.memIndexLock.Unlock()
+	m := ds.memIndexes[key]
+	if m == nil {
+		m = &memIndex{}
+		ds.memIndexes[key] = m
+	}
+	return m
+}
+
+func indexPrefix(t string, field string) []byte {
+	return []byte(t + "\x00" + field + "\x00")
+}
+
+// Persisted indexes are marked built once the documents written before the index existed are in it
+func indexBuiltKey(t string, field string) []byte {
+	return []byte("\x00built\x00" + t + "\x00" + field)
+}
+
+func indexRows(doc []byte, field string, id string) [][]byte {
+	if doc == nil {
+		return nil
+	}
+	rows := [][]byte{}
+	for _, v := range indexValues(doc, field) {
+		k, err := encodeViewKey([]interface{}{v}, true)
+		if err != nil {
+			continue
+		}
+		rows = append(rows, append(k, strtob(id)...))
+	}
+	return rows
+}
+
+// updateIndexes moves the rows of a document from old to data, either can be nil
+func (dtx *datastoreTx) updateIndexes(bucket string, id string, old []byte, data []byte) error {
+	for _, idx := range dtx.ds.indexMap[bucket] {
+		oldRows, newRows := indexRows(old, idx.fieldName, id), indexRows(data, idx.fieldName, id)
+
+		if idx.indexType == INMEM {
+			m := dtx.ds.memIndex(dtx.ctx, bucket, idx.fieldName)
+			m.lock.Lock()
+			if m.built {
+				for _, row := range oldRows {
+					m.remove(string(row))
+				}
+				for _, row := range newRows {
+					m.insert(string(row))
+				}
+				//a rollback leaves the rows behind, the index is dropped if it happens
+				dtx.memIndexes = append(dtx.memIndexes, m)
+			}
+			m.lock.Unlock()
+			continue
+		}
+
+		prefix := indexPrefix(bucket, idx.fieldName)
+		for _, row := range oldRows {
+			if err := dtx.tx.DeleteKey(IndexBucket, append(append([]byte{}, prefix...), row...)); err != nil {
+				return err
+			}
+		}
+		for _, row := range newRows {
+			if err := dtx.tx.PutKey(IndexBucket, append(append([]byte{}, prefix...), row...), []byte{}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// buildIndex adds the documents written before the index existed, it's done in a write transaction
+// so no write can slip past it
+func (ds *Datastore) buildIndex(ctx context.Context, t string, idx Index) error {
+	if idx.indexType == INMEM {
+		m := ds.memIndex(ctx, t, idx.fieldName)
+		m.lock.RLock()
+		built := m.built
+		m.lock.RUnlock()
+		if built {
+			return nil
+		}
+		return UpdateTx(ctx, ds.db, func(tx Tx) error {
+			m.lock.Lock()
+			defer m.lock.Unlock()
+			if m.built {
+				return nil
+			}
+			rows := []string{}
+			err := tx.ForEach(t, func(id string, data []byte) error {
+				for _, row := range indexRows(data, idx.fieldName, id) {
+					rows = append(rows, string(row))
+				}
+				return nil
+			})
+			if err != nil && err != ErrBucketNotFound {
+				return err
+			}
+			sort.Strings(rows)
+			m.rows, m.built = rows, true
+			return nil
+		})
+	}
+
+	built := false
+	err := ViewTx(ctx, ds.db, func(tx Tx) error {
+		v, err := tx.GetKey(IndexBucket, indexBuiltKey(t, idx.fieldName))
+		built = v != nil
+		return err
+	})
+	if err != nil || built {
+		return err
+	}
+	return UpdateTx(ctx, ds.db, func(tx Tx) error {
+		if v, err := tx.GetKey(IndexBucket, indexBuiltKey(t, idx.fieldName)); err != nil || v != nil {
+			return err
+		}
+		prefix := indexPrefix(t, idx.fieldName)
+		err := tx.ForEach(t, func(id string, data []byte) error {
+			for _, row := range indexRows(data, idx.fieldName, id) {
+				if err := tx.PutKey(IndexBucket, append(append([]byte{}, prefix...), row...), []byte{}); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil && err != ErrBucketNotFound {
+			return err
+		}
+		return tx.PutKey(IndexBucket, indexBuiltKey(t, idx.fieldName), []byte{1})
+	})
+}
+
+// indexCandidates returns the ids of the documents with rows in ranges, in id order
+func (ds *Datastore) indexCandidates(ctx context.Context, tx Tx, t string, idx Index, ranges [][2][]byte) ([]string, error) {
+	seen := map[string]struct{}{}
+	add := func(row []byte) {
+		if len(row) >= 8 {
+			seen[btos(row[len(row)-8:])] = struct{}{}
+		}
+	}
+
+	if idx.indexType == INMEM {
+		m := ds.memIndex(ctx, t, idx.fieldName)
+		m.lock.RLock()
+		for _, r := range ranges {
+			from, to := string(r[0]), string(r[1])
+			for i := sort.SearchStrings(m.rows, from); i < len(m.rows) && m.rows[i] < to; i++ {
+				add([]byte(m.rows[i]))
+			}
+		}
+		m.lock.RUnlock()
+	} else {
+		prefix := indexPrefix(t, idx.fieldName)
+		stop := errors.New("stop")
+		for _, r := range ranges {
+			to := append(append([]byte{}, prefix...), r[1]...)
+			err := tx.ForEachKeyFrom(IndexBucket, append(append([]byte{}, prefix...), r[0]...), func(k []byte, v []byte) error {
+				if bytes.Compare(k, to) >= 0 {
+					return stop
+				}
+				add(k[len(prefix):])
+				return nil
+			})
+			if err != nil && err != stop {
+				return nil, err
+			}
+		}
+	}
+
+	ids := make([]string, 0, len(seen))
+	for id := range seen {
+		ids = append(ids, id)
+	}
+	//ids are numbers, their byte form sorts
+	sort.Slice(ids, func(i, j int) bool {
+		return bytes.Compare(strtob(ids[i]), strtob(ids[j])) < 0
+	})
+	return ids, nil
+}
+
+// dropMemIndexes forgets in memory indexes touched by a transaction that didn't commit
+func dropMemIndexes(indexes []*memIndex) {
+	for _, m := range indexes {
+		m.lock.Lock()
+		m.built, m.rows = false, nil
+		m.lock.Unlock()
+	}
+}
+
+func (m *memIndex) insert(row string) {
+	i := sort.SearchStrings(m.rows, row)
+	if i < len(m.rows) && m.rows[i] == row {
+		return
+	}
+	m.rows = append(m.rows, "")
+	copy(m.rows[i+1:], m.rows[i:])
+	m.rows[i] = row
+}
+
+func (m *memIndex) remove(row string) {
+	i := sort.SearchStrings(m.rows, row)
+	if i < len(m.rows) && m.rows[i] == row {
+		m.rows = append(m.rows[:i], m.rows[i+1:]...)
+	}
+}
+
+// indexed returns the document as it is before a write if its type has indexes
+func (dtx *datastoreTx) indexed(bucket string, id string) ([]byte, error) {
+	if id == "" || len(dtx.ds.indexMap[bucket]) == 0 {
+		return nil, nil
+	}
+	return dtx.tx.Get(bucket, id)
+}
@@ -1,8 +1,12 @@
 package store
 
-import "sync"
+import (
+	"context"
+	"sync"
+)
 
 type InMemKV struct {
+	lock    sync.Mutex //guards the maps, not their contents
 	buckets map[string]map[string][]byte
 	mutexes map[string]*sync.RWMutex
 }
@@ -19,55 +23,62 @@ func NewInMemKV() *InMemKV {
 	}
 }
 
-func (kv *InMemKV) getMutex(bucket string) *sync.RWMutex {
+func (kv *InMemKV) getBucket(bucket string) (map[string][]byte, *sync.RWMutex) {
+	kv.lock.Lock()
+	defer kv.lock.Unlock()
 	m := kv.mutexes[bucket]
 	if m == nil {
-		kv.mutexes[bucket] = new(sync.RWMutex)
-		m = kv.mutexes[bucket]
+		m = new(sync.RWMutex)
+		kv.mutexes[bucket] = m
+		kv.buckets[bucket] = make(map[string][]byte)
 	}
-	return m
+	return kv.buckets[bucket], m
 }
 
 func (kv *InMemKV) Get(bucket string, key string) []byte {
-	m := kv.getMutex(bucket)
+	b, m := kv.getBucket(bucket)
 	m.RLock()
 	defer m.RUnlock()
-	b := kv.buckets[bucket]
-	if b == nil {
-		b = make(map[string][]byte)
-		kv.buckets[bucket] = b
-	}
 	return b[key]
 }
 
 func (kv *InMemKV) ClearBucket(bucket string) {
-	m := kv.getMutex(bucket)
+	b, m := kv.getBucket(bucket)
 	m.Lock()
 	defer m.Unlock()
-	b := make(map[string][]byte)
-	kv.buckets[bucket] = b
+	for k := range b {
+		delete(b, k)
+	}
 }
 
 func (kv *InMemKV) Set(bucket string, key string, val []byte) {
-	m := kv.getMutex(bucket)
+	b, m := kv.getBucket(bucket)
 	m.Lock()
 	defer m.Unlock()
-	b := kv.buckets[bucket]
-	if b == nil {
-		b = make(map[string][]byte)
-		kv.buckets[bucket] = b
-	}
 	b[key] = val
 }
 
 func (kv *InMemKV) Del(bucket string, key string) {
-	m := kv.getMutex(bucket)
+	b, m := kv.getBucket(bucket)
 	m.Lock()
 	defer m.Unlock()
-	b := kv.buckets[bucket]
-	if b == nil {
-		b = make(map[string][]byte)
-		kv.buckets[bucket] = b
-	}
 	delete(b, key)
 }
+
+// The context variants ignore ctx, there's nothing to wait for in memory
+
+func (kv *InMemKV) GetContext(ctx context.Context, bucket string, key string) []byte {
+	return kv.Get(bucket, key)
+}
+
+func (kv *InMemKV) SetContext(ctx context.Context, bucket string, key string, val []byte) {
+	kv.Set(bucket, key, val)
+}
+
+func (kv *InMemKV) DelContext(ctx context.Context, bucket string, key string) {
+	kv.Del(bucket, key)
+}
+
+func (kv *InMemKV) ClearBucketContext(ctx context.Context, bucket string) {
+	kv.ClearBucket(bucket)
+}
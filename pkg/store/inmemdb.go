@@ -0,0 +1,462 @@
+package store
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// InMemDatabase is a Database without a file, for tests and demos. Ids, sequences and ordering
+// behave like BoltDatabase. With SnapshotFile set it is loaded in Init and saved in Close.
+type InMemDatabase struct {
+	SnapshotFile string
+
+	lock    sync.RWMutex
+	buckets map[string]*memBucket
+}
+
+type memBucket struct {
+	sequence uint64
+	items    map[string][]byte
+	keys     []string //sorted, same byte order as bolt
+}
+
+func NewInMemDatabase() *InMemDatabase {
+	return &InMemDatabase{
+		buckets: map[string]*memBucket{},
+	}
+}
+
+func (db *InMemDatabase) Init() error {
+	if db.SnapshotFile == "" {
+		return nil
+	}
+	err := db.Load(db.SnapshotFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (db *InMemDatabase) Close() {
+	db.Shutdown()
+}
+
+// Shutdown is Close returning the error of saving the snapshot
+func (db *InMemDatabase) Shutdown() error {
+	if db.SnapshotFile == "" {
+		return nil
+	}
+	return db.Save(db.SnapshotFile)
+}
+
+func (db *InMemDatabase) CreateBucketIfNotExists(bucketName string) error {
+	return db.CreateBucketIfNotExistsContext(context.Background(), bucketName)
+}
+
+func (db *InMemDatabase) Get(t string, id string) ([]byte, error) {
+	return db.GetContext(context.Background(), t, id)
+}
+
+func (db *InMemDatabase) Put(t string, id string, data []byte) (string, error) {
+	return db.PutContext(context.Background(), t, id, data)
+}
+
+func (db *InMemDatabase) Delete(t string, id string) error {
+	return db.DeleteContext(context.Background(), t, id)
+}
+
+func (db *InMemDatabase) CreateBucketIfNotExistsContext(ctx context.Context, bucketName string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	if db.buckets[bucketName] == nil {
+		db.buckets[bucketName] = newMemBucket()
+	}
+	return nil
+}
+
+func (db *InMemDatabase) GetContext(ctx context.Context, t string, id string) ([]byte, error) {
+	var v []byte
+	err := db.View(ctx, func(tx Tx) error {
+		var err error
+		v, err = tx.Get(t, id)
+		return err
+	})
+	return v, err
+}
+
+func (db *InMemDatabase) PutContext(ctx context.Context, t string, id string, data []byte) (string, error) {
+	err := db.Update(ctx, func(tx Tx) error {
+		var err error
+		id, err = tx.Put(t, id, data)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+func (db *InMemDatabase) DeleteContext(ctx context.Context, t string, id string) error {
+	return db.Update(ctx, func(tx Tx) error {
+		return tx.Delete(t, id)
+	})
+}
+
+func (db *InMemDatabase) View(ctx context.Context, fn func(Tx) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+	return fn(&memTx{db: db})
+}
+
+// Update holds the write lock for the whole transaction, writes are made in place and undone
+// if fn fails so it leaves the database untouched
+func (db *InMemDatabase) Update(ctx context.Context, fn func(Tx) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	tx := &memTx{db: db, writable: true, sequences: map[*memBucket]uint64{}}
+	committed := false
+	defer func() {
+		if !committed {
+			tx.rollback()
+		}
+	}()
+	if err := fn(tx); err != nil {
+		return err
+	}
+	committed = true
+	return nil
+}
+
+// Stats implements StatsProvider, bytes are keys and values
+func (db *InMemDatabase) Stats() (DatabaseStats, error) {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	stats := DatabaseStats{Buckets: map[string]BucketStats{}}
+	for name, b := range db.buckets {
+		bs := BucketStats{Keys: len(b.items), Depth: 1}
+		for k, v := range b.items {
+			bs.Bytes += int64(len(k) + len(v))
+		}
+		stats.Buckets[name] = bs
+	}
+	return stats, nil
+}
+
+type snapshotBucket struct {
+	Sequence uint64            `json:"sequence"`
+	Items    map[string][]byte `json:"items"`
+	// Raw keys, hex encoded
+	Keys map[string][]byte `json:"keys,omitempty"`
+}
+
+// Save writes all buckets to filename, replacing it atomically
+func (db *InMemDatabase) Save(filename string) error {
+	db.lock.RLock()
+	snapshot := map[string]snapshotBucket{}
+	for name, b := range db.buckets {
+		sb := snapshotBucket{Sequence: b.sequence, Items: map[string][]byte{}, Keys: map[string][]byte{}}
+		for k, v := range b.items {
+			if len(k) == 8 {
+				sb.Items[btos([]byte(k))] = v
+			} else {
+				sb.Keys[hex.EncodeToString([]byte(k))] = v
+			}
+		}
+		snapshot[name] = sb
+	}
+	db.lock.RUnlock()
+
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(filename), filepath.Base(filename)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filename)
+}
+
+// Load replaces the contents of the database with a snapshot written by Save
+func (db *InMemDatabase) Load(filename string) error {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+
+	snapshot := map[string]snapshotBucket{}
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return err
+	}
+
+	buckets := map[string]*memBucket{}
+	for name, sb := range snapshot {
+		b := newMemBucket()
+		b.sequence = sb.Sequence
+		for id, v := range sb.Items {
+			b.put(string(strtob(id)), v)
+		}
+		for k, v := range sb.Keys {
+			key, err := hex.DecodeString(k)
+			if err != nil {
+				return err
+			}
+			b.put(string(key), v)
+		}
+		buckets[name] = b
+	}
+
+	db.lock.Lock()
+	db.buckets = buckets
+	db.lock.Unlock()
+	return nil
+}
+
+type memTx struct {
+	db       *InMemDatabase
+	writable bool
+	// what the writes replaced, in order, and the sequences of buckets before the transaction
+	undo      []memUndo
+	sequences map[*memBucket]uint64
+}
+
+type memUndo struct {
+	b       *memBucket
+	key     string
+	value   []byte
+	existed bool
+}
+
+func (tx *memTx) bucket(name string) *memBucket {
+	return tx.db.buckets[name]
+}
+
+func (tx *memTx) writableBucket(name string) (*memBucket, error) {
+	if !tx.writable {
+		return nil, ErrTxNotWritable
+	}
+	b := tx.db.buckets[name]
+	if b == nil {
+		return nil, ErrBucketNotFound
+	}
+	return b, nil
+}
+
+func (tx *memTx) put(b *memBucket, k string, v []byte) {
+	old, existed := b.items[k]
+	tx.undo = append(tx.undo, memUndo{b: b, key: k, value: old, existed: existed})
+	b.put(k, v)
+}
+
+func (tx *memTx) delete(b *memBucket, k string) {
+	old, existed := b.items[k]
+	if !existed {
+		return
+	}
+	tx.undo = append(tx.undo, memUndo{b: b, key: k, value: old, existed: true})
+	b.delete(k)
+}
+
+func (tx *memTx) nextSequence(b *memBucket) uint64 {
+	if _, ok := tx.sequences[b]; !ok {
+		tx.sequences[b] = b.sequence
+	}
+	b.sequence++
+	return b.sequence
+}
+
+// rollback undoes the writes, latest first
+func (tx *memTx) rollback() {
+	for i := len(tx.undo) - 1; i >= 0; i-- {
+		u := tx.undo[i]
+		if u.existed {
+			u.b.put(u.key, u.value)
+		} else {
+			u.b.delete(u.key)
+		}
+	}
+	for b, seq := range tx.sequences {
+		b.sequence = seq
+	}
+}
+
+func (tx *memTx) Get(t string, id string) ([]byte, error) {
+	b := tx.bucket(t)
+	if b == nil {
+		return nil, nil
+	}
+	v := b.items[string(strtob(id))]
+	if v == nil {
+		return nil, nil
+	}
+	vCopy := make([]byte, len(v))
+	copy(vCopy, v)
+	return vCopy, nil
+}
+
+func (tx *memTx) Put(t string, id string, data []byte) (string, error) {
+	b, err := tx.writableBucket(t)
+	if err != nil {
+		return "", err
+	}
+
+	var bid []byte
+
+	if id == "" { //id empty? autoincrement
+		bid = itob(tx.nextSequence(b))
+		id = btos(bid)
+	} else {
+		bid = strtob(id)
+	}
+
+	vCopy := make([]byte, len(data))
+	copy(vCopy, data)
+	tx.put(b, string(bid), vCopy)
+	return id, nil
+}
+
+func (tx *memTx) Delete(t string, id string) error {
+	b, err := tx.writableBucket(t)
+	if err != nil {
+		return err
+	}
+	tx.delete(b, string(strtob(id)))
+	return nil
+}
+
+func (tx *memTx) ForEach(t string, fn func(id string, data []byte) error) error {
+	return tx.ForEachFrom(t, "", fn)
+}
+
+func (tx *memTx) ForEachFrom(t string, id string, fn func(id string, data []byte) error) error {
+	b := tx.bucket(t)
+	if b == nil {
+		return ErrBucketNotFound
+	}
+	start := sort.SearchStrings(b.keys, string(strtob(id)))
+	for _, k := range b.keys[start:] {
+		if len(k) != 8 { //not a document
+			continue
+		}
+		v := b.items[k]
+		vCopy := make([]byte, len(v))
+		copy(vCopy, v)
+		if err := fn(btos([]byte(k)), vCopy); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (tx *memTx) Last(t string) (string, error) {
+	b := tx.bucket(t)
+	if b == nil {
+		return "", ErrBucketNotFound
+	}
+	for i := len(b.keys) - 1; i >= 0; i-- {
+		if len(b.keys[i]) == 8 {
+			return btos([]byte(b.keys[i])), nil
+		}
+	}
+	return "", nil
+}
+
+func (tx *memTx) GetKey(t string, key []byte) ([]byte, error) {
+	b := tx.bucket(t)
+	if b == nil {
+		return nil, nil
+	}
+	v := b.items[string(key)]
+	if v == nil {
+		return nil, nil
+	}
+	vCopy := make([]byte, len(v))
+	copy(vCopy, v)
+	return vCopy, nil
+}
+
+func (tx *memTx) PutKey(t string, key []byte, value []byte) error {
+	b, err := tx.writableBucket(t)
+	if err != nil {
+		return err
+	}
+	vCopy := make([]byte, len(value))
+	copy(vCopy, value)
+	tx.put(b, string(key), vCopy)
+	return nil
+}
+
+func (tx *memTx) DeleteKey(t string, key []byte) error {
+	b, err := tx.writableBucket(t)
+	if err != nil {
+		return err
+	}
+	tx.delete(b, string(key))
+	return nil
+}
+
+func (tx *memTx) ForEachKeyFrom(t string, from []byte, fn func(key []byte, value []byte) error) error {
+	b := tx.bucket(t)
+	if b == nil {
+		return ErrBucketNotFound
+	}
+	start := sort.SearchStrings(b.keys, string(from))
+	for _, k := range b.keys[start:] {
+		v := b.items[k]
+		vCopy := make([]byte, len(v))
+		copy(vCopy, v)
+		if err := fn([]byte(k), vCopy); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func newMemBucket() *memBucket {
+	return &memBucket{items: map[string][]byte{}}
+}
+
+func (b *memBucket) put(k string, v []byte) {
+	if _, ok := b.items[k]; !ok {
+		i := sort.SearchStrings(b.keys, k)
+		b.keys = append(b.keys, "")
+		copy(b.keys[i+1:], b.keys[i:])
+		b.keys[i] = k
+	}
+	b.items[k] = v
+}
+
+func (b *memBucket) delete(k string) {
+	if _, ok := b.items[k]; !ok {
+		return
+	}
+	delete(b.items, k)
+	i := sort.SearchStrings(b.keys, k)
+	b.keys = append(b.keys[:i], b.keys[i+1:]...)
+}
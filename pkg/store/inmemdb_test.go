@@ -0,0 +1,124 @@
+package store_test
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/fnurk/geom/pkg/store"
+)
+
+// exercise runs the same operations against a Database and returns what it observed
+func exercise(t *testing.T, db store.TxDatabase) []string {
+	ctx := context.Background()
+	seen := []string{}
+
+	db.CreateBucketIfNotExists("doc")
+	for _, d := range []string{"a", "b", "c"} {
+		id, err := db.Put("doc", "", []byte(d))
+		if err != nil {
+			t.Fatal(err)
+		}
+		seen = append(seen, id)
+	}
+	db.Put("doc", "300", []byte("x"))
+	db.Put("doc", "20", []byte("y"))
+	db.Delete("doc", "2")
+
+	failed := errors.New("fail")
+	err := db.Update(ctx, func(tx store.Tx) error {
+		tx.Put("doc", "", []byte("rolled back"))
+		tx.Delete("doc", "1")
+		return failed
+	})
+	if err != failed {
+		t.Errorf("expected update error, got %v", err)
+	}
+
+	id, _ := db.Put("doc", "", []byte("d"))
+	seen = append(seen, id)
+
+	db.View(ctx, func(tx store.Tx) error {
+		return tx.ForEach("doc", func(id string, data []byte) error {
+			seen = append(seen, id+"="+string(data))
+			return nil
+		})
+	})
+	return seen
+}
+
+func TestInMemDatabase_SameAsBolt(t *testing.T) {
+	fromBolt := exercise(t, newTestBolt(t))
+	fromMem := exercise(t, store.NewInMemDatabase())
+
+	if !reflect.DeepEqual(fromBolt, fromMem) {
+		t.Errorf("expected %v, got %v", fromBolt, fromMem)
+	}
+}
+
+func TestInMemDatabase_Snapshot(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "snapshot.json")
+
+	db := store.NewInMemDatabase()
+	db.SnapshotFile = file
+	if err := db.Init(); err != nil {
+		t.Fatal(err)
+	}
+	db.CreateBucketIfNotExists("doc")
+	db.Put("doc", "", []byte(`{"a":1}`))
+	db.Close()
+
+	db = store.NewInMemDatabase()
+	db.SnapshotFile = file
+	if err := db.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := db.Get("doc", "1"); string(v) != `{"a":1}` {
+		t.Errorf("expected doc from snapshot, got %s", v)
+	}
+	if id, _ := db.Put("doc", "", []byte("{}")); id != "2" {
+		t.Errorf("expected sequence from snapshot, got %s", id)
+	}
+}
+
+func TestInMemDatabase_Rollback(t *testing.T) {
+	db := store.NewInMemDatabase()
+	db.CreateBucketIfNotExists("doc")
+	db.Put("doc", "", []byte("a"))
+
+	failed := errors.New("fail")
+	err := db.Update(context.Background(), func(tx store.Tx) error {
+		tx.Put("doc", "1", []byte("b"))
+		tx.Put("doc", "1", []byte("c"))
+		tx.Delete("doc", "1")
+		tx.Put("doc", "", []byte("new"))
+		tx.PutKey("doc", []byte("raw"), []byte("x"))
+		return failed
+	})
+	if err != failed {
+		t.Fatalf("expected update error, got %v", err)
+	}
+
+	if v, _ := db.Get("doc", "1"); string(v) != "a" {
+		t.Errorf("expected the first value back, got %q", v)
+	}
+	db.View(context.Background(), func(tx store.Tx) error {
+		if v, _ := tx.GetKey("doc", []byte("raw")); v != nil {
+			t.Errorf("expected the raw key to be gone, got %q", v)
+		}
+		return nil
+	})
+	if id, _ := db.Put("doc", "", []byte("d")); id != "2" {
+		t.Errorf("expected the sequence to be restored, got %s", id)
+	}
+}
+
+func TestInMemDatabase_ShutdownError(t *testing.T) {
+	db := store.NewInMemDatabase()
+	db.SnapshotFile = filepath.Join(t.TempDir(), "missing", "snapshot.json")
+	if err := db.Shutdown(); err == nil {
+		t.Error("expected an error saving into a missing directory")
+	}
+}
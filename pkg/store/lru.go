@@ -0,0 +1,222 @@
+package store
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+)
+
+type LRUConfig struct {
+	// Byte budgets count key and value sizes, 0 means no limit
+	MaxBytes          int64
+	MaxBytesPerBucket int64
+	// Default time to live for entries added with Set, 0 means they never expire
+	TTL time.Duration
+}
+
+type LRUStats struct {
+	Entries     int     `json:"entries"`
+	Bytes       int64   `json:"bytes"`
+	Hits        uint64  `json:"hits"`
+	Misses      uint64  `json:"misses"`
+	Evictions   uint64  `json:"evictions"`
+	Expirations uint64  `json:"expirations"`
+	HitRate     float64 `json:"hitRate"`
+}
+
+// LRUCache is a Cache with byte budgets, least recently used eviction and per entry expiry
+type LRUCache struct {
+	lock    sync.Mutex
+	config  LRUConfig
+	buckets map[string]*lruBucket
+	bytes   int64
+	tick    uint64
+	stats   LRUStats
+	now     func() time.Time
+}
+
+type lruBucket struct {
+	items map[string]*list.Element
+	order *list.List // front is most recently used
+	bytes int64
+}
+
+type lruEntry struct {
+	key      string
+	val      []byte
+	expires  time.Time
+	lastUsed uint64
+}
+
+func NewLRUCache(config LRUConfig) *LRUCache {
+	return &LRUCache{
+		config:  config,
+		buckets: map[string]*lruBucket{},
+		now:     time.Now,
+	}
+}
+
+func (c *LRUCache) Get(bucket string, key string) []byte {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	b := c.buckets[bucket]
+	if b == nil {
+		c.stats.Misses++
+		return nil
+	}
+	el := b.items[key]
+	if el == nil {
+		c.stats.Misses++
+		return nil
+	}
+	e := el.Value.(*lruEntry)
+	if !e.expires.IsZero() && c.now().After(e.expires) {
+		c.remove(b, el)
+		c.stats.Expirations++
+		c.stats.Misses++
+		return nil
+	}
+
+	c.stats.Hits++
+	c.tick++
+	e.lastUsed = c.tick
+	b.order.MoveToFront(el)
+	return e.val
+}
+
+// Set implements Cache, the entry expires after the configured default TTL
+func (c *LRUCache) Set(bucket string, key string, val []byte) {
+	c.SetWithTTL(bucket, key, val, c.config.TTL)
+}
+
+func (c *LRUCache) SetWithTTL(bucket string, key string, val []byte, ttl time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	size := entrySize(key, val)
+	if (c.config.MaxBytes > 0 && size > c.config.MaxBytes) ||
+		(c.config.MaxBytesPerBucket > 0 && size > c.config.MaxBytesPerBucket) {
+		return
+	}
+
+	b := c.buckets[bucket]
+	if b == nil {
+		b = &lruBucket{items: map[string]*list.Element{}, order: list.New()}
+		c.buckets[bucket] = b
+	}
+	if el := b.items[key]; el != nil {
+		c.remove(b, el)
+	}
+
+	c.tick++
+	e := &lruEntry{key: key, val: val, lastUsed: c.tick}
+	if ttl > 0 {
+		e.expires = c.now().Add(ttl)
+	}
+	b.items[key] = b.order.PushFront(e)
+	b.bytes += size
+	c.bytes += size
+
+	for c.config.MaxBytesPerBucket > 0 && b.bytes > c.config.MaxBytesPerBucket {
+		c.evict(b)
+	}
+	for c.config.MaxBytes > 0 && c.bytes > c.config.MaxBytes {
+		c.evict(c.oldestBucket())
+	}
+}
+
+func (c *LRUCache) Del(bucket string, key string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if b := c.buckets[bucket]; b != nil {
+		if el := b.items[key]; el != nil {
+			c.remove(b, el)
+		}
+	}
+}
+
+func (c *LRUCache) ClearBucket(bucket string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if b := c.buckets[bucket]; b != nil {
+		c.bytes -= b.bytes
+		delete(c.buckets, bucket)
+	}
+}
+
+// The context variants ignore ctx, there's nothing to wait for in memory
+
+func (c *LRUCache) GetContext(ctx context.Context, bucket string, key string) []byte {
+	return c.Get(bucket, key)
+}
+
+func (c *LRUCache) SetContext(ctx context.Context, bucket string, key string, val []byte) {
+	c.Set(bucket, key, val)
+}
+
+func (c *LRUCache) DelContext(ctx context.Context, bucket string, key string) {
+	c.Del(bucket, key)
+}
+
+func (c *LRUCache) ClearBucketContext(ctx context.Context, bucket string) {
+	c.ClearBucket(bucket)
+}
+
+func (c *LRUCache) Stats() LRUStats {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	stats := c.stats
+	stats.Bytes = c.bytes
+	for _, b := range c.buckets {
+		stats.Entries += len(b.items)
+	}
+	if total := stats.Hits + stats.Misses; total > 0 {
+		stats.HitRate = float64(stats.Hits) / float64(total)
+	}
+	return stats
+}
+
+func (c *LRUCache) evict(b *lruBucket) {
+	el := b.order.Back()
+	e := el.Value.(*lruEntry)
+	if !e.expires.IsZero() && c.now().After(e.expires) {
+		c.stats.Expirations++
+	} else {
+		c.stats.Evictions++
+	}
+	c.remove(b, el)
+}
+
+// oldestBucket returns the bucket holding the least recently used entry overall
+func (c *LRUCache) oldestBucket() *lruBucket {
+	var oldest *lruBucket
+	var oldestTick uint64
+	for _, b := range c.buckets {
+		el := b.order.Back()
+		if el == nil {
+			continue
+		}
+		if t := el.Value.(*lruEntry).lastUsed; oldest == nil || t < oldestTick {
+			oldest = b
+			oldestTick = t
+		}
+	}
+	return oldest
+}
+
+func (c *LRUCache) remove(b *lruBucket, el *list.Element) {
+	e := b.order.Remove(el).(*lruEntry)
+	delete(b.items, e.key)
+	size := entrySize(e.key, e.val)
+	b.bytes -= size
+	c.bytes -= size
+}
+
+func entrySize(key string, val []byte) int64 {
+	return int64(len(key) + len(val))
+}
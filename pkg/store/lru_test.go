@@ -0,0 +1,78 @@
+package store_test
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fnurk/geom/pkg/store"
+)
+
+func TestLRUCache_Eviction(t *testing.T) {
+	c := store.NewLRUCache(store.LRUConfig{MaxBytes: 40, MaxBytesPerBucket: 30})
+
+	c.Set("a", "1", []byte("123456789")) //10 bytes
+	c.Set("a", "2", []byte("123456789"))
+	c.Get("a", "1")
+	c.Set("a", "3", []byte("123456789"))
+	c.Set("a", "4", []byte("123456789")) //over the bucket budget, 2 is the oldest
+
+	if c.Get("a", "2") != nil {
+		t.Error("expected 2 to be evicted")
+	}
+	if c.Get("a", "1") == nil {
+		t.Error("expected 1 to be kept")
+	}
+
+	c.Set("b", "1", []byte("123456789"))
+	c.Set("b", "2", []byte("123456789")) //over the total budget, a/3 is the oldest
+
+	if c.Get("a", "3") != nil {
+		t.Error("expected a/3 to be evicted")
+	}
+
+	stats := c.Stats()
+	if stats.Bytes > 40 || stats.Evictions != 2 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+func TestLRUCache_TTL(t *testing.T) {
+	c := store.NewLRUCache(store.LRUConfig{})
+
+	c.SetWithTTL("a", "1", []byte("x"), time.Millisecond)
+	c.Set("a", "2", []byte("y"))
+	time.Sleep(5 * time.Millisecond)
+
+	if c.Get("a", "1") != nil {
+		t.Error("expected entry to expire")
+	}
+	if c.Get("a", "2") == nil {
+		t.Error("expected entry without ttl to be kept")
+	}
+	if c.Stats().Expirations != 1 {
+		t.Errorf("expected 1 expiration, got %+v", c.Stats())
+	}
+}
+
+func TestCaches_Concurrent(t *testing.T) {
+	caches := []store.Cache{store.NewInMemKV(), store.NewLRUCache(store.LRUConfig{MaxBytes: 1000})}
+
+	for _, c := range caches {
+		wg := sync.WaitGroup{}
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				for j := 0; j < 1000; j++ {
+					bucket := fmt.Sprintf("b%d", j%10)
+					c.Set(bucket, fmt.Sprint(i), []byte("value"))
+					c.Get(bucket, fmt.Sprint(j))
+					c.Del(bucket, fmt.Sprint(j))
+				}
+			}(i)
+		}
+		wg.Wait()
+	}
+}
@@ -0,0 +1,199 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/fnurk/geom/pkg/model"
+)
+
+var ErrInvalidOp = errors.New("invalid operation")
+
+type OpKind string
+
+const (
+	// Add Value to the number at Path, a missing field counts as 0
+	OpInc OpKind = "inc"
+	OpSet OpKind = "set"
+	// Remove the field at Path
+	OpUnset OpKind = "unset"
+	// Append Value to the array at Path, a missing field counts as an empty array
+	OpPush OpKind = "push"
+	// Remove every element equal to Value from the array at Path
+	OpPull OpKind = "pull"
+	// Append Value to the array at Path unless it's already there
+	OpAddToSet OpKind = "addToSet"
+)
+
+// Op changes a single field, paths are the dot separated paths of model.Lookup
+type Op struct {
+	Kind  OpKind      `json:"op"`
+	Path  string      `json:"path"`
+	Value interface{} `json:"value,omitempty"`
+}
+
+func Inc(path string, n float64) Op {
+	return Op{Kind: OpInc, Path: path, Value: n}
+}
+
+func Set(path string, value interface{}) Op {
+	return Op{Kind: OpSet, Path: path, Value: value}
+}
+
+func Unset(path string) Op {
+	return Op{Kind: OpUnset, Path: path}
+}
+
+func Push(path string, value interface{}) Op {
+	return Op{Kind: OpPush, Path: path, Value: value}
+}
+
+func Pull(path string, value interface{}) Op {
+	return Op{Kind: OpPull, Path: path, Value: value}
+}
+
+func AddToSet(path string, value interface{}) Op {
+	return Op{Kind: OpAddToSet, Path: path, Value: value}
+}
+
+func (ds *Datastore) Apply(t string, id string, ops ...Op) ([]byte, error) {
+	return ds.ApplyContext(context.Background(), t, id, nil, ops...)
+}
+
+// ApplyContext applies ops to the stored document in a single transaction and returns the result.
+// check runs first with the stored document, returning an error aborts the whole thing. A failing op
+// leaves the document unchanged.
+func (ds *Datastore) ApplyContext(ctx context.Context, t string, id string, check func(current []byte) error, ops ...Op) ([]byte, error) {
+	var result []byte
+
+	err := ds.Update(ctx, func(tx Tx) error {
+		current, err := tx.Get(t, id)
+		if err != nil {
+			return err
+		}
+		if current == nil {
+			return ErrDocumentNotFound
+		}
+		if check != nil {
+			if err := check(current); err != nil {
+				return err
+			}
+		}
+
+		obj, err := model.DecodeObject(current)
+		if err != nil {
+			return err
+		}
+		for _, op := range ops {
+			if err := applyOp(obj, op); err != nil {
+				return err
+			}
+		}
+
+		data, err := json.Marshal(obj)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Put(t, id, data); err != nil {
+			return err
+		}
+
+		//computed fields may have changed on the way in
+		result, err = tx.Get(t, id)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func applyOp(obj map[string]interface{}, op Op) error {
+	if op.Path == "" || strings.HasPrefix(op.Path, AttachmentsField) {
+		return fmt.Errorf("%w: can't change %q", ErrInvalidOp, op.Path)
+	}
+
+	cur, exists := model.Lookup(obj, op.Path)
+
+	switch op.Kind {
+	case OpSet:
+		return model.Assign(obj, op.Path, op.Value)
+
+	case OpUnset:
+		model.Remove(obj, op.Path)
+		return nil
+
+	case OpInc:
+		delta, ok := model.Number(op.Value)
+		if !ok {
+			return fmt.Errorf("%w: inc %s by a non-number", ErrInvalidOp, op.Path)
+		}
+		n := 0.0
+		if exists && cur != nil {
+			if n, ok = model.Number(cur); !ok {
+				return fmt.Errorf("%w: %s is not a number", ErrInvalidOp, op.Path)
+			}
+		}
+		return model.Assign(obj, op.Path, n+delta)
+
+	case OpPush, OpPull, OpAddToSet:
+		arr := []interface{}{}
+		if exists && cur != nil {
+			a, ok := cur.([]interface{})
+			if !ok {
+				return fmt.Errorf("%w: %s is not an array", ErrInvalidOp, op.Path)
+			}
+			arr = a
+		}
+
+		switch op.Kind {
+		case OpPush:
+			arr = append(arr, op.Value)
+		case OpAddToSet:
+			if indexOf(arr, op.Value) < 0 {
+				arr = append(arr, op.Value)
+			}
+		case OpPull:
+			kept := []interface{}{}
+			for _, v := range arr {
+				if !jsonEqual(v, op.Value) {
+					kept = append(kept, v)
+				}
+			}
+			arr = kept
+		}
+		return model.Assign(obj, op.Path, arr)
+	}
+
+	return fmt.Errorf("%w: unknown op %q", ErrInvalidOp, op.Kind)
+}
+
+func indexOf(arr []interface{}, v interface{}) int {
+	for i := range arr {
+		if jsonEqual(arr[i], v) {
+			return i
+		}
+	}
+	return -1
+}
+
+// jsonEqual compares numbers by value and everything else by its encoding
+func jsonEqual(a interface{}, b interface{}) bool {
+	if an, ok := model.Number(a); ok {
+		bn, ok := model.Number(b)
+		return ok && an == bn
+	}
+	ab, err := json.Marshal(a)
+	if err != nil {
+		return false
+	}
+	bb, err := json.Marshal(b)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(ab, bb)
+}
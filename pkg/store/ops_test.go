@@ -0,0 +1,90 @@
+package store_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/fnurk/geom/pkg/store"
+	"github.com/tidwall/gjson"
+)
+
+func TestDatastore_ApplyConcurrentInc(t *testing.T) {
+	ds := newTestDatastore(t)
+	ds.Put("bulk", "1", []byte(`{"likes":0}`))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := ds.Apply("bulk", "1", store.Inc("likes", 1)); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	doc, _ := ds.Get("bulk", "1")
+	if n := gjson.GetBytes(doc, "likes").Int(); n != 50 {
+		t.Errorf("expected 50 likes, got %d", n)
+	}
+}
+
+func TestDatastore_ApplyOps(t *testing.T) {
+	ds := newTestDatastore(t)
+	ds.Put("bulk", "1", []byte(`{"body":"a","sharedWith":["1"],"meta":{"old":true}}`))
+
+	doc, err := ds.Apply("bulk", "1",
+		store.AddToSet("sharedWith", "2"),
+		store.AddToSet("sharedWith", "1"),
+		store.Push("tags", "x"),
+		store.Push("tags", "y"),
+		store.Pull("tags", "x"),
+		store.Set("meta.count", 3),
+		store.Unset("meta.old"),
+		store.Inc("meta.count", 1.5),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect := map[string]string{
+		"sharedWith": `["1","2"]`,
+		"tags":       `["y"]`,
+		"meta":       `{"count":4.5}`,
+		"body":       `"a"`,
+	}
+	for path, want := range expect {
+		if got := gjson.GetBytes(doc, path).Raw; got != want {
+			t.Errorf("%s: expected %s, got %s", path, want, got)
+		}
+	}
+}
+
+func TestDatastore_ApplyFailureChangesNothing(t *testing.T) {
+	ds := newTestDatastore(t)
+	ds.Put("bulk", "1", []byte(`{"body":"a","n":1}`))
+
+	_, err := ds.Apply("bulk", "1", store.Inc("n", 1), store.Inc("body", 1))
+	if !errors.Is(err, store.ErrInvalidOp) {
+		t.Errorf("expected ErrInvalidOp, got %v", err)
+	}
+
+	denied := errors.New("denied")
+	_, err = ds.ApplyContext(context.Background(), "bulk", "1", func(current []byte) error {
+		return denied
+	}, store.Inc("n", 1))
+	if err != denied {
+		t.Errorf("expected the check error, got %v", err)
+	}
+
+	if doc, _ := ds.Get("bulk", "1"); gjson.GetBytes(doc, "n").Int() != 1 {
+		t.Errorf("document changed: %s", doc)
+	}
+
+	if _, err := ds.Apply("bulk", "404", store.Inc("n", 1)); err != store.ErrDocumentNotFound {
+		t.Errorf("expected ErrDocumentNotFound, got %v", err)
+	}
+}
@@ -0,0 +1,256 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/tidwall/gjson"
+)
+
+// DefaultMaxScan is how many documents a query looks at if Query.MaxScan isn't set
+const DefaultMaxScan = 10000
+
+type SortField struct {
+	Path string
+	Desc bool
+}
+
+// ParseSort parses a comma separated list of paths, a leading - sorts descending, eg. "-created,title"
+func ParseSort(s string) []SortField {
+	fields := []SortField{}
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		f := SortField{Path: part}
+		if strings.HasPrefix(part, "-") {
+			f = SortField{Path: part[1:], Desc: true}
+		}
+		fields = append(fields, f)
+	}
+	return fields
+}
+
+type Query struct {
+	// nil matches every document
+	Filter *Filter
+	// Documents are in id order if Sort is empty
+	Sort []SortField
+	// 0 means no limit
+	Limit int
+	// The most documents looked at, the result is truncated if there are more. 0 is DefaultMaxScan.
+	MaxScan int
+	// Allow gets every matching document, those it rejects are left out and don't count towards Limit
+	Allow func(id string, doc []byte) bool
+}
+
+type QueryDoc struct {
+	Id  string          `json:"id"`
+	Doc json.RawMessage `json:"doc"`
+}
+
+// QueryPlan tells how a query was run
+type QueryPlan struct {
+	// The index used, as type.field, empty for a scan of every document
+	Index     string `json:"index,omitempty"`
+	IndexType string `json:"indexType,omitempty"`
+	// The part of the filter the index was used for
+	Condition string `json:"condition,omitempty"`
+	// Documents the index pointed at
+	Candidates int `json:"candidates"`
+	// Documents looked at
+	Scanned int `json:"scanned"`
+	// Documents that matched the filter and were allowed
+	Matched int `json:"matched"`
+}
+
+type QueryResult struct {
+	Docs []QueryDoc `json:"docs"`
+	// MaxScan was reached before every candidate was looked at
+	Truncated bool      `json:"truncated"`
+	Plan      QueryPlan `json:"-"`
+}
+
+// Query finds the documents of type t matching q.Filter. One condition of the filter, one that every
+// match has to pass, is looked up in an index if there is one for its path. The rest of the filter is
+// checked on the documents themselves.
+func (ds *Datastore) Query(ctx context.Context, t string, q Query) (QueryResult, error) {
+	res := QueryResult{Docs: []QueryDoc{}}
+	maxScan := q.MaxScan
+	if maxScan <= 0 {
+		maxScan = DefaultMaxScan
+	}
+
+	idx, cond, ranges := ds.planQuery(t, q.Filter)
+	if cond != nil {
+		if err := ds.buildIndex(ctx, t, idx); err != nil {
+			return res, err
+		}
+		res.Plan.Index = t + "." + idx.fieldName
+		res.Plan.IndexType = string(idx.indexType)
+		res.Plan.Condition = cond.String()
+	}
+
+	stop := errors.New("stop")
+	visit := func(id string, doc []byte) error {
+		if res.Plan.Scanned >= maxScan {
+			res.Truncated = true
+			return stop
+		}
+		res.Plan.Scanned++
+		if !q.Filter.Match(doc) || (q.Allow != nil && !q.Allow(id, doc)) {
+			return nil
+		}
+		res.Docs = append(res.Docs, QueryDoc{Id: id, Doc: doc})
+		if len(q.Sort) == 0 && q.Limit > 0 && len(res.Docs) >= q.Limit {
+			return stop
+		}
+		return nil
+	}
+
+	err := ds.View(ctx, func(tx Tx) error {
+		if cond == nil {
+			err := tx.ForEach(t, visit)
+			if err == ErrBucketNotFound {
+				return nil
+			}
+			return err
+		}
+
+		ids, err := ds.indexCandidates(ctx, tx, t, idx, ranges)
+		if err != nil {
+			return err
+		}
+		res.Plan.Candidates = len(ids)
+		for _, id := range ids {
+			doc, err := tx.Get(t, id)
+			if err != nil {
+				return err
+			}
+			if doc == nil {
+				continue
+			}
+			if err := visit(id, doc); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil && err != stop {
+		return QueryResult{}, err
+	}
+	res.Plan.Matched = len(res.Docs)
+
+	if len(q.Sort) > 0 {
+		sortDocs(res.Docs, q.Sort)
+	}
+	if q.Limit > 0 && len(res.Docs) > q.Limit {
+		res.Docs = res.Docs[:q.Limit]
+	}
+	return res, nil
+}
+
+// planQuery picks the condition to look up in an index, equality before ranges
+func (ds *Datastore) planQuery(t string, f *Filter) (Index, *Filter, [][2][]byte) {
+	if f == nil {
+		return Index{}, nil, nil
+	}
+	conds := []*Filter{f}
+	if f.Op == "and" {
+		conds = f.Children
+	}
+
+	var best *Filter
+	var bestIdx Index
+	var bestRanges [][2][]byte
+	for _, c := range conds {
+		if c.Op == "and" || c.Op == "or" {
+			continue
+		}
+		idx, ok := ds.findIndex(t, c.Path)
+		if !ok {
+			continue
+		}
+		ranges, ok := indexRanges(c)
+		if !ok {
+			continue
+		}
+		if best == nil || (isRange(best) && !isRange(c)) {
+			best, bestIdx, bestRanges = c, idx, ranges
+		}
+	}
+	return bestIdx, best, bestRanges
+}
+
+func isRange(f *Filter) bool {
+	return strings.ContainsAny(f.Op, "<>")
+}
+
+func sortDocs(docs []QueryDoc, fields []SortField) {
+	sort.SliceStable(docs, func(i, j int) bool {
+		for _, f := range fields {
+			c := compareResults(gjson.GetBytes(docs[i].Doc, f.Path), gjson.GetBytes(docs[j].Doc, f.Path))
+			if c == 0 {
+				continue
+			}
+			if f.Desc {
+				return c > 0
+			}
+			return c < 0
+		}
+		return false
+	})
+}
+
+// compareResults orders like view keys: missing and null, false, true, numbers, strings and then
+// arrays and objects by their json
+func compareResults(a gjson.Result, b gjson.Result) int {
+	ra, rb := resultRank(a), resultRank(b)
+	if ra != rb {
+		return ra - rb
+	}
+	switch a.Type {
+	case gjson.Number:
+		switch {
+		case a.Num < b.Num:
+			return -1
+		case a.Num > b.Num:
+			return 1
+		}
+		return 0
+	case gjson.String:
+		return strings.Compare(a.Str, b.Str)
+	case gjson.JSON:
+		return strings.Compare(a.Raw, b.Raw)
+	}
+	return 0
+}
+
+func resultRank(r gjson.Result) int {
+	switch r.Type {
+	case gjson.Null:
+		return 0
+	case gjson.False:
+		return 1
+	case gjson.True:
+		return 2
+	case gjson.Number:
+		return 3
+	case gjson.String:
+		return 4
+	}
+	return 5
+}
+
+func (p QueryPlan) String() string {
+	if p.Index == "" {
+		return fmt.Sprintf("scan, %d scanned, %d matched", p.Scanned, p.Matched)
+	}
+	return fmt.Sprintf("%s index %s for %s, %d candidates, %d scanned, %d matched",
+		p.IndexType, p.Index, p.Condition, p.Candidates, p.Scanned, p.Matched)
+}
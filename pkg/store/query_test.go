@@ -0,0 +1,192 @@
+package store_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/fnurk/geom/pkg/store"
+)
+
+func TestParseFilter(t *testing.T) {
+	valid := map[string]string{
+		`status == "open"`: `status == "open"`,
+		`a.b>=2 and (c != null or tags contains "x") and n in [1,2]`: `a.b >= 2 and (c != null or tags contains "x") and n in [1,2]`,
+		`android<"b" or indigo contains 1`:                           `android < "b" or indigo contains 1`,
+	}
+	for s, want := range valid {
+		f, err := store.ParseFilter(s)
+		if err != nil {
+			t.Errorf("%s: %v", s, err)
+			continue
+		}
+		if f.String() != want {
+			t.Errorf("%s: parsed as %s", s, f.String())
+		}
+	}
+
+	for _, s := range []string{``, `status`, `status ==`, `status == open`, `(a == 1`, `a == 1 b == 2`, `a in 1`, `a ~ 1`} {
+		if _, err := store.ParseFilter(s); !errors.Is(err, store.ErrInvalidFilter) {
+			t.Errorf("%s: expected ErrInvalidFilter, got %v", s, err)
+		}
+	}
+}
+
+func TestFilter_Match(t *testing.T) {
+	doc := []byte(`{"status":"open","n":2,"tags":["a","b"],"meta":{"owner":"alice"},"none":null}`)
+	cases := map[string]bool{
+		`status == "open"`:              true,
+		`n == 2.0`:                      true,
+		`n != 2`:                        false,
+		`n > 1 and n <= 2`:              true,
+		`n > "1"`:                       false,
+		`status < "p"`:                  true,
+		`meta.owner in ["bob","alice"]`: true,
+		`tags contains "b"`:             true,
+		`status contains "o"`:           false,
+		`missing == null`:               true,
+		`none == null and n < 0`:        false,
+		`n < 0 or tags contains "a"`:    true,
+		`tags == ["a","b"]`:             true,
+	}
+	for s, want := range cases {
+		f, err := store.ParseFilter(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f.Match(doc) != want {
+			t.Errorf("%s: expected %v", s, want)
+		}
+	}
+}
+
+func ids(res store.QueryResult) string {
+	s := []string{}
+	for _, d := range res.Docs {
+		s = append(s, d.Id)
+	}
+	return strings.Join(s, ",")
+}
+
+func query(t *testing.T, ds *store.Datastore, filter string, q store.Query) store.QueryResult {
+	t.Helper()
+	if filter != "" {
+		f, err := store.ParseFilter(filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		q.Filter = f
+	}
+	res, err := ds.Query(context.Background(), "task", q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+func testQuery(t *testing.T, db store.Database) {
+	ds := store.NewDatastore(db, nil)
+	ds.AddIndex("task", "status", store.PERSIST)
+	ds.AddIndex("task", "tags", store.INMEM)
+	if err := ds.Init(); err != nil {
+		t.Fatal(err)
+	}
+	ds.CreateBucketIfNotExists("task")
+
+	ds.Put("task", "1", []byte(`{"status":"open","priority":1,"tags":["x"]}`))
+	ds.Put("task", "2", []byte(`{"status":"done","priority":3,"tags":["x","y"]}`))
+	ds.Put("task", "3", []byte(`{"status":"open","priority":2}`))
+	ds.Put("task", "4", []byte(`{"status":"open","priority":5,"tags":["y"]}`))
+
+	res := query(t, ds, `status == "open"`, store.Query{})
+	if ids(res) != "1,3,4" || res.Plan.Index != "task.status" || res.Plan.Candidates != 3 {
+		t.Errorf("equality got %s %+v", ids(res), res.Plan)
+	}
+
+	//equality is picked over a range, in memory over persisted
+	res = query(t, ds, `priority > 1 and status >= "a" and tags contains "x"`, store.Query{})
+	if ids(res) != "2" || res.Plan.Index != "task.tags" || res.Plan.IndexType != store.INMEM || res.Plan.Candidates != 2 {
+		t.Errorf("contains got %s %+v", ids(res), res.Plan)
+	}
+
+	res = query(t, ds, `status > "done"`, store.Query{})
+	if ids(res) != "1,3,4" || res.Plan.Index != "task.status" {
+		t.Errorf("range got %s %+v", ids(res), res.Plan)
+	}
+
+	res = query(t, ds, `priority >= 2 or tags contains "x"`, store.Query{})
+	if ids(res) != "1,2,3,4" || res.Plan.Index != "" || res.Plan.Scanned != 4 {
+		t.Errorf("or got %s %+v", ids(res), res.Plan)
+	}
+
+	res = query(t, ds, `status in ["open","done"]`, store.Query{Sort: store.ParseSort("-priority"), Limit: 2})
+	if ids(res) != "4,2" || res.Plan.Matched != 4 {
+		t.Errorf("sorted got %s %+v", ids(res), res.Plan)
+	}
+
+	res = query(t, ds, `status == "open"`, store.Query{Allow: func(id string, doc []byte) bool { return id != "3" }, Limit: 2})
+	if ids(res) != "1,4" {
+		t.Errorf("allowed got %s", ids(res))
+	}
+
+	res = query(t, ds, ``, store.Query{MaxScan: 2})
+	if ids(res) != "1,2" || !res.Truncated {
+		t.Errorf("bounded scan got %s %v", ids(res), res.Truncated)
+	}
+
+	//writes move the rows
+	ds.Put("task", "1", []byte(`{"status":"done","priority":1,"tags":["z"]}`))
+	ds.Delete("task", "2")
+	res = query(t, ds, `status == "done"`, store.Query{})
+	if ids(res) != "1" || res.Plan.Candidates != 1 {
+		t.Errorf("after update got %s %+v", ids(res), res.Plan)
+	}
+	res = query(t, ds, `tags contains "x"`, store.Query{})
+	if ids(res) != "" || res.Plan.Candidates != 0 {
+		t.Errorf("after update got %s %+v", ids(res), res.Plan)
+	}
+
+	//a rolled back write leaves the indexes as they were
+	ds.Update(context.Background(), func(tx store.Tx) error {
+		tx.Put("task", "3", []byte(`{"status":"gone","tags":["z"]}`))
+		return errors.New("no")
+	})
+	res = query(t, ds, `tags contains "z"`, store.Query{})
+	if ids(res) != "1" || res.Plan.Candidates != 1 {
+		t.Errorf("after rollback got %s %+v", ids(res), res.Plan)
+	}
+	res = query(t, ds, `status == "gone"`, store.Query{})
+	if ids(res) != "" || res.Plan.Candidates != 0 {
+		t.Errorf("after rollback got %s %+v", ids(res), res.Plan)
+	}
+}
+
+func TestQuery_Bolt(t *testing.T) {
+	testQuery(t, newTestBolt(t))
+}
+
+func TestQuery_InMem(t *testing.T) {
+	testQuery(t, store.NewInMemDatabase())
+}
+
+func TestQuery_IndexAddedLater(t *testing.T) {
+	db := newTestBolt(t)
+
+	plain := store.NewDatastore(db, nil)
+	plain.CreateBucketIfNotExists("task")
+	plain.Put("task", "1", []byte(`{"status":"open"}`))
+	plain.Put("task", "2", []byte(`{"status":"done"}`))
+
+	for _, indexType := range []store.IndexType{store.PERSIST, store.INMEM} {
+		ds := store.NewDatastore(db, nil)
+		ds.AddIndex("task", "status", indexType)
+		ds.Init()
+		ds.CreateBucketIfNotExists("task")
+
+		res := query(t, ds, `status == "done"`, store.Query{})
+		if ids(res) != "2" || res.Plan.Candidates != 1 {
+			t.Errorf("%s index got %s %+v", indexType, ids(res), res.Plan)
+		}
+	}
+}
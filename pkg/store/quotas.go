@@ -0,0 +1,236 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/fnurk/geom/pkg/model"
+)
+
+// Usage per owner and type and the owner and size of every document are kept here
+const UsageBucket = "_usage"
+
+var (
+	ErrDocumentTooLarge = errors.New("document too large")
+	ErrQuotaExceeded    = errors.New("quota exceeded")
+)
+
+// Quota limits the documents of a type, 0 means no limit. Owners are set when a document is created,
+// from OwnerField if it's set and the acting identity otherwise. Documents without an owner only have
+// their size limited. Usage is counted from the moment a quota is set.
+type Quota struct {
+	MaxDocSize int
+	MaxDocs    int64
+	// Documents and the attachments on them
+	MaxBytes   int64
+	OwnerField string
+}
+
+// QuotaError tells which limit a write ran into, it matches ErrDocumentTooLarge or ErrQuotaExceeded with errors.Is
+type QuotaError struct {
+	Type  string
+	Owner string
+	// "size", "docs" or "bytes"
+	Limit string
+	Max   int64
+	// What it would have been after the write
+	Value int64
+}
+
+func (e *QuotaError) Error() string {
+	if e.Limit == "size" {
+		return fmt.Sprintf("%s: %s is %d bytes, the limit is %d", ErrDocumentTooLarge, e.Type, e.Value, e.Max)
+	}
+	return fmt.Sprintf("%s: %s of %s by %s would be %d, the limit is %d", ErrQuotaExceeded, e.Limit, e.Type, e.Owner, e.Value, e.Max)
+}
+
+func (e *QuotaError) Is(target error) bool {
+	if e.Limit == "size" {
+		return target == ErrDocumentTooLarge
+	}
+	return target == ErrQuotaExceeded
+}
+
+type Usage struct {
+	Docs     int64 `json:"docs"`
+	Bytes    int64 `json:"bytes"`
+	MaxDocs  int64 `json:"maxDocs,omitempty"`
+	MaxBytes int64 `json:"maxBytes,omitempty"`
+}
+
+type docUsage struct {
+	Owner string `json:"owner"`
+	Size  int64  `json:"size"`
+}
+
+// SetQuota limits the documents of type t, call it before Init
+func (ds *Datastore) SetQuota(t string, q Quota) {
+	ds.quotas[t] = q
+}
+
+// Usage returns what owner uses of every type that has a quota
+func (ds *Datastore) Usage(ctx context.Context, owner string) (map[string]Usage, error) {
+	usage := map[string]Usage{}
+	err := ds.View(ctx, func(tx Tx) error {
+		for t, q := range ds.quotas {
+			u, err := ownerUsage(tx, t, owner)
+			if err != nil {
+				return err
+			}
+			u.MaxDocs, u.MaxBytes = q.MaxDocs, q.MaxBytes
+			usage[t] = u
+		}
+		return nil
+	})
+	return usage, err
+}
+
+// checkQuota fails a write that would take its owner over a limit, writes that don't add to the usage always pass
+func (ds *Datastore) checkQuota(ctx context.Context, tx Tx, t string, id string, data []byte) error {
+	q, ok := ds.quotas[t]
+	if !ok {
+		return nil
+	}
+
+	if q.MaxDocSize > 0 && len(data) > q.MaxDocSize {
+		return &QuotaError{Type: t, Limit: "size", Max: int64(q.MaxDocSize), Value: int64(len(data))}
+	}
+
+	old, exists, err := documentUsage(tx, t, id)
+	if err != nil {
+		return err
+	}
+	owner := old.Owner
+	if !exists {
+		owner = q.owner(ctx, data)
+	}
+	if owner == "" {
+		return nil
+	}
+
+	u, err := ownerUsage(tx, t, owner)
+	if err != nil {
+		return err
+	}
+
+	if !exists && q.MaxDocs > 0 && u.Docs+1 > q.MaxDocs {
+		return &QuotaError{Type: t, Owner: owner, Limit: "docs", Max: q.MaxDocs, Value: u.Docs + 1}
+	}
+	size := documentSize(data)
+	if q.MaxBytes > 0 && size > old.Size && u.Bytes-old.Size+size > q.MaxBytes {
+		return &QuotaError{Type: t, Owner: owner, Limit: "bytes", Max: q.MaxBytes, Value: u.Bytes - old.Size + size}
+	}
+	return nil
+}
+
+// account moves the usage of a document that has been written, data is nil for deletes
+func (ds *Datastore) account(ctx context.Context, tx Tx, t string, id string, data []byte) error {
+	q, ok := ds.quotas[t]
+	if !ok {
+		return nil
+	}
+	id = btos(strtob(id))
+
+	old, exists, err := documentUsage(tx, t, id)
+	if err != nil || (data == nil && !exists) {
+		return err
+	}
+
+	cur := old
+	if !exists {
+		cur.Owner = q.owner(ctx, data)
+	}
+	if data == nil {
+		cur.Size = 0
+	} else {
+		cur.Size = documentSize(data)
+	}
+
+	if cur.Owner != "" {
+		u, err := ownerUsage(tx, t, cur.Owner)
+		if err != nil {
+			return err
+		}
+		u.Bytes += cur.Size - old.Size
+		switch {
+		case data == nil && exists:
+			u.Docs--
+		case data != nil && !exists:
+			u.Docs++
+		}
+		raw, err := json.Marshal(u)
+		if err != nil {
+			return err
+		}
+		if err := tx.PutKey(UsageBucket, ownerUsageKey(t, cur.Owner), raw); err != nil {
+			return err
+		}
+	}
+
+	if data == nil {
+		return tx.DeleteKey(UsageBucket, documentUsageKey(t, id))
+	}
+	raw, err := json.Marshal(cur)
+	if err != nil {
+		return err
+	}
+	return tx.PutKey(UsageBucket, documentUsageKey(t, id), raw)
+}
+
+func (q Quota) owner(ctx context.Context, data []byte) string {
+	if q.OwnerField == "" {
+		return IdentityFrom(ctx)
+	}
+	obj, err := model.DecodeObject(data)
+	if err != nil {
+		return ""
+	}
+	owner, _ := model.Lookup(obj, q.OwnerField)
+	s, _ := owner.(string)
+	return s
+}
+
+// documentSize is the size of the document and its attachments. The attachment metadata is the one the
+// attachment methods wrote, other writes can't change it, see checkAttachments.
+func documentSize(data []byte) int64 {
+	size := int64(len(data))
+	if atts, err := DecodeAttachments(data); err == nil {
+		for _, att := range atts {
+			size += att.Size
+		}
+	}
+	return size
+}
+
+func ownerUsage(tx Tx, t string, owner string) (Usage, error) {
+	u := Usage{}
+	raw, err := tx.GetKey(UsageBucket, ownerUsageKey(t, owner))
+	if err != nil || raw == nil {
+		return u, err
+	}
+	err = json.Unmarshal(raw, &u)
+	return u, err
+}
+
+func documentUsage(tx Tx, t string, id string) (docUsage, bool, error) {
+	du := docUsage{}
+	if id == "" {
+		return du, false, nil
+	}
+	raw, err := tx.GetKey(UsageBucket, documentUsageKey(t, btos(strtob(id))))
+	if err != nil || raw == nil {
+		return du, false, err
+	}
+	err = json.Unmarshal(raw, &du)
+	return du, true, err
+}
+
+func ownerUsageKey(t string, owner string) []byte {
+	return []byte("o\x00" + t + "\x00" + owner)
+}
+
+func documentUsageKey(t string, id string) []byte {
+	return []byte("d\x00" + t + "\x00" + id)
+}
@@ -0,0 +1,125 @@
+package store_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/fnurk/geom/pkg/store"
+)
+
+func TestDatastore_Quotas(t *testing.T) {
+	ds := store.NewDatastore(newTestBolt(t), nil)
+	ds.SetQuota("note", store.Quota{MaxDocSize: 100, MaxDocs: 2, MaxBytes: 150})
+	if err := ds.Init(); err != nil {
+		t.Fatal(err)
+	}
+	ds.CreateBucketIfNotExists("note")
+
+	alice := store.WithIdentity(context.Background(), "alice")
+	bob := store.WithIdentity(context.Background(), "bob")
+
+	_, err := ds.PutContext(alice, "note", "", []byte(`{"body":"`+strings.Repeat("x", 100)+`"}`))
+	qe := &store.QuotaError{}
+	if !errors.Is(err, store.ErrDocumentTooLarge) || !errors.As(err, &qe) || qe.Limit != "size" {
+		t.Errorf("expected a size error, got %v", err)
+	}
+
+	doc := []byte(`{"body":"` + strings.Repeat("x", 50) + `"}`) //61 bytes
+	if _, err := ds.PutContext(alice, "note", "1", doc); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ds.PutContext(alice, "note", "2", doc); err != nil {
+		t.Fatal(err)
+	}
+
+	//third document
+	if _, err := ds.PutContext(alice, "note", "", []byte(`{}`)); !errors.Is(err, store.ErrQuotaExceeded) {
+		t.Errorf("expected ErrQuotaExceeded for docs, got %v", err)
+	}
+	//growing a document past the byte limit, whoever writes it
+	big := []byte(`{"body":"` + strings.Repeat("x", 80) + `"}`)
+	if _, err := ds.PutContext(bob, "note", "1", big); !errors.As(err, &qe) || qe.Limit != "bytes" || qe.Owner != "alice" {
+		t.Errorf("expected alice's byte limit, got %v", err)
+	}
+	//shrinking is fine
+	if _, err := ds.PutContext(alice, "note", "1", []byte(`{}`)); err != nil {
+		t.Errorf("shrinking failed: %v", err)
+	}
+
+	//others have their own quota
+	if _, err := ds.PutContext(bob, "note", "3", doc); err != nil {
+		t.Errorf("bob's write failed: %v", err)
+	}
+
+	usage, err := ds.Usage(context.Background(), "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u := usage["note"]; u.Docs != 2 || u.Bytes != 63 || u.MaxDocs != 2 {
+		t.Errorf("unexpected usage %+v", u)
+	}
+
+	ds.DeleteContext(bob, "note", "2")
+	usage, _ = ds.Usage(context.Background(), "alice")
+	if u := usage["note"]; u.Docs != 1 || u.Bytes != 2 {
+		t.Errorf("unexpected usage after delete %+v", u)
+	}
+}
+
+func TestDatastore_QuotaOwnerField(t *testing.T) {
+	ds := store.NewDatastore(store.NewInMemDatabase(), nil)
+	ds.SetQuota("note", store.Quota{MaxDocs: 1, OwnerField: "createdBy"})
+	ds.Init()
+	ds.CreateBucketIfNotExists("note")
+
+	ds.Put("note", "", []byte(`{"createdBy":"alice"}`))
+	if _, err := ds.Put("note", "", []byte(`{"createdBy":"alice"}`)); !errors.Is(err, store.ErrQuotaExceeded) {
+		t.Errorf("expected ErrQuotaExceeded, got %v", err)
+	}
+	if _, err := ds.Put("note", "", []byte(`{"createdBy":"bob"}`)); err != nil {
+		t.Error(err)
+	}
+	//no owner, not counted
+	if _, err := ds.Put("note", "", []byte(`{}`)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDatastore_QuotaClientAttachments(t *testing.T) {
+	ds, _ := newAttachmentStore(t)
+	ds.SetQuota("note", store.Quota{MaxBytes: 1000})
+	if err := ds.Init(); err != nil {
+		t.Fatal(err)
+	}
+	ds.CreateBucketIfNotExists("note")
+	alice := store.WithIdentity(context.Background(), "alice")
+
+	//metadata made up by the client can't shrink what the attachments count
+	forged := []byte(`{"title":"a","_attachments":[{"name":"a.txt","size":0}]}`)
+	if _, err := ds.PutContext(alice, "note", "", forged); !errors.Is(err, store.ErrAttachmentsReadOnly) {
+		t.Errorf("expected ErrAttachmentsReadOnly creating, got %v", err)
+	}
+
+	id, err := ds.PutContext(alice, "note", "", []byte(`{"title":"a"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ds.PutAttachmentContext(alice, "note", id, "a.txt", "text/plain", strings.NewReader(strings.Repeat("x", 50))); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ds.PutContext(alice, "note", id, []byte(`{"title":"b","_attachments":[]}`)); !errors.Is(err, store.ErrAttachmentsReadOnly) {
+		t.Errorf("expected ErrAttachmentsReadOnly dropping attachments, got %v", err)
+	}
+
+	//writing back what was read keeps them
+	doc, _ := ds.GetContext(alice, "note", id)
+	if _, err := ds.PutContext(alice, "note", id, doc); err != nil {
+		t.Errorf("expected the document to be written back, got %v", err)
+	}
+	usage, _ := ds.Usage(context.Background(), "alice")
+	if u := usage["note"]; u.Bytes < 50 {
+		t.Errorf("expected the attachment to be counted, got %+v", u)
+	}
+}
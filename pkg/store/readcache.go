@@ -0,0 +1,101 @@
+package store
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+)
+
+type CachePolicy struct {
+	// Documents larger than this are read from the database every time, 0 means no limit
+	MaxDocSize int
+}
+
+type CacheStats struct {
+	Hits          uint64 `json:"hits"`
+	Misses        uint64 `json:"misses"`
+	Invalidations uint64 `json:"invalidations"`
+}
+
+type typeCache struct {
+	policy        CachePolicy
+	hits          uint64
+	misses        uint64
+	invalidations uint64
+
+	// generation is bumped on every invalidation so a read that raced with a write doesn't cache stale data
+	lock       sync.Mutex
+	generation uint64
+}
+
+// CacheType enables the read-through cache for documents of type t, call it before Init
+func (ds *Datastore) CacheType(t string, policy CachePolicy) {
+	ds.cachedTypes[t] = &typeCache{policy: policy}
+}
+
+func (ds *Datastore) CacheStats() map[string]CacheStats {
+	stats := map[string]CacheStats{}
+	for t, tc := range ds.cachedTypes {
+		stats[t] = CacheStats{
+			Hits:          atomic.LoadUint64(&tc.hits),
+			Misses:        atomic.LoadUint64(&tc.misses),
+			Invalidations: atomic.LoadUint64(&tc.invalidations),
+		}
+	}
+	return stats
+}
+
+func (ds *Datastore) typeCache(t string) *typeCache {
+	if ds.cache == nil {
+		return nil
+	}
+	return ds.cachedTypes[t]
+}
+
+func (ds *Datastore) cachedGet(ctx context.Context, tc *typeCache, t string, id string) ([]byte, error) {
+	if v := cacheGet(ctx, ds.cache, cacheBucket(ctx, t), id); v != nil {
+		atomic.AddUint64(&tc.hits, 1)
+		return v, nil
+	}
+	atomic.AddUint64(&tc.misses, 1)
+
+	tc.lock.Lock()
+	gen := tc.generation
+	tc.lock.Unlock()
+
+	v, err := GetContext(ctx, ds.db, t, id)
+	if err != nil || v == nil {
+		return v, err
+	}
+	if tc.policy.MaxDocSize > 0 && len(v) > tc.policy.MaxDocSize {
+		return v, nil
+	}
+
+	tc.lock.Lock()
+	if gen == tc.generation {
+		cacheSet(ctx, ds.cache, cacheBucket(ctx, t), id, v)
+	}
+	tc.lock.Unlock()
+
+	return v, nil
+}
+
+func (ds *Datastore) invalidate(ctx context.Context, t string, id string) {
+	tc := ds.typeCache(t)
+	if tc == nil {
+		return
+	}
+	tc.lock.Lock()
+	tc.generation++
+	cacheDel(ctx, ds.cache, cacheBucket(ctx, t), id)
+	tc.lock.Unlock()
+	atomic.AddUint64(&tc.invalidations, 1)
+}
+
+// cacheBucket keeps the documents of different tenants apart in a shared cache
+func cacheBucket(ctx context.Context, t string) string {
+	if tenant := TenantFrom(ctx); tenant != "" {
+		return tenant + "/" + t
+	}
+	return t
+}
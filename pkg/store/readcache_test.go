@@ -0,0 +1,55 @@
+package store_test
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/fnurk/geom/pkg/model"
+	"github.com/fnurk/geom/pkg/store"
+)
+
+type cachedDoc struct {
+	Body string `json:"body"`
+}
+
+func TestDatastore_ReadThroughCache(t *testing.T) {
+	db, err := store.NewBoltDb(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.PeriodicDump = false
+
+	model.RegisterType("cached", cachedDoc{})
+	ds := store.NewDatastore(db, store.NewInMemKV())
+	ds.CacheType("cached", store.CachePolicy{})
+	if err := ds.Init(); err != nil {
+		t.Fatal(err)
+	}
+	defer ds.Close()
+
+	ds.Put("cached", "1", []byte(`{"body":"a"}`))
+
+	for i := 0; i < 3; i++ {
+		doc, _ := ds.Get("cached", "1")
+		if string(doc) != `{"body":"a"}` {
+			t.Fatalf("unexpected doc %s", doc)
+		}
+	}
+
+	stats := ds.CacheStats()["cached"]
+	if stats.Misses != 1 || stats.Hits != 2 {
+		t.Errorf("expected 1 miss and 2 hits, got %+v", stats)
+	}
+
+	ds.Put("cached", "1", []byte(`{"body":"b"}`))
+	doc, _ := ds.Get("cached", "1")
+	if string(doc) != `{"body":"b"}` {
+		t.Errorf("expected put to invalidate, got %s", doc)
+	}
+
+	ds.Delete("cached", "1")
+	doc, _ = ds.Get("cached", "1")
+	if doc != nil {
+		t.Errorf("expected delete to invalidate, got %s", doc)
+	}
+}
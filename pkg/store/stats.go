@@ -0,0 +1,167 @@
+package store
+
+import (
+	"context"
+	"time"
+)
+
+// StatsProvider is implemented by databases that can describe their contents
+type StatsProvider interface {
+	Stats() (DatabaseStats, error)
+}
+
+type BucketStats struct {
+	Keys  int   `json:"keys"`
+	Bytes int64 `json:"bytes"`
+	Pages int   `json:"pages"`
+	Depth int   `json:"depth"`
+}
+
+type TxStats struct {
+	// Read transactions started and currently open
+	Started int `json:"started"`
+	Open    int `json:"open"`
+
+	PageCount     int64         `json:"pageCount"`
+	PageAlloc     int64         `json:"pageAlloc"`
+	Cursors       int64         `json:"cursors"`
+	Nodes         int64         `json:"nodes"`
+	Rebalances    int64         `json:"rebalances"`
+	RebalanceTime time.Duration `json:"rebalanceTime"`
+	Splits        int64         `json:"splits"`
+	Spills        int64         `json:"spills"`
+	SpillTime     time.Duration `json:"spillTime"`
+	Writes        int64         `json:"writes"`
+	WriteTime     time.Duration `json:"writeTime"`
+}
+
+type DatabaseStats struct {
+	Buckets map[string]BucketStats `json:"buckets"`
+
+	FileSize      int64 `json:"fileSize"`
+	PageSize      int   `json:"pageSize"`
+	FreePages     int   `json:"freePages"`
+	PendingPages  int   `json:"pendingPages"`
+	FreeBytes     int   `json:"freeBytes"`
+	FreelistInuse int   `json:"freelistInuse"`
+
+	Tx TxStats `json:"tx"`
+}
+
+type Stats struct {
+	DatabaseStats
+
+	// Document buckets, everything else in DatabaseStats.Buckets is internal
+	Documents map[string]BucketStats `json:"documents"`
+	Indexes   map[string]BucketStats `json:"indexes"`
+	Cache     map[string]CacheStats  `json:"cache"`
+	Time      time.Time              `json:"time"`
+}
+
+// Stats describes what is stored, the database has to implement StatsProvider for anything but cache stats
+func (ds *Datastore) Stats() (Stats, error) {
+	stats := Stats{
+		Documents: map[string]BucketStats{},
+		Indexes:   map[string]BucketStats{},
+		Cache:     ds.CacheStats(),
+		Time:      time.Now(),
+	}
+
+	sp, ok := ds.db.(StatsProvider)
+	if !ok {
+		return stats, nil
+	}
+
+	dbStats, err := sp.Stats()
+	if err != nil {
+		return stats, err
+	}
+	stats.DatabaseStats = dbStats
+
+	for name, b := range dbStats.Buckets {
+		switch {
+		case isIndexBucket(name):
+			stats.Indexes[name] = b
+		case !IsInternalBucket(name):
+			stats.Documents[name] = b
+		}
+	}
+
+	return stats, nil
+}
+
+func isIndexBucket(bucket string) bool {
+	return bucket == IndexBucket
+}
+
+// BucketLimit is a threshold for WatchStats, zero values are not checked
+type BucketLimit struct {
+	MaxKeys  int
+	MaxBytes int64
+	// Growth between two samples
+	MaxKeyGrowth  int
+	MaxByteGrowth int64
+}
+
+type Alert struct {
+	Bucket  string      `json:"bucket"`
+	Reason  string      `json:"reason"`
+	Limit   BucketLimit `json:"limit"`
+	Current BucketStats `json:"current"`
+	Before  BucketStats `json:"before"`
+}
+
+// CheckLimits compares stats against limits per bucket, before is the previous sample and may be empty
+func CheckLimits(stats Stats, before Stats, limits map[string]BucketLimit) []Alert {
+	alerts := []Alert{}
+	for bucket, limit := range limits {
+		cur, ok := stats.Buckets[bucket]
+		if !ok {
+			continue
+		}
+		prev, hasPrev := before.Buckets[bucket]
+		alert := func(reason string) {
+			alerts = append(alerts, Alert{Bucket: bucket, Reason: reason, Limit: limit, Current: cur, Before: prev})
+		}
+
+		if limit.MaxKeys > 0 && cur.Keys > limit.MaxKeys {
+			alert("too many keys")
+		}
+		if limit.MaxBytes > 0 && cur.Bytes > limit.MaxBytes {
+			alert("too many bytes")
+		}
+		if hasPrev && limit.MaxKeyGrowth > 0 && cur.Keys-prev.Keys > limit.MaxKeyGrowth {
+			alert("keys growing too fast")
+		}
+		if hasPrev && limit.MaxByteGrowth > 0 && cur.Bytes-prev.Bytes > limit.MaxByteGrowth {
+			alert("bytes growing too fast")
+		}
+	}
+	return alerts
+}
+
+// WatchStats samples stats every interval until ctx is done and calls onAlert for every exceeded limit
+func (ds *Datastore) WatchStats(ctx context.Context, interval time.Duration, limits map[string]BucketLimit, onAlert func(Alert)) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		before, _ := ds.Stats()
+		for {
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+
+			stats, err := ds.Stats()
+			if err != nil {
+				continue
+			}
+			for _, a := range CheckLimits(stats, before, limits) {
+				onAlert(a)
+			}
+			before = stats
+		}
+	}()
+}
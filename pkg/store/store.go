@@ -1,15 +1,31 @@
 package store
 
 import (
-	"fmt"
+	"context"
+	"errors"
 	"reflect"
+	"sort"
 	"strings"
+	"sync"
 
 	"github.com/fnurk/geom/pkg/model"
 )
 
+var (
+	ErrBucketNotFound   = errors.New("bucket not found")
+	ErrDocumentNotFound = errors.New("document not found")
+	ErrTxNotWritable    = errors.New("transaction not writable")
+	// Iterating needs a TxDatabase
+	ErrNoTransactions = errors.New("database does not support transactions")
+)
+
 type DbInitHook func(*Datastore) error
 type DbPutHook func(t string, id string, value []byte)
+type DbDeleteHook func(t string, id string)
+
+// Context hooks see the context of the write, eg. the identity that performed it
+type DbPutContextHook func(ctx context.Context, t string, id string, value []byte)
+type DbDeleteContextHook func(ctx context.Context, t string, id string)
 
 type Database interface {
 	Init() error
@@ -21,6 +37,34 @@ type Database interface {
 	Close()
 }
 
+// TxDatabase is a Database with transactions. Databases without them get their calls one by one, see UpdateTx.
+type TxDatabase interface {
+	Database
+	// The transaction is committed if fn returns nil and rolled back otherwise
+	View(ctx context.Context, fn func(Tx) error) error
+	Update(ctx context.Context, fn func(Tx) error) error
+}
+
+// Tx is a transaction from TxDatabase.View or TxDatabase.Update, writes in a View fail
+type Tx interface {
+	Get(bucket string, id string) ([]byte, error)
+	Put(bucket string, id string, data []byte) (string, error)
+	Delete(bucket string, id string) error
+	// ForEach calls fn for every document in bucket in id order, returning an error stops the iteration
+	ForEach(bucket string, fn func(id string, data []byte) error) error
+	// ForEachFrom is ForEach starting at the first document with an id >= id
+	ForEachFrom(bucket string, id string, fn func(id string, data []byte) error) error
+	// Last returns the id of the last document in bucket, "" if there's none
+	Last(bucket string) (string, error)
+
+	// Raw keys are for internal buckets that aren't keyed by document id, eg. views
+	GetKey(bucket string, key []byte) ([]byte, error)
+	PutKey(bucket string, key []byte, value []byte) error
+	DeleteKey(bucket string, key []byte) error
+	// ForEachKeyFrom calls fn for every key >= from in byte order, returning an error stops the iteration
+	ForEachKeyFrom(bucket string, from []byte, fn func(key []byte, value []byte) error) error
+}
+
 type Cache interface {
 	Get(bucket string, key string) []byte
 	Set(bucket string, key string, val []byte)
@@ -28,6 +72,140 @@ type Cache interface {
 	ClearBucket(bucket string)
 }
 
+// ContextDatabase is a Database whose calls see the context of the request, eg. to give up when it's done
+// or to tell tenants apart. Databases without it get the plain calls, see GetContext.
+type ContextDatabase interface {
+	Database
+	CreateBucketIfNotExistsContext(ctx context.Context, bucketName string) error
+	GetContext(ctx context.Context, bucket string, id string) ([]byte, error)
+	PutContext(ctx context.Context, bucket string, id string, data []byte) (string, error)
+	DeleteContext(ctx context.Context, bucket string, id string) error
+}
+
+// ContextCache is a Cache whose calls see the context of the request
+type ContextCache interface {
+	Cache
+	GetContext(ctx context.Context, bucket string, key string) []byte
+	SetContext(ctx context.Context, bucket string, key string, val []byte)
+	DelContext(ctx context.Context, bucket string, key string)
+	ClearBucketContext(ctx context.Context, bucket string)
+}
+
+func CreateBucketIfNotExistsContext(ctx context.Context, db Database, bucketName string) error {
+	if cdb, ok := db.(ContextDatabase); ok {
+		return cdb.CreateBucketIfNotExistsContext(ctx, bucketName)
+	}
+	return db.CreateBucketIfNotExists(bucketName)
+}
+
+// GetContext reads from db with ctx if it's a ContextDatabase, without otherwise
+func GetContext(ctx context.Context, db Database, bucket string, id string) ([]byte, error) {
+	if cdb, ok := db.(ContextDatabase); ok {
+		return cdb.GetContext(ctx, bucket, id)
+	}
+	return db.Get(bucket, id)
+}
+
+func PutContext(ctx context.Context, db Database, bucket string, id string, data []byte) (string, error) {
+	if cdb, ok := db.(ContextDatabase); ok {
+		return cdb.PutContext(ctx, bucket, id, data)
+	}
+	return db.Put(bucket, id, data)
+}
+
+func DeleteContext(ctx context.Context, db Database, bucket string, id string) error {
+	if cdb, ok := db.(ContextDatabase); ok {
+		return cdb.DeleteContext(ctx, bucket, id)
+	}
+	return db.Delete(bucket, id)
+}
+
+// ViewTx runs fn in a read transaction of db, see UpdateTx
+func ViewTx(ctx context.Context, db Database, fn func(Tx) error) error {
+	if tdb, ok := db.(TxDatabase); ok {
+		return tdb.View(ctx, fn)
+	}
+	return fn(directTx{db: db})
+}
+
+// UpdateTx runs fn in a write transaction of db. If db isn't a TxDatabase the writes are made as they come
+// and aren't rolled back when fn fails.
+func UpdateTx(ctx context.Context, db Database, fn func(Tx) error) error {
+	if tdb, ok := db.(TxDatabase); ok {
+		return tdb.Update(ctx, fn)
+	}
+	return fn(directTx{db: db})
+}
+
+// directTx passes the calls of a Tx to a Database without transactions, it can't iterate
+type directTx struct {
+	db Database
+}
+
+func (t directTx) Get(bucket string, id string) ([]byte, error) {
+	return t.db.Get(bucket, id)
+}
+
+func (t directTx) Put(bucket string, id string, data []byte) (string, error) {
+	return t.db.Put(bucket, id, data)
+}
+
+func (t directTx) Delete(bucket string, id string) error {
+	return t.db.Delete(bucket, id)
+}
+
+func (t directTx) ForEach(bucket string, fn func(id string, data []byte) error) error {
+	return ErrNoTransactions
+}
+
+func (t directTx) ForEachFrom(bucket string, id string, fn func(id string, data []byte) error) error {
+	return ErrNoTransactions
+}
+
+func (t directTx) Last(bucket string) (string, error) {
+	return "", ErrNoTransactions
+}
+
+func (t directTx) GetKey(bucket string, key []byte) ([]byte, error) {
+	return t.db.Get(bucket, string(key))
+}
+
+func (t directTx) PutKey(bucket string, key []byte, value []byte) error {
+	_, err := t.db.Put(bucket, string(key), value)
+	return err
+}
+
+func (t directTx) DeleteKey(bucket string, key []byte) error {
+	return t.db.Delete(bucket, string(key))
+}
+
+func (t directTx) ForEachKeyFrom(bucket string, from []byte, fn func(key []byte, value []byte) error) error {
+	return ErrNoTransactions
+}
+
+func cacheGet(ctx context.Context, c Cache, bucket string, key string) []byte {
+	if cc, ok := c.(ContextCache); ok {
+		return cc.GetContext(ctx, bucket, key)
+	}
+	return c.Get(bucket, key)
+}
+
+func cacheSet(ctx context.Context, c Cache, bucket string, key string, val []byte) {
+	if cc, ok := c.(ContextCache); ok {
+		cc.SetContext(ctx, bucket, key, val)
+		return
+	}
+	c.Set(bucket, key, val)
+}
+
+func cacheDel(ctx context.Context, c Cache, bucket string, key string) {
+	if cc, ok := c.(ContextCache); ok {
+		cc.DelContext(ctx, bucket, key)
+		return
+	}
+	c.Del(bucket, key)
+}
+
 type IndexType string
 
 const (
@@ -41,20 +219,42 @@ type Index struct {
 }
 
 type Datastore struct {
-	db        Database
-	cache     Cache
-	initHooks []DbInitHook
-	putHooks  []DbPutHook
-	indexMap  map[string][]Index
+	db          Database
+	cache       Cache
+	initHooks   []DbInitHook
+	putHooks    []DbPutContextHook
+	deleteHooks []DbDeleteContextHook
+	indexMap    map[string][]Index
+	blobs       *BlobStore
+	cachedTypes map[string]*typeCache
+	bucketLock  sync.RWMutex
+	buckets     map[string]struct{}
+	changeLog   bool
+	readOnly    bool
+	computed    map[string][]ComputedField
+	aggregates  map[string][]aggregateTarget
+	views       map[string]View
+	quotas      map[string]Quota
+	// in memory indexes per tenant, type and field
+	memIndexLock sync.Mutex
+	memIndexes   map[string]*memIndex
 }
 
 func NewDatastore(db Database, cache Cache) *Datastore {
 	return &Datastore{
-		db:        db,
-		cache:     cache,
-		initHooks: []DbInitHook{},
-		putHooks:  []DbPutHook{},
-		indexMap:  map[string][]Index{},
+		db:          db,
+		cache:       cache,
+		initHooks:   []DbInitHook{},
+		putHooks:    []DbPutContextHook{},
+		deleteHooks: []DbDeleteContextHook{},
+		indexMap:    map[string][]Index{},
+		cachedTypes: map[string]*typeCache{},
+		buckets:     map[string]struct{}{},
+		computed:    map[string][]ComputedField{},
+		aggregates:  map[string][]aggregateTarget{},
+		views:       map[string]View{},
+		quotas:      map[string]Quota{},
+		memIndexes:  map[string]*memIndex{},
 	}
 }
 
@@ -63,23 +263,54 @@ func (ds *Datastore) AddInitHook(hook DbInitHook) {
 }
 
 func (ds *Datastore) AddPutHook(hook DbPutHook) {
+	ds.AddPutContextHook(func(ctx context.Context, t string, id string, value []byte) {
+		hook(t, id, value)
+	})
+}
+
+func (ds *Datastore) AddPutContextHook(hook DbPutContextHook) {
 	ds.putHooks = append(ds.putHooks, hook)
 }
 
+func (ds *Datastore) AddDeleteHook(hook DbDeleteHook) {
+	ds.AddDeleteContextHook(func(ctx context.Context, t string, id string) {
+		hook(t, id)
+	})
+}
+
+func (ds *Datastore) AddDeleteContextHook(hook DbDeleteContextHook) {
+	ds.deleteHooks = append(ds.deleteHooks, hook)
+}
+
 func (ds *Datastore) Init() error {
 	err := ds.db.Init()
 
-	ds.db.CreateBucketIfNotExists("index")
+	ds.db.CreateBucketIfNotExists(IndexBucket)
 
 	for k := range model.Types {
-		err := ds.db.CreateBucketIfNotExists(k)
+		err := ds.CreateBucketIfNotExists(k)
 		if err != nil {
 			return err
 		}
 	}
 
+	if ds.changeLog {
+		if err := ds.db.CreateBucketIfNotExists(ChangesBucket); err != nil {
+			return err
+		}
+	}
+
+	if err := ds.createViewBuckets(); err != nil {
+		return err
+	}
+
+	if len(ds.quotas) > 0 {
+		if err := ds.db.CreateBucketIfNotExists(UsageBucket); err != nil {
+			return err
+		}
+	}
+
 	ds.populateIndexTypes()
-	ds.populateIndexes()
 
 	for _, ih := range ds.initHooks {
 		err := ih(ds)
@@ -92,45 +323,117 @@ func (ds *Datastore) Init() error {
 }
 
 func (ds *Datastore) CreateBucketIfNotExists(bucketName string) error {
-	return ds.db.CreateBucketIfNotExists(bucketName)
+	return ds.CreateBucketIfNotExistsContext(context.Background(), bucketName)
 }
 
 func (ds *Datastore) Get(bucket string, id string) ([]byte, error) {
-	return ds.db.Get(bucket, id)
+	return ds.GetContext(context.Background(), bucket, id)
 }
 
 func (ds *Datastore) Put(bucket string, id string, data []byte) (string, error) {
-	id, err := ds.db.Put(bucket, id, data)
+	return ds.PutContext(context.Background(), bucket, id, data)
+}
+
+func (ds *Datastore) Delete(bucket string, id string) error {
+	return ds.DeleteContext(context.Background(), bucket, id)
+}
+
+func (ds *Datastore) CreateBucketIfNotExistsContext(ctx context.Context, bucketName string) error {
+	err := CreateBucketIfNotExistsContext(ctx, ds.db, bucketName)
 	if err != nil {
-		return "", err
+		return err
 	}
 
-	for _, ph := range ds.putHooks {
-		ph(bucket, id, data)
+	ds.bucketLock.Lock()
+	ds.buckets[bucketName] = struct{}{}
+	ds.bucketLock.Unlock()
+	return nil
+}
+
+// Buckets returns the names of the buckets created through the Datastore
+func (ds *Datastore) Buckets() []string {
+	ds.bucketLock.RLock()
+	defer ds.bucketLock.RUnlock()
+	names := make([]string, 0, len(ds.buckets))
+	for name := range ds.buckets {
+		names = append(names, name)
 	}
+	sort.Strings(names)
+	return names
+}
 
+func (ds *Datastore) GetContext(ctx context.Context, bucket string, id string) ([]byte, error) {
+	if tc := ds.typeCache(bucket); tc != nil {
+		return ds.cachedGet(ctx, tc, bucket, id)
+	}
+	return GetContext(ctx, ds.db, bucket, id)
+}
+
+func (ds *Datastore) PutContext(ctx context.Context, bucket string, id string, data []byte) (string, error) {
+	err := ds.Update(ctx, func(tx Tx) error {
+		var err error
+		id, err = tx.Put(bucket, id, data)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
 	return id, nil
 }
 
-func (ds *Datastore) Delete(bucket string, id string) error {
-	return ds.db.Delete(bucket, id)
+func (ds *Datastore) DeleteContext(ctx context.Context, bucket string, id string) error {
+	return ds.Update(ctx, func(tx Tx) error {
+		return tx.Delete(bucket, id)
+	})
 }
 
-func (ds *Datastore) Close() {
-	ds.db.Close()
+// View runs fn in a read transaction, reads bypass the cache
+func (ds *Datastore) View(ctx context.Context, fn func(Tx) error) error {
+	return ViewTx(ctx, ds.db, fn)
 }
 
-func (ds *Datastore) populateIndexes() {
-	for typeName, idxs := range ds.indexMap {
-		for _, idx := range idxs {
-			if idx.indexType == INMEM {
-				prefix := fmt.Sprintf("%s_%s:", typeName, idx.fieldName)
-				fmt.Printf("Prefix: %s\n", prefix)
+// Update runs fn in a write transaction, the cache is invalidated and hooks run once it has committed
+func (ds *Datastore) Update(ctx context.Context, fn func(Tx) error) error {
+	if ds.readOnly && !isReplicaWrite(ctx) {
+		return ErrReadOnly
+	}
+
+	dtx := &datastoreTx{ds: ds, ctx: ctx}
+
+	err := UpdateTx(ctx, ds.db, func(tx Tx) error {
+		dtx.tx = tx
+		dtx.writes = nil
+		return fn(dtx)
+	})
+	if err != nil {
+		dropMemIndexes(dtx.memIndexes)
+		return err
+	}
+
+	for _, w := range dtx.writes {
+		ds.invalidate(ctx, w.bucket, w.id)
+	}
+
+	for _, w := range dtx.writes {
+		if w.deleted {
+			for _, dh := range ds.deleteHooks {
+				dh(ctx, w.bucket, w.id)
+			}
+		} else {
+			for _, ph := range ds.putHooks {
+				ph(ctx, w.bucket, w.id, w.data)
 			}
 		}
-
 	}
 
+	return nil
+}
+
+func (ds *Datastore) Close() {
+	ds.db.Close()
+	if ds.blobs != nil {
+		ds.blobs.Close()
+	}
 }
 
 func (ds *Datastore) populateIndexTypes() {
@@ -167,5 +470,170 @@ func (ds *Datastore) populateIndexTypes() {
 			}
 		}
 	}
-	fmt.Printf("INDEXES: %+v\n", ds.indexMap)
+}
+
+type write struct {
+	bucket  string
+	id      string
+	data    []byte
+	deleted bool
+}
+
+// datastoreTx records the writes of a transaction so they can be acted upon after commit
+type datastoreTx struct {
+	ds     *Datastore
+	ctx    context.Context
+	tx     Tx
+	writes []write
+	// in memory indexes changed by the transaction
+	memIndexes []*memIndex
+}
+
+func (dtx *datastoreTx) Get(bucket string, id string) ([]byte, error) {
+	return dtx.tx.Get(bucket, id)
+}
+
+func (dtx *datastoreTx) ForEach(bucket string, fn func(id string, data []byte) error) error {
+	return dtx.tx.ForEach(bucket, fn)
+}
+
+func (dtx *datastoreTx) ForEachFrom(bucket string, id string, fn func(id string, data []byte) error) error {
+	return dtx.tx.ForEachFrom(bucket, id, fn)
+}
+
+func (dtx *datastoreTx) Last(bucket string) (string, error) {
+	return dtx.tx.Last(bucket)
+}
+
+// Raw key writes are not recorded, they are for internal buckets
+func (dtx *datastoreTx) GetKey(bucket string, key []byte) ([]byte, error) {
+	return dtx.tx.GetKey(bucket, key)
+}
+
+func (dtx *datastoreTx) PutKey(bucket string, key []byte, value []byte) error {
+	return dtx.tx.PutKey(bucket, key, value)
+}
+
+func (dtx *datastoreTx) DeleteKey(bucket string, key []byte) error {
+	return dtx.tx.DeleteKey(bucket, key)
+}
+
+func (dtx *datastoreTx) ForEachKeyFrom(bucket string, from []byte, fn func(key []byte, value []byte) error) error {
+	return dtx.tx.ForEachKeyFrom(bucket, from, fn)
+}
+
+func (dtx *datastoreTx) Put(bucket string, id string, data []byte) (string, error) {
+	//replicas get attachments and computed fields from the leader's writes
+	if isReplicaWrite(dtx.ctx) {
+		return dtx.put(bucket, id, data)
+	}
+
+	var err error
+	if !isAttachmentWrite(dtx.ctx) && !IsInternalBucket(bucket) {
+		if data, err = dtx.ds.checkAttachments(dtx.tx, bucket, id, data); err != nil {
+			return "", err
+		}
+	}
+
+	data, err = dtx.ds.compute(dtx.tx, bucket, id, data)
+	if err != nil {
+		return "", err
+	}
+	if err := dtx.ds.checkQuota(dtx.ctx, dtx.tx, bucket, id, data); err != nil {
+		return "", err
+	}
+	old, err := dtx.referencing(bucket, id)
+	if err != nil {
+		return "", err
+	}
+
+	id, err = dtx.put(bucket, id, data)
+	if err != nil {
+		return "", err
+	}
+	return id, afterWrite(dtx.ds.aggregate(dtx, bucket, old, data))
+}
+
+// put writes data as is, without checking attachments or computing fields
+func (dtx *datastoreTx) put(bucket string, id string, data []byte) (string, error) {
+	old, err := dtx.indexed(bucket, id)
+	if err != nil {
+		return "", err
+	}
+	id, err = dtx.tx.Put(bucket, id, data)
+	if err != nil {
+		return "", err
+	}
+	if err := dtx.updateIndexes(bucket, id, old, data); err != nil {
+		return "", afterWrite(err)
+	}
+	if err := dtx.ds.updateViews(dtx.tx, bucket, id, data); err != nil {
+		return "", afterWrite(err)
+	}
+	if err := dtx.ds.account(dtx.ctx, dtx.tx, bucket, id, data); err != nil {
+		return "", afterWrite(err)
+	}
+	if err := dtx.ds.logChange(dtx.tx, Change{Bucket: bucket, Id: id, Data: data}); err != nil {
+		return "", afterWrite(err)
+	}
+	dtx.writes = append(dtx.writes, write{bucket: bucket, id: id, data: data})
+	return id, nil
+}
+
+func (dtx *datastoreTx) Delete(bucket string, id string) error {
+	var old []byte
+	if !isReplicaWrite(dtx.ctx) {
+		var err error
+		if old, err = dtx.referencing(bucket, id); err != nil {
+			return err
+		}
+	}
+
+	indexed, err := dtx.indexed(bucket, id)
+	if err != nil {
+		return err
+	}
+	err = dtx.tx.Delete(bucket, id)
+	if err != nil {
+		return err
+	}
+	if err := dtx.updateIndexes(bucket, id, indexed, nil); err != nil {
+		return afterWrite(err)
+	}
+	if err := dtx.ds.aggregate(dtx, bucket, old, nil); err != nil {
+		return afterWrite(err)
+	}
+	if err := dtx.ds.updateViews(dtx.tx, bucket, id, nil); err != nil {
+		return afterWrite(err)
+	}
+	if err := dtx.ds.account(dtx.ctx, dtx.tx, bucket, id, nil); err != nil {
+		return afterWrite(err)
+	}
+	if err := dtx.ds.logChange(dtx.tx, Change{Bucket: bucket, Id: id, Deleted: true}); err != nil {
+		return afterWrite(err)
+	}
+	dtx.writes = append(dtx.writes, write{bucket: bucket, id: id, deleted: true})
+	return nil
+}
+
+// writtenError is a failure after the document was written, the transaction has part of the write and
+// can only be rolled back as a whole
+type writtenError struct {
+	err error
+}
+
+func (e *writtenError) Error() string {
+	return e.err.Error()
+}
+
+func (e *writtenError) Unwrap() error {
+	return e.err
+}
+
+func afterWrite(err error) error {
+	var we *writtenError
+	if err == nil || errors.As(err, &we) {
+		return err
+	}
+	return &writtenError{err: err}
 }
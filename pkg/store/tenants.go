@@ -0,0 +1,379 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	ErrNoTenant      = errors.New("no tenant in context")
+	ErrInvalidTenant = errors.New("invalid tenant name")
+	// The tenant has no file yet, see TenantDatabase.Provision
+	ErrUnknownTenant = errors.New("unknown tenant")
+	// MaxOpen tenants are open and in use
+	ErrTooManyTenants = errors.New("too many open tenants")
+)
+
+var tenantName = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_-]{0,62}$`)
+
+// ValidTenant reports whether name can be used as a tenant, it becomes part of a file name
+func ValidTenant(name string) bool {
+	return tenantName.MatchString(name)
+}
+
+// TenantInitHook runs when a tenant's file is opened, after the shared buckets have been created.
+// It gets the tenant's own database so migrations don't go through the Datastore and its hooks.
+type TenantInitHook func(ctx context.Context, tenant string, db Database) error
+
+// TenantDatabase keeps every tenant in its own bolt file in Dir, opened on first use and closed again
+// when it has been idle for IdleTimeout. Calls are routed by the tenant set with WithTenant, calls
+// without one fail with ErrNoTenant, except for creating buckets which then applies to every tenant.
+// Tenants are created with Provision, calls for a tenant without a file fail with ErrUnknownTenant.
+type TenantDatabase struct {
+	Dir         string
+	IdleTimeout time.Duration
+	// At most this many files are open, the least recently used idle one is closed to open another
+	MaxOpen int
+	// How long opening a file waits for another process holding its lock
+	OpenTimeout time.Duration
+
+	lock      sync.Mutex
+	tenants   map[string]*tenantHandle
+	buckets   []string
+	initHooks []TenantInitHook
+	stop      chan struct{}
+}
+
+// tenantHandle is in the map while its file is being opened, ready is closed once db or err is set
+type tenantHandle struct {
+	ready    chan struct{}
+	db       *BoltDatabase
+	err      error
+	users    int
+	lastUsed time.Time
+}
+
+func NewTenantDatabase(dir string) *TenantDatabase {
+	return &TenantDatabase{
+		Dir:         dir,
+		IdleTimeout: 10 * time.Minute,
+		MaxOpen:     256,
+		OpenTimeout: 5 * time.Second,
+		tenants:     map[string]*tenantHandle{},
+		initHooks:   []TenantInitHook{},
+	}
+}
+
+func (td *TenantDatabase) AddInitHook(hook TenantInitHook) {
+	td.lock.Lock()
+	defer td.lock.Unlock()
+	td.initHooks = append(td.initHooks, hook)
+}
+
+func (td *TenantDatabase) Init() error {
+	if err := os.MkdirAll(td.Dir, 0755); err != nil {
+		return err
+	}
+
+	td.lock.Lock()
+	defer td.lock.Unlock()
+	if td.stop == nil && td.IdleTimeout > 0 {
+		td.stop = make(chan struct{})
+		go td.closeIdle(td.stop)
+	}
+	return nil
+}
+
+func (td *TenantDatabase) Close() {
+	td.lock.Lock()
+	defer td.lock.Unlock()
+	if td.stop != nil {
+		close(td.stop)
+		td.stop = nil
+	}
+	for name, h := range td.tenants {
+		if h.db != nil {
+			h.db.Close()
+		}
+		delete(td.tenants, name)
+	}
+}
+
+// Provision creates the file of a tenant if it doesn't exist yet, running the init hooks
+func (td *TenantDatabase) Provision(ctx context.Context, tenant string) error {
+	_, release, err := td.acquire(WithTenant(ctx, tenant), true)
+	if err != nil {
+		return err
+	}
+	release()
+	return nil
+}
+
+// Tenants returns the names of all tenants that have a file in Dir
+func (td *TenantDatabase) Tenants() ([]string, error) {
+	entries, err := os.ReadDir(td.Dir)
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for _, e := range entries {
+		name := strings.TrimSuffix(e.Name(), ".db")
+		if !e.IsDir() && name != e.Name() && ValidTenant(name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Open reports how many tenant files are currently open
+func (td *TenantDatabase) Open() int {
+	td.lock.Lock()
+	defer td.lock.Unlock()
+	return len(td.tenants)
+}
+
+func (td *TenantDatabase) CreateBucketIfNotExists(bucketName string) error {
+	return td.CreateBucketIfNotExistsContext(context.Background(), bucketName)
+}
+
+func (td *TenantDatabase) Get(bucket string, id string) ([]byte, error) {
+	return td.GetContext(context.Background(), bucket, id)
+}
+
+func (td *TenantDatabase) Put(bucket string, id string, data []byte) (string, error) {
+	return td.PutContext(context.Background(), bucket, id, data)
+}
+
+func (td *TenantDatabase) Delete(bucket string, id string) error {
+	return td.DeleteContext(context.Background(), bucket, id)
+}
+
+// CreateBucketIfNotExistsContext creates the bucket for the tenant in ctx, or for every tenant if there is none
+func (td *TenantDatabase) CreateBucketIfNotExistsContext(ctx context.Context, bucketName string) error {
+	if TenantFrom(ctx) != "" {
+		db, release, err := td.acquire(ctx, false)
+		if err != nil {
+			return err
+		}
+		defer release()
+		return db.CreateBucketIfNotExistsContext(ctx, bucketName)
+	}
+
+	td.lock.Lock()
+	defer td.lock.Unlock()
+	for _, b := range td.buckets {
+		if b == bucketName {
+			return nil
+		}
+	}
+	td.buckets = append(td.buckets, bucketName)
+	for _, h := range td.tenants {
+		//files being opened get it when they are ready
+		if h.db == nil {
+			continue
+		}
+		if err := h.db.CreateBucketIfNotExistsContext(ctx, bucketName); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (td *TenantDatabase) GetContext(ctx context.Context, bucket string, id string) ([]byte, error) {
+	db, release, err := td.acquire(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return db.GetContext(ctx, bucket, id)
+}
+
+func (td *TenantDatabase) PutContext(ctx context.Context, bucket string, id string, data []byte) (string, error) {
+	db, release, err := td.acquire(ctx, false)
+	if err != nil {
+		return "", err
+	}
+	defer release()
+	return db.PutContext(ctx, bucket, id, data)
+}
+
+func (td *TenantDatabase) DeleteContext(ctx context.Context, bucket string, id string) error {
+	db, release, err := td.acquire(ctx, false)
+	if err != nil {
+		return err
+	}
+	defer release()
+	return db.DeleteContext(ctx, bucket, id)
+}
+
+func (td *TenantDatabase) View(ctx context.Context, fn func(Tx) error) error {
+	db, release, err := td.acquire(ctx, false)
+	if err != nil {
+		return err
+	}
+	defer release()
+	return db.View(ctx, fn)
+}
+
+func (td *TenantDatabase) Update(ctx context.Context, fn func(Tx) error) error {
+	db, release, err := td.acquire(ctx, false)
+	if err != nil {
+		return err
+	}
+	defer release()
+	return db.Update(ctx, fn)
+}
+
+// acquire returns the database of the tenant in ctx, opening it if needed, and creating it if create is set.
+// It stays open until release is called. Files are opened outside the lock, callers for the same tenant
+// wait for the first one.
+func (td *TenantDatabase) acquire(ctx context.Context, create bool) (*BoltDatabase, func(), error) {
+	tenant := TenantFrom(ctx)
+	if tenant == "" {
+		return nil, nil, ErrNoTenant
+	}
+	if !ValidTenant(tenant) {
+		return nil, nil, ErrInvalidTenant
+	}
+
+	td.lock.Lock()
+	h, ok := td.tenants[tenant]
+	if !ok {
+		if td.MaxOpen > 0 && len(td.tenants) >= td.MaxOpen && !td.closeLeastRecentlyUsed() {
+			td.lock.Unlock()
+			return nil, nil, ErrTooManyTenants
+		}
+		h = &tenantHandle{ready: make(chan struct{})}
+		td.tenants[tenant] = h
+		buckets := td.buckets
+		hooks := td.initHooks
+		h.users++
+		td.lock.Unlock()
+
+		db, err := td.open(ctx, tenant, create, buckets, hooks)
+		td.lock.Lock()
+		if err == nil {
+			//buckets created for every tenant meanwhile
+			for _, b := range td.buckets[len(buckets):] {
+				if err = db.CreateBucketIfNotExistsContext(ctx, b); err != nil {
+					db.Close()
+					break
+				}
+			}
+		}
+		if err != nil {
+			delete(td.tenants, tenant)
+			db = nil
+		}
+		h.db, h.err = db, err
+		td.lock.Unlock()
+		close(h.ready)
+	} else {
+		h.users++
+		td.lock.Unlock()
+	}
+
+	release := func() {
+		td.lock.Lock()
+		h.users--
+		h.lastUsed = time.Now()
+		td.lock.Unlock()
+	}
+
+	select {
+	case <-h.ready:
+	case <-ctx.Done():
+		release()
+		return nil, nil, ctx.Err()
+	}
+	if h.err != nil {
+		release()
+		return nil, nil, h.err
+	}
+	return h.db, release, nil
+}
+
+// closeLeastRecentlyUsed makes room for another tenant, it's called with the lock held
+func (td *TenantDatabase) closeLeastRecentlyUsed() bool {
+	oldest := ""
+	for name, h := range td.tenants {
+		if h.users > 0 || h.db == nil {
+			continue
+		}
+		if oldest == "" || h.lastUsed.Before(td.tenants[oldest].lastUsed) {
+			oldest = name
+		}
+	}
+	if oldest == "" {
+		return false
+	}
+	td.tenants[oldest].db.Close()
+	delete(td.tenants, oldest)
+	return true
+}
+
+func (td *TenantDatabase) open(ctx context.Context, tenant string, create bool, buckets []string, hooks []TenantInitHook) (*BoltDatabase, error) {
+	path := filepath.Join(td.Dir, tenant+".db")
+	if !create {
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			return nil, ErrUnknownTenant
+		}
+	}
+
+	boltdb, err := bolt.Open(path, 0666, &bolt.Options{Timeout: td.OpenTimeout})
+	if err != nil {
+		return nil, err
+	}
+	db := &BoltDatabase{DB: boltdb}
+
+	err = db.Init()
+	for _, b := range buckets {
+		if err != nil {
+			break
+		}
+		err = db.CreateBucketIfNotExistsContext(ctx, b)
+	}
+	for _, hook := range hooks {
+		if err != nil {
+			break
+		}
+		err = hook(ctx, tenant, db)
+	}
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+func (td *TenantDatabase) closeIdle(stop chan struct{}) {
+	ticker := time.NewTicker(td.IdleTimeout / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		td.lock.Lock()
+		for name, h := range td.tenants {
+			if h.users == 0 && time.Since(h.lastUsed) > td.IdleTimeout {
+				h.db.Close()
+				delete(td.tenants, name)
+			}
+		}
+		td.lock.Unlock()
+	}
+}
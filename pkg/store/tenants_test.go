@@ -0,0 +1,180 @@
+package store_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/fnurk/geom/pkg/store"
+)
+
+func TestTenantDatabase_Isolation(t *testing.T) {
+	dir := t.TempDir()
+	td := store.NewTenantDatabase(dir)
+
+	migrated := map[string]int{}
+	td.AddInitHook(func(ctx context.Context, tenant string, db store.Database) error {
+		migrated[tenant]++
+		return store.CreateBucketIfNotExistsContext(ctx, db, "_migrations")
+	})
+
+	ds := store.NewDatastore(td, store.NewLRUCache(store.LRUConfig{MaxBytes: 1 << 20}))
+	ds.CacheType("doc", store.CachePolicy{})
+	if err := ds.Init(); err != nil {
+		t.Fatal(err)
+	}
+	defer ds.Close()
+	ds.CreateBucketIfNotExists("doc")
+
+	acme := store.WithTenant(context.Background(), "acme")
+	globex := store.WithTenant(context.Background(), "globex")
+
+	if _, err := ds.PutContext(acme, "doc", "1", []byte("acme")); err != store.ErrUnknownTenant {
+		t.Errorf("expected ErrUnknownTenant before provisioning, got %v", err)
+	}
+	for _, tenant := range []string{"acme", "globex"} {
+		if err := td.Provision(context.Background(), tenant); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := ds.PutContext(acme, "doc", "1", []byte("acme")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ds.PutContext(globex, "doc", "1", []byte("globex")); err != nil {
+		t.Fatal(err)
+	}
+
+	//twice so the second read comes from the cache
+	for i := 0; i < 2; i++ {
+		if v, _ := ds.GetContext(acme, "doc", "1"); string(v) != "acme" {
+			t.Errorf("acme read %q", v)
+		}
+		if v, _ := ds.GetContext(globex, "doc", "1"); string(v) != "globex" {
+			t.Errorf("globex read %q", v)
+		}
+	}
+
+	if _, err := ds.Get("doc", "1"); err != store.ErrNoTenant {
+		t.Errorf("expected ErrNoTenant, got %v", err)
+	}
+	if _, err := ds.GetContext(store.WithTenant(context.Background(), "../x"), "doc", "1"); err != store.ErrInvalidTenant {
+		t.Errorf("expected ErrInvalidTenant, got %v", err)
+	}
+
+	if migrated["acme"] != 1 || migrated["globex"] != 1 {
+		t.Errorf("init hooks ran %v", migrated)
+	}
+
+	tenants, err := td.Tenants()
+	if err != nil || len(tenants) != 2 || tenants[0] != "acme" {
+		t.Errorf("unexpected tenants %v %v", tenants, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "acme.db")); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestTenantDatabase_ClosesIdle(t *testing.T) {
+	td := store.NewTenantDatabase(t.TempDir())
+	td.IdleTimeout = 20 * time.Millisecond
+	if err := td.Init(); err != nil {
+		t.Fatal(err)
+	}
+	defer td.Close()
+	td.CreateBucketIfNotExists("doc")
+
+	td.Provision(context.Background(), "acme")
+	ctx := store.WithTenant(context.Background(), "acme")
+	if _, err := td.PutContext(ctx, "doc", "1", []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	if td.Open() != 1 {
+		t.Fatal("tenant not open")
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for td.Open() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("idle tenant was not closed")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	//reopened on the next use
+	if v, err := td.GetContext(ctx, "doc", "1"); err != nil || string(v) != "a" {
+		t.Errorf("read %q %v after reopening", v, err)
+	}
+}
+
+func TestTenantDatabase_MaxOpen(t *testing.T) {
+	td := store.NewTenantDatabase(t.TempDir())
+	td.MaxOpen = 2
+	if err := td.Init(); err != nil {
+		t.Fatal(err)
+	}
+	defer td.Close()
+	td.CreateBucketIfNotExists("doc")
+
+	for _, tenant := range []string{"a", "b", "c"} {
+		if err := td.Provision(context.Background(), tenant); err != nil {
+			t.Fatal(err)
+		}
+		if td.Open() > 2 {
+			t.Fatalf("expected at most 2 open tenants, got %d", td.Open())
+		}
+	}
+
+	//both open tenants in use, there's no room for a third
+	hold := make(chan struct{})
+	defer close(hold)
+	started := make(chan struct{}, 2)
+	for _, tenant := range []string{"b", "c"} {
+		go td.Update(store.WithTenant(context.Background(), tenant), func(tx store.Tx) error {
+			started <- struct{}{}
+			<-hold
+			return nil
+		})
+	}
+	<-started
+	<-started
+	if _, err := td.GetContext(store.WithTenant(context.Background(), "a"), "doc", "1"); err != store.ErrTooManyTenants {
+		t.Errorf("expected ErrTooManyTenants, got %v", err)
+	}
+}
+
+func TestTenantDatabase_ConcurrentOpen(t *testing.T) {
+	td := store.NewTenantDatabase(t.TempDir())
+	opened := int32(0)
+	td.AddInitHook(func(ctx context.Context, tenant string, db store.Database) error {
+		atomic.AddInt32(&opened, 1)
+		return nil
+	})
+	if err := td.Init(); err != nil {
+		t.Fatal(err)
+	}
+	defer td.Close()
+	td.CreateBucketIfNotExists("doc")
+	td.Provision(context.Background(), "acme")
+	td.Close()
+
+	ctx := store.WithTenant(context.Background(), "acme")
+	wg := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := td.GetContext(ctx, "doc", "1"); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if opened != 2 {
+		t.Errorf("expected the file to be opened once more, init hooks ran %d times", opened)
+	}
+}
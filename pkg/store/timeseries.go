@@ -0,0 +1,432 @@
+package store
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/tidwall/match"
+	bolt "go.etcd.io/bbolt"
+)
+
+/*
+
+Time-series data lives in its own bolt file, separate from the documents. Every series gets a top level
+bucket with one nested bucket for the raw points and one for each rollup resolution. Keys are big endian
+unix nanoseconds, so points are stored in time order and appends always land at the end of the bucket.
+
+Rollups are computed on a schedule from the next finer resolution (raw -> 1m -> 1h -> 1d) and only for
+buckets that are complete. Points written with a timestamp older than the last rollup are stored but not
+rolled up again.
+
+*/
+
+var (
+	ErrInvalidTimestamp = errors.New("timestamp before unix epoch")
+	ErrUnknownRes       = errors.New("unknown resolution")
+)
+
+var (
+	rawBucket  = []byte("raw")
+	metaBucket = []byte("meta")
+)
+
+type Resolution time.Duration
+
+const (
+	Raw    Resolution = 0
+	Minute            = Resolution(time.Minute)
+	Hour              = Resolution(time.Hour)
+	Day               = Resolution(24 * time.Hour)
+)
+
+var rollupResolutions = []Resolution{Minute, Hour, Day}
+
+func ParseResolution(s string) (Resolution, error) {
+	switch s {
+	case "", "raw":
+		return Raw, nil
+	case "1m":
+		return Minute, nil
+	case "1h":
+		return Hour, nil
+	case "1d":
+		return Day, nil
+	}
+	return Raw, ErrUnknownRes
+}
+
+func (r Resolution) String() string {
+	switch r {
+	case Raw:
+		return "raw"
+	case Minute:
+		return "1m"
+	case Hour:
+		return "1h"
+	case Day:
+		return "1d"
+	}
+	return time.Duration(r).String()
+}
+
+func (r Resolution) bucket() []byte {
+	if r == Raw {
+		return rawBucket
+	}
+	return []byte(r.String())
+}
+
+type Point struct {
+	Time  time.Time `json:"time"`
+	Value float64   `json:"value"`
+}
+
+type Aggregate struct {
+	Time  time.Time `json:"time"`
+	Count uint64    `json:"count"`
+	Sum   float64   `json:"sum"`
+	Min   float64   `json:"min"`
+	Max   float64   `json:"max"`
+	Avg   float64   `json:"avg"`
+}
+
+// Zero durations keep data forever
+type RetentionPolicy struct {
+	Raw     time.Duration
+	Rollups map[Resolution]time.Duration
+}
+
+type retentionRule struct {
+	pattern string
+	policy  RetentionPolicy
+}
+
+type TimeSeriesStore struct {
+	DB        *bolt.DB
+	retention []retentionRule
+	lock      sync.RWMutex
+	stop      chan struct{}
+	now       func() time.Time
+}
+
+func NewTimeSeriesStore(filename string) (*TimeSeriesStore, error) {
+	boltdb, err := bolt.Open(filename, 0666, nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &TimeSeriesStore{
+		DB:  boltdb,
+		now: time.Now,
+	}, nil
+}
+
+// SetRetention applies policy to all series matching pattern, first match wins
+func (ts *TimeSeriesStore) SetRetention(pattern string, policy RetentionPolicy) {
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+	ts.retention = append(ts.retention, retentionRule{pattern: pattern, policy: policy})
+}
+
+func (ts *TimeSeriesStore) retentionFor(series string) (RetentionPolicy, bool) {
+	ts.lock.RLock()
+	defer ts.lock.RUnlock()
+	for _, r := range ts.retention {
+		if match.Match(series, r.pattern) {
+			return r.policy, true
+		}
+	}
+	return RetentionPolicy{}, false
+}
+
+// Start runs rollups and retention every interval until Close is called
+func (ts *TimeSeriesStore) Start(interval time.Duration) {
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+	if ts.stop != nil {
+		return
+	}
+	ts.stop = make(chan struct{})
+
+	go func(stop chan struct{}) {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				ts.Maintain()
+			case <-stop:
+				return
+			}
+		}
+	}(ts.stop)
+}
+
+func (ts *TimeSeriesStore) Close() {
+	ts.lock.Lock()
+	if ts.stop != nil {
+		close(ts.stop)
+		ts.stop = nil
+	}
+	ts.lock.Unlock()
+	ts.DB.Close()
+}
+
+func (ts *TimeSeriesStore) Append(series string, points ...Point) error {
+	return ts.DB.Update(func(tx *bolt.Tx) error {
+		sb, err := tx.CreateBucketIfNotExists([]byte(series))
+		if err != nil {
+			return err
+		}
+		raw, err := sb.CreateBucketIfNotExists(rawBucket)
+		if err != nil {
+			return err
+		}
+		// Points almost always arrive in order, so pack the pages fully
+		raw.FillPercent = 1.0
+
+		for _, p := range points {
+			if p.Time.UnixNano() < 0 {
+				return ErrInvalidTimestamp
+			}
+			err := raw.Put(ttob(p.Time), ftob(p.Value))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (ts *TimeSeriesStore) Series() ([]string, error) {
+	series := []string{}
+	err := ts.DB.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, _ *bolt.Bucket) error {
+			series = append(series, string(name))
+			return nil
+		})
+	})
+	return series, err
+}
+
+// Range returns raw points in [from, to)
+func (ts *TimeSeriesStore) Range(series string, from time.Time, to time.Time) ([]Point, error) {
+	points := []Point{}
+	err := ts.DB.View(func(tx *bolt.Tx) error {
+		b := nestedBucket(tx, series, rawBucket)
+		if b == nil {
+			return nil
+		}
+		return scanRange(b, from, to, func(k []byte, v []byte) error {
+			points = append(points, Point{Time: btot(k), Value: btof(v)})
+			return nil
+		})
+	})
+	return points, err
+}
+
+// Rollups returns aggregates of resolution res with start time in [from, to)
+func (ts *TimeSeriesStore) Rollups(series string, res Resolution, from time.Time, to time.Time) ([]Aggregate, error) {
+	if res == Raw {
+		return nil, ErrUnknownRes
+	}
+	aggs := []Aggregate{}
+	err := ts.DB.View(func(tx *bolt.Tx) error {
+		b := nestedBucket(tx, series, res.bucket())
+		if b == nil {
+			return nil
+		}
+		return scanRange(b, from, to, func(k []byte, v []byte) error {
+			aggs = append(aggs, decodeAggregate(btot(k), v))
+			return nil
+		})
+	})
+	return aggs, err
+}
+
+// Maintain computes pending rollups and applies retention to every series
+func (ts *TimeSeriesStore) Maintain() error {
+	series, err := ts.Series()
+	if err != nil {
+		return err
+	}
+	now := ts.now()
+	for _, s := range series {
+		err := ts.DB.Update(func(tx *bolt.Tx) error {
+			sb := tx.Bucket([]byte(s))
+			if err := rollup(sb, now); err != nil {
+				return err
+			}
+			if policy, ok := ts.retentionFor(s); ok {
+				return applyRetention(sb, policy, now)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func rollup(sb *bolt.Bucket, now time.Time) error {
+	meta, err := sb.CreateBucketIfNotExists(metaBucket)
+	if err != nil {
+		return err
+	}
+
+	source := Raw
+	for _, res := range rollupResolutions {
+		src := sb.Bucket(source.bucket())
+		if src == nil {
+			return nil
+		}
+		dst, err := sb.CreateBucketIfNotExists(res.bucket())
+		if err != nil {
+			return err
+		}
+		dst.FillPercent = 1.0
+
+		from := time.Unix(0, 0)
+		if wm := meta.Get(res.bucket()); wm != nil {
+			from = btot(wm)
+		}
+		// Only roll up buckets that can not receive more points
+		to := now.Truncate(time.Duration(res))
+
+		var current *Aggregate
+		flush := func() error {
+			if current == nil {
+				return nil
+			}
+			current.Avg = current.Sum / float64(current.Count)
+			return dst.Put(ttob(current.Time), encodeAggregate(*current))
+		}
+
+		err = scanRange(src, from, to, func(k []byte, v []byte) error {
+			var a Aggregate
+			if source == Raw {
+				f := btof(v)
+				a = Aggregate{Count: 1, Sum: f, Min: f, Max: f}
+			} else {
+				a = decodeAggregate(btot(k), v)
+			}
+			start := btot(k).Truncate(time.Duration(res))
+			if current == nil || !current.Time.Equal(start) {
+				if err := flush(); err != nil {
+					return err
+				}
+				current = &Aggregate{Time: start, Min: math.Inf(1), Max: math.Inf(-1)}
+			}
+			current.Count += a.Count
+			current.Sum += a.Sum
+			current.Min = math.Min(current.Min, a.Min)
+			current.Max = math.Max(current.Max, a.Max)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if err := flush(); err != nil {
+			return err
+		}
+		if to.After(from) {
+			if err := meta.Put(res.bucket(), ttob(to)); err != nil {
+				return err
+			}
+		}
+		source = res
+	}
+	return nil
+}
+
+func applyRetention(sb *bolt.Bucket, policy RetentionPolicy, now time.Time) error {
+	if err := trimBefore(sb.Bucket(rawBucket), policy.Raw, now); err != nil {
+		return err
+	}
+	for res, keep := range policy.Rollups {
+		if err := trimBefore(sb.Bucket(res.bucket()), keep, now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func trimBefore(b *bolt.Bucket, keep time.Duration, now time.Time) error {
+	if b == nil || keep == 0 {
+		return nil
+	}
+	cutoff := ttob(now.Add(-keep))
+	c := b.Cursor()
+	for k, _ := c.First(); k != nil && string(k) < string(cutoff); k, _ = c.First() {
+		if err := c.Delete(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func nestedBucket(tx *bolt.Tx, series string, name []byte) *bolt.Bucket {
+	sb := tx.Bucket([]byte(series))
+	if sb == nil {
+		return nil
+	}
+	return sb.Bucket(name)
+}
+
+func scanRange(b *bolt.Bucket, from time.Time, to time.Time, fn func(k []byte, v []byte) error) error {
+	if from.UnixNano() < 0 {
+		from = time.Unix(0, 0)
+	}
+	end := ttob(to)
+	c := b.Cursor()
+	for k, v := c.Seek(ttob(from)); k != nil && string(k) < string(end); k, v = c.Next() {
+		if err := fn(k, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func encodeAggregate(a Aggregate) []byte {
+	b := make([]byte, 32)
+	binary.BigEndian.PutUint64(b[0:], a.Count)
+	binary.BigEndian.PutUint64(b[8:], math.Float64bits(a.Sum))
+	binary.BigEndian.PutUint64(b[16:], math.Float64bits(a.Min))
+	binary.BigEndian.PutUint64(b[24:], math.Float64bits(a.Max))
+	return b
+}
+
+func decodeAggregate(t time.Time, b []byte) Aggregate {
+	a := Aggregate{
+		Time:  t,
+		Count: binary.BigEndian.Uint64(b[0:]),
+		Sum:   math.Float64frombits(binary.BigEndian.Uint64(b[8:])),
+		Min:   math.Float64frombits(binary.BigEndian.Uint64(b[16:])),
+		Max:   math.Float64frombits(binary.BigEndian.Uint64(b[24:])),
+	}
+	if a.Count > 0 {
+		a.Avg = a.Sum / float64(a.Count)
+	}
+	return a
+}
+
+func ttob(t time.Time) []byte {
+	return itob(uint64(t.UnixNano()))
+}
+
+func btot(b []byte) time.Time {
+	return time.Unix(0, int64(binary.BigEndian.Uint64(b))).UTC()
+}
+
+func ftob(f float64) []byte {
+	return itob(math.Float64bits(f))
+}
+
+func btof(b []byte) float64 {
+	return math.Float64frombits(binary.BigEndian.Uint64(b))
+}
@@ -0,0 +1,74 @@
+package store_test
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fnurk/geom/pkg/store"
+)
+
+func TestTimeSeries_RollupAndRetention(t *testing.T) {
+	ts, err := store.NewTimeSeriesStore(filepath.Join(t.TempDir(), "ts.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ts.Close()
+
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 120; i++ {
+		err := ts.Append("cpu", store.Point{Time: start.Add(time.Duration(i) * time.Second), Value: float64(i)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	points, err := ts.Range("cpu", start, start.Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(points) != 60 {
+		t.Errorf("expected 60 points, got %d", len(points))
+	}
+
+	if err := ts.Maintain(); err != nil {
+		t.Fatal(err)
+	}
+
+	aggs, err := ts.Rollups("cpu", store.Minute, start, start.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(aggs) != 2 {
+		t.Fatalf("expected 2 minute rollups, got %d", len(aggs))
+	}
+	if aggs[1].Count != 60 || aggs[1].Min != 60 || aggs[1].Max != 119 || aggs[1].Avg != 89.5 {
+		t.Errorf("unexpected rollup %+v", aggs[1])
+	}
+
+	hours, err := ts.Rollups("cpu", store.Hour, start, start.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hours) != 1 || hours[0].Count != 120 {
+		t.Errorf("unexpected hour rollups %+v", hours)
+	}
+
+	ts.SetRetention("cpu", store.RetentionPolicy{Raw: time.Hour})
+	if err := ts.Maintain(); err != nil {
+		t.Fatal(err)
+	}
+
+	points, err = ts.Range("cpu", start, start.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(points) != 0 {
+		t.Errorf("expected raw points to be dropped, got %d", len(points))
+	}
+
+	aggs, _ = ts.Rollups("cpu", store.Minute, start, start.Add(time.Hour))
+	if len(aggs) != 2 {
+		t.Errorf("expected rollups to survive retention, got %d", len(aggs))
+	}
+}
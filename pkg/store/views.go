@@ -0,0 +1,418 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/fnurk/geom/pkg/model"
+)
+
+var (
+	ErrViewNotFound = errors.New("view not found")
+	ErrViewKey      = errors.New("view keys can only hold strings, numbers, booleans and nulls")
+)
+
+// ViewEntry is a row emitted by a map function. Keys sort element by element: null, false, true,
+// numbers, strings.
+type ViewEntry struct {
+	Key   []interface{}
+	Value interface{}
+}
+
+// MapFunc emits the view rows of a document, it has to be deterministic
+type MapFunc func(t string, id string, doc map[string]interface{}) []ViewEntry
+
+type View struct {
+	// Document types that are mapped, every type if empty
+	Types []string
+	Map   MapFunc
+}
+
+type ViewRow struct {
+	Key   []interface{}   `json:"key"`
+	Value json.RawMessage `json:"value"`
+	Type  string          `json:"type"`
+	Id    string          `json:"id"`
+}
+
+type ViewQuery struct {
+	// Rows with keys from Start to End, both inclusive, nil means unbounded.
+	// Longer keys sort after their prefixes so End ["a"] doesn't include ["a","b"], use Prefix for that.
+	Start []interface{}
+	End   []interface{}
+	// Only rows whose key starts with these elements
+	Prefix []interface{}
+	// 0 means no limit
+	Limit int
+	// Filter gets the source document of every row, rows it rejects are left out and don't count towards Limit
+	Filter func(row ViewRow, doc []byte) bool
+}
+
+// AddView registers a view, call it before Init. Rows are kept up to date by every write from then on,
+// documents written before need RebuildView.
+func (ds *Datastore) AddView(name string, view View) {
+	ds.views[name] = view
+}
+
+// Rows live in _view_<name>, keyed by the encoded key followed by the source document.
+// _viewdocs_<name> has the row keys of every document so they can be removed when it changes.
+func viewBucket(name string) string {
+	return "_view_" + name
+}
+
+func viewDocsBucket(name string) string {
+	return "_viewdocs_" + name
+}
+
+func (ds *Datastore) createViewBuckets() error {
+	for name := range ds.views {
+		if err := ds.db.CreateBucketIfNotExists(viewBucket(name)); err != nil {
+			return err
+		}
+		if err := ds.db.CreateBucketIfNotExists(viewDocsBucket(name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ds *Datastore) QueryView(ctx context.Context, name string, q ViewQuery) ([]ViewRow, error) {
+	if _, ok := ds.views[name]; !ok {
+		return nil, ErrViewNotFound
+	}
+
+	var from, prefix, end []byte
+	var err error
+	if q.Start != nil {
+		if from, err = encodeViewKey(q.Start, false); err != nil {
+			return nil, err
+		}
+	}
+	if q.Prefix != nil {
+		if prefix, err = encodeViewKey(q.Prefix, false); err != nil {
+			return nil, err
+		}
+		if bytes.Compare(prefix, from) > 0 {
+			from = prefix
+		}
+	}
+	if q.End != nil {
+		if end, err = encodeViewKey(q.End, true); err != nil {
+			return nil, err
+		}
+	}
+
+	rows := []ViewRow{}
+	stop := errors.New("stop")
+
+	err = ds.View(ctx, func(tx Tx) error {
+		return tx.ForEachKeyFrom(viewBucket(name), from, func(k []byte, v []byte) error {
+			if q.Limit > 0 && len(rows) >= q.Limit {
+				return stop
+			}
+			if prefix != nil && !bytes.HasPrefix(k, prefix) {
+				return stop
+			}
+
+			key, n, err := decodeViewKey(k)
+			if err != nil {
+				return err
+			}
+			if end != nil && bytes.Compare(k[:n], end) > 0 {
+				return stop
+			}
+
+			row := ViewRow{Key: key, Value: v}
+			row.Type, row.Id = splitViewDoc(k[n:])
+
+			if q.Filter != nil {
+				doc, err := tx.Get(row.Type, row.Id)
+				if err != nil {
+					return err
+				}
+				if doc == nil || !q.Filter(row, doc) {
+					return nil
+				}
+			}
+
+			rows = append(rows, row)
+			return nil
+		})
+	})
+	if err == stop {
+		err = nil
+	}
+	return rows, err
+}
+
+// RebuildView maps every document again in a single transaction, run it after adding a view or changing
+// its map function. It returns the number of rows.
+func (ds *Datastore) RebuildView(ctx context.Context, name string) (int, error) {
+	view, ok := ds.views[name]
+	if !ok {
+		return 0, ErrViewNotFound
+	}
+
+	types := view.Types
+	if len(types) == 0 {
+		for _, b := range ds.Buckets() {
+			if !IsInternalBucket(b) {
+				types = append(types, b)
+			}
+		}
+	}
+
+	rows := 0
+	err := ds.Update(ctx, func(tx Tx) error {
+		rows = 0
+		for _, bucket := range []string{viewBucket(name), viewDocsBucket(name)} {
+			if err := clearKeys(tx, bucket); err != nil {
+				return err
+			}
+		}
+
+		for _, t := range types {
+			err := tx.ForEach(t, func(id string, data []byte) error {
+				n, err := mapDocument(tx, name, view, t, id, data)
+				rows += n
+				return err
+			})
+			if err != nil && err != ErrBucketNotFound {
+				return err
+			}
+		}
+		return nil
+	})
+
+	return rows, err
+}
+
+// updateViews replaces the rows of a document in every view that maps its type, data is nil for deletes
+func (ds *Datastore) updateViews(tx Tx, t string, id string, data []byte) error {
+	if IsInternalBucket(t) || len(ds.views) == 0 {
+		return nil
+	}
+	id = btos(strtob(id)) //"01" is document 1
+	for name, view := range ds.views {
+		if !view.maps(t) {
+			continue
+		}
+		if err := removeViewRows(tx, name, t, id); err != nil {
+			return err
+		}
+		if data == nil {
+			continue
+		}
+		if _, err := mapDocument(tx, name, view, t, id, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (view View) maps(t string) bool {
+	if len(view.Types) == 0 {
+		return true
+	}
+	for _, vt := range view.Types {
+		if vt == t {
+			return true
+		}
+	}
+	return false
+}
+
+func mapDocument(tx Tx, name string, view View, t string, id string, data []byte) (int, error) {
+	obj, err := model.DecodeObject(data)
+	if err != nil {
+		return 0, nil //not an object, nothing to map
+	}
+
+	doc := viewDoc(t, id)
+	rowKeys := [][]byte{}
+	for _, entry := range view.Map(t, id, obj) {
+		k, err := encodeViewKey(entry.Key, true)
+		if err != nil {
+			return 0, fmt.Errorf("view %s: %w", name, err)
+		}
+		v, err := json.Marshal(entry.Value)
+		if err != nil {
+			return 0, fmt.Errorf("view %s: %w", name, err)
+		}
+		k = append(k, doc...)
+		if err := tx.PutKey(viewBucket(name), k, v); err != nil {
+			return 0, err
+		}
+		rowKeys = append(rowKeys, k)
+	}
+
+	if len(rowKeys) == 0 {
+		return 0, nil
+	}
+	keys, err := json.Marshal(rowKeys)
+	if err != nil {
+		return 0, err
+	}
+	return len(rowKeys), tx.PutKey(viewDocsBucket(name), doc, keys)
+}
+
+func removeViewRows(tx Tx, name string, t string, id string) error {
+	doc := viewDoc(t, id)
+	raw, err := tx.GetKey(viewDocsBucket(name), doc)
+	if err != nil || raw == nil {
+		return err
+	}
+	rowKeys := [][]byte{}
+	if err := json.Unmarshal(raw, &rowKeys); err != nil {
+		return err
+	}
+	for _, k := range rowKeys {
+		if err := tx.DeleteKey(viewBucket(name), k); err != nil {
+			return err
+		}
+	}
+	return tx.DeleteKey(viewDocsBucket(name), doc)
+}
+
+func clearKeys(tx Tx, bucket string) error {
+	keys := [][]byte{}
+	err := tx.ForEachKeyFrom(bucket, nil, func(k []byte, v []byte) error {
+		keys = append(keys, k)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		if err := tx.DeleteKey(bucket, k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func viewDoc(t string, id string) []byte {
+	return []byte(t + "\x00" + id)
+}
+
+func splitViewDoc(b []byte) (string, string) {
+	i := bytes.IndexByte(b, 0)
+	if i < 0 {
+		return "", string(b)
+	}
+	return string(b[:i]), string(b[i+1:])
+}
+
+// View keys are encoded so their byte order is the order of the key elements.
+// Every element starts with a tag byte, the key ends with a 0 byte so shorter keys sort first.
+const (
+	keyEnd    = 0x00
+	keyNull   = 0x01
+	keyFalse  = 0x02
+	keyTrue   = 0x03
+	keyNumber = 0x04
+	keyString = 0x05
+)
+
+func encodeViewKey(key []interface{}, terminate bool) ([]byte, error) {
+	b := []byte{}
+	for _, el := range key {
+		switch v := el.(type) {
+		case nil:
+			b = append(b, keyNull)
+		case bool:
+			if v {
+				b = append(b, keyTrue)
+			} else {
+				b = append(b, keyFalse)
+			}
+		case string:
+			b = append(b, keyString)
+			//0 bytes are escaped so the terminator sorts before any content
+			for i := 0; i < len(v); i++ {
+				if v[i] == 0 {
+					b = append(b, 0, 0xff)
+				} else {
+					b = append(b, v[i])
+				}
+			}
+			b = append(b, 0, 1)
+		default:
+			f, ok := model.Number(el)
+			if !ok {
+				return nil, fmt.Errorf("%w, got %T", ErrViewKey, el)
+			}
+			bits := math.Float64bits(f)
+			if f >= 0 {
+				bits ^= 1 << 63
+			} else {
+				bits = ^bits
+			}
+			b = append(b, keyNumber)
+			b = append(b, itob(bits)...)
+		}
+	}
+	if terminate {
+		b = append(b, keyEnd)
+	}
+	return b, nil
+}
+
+// decodeViewKey returns the key at the start of b and its length, terminator included
+func decodeViewKey(b []byte) ([]interface{}, int, error) {
+	key := []interface{}{}
+	i := 0
+	for i < len(b) {
+		tag := b[i]
+		i++
+		switch tag {
+		case keyEnd:
+			return key, i, nil
+		case keyNull:
+			key = append(key, nil)
+		case keyFalse:
+			key = append(key, false)
+		case keyTrue:
+			key = append(key, true)
+		case keyNumber:
+			if i+8 > len(b) {
+				return nil, 0, ErrViewKey
+			}
+			bits := binary.BigEndian.Uint64(b[i:])
+			if bits&(1<<63) != 0 {
+				bits ^= 1 << 63
+			} else {
+				bits = ^bits
+			}
+			key = append(key, math.Float64frombits(bits))
+			i += 8
+		case keyString:
+			s := []byte{}
+			for {
+				if i+1 >= len(b) {
+					return nil, 0, ErrViewKey
+				}
+				if b[i] == 0 {
+					if b[i+1] == 1 {
+						i += 2
+						break
+					}
+					s = append(s, 0)
+					i += 2
+					continue
+				}
+				s = append(s, b[i])
+				i++
+			}
+			key = append(key, string(s))
+		default:
+			return nil, 0, ErrViewKey
+		}
+	}
+	return nil, 0, ErrViewKey
+}
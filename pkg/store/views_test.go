@@ -0,0 +1,167 @@
+package store_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/fnurk/geom/pkg/store"
+)
+
+func tagsByMonth(t string, id string, doc map[string]interface{}) []store.ViewEntry {
+	month, _ := doc["created"].(string)
+	if len(month) < 7 {
+		return nil
+	}
+	tags, _ := doc["tags"].([]interface{})
+	entries := []store.ViewEntry{}
+	for _, tag := range tags {
+		entries = append(entries, store.ViewEntry{Key: []interface{}{tag, month[:7]}, Value: 1})
+	}
+	return entries
+}
+
+func keys(rows []store.ViewRow) string {
+	s := []string{}
+	for _, r := range rows {
+		s = append(s, fmt.Sprintf("%v:%s", r.Key, r.Id))
+	}
+	return strings.Join(s, " ")
+}
+
+func testViews(t *testing.T, db store.Database) {
+	ctx := context.Background()
+	ds := store.NewDatastore(db, nil)
+	ds.AddView("tags", store.View{Types: []string{"note"}, Map: tagsByMonth})
+	if err := ds.Init(); err != nil {
+		t.Fatal(err)
+	}
+	ds.CreateBucketIfNotExists("note")
+
+	ds.Put("note", "1", []byte(`{"tags":["work","home"],"created":"2024-05-02"}`))
+	ds.Put("note", "2", []byte(`{"tags":["work"],"created":"2024-04-30"}`))
+	ds.Put("note", "3", []byte(`{"tags":["work"],"created":"2024-06-01"}`))
+	ds.Put("note", "4", []byte(`{"tags":["workshop"],"created":"2024-06-01"}`))
+
+	rows, err := ds.QueryView(ctx, "tags", store.ViewQuery{Prefix: []interface{}{"work"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := keys(rows); got != "[work 2024-04]:2 [work 2024-05]:1 [work 2024-06]:3" {
+		t.Errorf("prefix query got %s", got)
+	}
+
+	rows, _ = ds.QueryView(ctx, "tags", store.ViewQuery{
+		Start: []interface{}{"work", "2024-05"},
+		End:   []interface{}{"work", "2024-06"},
+	})
+	if got := keys(rows); got != "[work 2024-05]:1 [work 2024-06]:3" {
+		t.Errorf("range query got %s", got)
+	}
+
+	//updates and deletes replace the rows of the document
+	ds.Put("note", "1", []byte(`{"tags":["home"],"created":"2024-05-02"}`))
+	ds.Delete("note", "3")
+	rows, _ = ds.QueryView(ctx, "tags", store.ViewQuery{})
+	if got := keys(rows); got != "[home 2024-05]:1 [work 2024-04]:2 [workshop 2024-06]:4" {
+		t.Errorf("after update got %s", got)
+	}
+
+	rows, _ = ds.QueryView(ctx, "tags", store.ViewQuery{Limit: 1, Filter: func(row store.ViewRow, doc []byte) bool {
+		return row.Id != "1"
+	}})
+	if got := keys(rows); got != "[work 2024-04]:2" {
+		t.Errorf("filtered query got %s", got)
+	}
+
+	if _, err := ds.QueryView(ctx, "nope", store.ViewQuery{}); err != store.ErrViewNotFound {
+		t.Errorf("expected ErrViewNotFound, got %v", err)
+	}
+}
+
+func TestViews_Bolt(t *testing.T) {
+	testViews(t, newTestBolt(t))
+}
+
+func TestViews_InMem(t *testing.T) {
+	testViews(t, store.NewInMemDatabase())
+}
+
+func TestViews_KeyOrder(t *testing.T) {
+	ds := store.NewDatastore(store.NewInMemDatabase(), nil)
+	ds.AddView("order", store.View{Map: func(t string, id string, doc map[string]interface{}) []store.ViewEntry {
+		return []store.ViewEntry{{Key: []interface{}{doc["k"]}}}
+	}})
+	ds.Init()
+	ds.CreateBucketIfNotExists("doc")
+
+	values := []string{`"b"`, `"a\u0000"`, `"a"`, `10`, `-2.5`, `2`, `true`, `false`, `null`, `-100`}
+	for i, v := range values {
+		ds.Put("doc", fmt.Sprint(i+1), []byte(`{"k":`+v+`}`))
+	}
+
+	rows, err := ds.QueryView(context.Background(), "order", store.ViewQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := []string{}
+	for _, r := range rows {
+		k, _ := json.Marshal(r.Key[0])
+		got = append(got, string(k))
+	}
+	want := `null false true -100 -2.5 2 10 "a" "a\u0000" "b"`
+	if strings.Join(got, " ") != want {
+		t.Errorf("unexpected order %s", strings.Join(got, " "))
+	}
+}
+
+func TestViews_Rebuild(t *testing.T) {
+	db := newTestBolt(t)
+
+	plain := store.NewDatastore(db, nil)
+	plain.CreateBucketIfNotExists("note")
+	plain.Put("note", "1", []byte(`{"tags":["a","b"],"created":"2024-01-01"}`))
+
+	ds := store.NewDatastore(db, nil)
+	ds.AddView("tags", store.View{Map: tagsByMonth})
+	ds.Init()
+	ds.CreateBucketIfNotExists("note")
+
+	n, err := ds.RebuildView(context.Background(), "tags")
+	if err != nil || n != 2 {
+		t.Fatalf("expected 2 rows, got %d %v", n, err)
+	}
+	n, _ = ds.RebuildView(context.Background(), "tags")
+	rows, _ := ds.QueryView(context.Background(), "tags", store.ViewQuery{})
+	if n != 2 || len(rows) != 2 {
+		t.Errorf("rebuilding twice left %d rows", len(rows))
+	}
+}
+
+func TestViews_InMemSnapshot(t *testing.T) {
+	snapshot := filepath.Join(t.TempDir(), "snapshot.json")
+	open := func() *store.Datastore {
+		db := store.NewInMemDatabase()
+		db.SnapshotFile = snapshot
+		ds := store.NewDatastore(db, nil)
+		ds.AddView("tags", store.View{Map: tagsByMonth})
+		if err := ds.Init(); err != nil {
+			t.Fatal(err)
+		}
+		ds.CreateBucketIfNotExists("note")
+		return ds
+	}
+
+	ds := open()
+	ds.Put("note", "1", []byte(`{"tags":["a"],"created":"2024-01-01"}`))
+	ds.Close()
+
+	ds = open()
+	rows, err := ds.QueryView(context.Background(), "tags", store.ViewQuery{})
+	if err != nil || keys(rows) != "[a 2024-01]:1" {
+		t.Errorf("rows lost in snapshot: %s %v", keys(rows), err)
+	}
+}
@@ -0,0 +1,70 @@
+package tsclient_test
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/fnurk/geom/pkg/handlers"
+	"github.com/fnurk/geom/pkg/model"
+	"github.com/fnurk/geom/pkg/pubsub"
+	"github.com/fnurk/geom/pkg/store"
+	"github.com/fnurk/geom/pkg/tsclient"
+	"github.com/labstack/echo/v4"
+)
+
+type task struct {
+	Title string `json:"title"`
+	Done  bool   `json:"done,omitempty"`
+}
+
+// TestGenerateFromHandlers generates a client from the document handlers.OpenAPI makes of the real
+// handlers, so the operation names the two packages agree on can't drift apart
+func TestGenerateFromHandlers(t *testing.T) {
+	model.RegisterType("task", task{})
+	ds := store.NewDatastore(store.NewInMemDatabase(), nil)
+	if err := ds.Init(); err != nil {
+		t.Fatal(err)
+	}
+	defer ds.Close()
+	changes := pubsub.NewChanPubsub()
+
+	e := echo.New()
+	checkers := handlers.CRUDLAccessCheckers{}
+	handlers.AddCrudEndpointsForType(e, ds, changes, "task", checkers)
+	handlers.AddBulkEndpointsForType(e, ds, "task", checkers)
+	handlers.AddOpsEndpointsForType(e, ds, "task", checkers)
+	handlers.AddQueryEndpointForType(e, ds, "task", checkers)
+	handlers.AddLiveQueryEndpointForType(e, ds, changes, "task", checkers)
+
+	spec, err := json.Marshal(handlers.OpenAPI(e, handlers.OpenAPIInfo{Title: "tasks", Version: "1.0"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := tsclient.Generate(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := string(out)
+
+	for _, want := range []string{
+		"export interface Task {",
+		"export class TaskCollection {",
+		"  // Get a task\n  get(id: string",
+		"  // Create a task\n  create(doc: Task)",
+		"  // Replace a task\n  replace(id: string",
+		"  // Patch a task\n  patch(id: string",
+		"  // Delete a task\n  delete(id: string)",
+		"  find(): Query<Task, TaskProjection>",
+		"(params) => this.client.request(\"GET\", `/task`",
+		"websocket: `/task/${encodeURIComponent(id)}/live`, sse: `/task/${encodeURIComponent(id)}/live/sse`",
+		"  // Get many task\n  getMany(ids: string[]",
+		"  // Write many task\n  bulk(items: BulkItem<Task>[]",
+		"  // Apply operations to a task\n  apply(id: string",
+		"  task = new TaskCollection(this);",
+	} {
+		if !strings.Contains(src, want) {
+			t.Errorf("expected the client to contain\n%s", want)
+		}
+	}
+}
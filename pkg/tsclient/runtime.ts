@@ -0,0 +1,221 @@
+export interface ClientOptions {
+  // eg. "https://api.example.com", the page's origin if empty
+  baseUrl?: string;
+  // Sent with every request, not with live subscriptions: browsers can't set headers on those
+  headers?: Record<string, string>;
+  fetch?: typeof fetch;
+}
+
+export class GeomError extends Error {
+  constructor(public status: number, public body: string) {
+    super(`${status}: ${body}`);
+  }
+}
+
+// Shape picks parts of documents, with gjson paths or a projection registered on the server
+export interface Shape<P extends string = string> {
+  fields?: string[];
+  projection?: P;
+}
+
+export interface LiveOptions<P extends string = string> extends Shape<P> {
+  // Server-sent events if the browser has EventSource, a websocket otherwise
+  transport?: "sse" | "websocket";
+  withCredentials?: boolean;
+  onError?: (err: Error) => void;
+}
+
+export interface Subscription {
+  close(): void;
+}
+
+export interface QueryDoc<T> {
+  id: string;
+  doc: T;
+}
+
+export interface QueryResponse<T> {
+  docs: QueryDoc<T>[];
+  truncated: boolean;
+  explain?: Record<string, unknown>;
+}
+
+export interface LiveQueryEvent<T> {
+  type: "initial" | "added" | "changed" | "removed" | "error";
+  docs?: QueryDoc<T>[];
+  truncated?: boolean;
+  id?: string;
+  doc?: T;
+  error?: string;
+}
+
+export interface BulkItem<T> {
+  op?: "put" | "delete";
+  id?: string;
+  doc?: T;
+}
+
+export interface BulkResult<T> {
+  id: string;
+  status: number;
+  error?: string;
+  doc?: T;
+}
+
+// MergePatch is a JSON Merge Patch (RFC 7396) of T, null removes a field
+export type MergePatch<T> = { [K in keyof T]?: T[K] | null };
+
+export type FilterOp = "==" | "!=" | "<" | "<=" | ">" | ">=" | "in" | "contains";
+
+export type Field<T> = keyof T & string;
+
+// Query builds a filter, sort order and limit, the conditions are all and-ed together
+export class Query<T, P extends string = string> {
+  private conditions: string[] = [];
+  private params: Record<string, string> = {};
+
+  constructor(
+    private runner?: (params: Record<string, string>) => Promise<QueryResponse<T>>,
+    private follower?: (params: Record<string, string>, onEvent: (ev: LiveQueryEvent<T>) => void, options?: LiveOptions<P>) => Subscription,
+  ) {}
+
+  where(field: Field<T>, op: FilterOp, value: unknown): this {
+    this.conditions.push(`${field} ${op} ${JSON.stringify(value)}`);
+    return this;
+  }
+
+  // filter adds a condition as the server parses it, eg. `meta.owner == "alice" or shared == true`
+  filter(expression: string): this {
+    this.conditions.push(`(${expression})`);
+    return this;
+  }
+
+  sort(...fields: Array<Field<T> | `-${Field<T>}`>): this {
+    this.params.sort = fields.join(",");
+    return this;
+  }
+
+  limit(n: number): this {
+    this.params.limit = String(n);
+    return this;
+  }
+
+  fields(...paths: string[]): this {
+    this.params.fields = paths.join(",");
+    return this;
+  }
+
+  projection(name: P): this {
+    this.params.projection = name;
+    return this;
+  }
+
+  explain(): this {
+    this.params.explain = "true";
+    return this;
+  }
+
+  toParams(): Record<string, string> {
+    const params = { ...this.params };
+    if (this.conditions.length > 0) {
+      params.filter = this.conditions.join(" and ");
+    }
+    return params;
+  }
+
+  run(): Promise<QueryResponse<T>> {
+    if (!this.runner) {
+      return Promise.reject(new Error("no query endpoint for this type"));
+    }
+    return this.runner(this.toParams());
+  }
+
+  live(onEvent: (ev: LiveQueryEvent<T>) => void, options?: LiveOptions<P>): Subscription {
+    if (!this.follower) {
+      throw new Error("no live query endpoint for this type");
+    }
+    return this.follower(this.toParams(), onEvent, options);
+  }
+}
+
+export interface RequestOptions {
+  query?: Record<string, string | undefined>;
+  body?: unknown;
+  contentType?: string;
+  // The response is text, not json
+  text?: boolean;
+}
+
+export class GeomClient {
+  private baseUrl: string;
+  private headers: Record<string, string>;
+  private fetcher: typeof fetch;
+
+  constructor(options: ClientOptions = {}) {
+    this.baseUrl = (options.baseUrl ?? "").replace(/\/$/, "");
+    this.headers = options.headers ?? {};
+    this.fetcher = options.fetch ?? ((input, init) => fetch(input, init));
+  }
+
+  url(path: string, query: Record<string, string | undefined> = {}): string {
+    const base = typeof location !== "undefined" ? location.href : undefined;
+    const url = new URL(this.baseUrl + path, base);
+    for (const [key, value] of Object.entries(query)) {
+      if (value !== undefined && value !== "") {
+        url.searchParams.set(key, value);
+      }
+    }
+    return url.toString();
+  }
+
+  async request<R>(method: string, path: string, options: RequestOptions = {}): Promise<R> {
+    const headers: Record<string, string> = { ...this.headers };
+    let body: string | undefined;
+    if (options.body !== undefined) {
+      headers["Content-Type"] = options.contentType ?? "application/json";
+      body = JSON.stringify(options.body);
+    }
+    const res = await this.fetcher(this.url(path, options.query), { method, headers, body });
+    const text = await res.text();
+    if (!res.ok) {
+      throw new GeomError(res.status, text);
+    }
+    if (options.text) {
+      return text as unknown as R;
+    }
+    return (text === "" ? undefined : JSON.parse(text)) as R;
+  }
+
+  // live follows a live endpoint, paths are the endpoint's websocket and sse variants
+  live<M>(
+    paths: { websocket?: string; sse?: string },
+    query: Record<string, string | undefined>,
+    onMessage: (msg: M) => void,
+    options: LiveOptions = {},
+  ): Subscription {
+    const transport = options.transport ?? (paths.sse && typeof EventSource !== "undefined" ? "sse" : "websocket");
+    const path = paths[transport];
+    if (!path) {
+      throw new Error(`no ${transport} endpoint`);
+    }
+    const url = this.url(path, query);
+    const fail = (err: Error) => options.onError?.(err);
+
+    if (transport === "sse") {
+      //EventSource reconnects by itself, resuming after the last event it saw
+      const source = new EventSource(url, { withCredentials: options.withCredentials });
+      source.onmessage = (ev) => onMessage(JSON.parse(ev.data) as M);
+      source.onerror = () => fail(new Error(`event stream ${url} failed`));
+      return { close: () => source.close() };
+    }
+
+    const ws = new WebSocket(url.replace(/^http/, "ws"));
+    ws.onmessage = (ev) => onMessage(JSON.parse(String(ev.data)) as M);
+    ws.onerror = () => fail(new Error(`websocket ${url} failed`));
+    return { close: () => ws.close() };
+  }
+}
+
+export function shapeParams(shape?: Shape): Record<string, string | undefined> {
+  return { fields: shape?.fields?.join(","), projection: shape?.projection };
+}
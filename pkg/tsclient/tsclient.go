@@ -0,0 +1,354 @@
+// Package tsclient generates a typed TypeScript client from the OpenAPI document of a geom server, see
+// handlers.OpenAPI. Every registered type gets an interface and a collection with the operations that have
+// routes: get, create, replace, patch, delete, find (queries, run once or live), watch (live documents),
+// getMany, bulk and apply. Other routes are left to fetch.
+package tsclient
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var ErrInvalidSpec = errors.New("invalid openapi document")
+
+//go:embed runtime.ts
+var runtime string
+
+type spec struct {
+	OpenAPI string `json:"openapi"`
+	Info    struct {
+		Title   string `json:"title"`
+		Version string `json:"version"`
+	} `json:"info"`
+	Paths      map[string]map[string]operation `json:"paths"`
+	Components struct {
+		Schemas map[string]*schema `json:"schemas"`
+	} `json:"components"`
+}
+
+type operation struct {
+	Summary     string `json:"summary"`
+	Operation   string `json:"x-geom-operation"`
+	Type        string `json:"x-geom-type"`
+	RequestBody struct {
+		Content map[string]struct {
+			Schema *schema `json:"schema"`
+		} `json:"content"`
+	} `json:"requestBody"`
+}
+
+type schema struct {
+	Ref                  string             `json:"$ref"`
+	Type                 interface{}        `json:"type"`
+	Properties           map[string]*schema `json:"properties"`
+	Required             []string           `json:"required"`
+	Items                *schema            `json:"items"`
+	AdditionalProperties *schema            `json:"additionalProperties"`
+	Enum                 []interface{}      `json:"enum"`
+	OneOf                []*schema          `json:"oneOf"`
+	Projections          []string           `json:"x-geom-projections"`
+}
+
+// route is an operation of a type, live ones can have a websocket and an sse path
+type route struct {
+	path string
+	sse  string
+	op   operation
+}
+
+// Generate returns the TypeScript source of a client for spec, an OpenAPI document as json
+func Generate(specJSON []byte) ([]byte, error) {
+	s := spec{}
+	if err := json.Unmarshal(specJSON, &s); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidSpec, err)
+	}
+	if !strings.HasPrefix(s.OpenAPI, "3.") {
+		return nil, fmt.Errorf("%w: version %q", ErrInvalidSpec, s.OpenAPI)
+	}
+
+	types := map[string]map[string]*route{}
+	for _, path := range sortedKeys(s.Paths) {
+		for _, op := range s.Paths[path] {
+			if op.Operation == "" || op.Type == "" {
+				continue
+			}
+			if types[op.Type] == nil {
+				types[op.Type] = map[string]*route{}
+			}
+			r := types[op.Type][op.Operation]
+			if r == nil {
+				r = &route{op: op}
+				types[op.Type][op.Operation] = r
+			}
+			if strings.HasSuffix(path, "/sse") {
+				r.sse = path
+			} else if r.path == "" {
+				r.path = path
+			}
+		}
+	}
+
+	out := &bytes.Buffer{}
+	fmt.Fprintf(out, "// Code generated by geom-ts from %s %s. DO NOT EDIT.\n\n", s.Info.Title, s.Info.Version)
+	out.WriteString(runtime)
+
+	for _, name := range sortedKeys(s.Components.Schemas) {
+		sch := s.Components.Schemas[name]
+		if sch.Properties != nil && len(sch.OneOf) == 0 && sch.Enum == nil {
+			fmt.Fprintf(out, "\nexport interface %s %s\n", typeName(name), tsType(sch, ""))
+		} else {
+			fmt.Fprintf(out, "\nexport type %s = %s;\n", typeName(name), tsType(sch, ""))
+		}
+	}
+
+	for _, t := range sortedKeys(types) {
+		projections := "never"
+		if sch := s.Components.Schemas[t]; sch != nil && len(sch.Projections) > 0 {
+			projections = literals(sch.Projections)
+		}
+		fmt.Fprintf(out, "\nexport type %sProjection = %s;\n", typeName(t), projections)
+		writeCollection(out, t, types[t], s.Components.Schemas[t] != nil)
+	}
+
+	out.WriteString("\nexport class Client extends GeomClient {\n")
+	for _, t := range sortedKeys(types) {
+		fmt.Fprintf(out, "  %s = new %sCollection(this);\n", propertyName(t), typeName(t))
+	}
+	out.WriteString("}\n")
+	return out.Bytes(), nil
+}
+
+func writeCollection(out *bytes.Buffer, t string, routes map[string]*route, registered bool) {
+	doc := "Record<string, unknown>"
+	if registered {
+		doc = typeName(t)
+	}
+	p := typeName(t) + "Projection"
+
+	fmt.Fprintf(out, "\nexport class %sCollection {\n", typeName(t))
+	out.WriteString("  constructor(private client: GeomClient) {}\n")
+	method := func(name string, summary string, signature string, body string) {
+		fmt.Fprintf(out, "\n  // %s\n  %s%s {\n    %s\n  }\n", summary, name, signature, body)
+	}
+
+	if r := routes["Get"]; r != nil {
+		method("get", r.op.Summary, fmt.Sprintf("(id: string, shape?: Shape<%s>): Promise<%s>", p, doc),
+			fmt.Sprintf(`return this.client.request("GET", %s, { query: shapeParams(shape) });`, pathExpr(r.path)))
+	}
+	if r := routes["Post"]; r != nil {
+		method("create", r.op.Summary, fmt.Sprintf("(doc: %s): Promise<string>", doc),
+			fmt.Sprintf(`return this.client.request("POST", %s, { body: doc, text: true });`, pathExpr(r.path)))
+	}
+	if r := routes["Put"]; r != nil {
+		method("replace", r.op.Summary, fmt.Sprintf("(id: string, doc: %s): Promise<void>", doc),
+			fmt.Sprintf(`return this.client.request("PUT", %s, { body: doc });`, pathExpr(r.path)))
+	}
+	if r := routes["Patch"]; r != nil {
+		method("patch", r.op.Summary, fmt.Sprintf("(id: string, patch: MergePatch<%s> | JSONPatch): Promise<%s>", doc, doc),
+			fmt.Sprintf(`const contentType = Array.isArray(patch) ? "application/json-patch+json" : "application/merge-patch+json";
+    return this.client.request("PATCH", %s, { body: patch, contentType });`, pathExpr(r.path)))
+	}
+	if r := routes["Delete"]; r != nil {
+		method("delete", r.op.Summary, "(id: string): Promise<void>",
+			fmt.Sprintf(`return this.client.request("DELETE", %s);`, pathExpr(r.path)))
+	}
+
+	query, live := routes["Query"], routes["LiveQuery"]
+	if query != nil || live != nil {
+		runner, follower := "undefined", "undefined"
+		if query != nil {
+			runner = fmt.Sprintf(`(params) => this.client.request("GET", %s, { query: params })`, pathExpr(query.path))
+		}
+		if live != nil {
+			follower = fmt.Sprintf(`(params, onEvent, options) => this.client.live(%s, params, onEvent, options)`, livePaths(live))
+		}
+		method("find", "Query "+t+", run it once or follow it live",
+			fmt.Sprintf("(): Query<%s, %s>", doc, p),
+			fmt.Sprintf("return new Query<%s, %s>(\n      %s,\n      %s,\n    );", doc, p, runner, follower))
+	}
+	if r := routes["LiveUpdates"]; r != nil {
+		method("watch", "Follow a "+t+" as it's written, see LiveOptions for the transport",
+			fmt.Sprintf("(id: string, onDoc: (doc: %s) => void, options: LiveOptions<%s> = {}): Subscription", doc, p),
+			fmt.Sprintf(`return this.client.live(%s, shapeParams(options), onDoc, options);`, livePaths(r)))
+	}
+	if r := routes["MultiGet"]; r != nil {
+		method("getMany", r.op.Summary, fmt.Sprintf("(ids: string[], shape?: Shape<%s>): Promise<BulkResult<%s>[]>", p, doc),
+			fmt.Sprintf(`return this.client.request("POST", %s, { body: { ids }, query: shapeParams(shape) });`, pathExpr(r.path)))
+	}
+	if r := routes["Bulk"]; r != nil {
+		method("bulk", r.op.Summary, fmt.Sprintf(`(items: BulkItem<%s>[], mode: "atomic" | "bestEffort" = "atomic"): Promise<{ committed: boolean; results: BulkResult<%s>[] }>`, doc, doc),
+			fmt.Sprintf(`return this.client.request("POST", %s, { body: { mode, items } });`, pathExpr(r.path)))
+	}
+	if r := routes["Apply"]; r != nil {
+		ops := "unknown[]"
+		if c, ok := r.op.RequestBody.Content["application/json"]; ok && c.Schema != nil {
+			ops = tsType(c.Schema, "  ")
+		}
+		method("apply", r.op.Summary, fmt.Sprintf("(id: string, ops: %s): Promise<%s>", ops, doc),
+			fmt.Sprintf(`return this.client.request("POST", %s, { body: ops });`, pathExpr(r.path)))
+	}
+	out.WriteString("}\n")
+}
+
+var pathParam = regexp.MustCompile(`\{([^}]+)\}`)
+
+// pathExpr is a template literal of path with {id} taken from the id argument
+func pathExpr(path string) string {
+	path = strings.ReplaceAll(path, "`", "\\`")
+	return "`" + pathParam.ReplaceAllStringFunc(path, func(p string) string {
+		return "${encodeURIComponent(" + p[1:len(p)-1] + ")}"
+	}) + "`"
+}
+
+func livePaths(r *route) string {
+	paths := []string{}
+	if r.path != "" {
+		paths = append(paths, "websocket: "+pathExpr(r.path))
+	}
+	if r.sse != "" {
+		paths = append(paths, "sse: "+pathExpr(r.sse))
+	}
+	return "{ " + strings.Join(paths, ", ") + " }"
+}
+
+// tsType is the TypeScript type of values valid against s, indent is that of the line it's on
+func tsType(s *schema, indent string) string {
+	if s == nil {
+		return "unknown"
+	}
+	if s.Ref != "" {
+		return typeName(s.Ref[strings.LastIndex(s.Ref, "/")+1:])
+	}
+	if len(s.Enum) > 0 {
+		values := []string{}
+		for _, v := range s.Enum {
+			b, _ := json.Marshal(v)
+			values = append(values, string(b))
+		}
+		return strings.Join(values, " | ")
+	}
+	if len(s.OneOf) > 0 {
+		types := []string{}
+		for _, o := range s.OneOf {
+			types = append(types, tsType(o, indent))
+		}
+		return strings.Join(types, " | ")
+	}
+
+	var kinds []string
+	switch t := s.Type.(type) {
+	case string:
+		kinds = []string{t}
+	case []interface{}:
+		for _, k := range t {
+			if k, ok := k.(string); ok {
+				kinds = append(kinds, k)
+			}
+		}
+	}
+	if len(kinds) == 0 {
+		return "unknown"
+	}
+
+	types := []string{}
+	for _, kind := range kinds {
+		switch kind {
+		case "string":
+			types = append(types, "string")
+		case "integer", "number":
+			types = append(types, "number")
+		case "boolean":
+			types = append(types, "boolean")
+		case "null":
+			types = append(types, "null")
+		case "array":
+			types = append(types, "Array<"+tsType(s.Items, indent)+">")
+		case "object":
+			types = append(types, objectType(s, indent))
+		default:
+			types = append(types, "unknown")
+		}
+	}
+	return strings.Join(types, " | ")
+}
+
+func objectType(s *schema, indent string) string {
+	if s.Properties == nil {
+		if s.AdditionalProperties != nil {
+			return "Record<string, " + tsType(s.AdditionalProperties, indent) + ">"
+		}
+		return "Record<string, unknown>"
+	}
+	required := map[string]bool{}
+	for _, name := range s.Required {
+		required[name] = true
+	}
+	b := strings.Builder{}
+	b.WriteString("{\n")
+	for _, name := range sortedKeys(s.Properties) {
+		optional := "?"
+		if required[name] {
+			optional = ""
+		}
+		fmt.Fprintf(&b, "%s  %s%s: %s;\n", indent, propertyKey(name), optional, tsType(s.Properties[name], indent+"  "))
+	}
+	b.WriteString(indent + "}")
+	return b.String()
+}
+
+var identifier = regexp.MustCompile(`^[A-Za-z_$][A-Za-z0-9_$]*$`)
+
+func propertyKey(name string) string {
+	if identifier.MatchString(name) {
+		return name
+	}
+	b, _ := json.Marshal(name)
+	return string(b)
+}
+
+var wordSeparator = regexp.MustCompile(`[^A-Za-z0-9]+`)
+
+// typeName is name in PascalCase, eg. note -> Note and time-series -> TimeSeries
+func typeName(name string) string {
+	b := strings.Builder{}
+	for _, word := range wordSeparator.Split(name, -1) {
+		if word != "" {
+			b.WriteString(strings.ToUpper(word[:1]) + word[1:])
+		}
+	}
+	s := b.String()
+	if s == "" || (s[0] >= '0' && s[0] <= '9') {
+		s = "T" + s
+	}
+	return s
+}
+
+// propertyName is name in camelCase
+func propertyName(name string) string {
+	s := typeName(name)
+	return strings.ToLower(s[:1]) + s[1:]
+}
+
+func literals(values []string) string {
+	quoted := []string{}
+	for _, v := range values {
+		b, _ := json.Marshal(v)
+		quoted = append(quoted, string(b))
+	}
+	return strings.Join(quoted, " | ")
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,102 @@
+package tsclient_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/fnurk/geom/pkg/tsclient"
+)
+
+const testSpec = `{
+  "openapi": "3.1.0",
+  "info": {"title": "notes", "version": "1.0"},
+  "paths": {
+    "/note": {
+      "get": {"summary": "Query note documents", "x-geom-operation": "Query", "x-geom-type": "note"},
+      "post": {"summary": "Create a note", "x-geom-operation": "Post", "x-geom-type": "note"}
+    },
+    "/note/{id}": {
+      "get": {"summary": "Get a note", "x-geom-operation": "Get", "x-geom-type": "note"},
+      "delete": {"summary": "Delete a note", "x-geom-operation": "Delete", "x-geom-type": "note"}
+    },
+    "/note/{id}/live": {
+      "get": {"summary": "Follow a note", "x-geom-operation": "LiveUpdates", "x-geom-type": "note"}
+    },
+    "/note/{id}/live/sse": {
+      "get": {"summary": "Follow a note", "x-geom-operation": "LiveUpdates", "x-geom-type": "note"}
+    },
+    "/time-series": {
+      "get": {"summary": "Query time-series documents", "x-geom-operation": "Query", "x-geom-type": "time-series"}
+    },
+    "/healthz": {
+      "get": {"summary": "Health check"}
+    }
+  },
+  "components": {
+    "schemas": {
+      "note": {
+        "type": "object",
+        "properties": {
+          "title": {"type": "string"},
+          "status": {"type": "string", "enum": ["open", "done"]},
+          "score": {"type": ["number", "null"]},
+          "tags": {"type": "array", "items": {"type": "string"}},
+          "content-type": {"type": "string"}
+        },
+        "required": ["title"],
+        "x-geom-projections": ["public", "summary"]
+      }
+    }
+  }
+}`
+
+func TestGenerate(t *testing.T) {
+	out, err := tsclient.Generate([]byte(testSpec))
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := string(out)
+
+	for _, want := range []string{
+		"// Code generated by geom-ts from notes 1.0. DO NOT EDIT.",
+		"export class GeomClient",
+		"export interface Note {\n" +
+			"  \"content-type\"?: string;\n" +
+			"  score?: number | null;\n" +
+			"  status?: \"open\" | \"done\";\n" +
+			"  tags?: Array<string>;\n" +
+			"  title: string;\n" +
+			"}",
+		`export type NoteProjection = "public" | "summary";`,
+		"export class NoteCollection {",
+		"get(id: string, shape?: Shape<NoteProjection>): Promise<Note> {",
+		"return this.client.request(\"GET\", `/note/${encodeURIComponent(id)}`, { query: shapeParams(shape) });",
+		"create(doc: Note): Promise<string> {",
+		"delete(id: string): Promise<void> {",
+		"find(): Query<Note, NoteProjection> {",
+		"websocket: `/note/${encodeURIComponent(id)}/live`, sse: `/note/${encodeURIComponent(id)}/live/sse`",
+		"export type TimeSeriesProjection = never;",
+		"find(): Query<Record<string, unknown>, TimeSeriesProjection> {",
+		"  note = new NoteCollection(this);",
+		"  timeSeries = new TimeSeriesCollection(this);",
+	} {
+		if !strings.Contains(src, want) {
+			t.Errorf("expected the client to contain\n%s", want)
+		}
+	}
+
+	for _, unwanted := range []string{"replace(id", "patch(id", "healthz"} {
+		if strings.Contains(src, unwanted) {
+			t.Errorf("expected no %q without a route for it", unwanted)
+		}
+	}
+}
+
+func TestGenerateInvalidSpec(t *testing.T) {
+	for _, spec := range []string{`not json`, `{"swagger": "2.0"}`} {
+		if _, err := tsclient.Generate([]byte(spec)); !errors.Is(err, tsclient.ErrInvalidSpec) {
+			t.Errorf("expected ErrInvalidSpec for %s, got %v", spec, err)
+		}
+	}
+}